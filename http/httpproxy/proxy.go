@@ -35,6 +35,12 @@ type Config struct {
 	// HTTPS requests unless overridden by NoProxy.
 	HTTPSProxy string
 
+	// AllProxy represents the ALL_PROXY or all_proxy environment
+	// variable. It will be used as the proxy URL for requests of any
+	// scheme for which no other proxy is set, unless overridden by
+	// NoProxy. Its scheme may be http, https, socks5 or socks5h.
+	AllProxy string
+
 	// NoProxy represents the NO_PROXY or no_proxy environment
 	// variable. It specifies a string that contains comma-separated values
 	// specifying hosts that should be excluded from proxying. Each value is
@@ -70,6 +76,9 @@ type config struct {
 	// httpProxy is the parsed URL of the HTTPProxy if defined.
 	httpProxy *url.URL
 
+	// allProxy is the parsed URL of the AllProxy if defined.
+	allProxy *url.URL
+
 	// ipMatchers represent all values in the NoProxy that are IP address
 	// prefixes or an IP address in CIDR notation.
 	ipMatchers []matcher
@@ -80,8 +89,8 @@ type config struct {
 }
 
 // FromEnvironment returns a Config instance populated from the
-// environment variables HTTP_PROXY, HTTPS_PROXY and NO_PROXY (or the
-// lowercase versions thereof).
+// environment variables HTTP_PROXY, HTTPS_PROXY, ALL_PROXY and NO_PROXY
+// (or the lowercase versions thereof).
 //
 // The environment values may be either a complete URL or a
 // "host[:port]", in which case the "http" scheme is assumed. An error
@@ -90,6 +99,7 @@ func FromEnvironment() *Config {
 	return &Config{
 		HTTPProxy:  getEnvAny("HTTP_PROXY", "http_proxy"),
 		HTTPSProxy: getEnvAny("HTTPS_PROXY", "https_proxy"),
+		AllProxy:   getEnvAny("ALL_PROXY", "all_proxy"),
 		NoProxy:    getEnvAny("NO_PROXY", "no_proxy"),
 		CGI:        os.Getenv("REQUEST_METHOD") != "",
 	}
@@ -108,6 +118,10 @@ func getEnvAny(names ...string) string {
 // a given request URL. Changing the contents of cfg will not affect
 // proxy functions created earlier.
 //
+// WebSocket URLs with the ws and wss schemes use the proxies of http
+// and https URLs respectively. AllProxy is used for any scheme whose
+// proxy is not set.
+//
 // A nil URL and nil error are returned if no proxy is defined in the
 // environment, or a proxy should not be used for the given request, as
 // defined by NO_PROXY.
@@ -123,16 +137,55 @@ func (cfg *Config) ProxyFunc() func(reqURL *url.URL) (*url.URL, error) {
 	return cfg1.proxyForURL
 }
 
+// UseProxy reports whether connections to addr, a "host:port" address,
+// should use a proxy according to NoProxy. Connections to localhost and
+// loopback addresses never use a proxy.
+//
+// UseProxy parses cfg on each call. To check many addresses, use
+// UseProxyFunc.
+func (cfg *Config) UseProxy(addr string) bool {
+	return cfg.UseProxyFunc()(addr)
+}
+
+// UseProxyFunc returns a function that reports whether connections to
+// an address should use a proxy, like UseProxy.
+//
+// The returned function is safe for use by multiple goroutines. Changing
+// the contents of cfg will not affect functions created earlier.
+func (cfg *Config) UseProxyFunc() func(addr string) bool {
+	cfg1 := &config{
+		Config: *cfg,
+	}
+	cfg1.init()
+	return cfg1.useProxyAddr
+}
+
+// useProxyAddr is like useProxy, for any "host:port" address.
+func (cfg *config) useProxyAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return true
+	}
+	if v, err := idnaASCII(host); err == nil {
+		host = v
+	}
+	return cfg.useProxy(net.JoinHostPort(host, port))
+}
+
 func (cfg *config) proxyForURL(reqURL *url.URL) (*url.URL, error) {
 	var proxy *url.URL
-	if reqURL.Scheme == "https" {
+	switch reqURL.Scheme {
+	case "https", "wss":
 		proxy = cfg.httpsProxy
-	} else if reqURL.Scheme == "http" {
+	case "http", "ws":
 		proxy = cfg.httpProxy
 		if proxy != nil && cfg.CGI {
 			return nil, errors.New("refusing to use HTTP_PROXY value in CGI environment; see golang.org/s/cgihttpproxy")
 		}
 	}
+	if proxy == nil {
+		proxy = cfg.allProxy
+	}
 	if proxy == nil {
 		return nil, nil
 	}
@@ -208,6 +261,9 @@ func (c *config) init() {
 	if parsed, err := parseProxy(c.HTTPSProxy); err == nil {
 		c.httpsProxy = parsed
 	}
+	if parsed, err := parseProxy(c.AllProxy); err == nil {
+		c.allProxy = parsed
+	}
 
 	for _, p := range strings.Split(c.NoProxy, ",") {
 		p = strings.ToLower(strings.TrimSpace(p))
@@ -271,9 +327,12 @@ func (c *config) init() {
 }
 
 var portMap = map[string]string{
-	"http":   "80",
-	"https":  "443",
-	"socks5": "1080",
+	"http":    "80",
+	"https":   "443",
+	"ws":      "80",
+	"wss":     "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
 }
 
 // canonicalAddr returns url.Host but always with a ":port" suffix
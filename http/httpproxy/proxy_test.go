@@ -40,6 +40,10 @@ func (t proxyForURLTest) String() string {
 		space()
 		fmt.Fprintf(&buf, "https_proxy=%q", t.cfg.HTTPSProxy)
 	}
+	if t.cfg.AllProxy != "" {
+		space()
+		fmt.Fprintf(&buf, "all_proxy=%q", t.cfg.AllProxy)
+	}
 	if t.cfg.NoProxy != "" {
 		space()
 		fmt.Fprintf(&buf, "no_proxy=%q", t.cfg.NoProxy)
@@ -211,6 +215,60 @@ var proxyForURLTests = []proxyForURLTest{{
 	},
 	req:  "http://www.xn--fsq092h.com",
 	want: "<nil>",
+}, {
+	cfg: httpproxy.Config{
+		AllProxy: "socks5://proxy.tld:1080",
+	},
+	want: "socks5://proxy.tld:1080",
+}, {
+	cfg: httpproxy.Config{
+		HTTPProxy: "http.proxy.tld",
+		AllProxy:  "socks5://proxy.tld:1080",
+	},
+	req:  "https://secure.tld/",
+	want: "socks5://proxy.tld:1080",
+}, {
+	cfg: httpproxy.Config{
+		HTTPProxy: "http.proxy.tld",
+		AllProxy:  "socks5://proxy.tld:1080",
+	},
+	req:  "ftp://example.com/",
+	want: "socks5://proxy.tld:1080",
+}, {
+	cfg: httpproxy.Config{
+		HTTPProxy: "http.proxy.tld",
+	},
+	req:  "ftp://example.com/",
+	want: "<nil>",
+}, {
+	cfg: httpproxy.Config{
+		HTTPProxy:  "http.proxy.tld",
+		HTTPSProxy: "secure.proxy.tld",
+	},
+	req:  "ws://example.com/",
+	want: "http://http.proxy.tld",
+}, {
+	cfg: httpproxy.Config{
+		HTTPProxy:  "http.proxy.tld",
+		HTTPSProxy: "secure.proxy.tld",
+	},
+	req:  "wss://example.com/",
+	want: "http://secure.proxy.tld",
+}, {
+	cfg: httpproxy.Config{
+		HTTPProxy: "http://10.1.2.3:8080",
+		CGI:       true,
+	},
+	req:     "ws://example.com/",
+	want:    "<nil>",
+	wanterr: errors.New("refusing to use HTTP_PROXY value in CGI environment; see golang.org/s/cgihttpproxy"),
+}, {
+	cfg: httpproxy.Config{
+		NoProxy:  "example.com",
+		AllProxy: "socks5h://proxy.tld",
+	},
+	req:  "wss://foo.example.com/",
+	want: "<nil>",
 },
 }
 
@@ -258,12 +316,14 @@ func TestProxyForURL(t *testing.T) {
 func TestFromEnvironment(t *testing.T) {
 	os.Setenv("HTTP_PROXY", "httpproxy")
 	os.Setenv("HTTPS_PROXY", "httpsproxy")
+	os.Setenv("ALL_PROXY", "allproxy")
 	os.Setenv("NO_PROXY", "noproxy")
 	os.Setenv("REQUEST_METHOD", "")
 	got := httpproxy.FromEnvironment()
 	want := httpproxy.Config{
 		HTTPProxy:  "httpproxy",
 		HTTPSProxy: "httpsproxy",
+		AllProxy:   "allproxy",
 		NoProxy:    "noproxy",
 	}
 	if *got != want {
@@ -274,12 +334,14 @@ func TestFromEnvironment(t *testing.T) {
 func TestFromEnvironmentWithRequestMethod(t *testing.T) {
 	os.Setenv("HTTP_PROXY", "httpproxy")
 	os.Setenv("HTTPS_PROXY", "httpsproxy")
+	os.Setenv("ALL_PROXY", "allproxy")
 	os.Setenv("NO_PROXY", "noproxy")
 	os.Setenv("REQUEST_METHOD", "PUT")
 	got := httpproxy.FromEnvironment()
 	want := httpproxy.Config{
 		HTTPProxy:  "httpproxy",
 		HTTPSProxy: "httpsproxy",
+		AllProxy:   "allproxy",
 		NoProxy:    "noproxy",
 		CGI:        true,
 	}
@@ -291,12 +353,14 @@ func TestFromEnvironmentWithRequestMethod(t *testing.T) {
 func TestFromEnvironmentLowerCase(t *testing.T) {
 	os.Setenv("http_proxy", "httpproxy")
 	os.Setenv("https_proxy", "httpsproxy")
+	os.Setenv("all_proxy", "allproxy")
 	os.Setenv("no_proxy", "noproxy")
 	os.Setenv("REQUEST_METHOD", "")
 	got := httpproxy.FromEnvironment()
 	want := httpproxy.Config{
 		HTTPProxy:  "httpproxy",
 		HTTPSProxy: "httpsproxy",
+		AllProxy:   "allproxy",
 		NoProxy:    "noproxy",
 	}
 	if *got != want {
@@ -374,6 +438,51 @@ func TestAllNoProxy(t *testing.T) {
 	}
 }
 
+func TestConfigUseProxy(t *testing.T) {
+	cfg := &httpproxy.Config{
+		NoProxy: noProxy,
+	}
+	for _, test := range []struct {
+		addr string
+		want bool
+	}{
+		{"example.com:22", true},
+		{"www.foobar.com:22", false},
+		{"WWW.FOOBAR.COM:22", false},
+		{"192.168.1.1:5432", false},
+		{"192.168.1.2:5432", true},
+		{"localhost:22", false},
+		{"[::1]:22", false},
+	} {
+		if got := cfg.UseProxy(test.addr); got != test.want {
+			t.Errorf("UseProxy(%q) = %v; want %v", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestConfigUseProxyFunc(t *testing.T) {
+	cfg := &httpproxy.Config{
+		NoProxy: noProxy,
+	}
+	useProxy := cfg.UseProxyFunc()
+	// Changes to cfg do not affect the function.
+	cfg.NoProxy = ""
+	for _, test := range []struct {
+		addr string
+		want bool
+	}{
+		{"example.com:22", true},
+		{"www.foobar.com:22", false},
+		{"192.168.1.1:5432", false},
+		{"localhost:22", false},
+		{"missing-port", true},
+	} {
+		if got := useProxy(test.addr); got != test.want {
+			t.Errorf("UseProxyFunc()(%q) = %v; want %v", test.addr, got, test.want)
+		}
+	}
+}
+
 func BenchmarkProxyForURL(b *testing.B) {
 	cfg := &httpproxy.Config{
 		HTTPProxy:  "http://proxy.example.org",
@@ -0,0 +1,170 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http2
+
+import (
+	"math"
+	"time"
+)
+
+// An AbuseEvent is client behavior on a server connection which is
+// legitimate in moderation, but may be part of a denial of service
+// attack when repeated.
+type AbuseEvent int
+
+const (
+	// AbuseRSTStream is a RST_STREAM frame.
+	AbuseRSTStream AbuseEvent = iota
+
+	// AbuseEmptyData is a DATA frame with no payload
+	// which does not end the stream.
+	AbuseEmptyData
+
+	// AbuseSettings is a SETTINGS frame which is not an acknowledgement.
+	AbuseSettings
+
+	// AbusePing is a PING frame which is not an acknowledgement.
+	AbusePing
+
+	// AbusePriority is a PRIORITY frame.
+	AbusePriority
+
+	// AbuseContinuation is a CONTINUATION frame.
+	AbuseContinuation
+
+	// AbuseSmallWindowUpdate is a WINDOW_UPDATE frame with an
+	// increment smaller than 1024 bytes.
+	AbuseSmallWindowUpdate
+
+	numAbuseEvents
+)
+
+// smallWindowUpdate is the increment below which a WINDOW_UPDATE frame
+// is reported as AbuseSmallWindowUpdate.
+const smallWindowUpdate = 1024
+
+var abuseEventNames = [...]string{
+	AbuseRSTStream:         "RST_STREAM",
+	AbuseEmptyData:         "EMPTY_DATA",
+	AbuseSettings:          "SETTINGS",
+	AbusePing:              "PING",
+	AbusePriority:          "PRIORITY",
+	AbuseContinuation:      "CONTINUATION",
+	AbuseSmallWindowUpdate: "SMALL_WINDOW_UPDATE",
+}
+
+func (e AbuseEvent) String() string {
+	if e >= 0 && e < numAbuseEvents {
+		return abuseEventNames[e]
+	}
+	return "UNKNOWN_ABUSE_EVENT"
+}
+
+// An AbuseResponse is an AbuseScorer's decision on how to respond
+// to an event.
+type AbuseResponse struct {
+	// GoAway, if true, closes the connection with a GOAWAY frame
+	// with error code ENHANCE_YOUR_CALM.
+	GoAway bool
+
+	// Throttle, if positive, is how long to wait before
+	// reading the next frame from the connection.
+	Throttle time.Duration
+}
+
+// An AbusePolicy decides how a Server responds to potentially abusive
+// client behavior.
+type AbusePolicy interface {
+	// NewConn returns an AbuseScorer for a new connection.
+	NewConn() AbuseScorer
+}
+
+// An AbuseScorer tracks the behavior of a single connection.
+//
+// Observe is called when the connection produces an event, at time now.
+// Calls are never concurrent, but are not all made from the same
+// goroutine: CONTINUATION frames are reported as they are read, before
+// the rest of the header block.
+type AbuseScorer interface {
+	Observe(e AbuseEvent, now time.Time) AbuseResponse
+}
+
+// ScoreAbusePolicy is an AbusePolicy which tracks a score for each
+// connection. Each event adds its cost to the score, and the score
+// decays over time. When the score exceeds ThrottleScore, the server
+// pauses reading from the connection. When it exceeds GoAwayScore,
+// the server closes the connection.
+type ScoreAbusePolicy struct {
+	// Costs is the cost of each event.
+	// Events not in Costs cost 1.
+	Costs map[AbuseEvent]float64
+
+	// HalfLife is how long it takes a connection's score to decay
+	// by half. If zero, a default of 1 second is used.
+	HalfLife time.Duration
+
+	// ThrottleScore is the score above which reading from a connection
+	// is paused for ThrottleDelay after each event.
+	// If zero, connections are not throttled.
+	ThrottleScore float64
+
+	// ThrottleDelay is how long to pause reading when throttling.
+	// If zero, a default of 100 milliseconds is used.
+	ThrottleDelay time.Duration
+
+	// GoAwayScore is the score above which a connection is closed.
+	// If zero, connections are not closed.
+	GoAwayScore float64
+}
+
+// NewConn implements AbusePolicy.
+func (p *ScoreAbusePolicy) NewConn() AbuseScorer {
+	return &scoreAbuseScorer{p: p}
+}
+
+func (p *ScoreAbusePolicy) cost(e AbuseEvent) float64 {
+	if c, ok := p.Costs[e]; ok {
+		return c
+	}
+	return 1
+}
+
+func (p *ScoreAbusePolicy) halfLife() time.Duration {
+	if p.HalfLife > 0 {
+		return p.HalfLife
+	}
+	return 1 * time.Second
+}
+
+func (p *ScoreAbusePolicy) throttleDelay() time.Duration {
+	if p.ThrottleDelay > 0 {
+		return p.ThrottleDelay
+	}
+	return 100 * time.Millisecond
+}
+
+type scoreAbuseScorer struct {
+	p     *ScoreAbusePolicy
+	score float64
+	last  time.Time
+}
+
+func (s *scoreAbuseScorer) Observe(e AbuseEvent, now time.Time) AbuseResponse {
+	if !s.last.IsZero() {
+		if elapsed := now.Sub(s.last); elapsed > 0 {
+			s.score *= math.Exp2(-float64(elapsed) / float64(s.p.halfLife()))
+		}
+	}
+	s.last = now
+	s.score += s.p.cost(e)
+	var res AbuseResponse
+	if s.p.GoAwayScore > 0 && s.score > s.p.GoAwayScore {
+		res.GoAway = true
+	}
+	if s.p.ThrottleScore > 0 && s.score > s.p.ThrottleScore {
+		res.Throttle = s.p.throttleDelay()
+	}
+	return res
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScoreAbusePolicy(t *testing.T) {
+	p := &ScoreAbusePolicy{
+		Costs:         map[AbuseEvent]float64{AbuseRSTStream: 4},
+		HalfLife:      time.Second,
+		ThrottleScore: 3,
+		ThrottleDelay: 10 * time.Millisecond,
+		GoAwayScore:   5,
+	}
+	s := p.NewConn()
+	now := time.Unix(0, 0)
+
+	for i := 0; i < 3; i++ {
+		if got := s.Observe(AbusePing, now); got != (AbuseResponse{}) {
+			t.Fatalf("ping %v: got %+v; want no response", i, got)
+		}
+	}
+	if got, want := s.Observe(AbusePing, now), (AbuseResponse{Throttle: 10 * time.Millisecond}); got != want {
+		t.Fatalf("fourth ping: got %+v; want %+v", got, want)
+	}
+
+	// Two half-lives take the score from 4 to 1.
+	now = now.Add(2 * time.Second)
+	if got := s.Observe(AbusePing, now); got != (AbuseResponse{}) {
+		t.Fatalf("ping after decay: got %+v; want no response", got)
+	}
+
+	// Score is now 2; an RST_STREAM costs 4.
+	if got := s.Observe(AbuseRSTStream, now); !got.GoAway || got.Throttle == 0 {
+		t.Fatalf("RST_STREAM: got %+v; want GoAway and Throttle", got)
+	}
+}
+
+func TestAbuseEventString(t *testing.T) {
+	for e := AbuseEvent(0); e < numAbuseEvents; e++ {
+		if s := e.String(); s == "" || s == "UNKNOWN_ABUSE_EVENT" {
+			t.Errorf("AbuseEvent(%d).String() = %q", int(e), s)
+		}
+	}
+	if got, want := AbuseEvent(-1).String(), "UNKNOWN_ABUSE_EVENT"; got != want {
+		t.Errorf("AbuseEvent(-1).String() = %q; want %q", got, want)
+	}
+}
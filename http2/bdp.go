@@ -0,0 +1,111 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Receive window autotuning
+
+package http2
+
+import "time"
+
+// bdpPing is the payload of PING frames sent to measure the round trip
+// time of a connection for receive window autotuning.
+var bdpPing = [8]byte{'h', '2', 'b', 'd', 'p', 'e', 's', 't'}
+
+const (
+	// bdpBeta is the fraction of the current window that must be
+	// received during one PING round trip for the window to grow.
+	bdpBeta = 0.66
+
+	// bdpGamma is the multiple of the bytes received during one PING
+	// round trip that the window grows to.
+	bdpGamma = 2
+
+	// bdpAlpha is the weight given to a new RTT sample once the
+	// estimator has warmed up.
+	bdpAlpha = 0.9
+
+	// bdpWarmup is the number of RTT samples averaged uniformly
+	// before switching to an exponentially weighted average.
+	bdpWarmup = 10
+)
+
+// A bdpEstimator estimates the bandwidth-delay product of a connection
+// and uses it to size receive flow control windows.
+//
+// When DATA arrives and no measurement is in progress, the estimator
+// asks for a PING to be sent. It then counts the bytes received until
+// the PING is acknowledged. If that sample fills most of the current
+// window while bandwidth is at its highest observed level, the
+// window is too small to keep the link busy, and it grows to a
+// multiple of the sample.
+//
+// This is the scheme used by gRPC.
+type bdpEstimator struct {
+	window int32 // current window size
+	max    int32 // largest window size; zero disables autotuning
+
+	pinging bool      // a PING is outstanding
+	sentAt  time.Time // when the outstanding PING was sent
+	sample  int64     // bytes received since the PING was sent
+	samples int       // number of RTT samples taken
+	rtt     float64   // smoothed RTT, in seconds
+	bwMax   float64   // highest observed bandwidth, in bytes per second
+}
+
+// init sets the initial window size and the maximum the window
+// may grow to. A max no larger than window disables autotuning.
+func (b *bdpEstimator) init(window, max int32) {
+	b.window = window
+	b.max = max
+}
+
+// add records n bytes of DATA received at now. It reports whether the
+// caller should send a PING with bdpPing as its payload.
+func (b *bdpEstimator) add(n int, now time.Time) (sendPing bool) {
+	if b.window >= b.max {
+		return false
+	}
+	if b.pinging {
+		b.sample += int64(n)
+		return false
+	}
+	b.pinging = true
+	b.sentAt = now
+	b.sample = int64(n)
+	return true
+}
+
+// acked processes the acknowledgement of a bdpPing received at now.
+// It returns the new window size if the window should grow, or zero.
+func (b *bdpEstimator) acked(now time.Time) int32 {
+	if !b.pinging {
+		return 0
+	}
+	b.pinging = false
+	rttSample := now.Sub(b.sentAt).Seconds()
+	b.samples++
+	if b.samples < bdpWarmup {
+		b.rtt += (rttSample - b.rtt) / float64(b.samples)
+	} else {
+		b.rtt += (rttSample - b.rtt) * bdpAlpha
+	}
+	// A zero RTT yields an infinite bandwidth, which is treated as
+	// the highest observed.
+	bw := float64(b.sample) / (b.rtt * 1.5)
+	if bw > b.bwMax {
+		b.bwMax = bw
+	}
+	if float64(b.sample) < bdpBeta*float64(b.window) || bw < b.bwMax {
+		return 0
+	}
+	w := bdpGamma * b.sample
+	if w > int64(b.max) {
+		w = int64(b.max)
+	}
+	if w <= int64(b.window) {
+		return 0
+	}
+	b.window = int32(w)
+	return b.window
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBDPEstimator(t *testing.T) {
+	var b bdpEstimator
+	b.init(1000, 5000)
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Too little data is received during the round trip.
+	if !b.add(100, now) {
+		t.Fatalf("add: no PING requested, want one")
+	}
+	if b.add(100, now) {
+		t.Fatalf("add: PING requested while one is outstanding")
+	}
+	now = now.Add(10 * time.Millisecond)
+	if got := b.acked(now); got != 0 {
+		t.Fatalf("acked after 200 bytes = %v, want 0", got)
+	}
+
+	// Most of the window is received during the round trip.
+	if !b.add(500, now) {
+		t.Fatalf("add: no PING requested, want one")
+	}
+	b.add(400, now)
+	now = now.Add(10 * time.Millisecond)
+	if got, want := b.acked(now), int32(1800); got != want {
+		t.Fatalf("acked after 900 bytes = %v, want %v", got, want)
+	}
+
+	// The window is capped at its maximum.
+	b.add(1800, now)
+	b.add(1800, now)
+	now = now.Add(10 * time.Millisecond)
+	if got, want := b.acked(now), int32(5000); got != want {
+		t.Fatalf("acked after 3600 bytes = %v, want %v", got, want)
+	}
+
+	// No more PINGs are sent once the window is at its maximum.
+	if b.add(5000, now) {
+		t.Fatalf("add: PING requested at maximum window")
+	}
+}
+
+func TestBDPEstimatorDisabled(t *testing.T) {
+	var b bdpEstimator
+	b.init(1000, 0)
+	if b.add(1000, time.Now()) {
+		t.Fatalf("add: PING requested with autotuning disabled")
+	}
+}
+
+func TestBDPEstimatorLowerBandwidth(t *testing.T) {
+	var b bdpEstimator
+	b.init(1000, 1<<20)
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b.add(1000, now)
+	now = now.Add(10 * time.Millisecond)
+	if got := b.acked(now); got != 2000 {
+		t.Fatalf("acked = %v, want 2000", got)
+	}
+
+	// Enough bytes to fill the window, but over a much longer round
+	// trip: bandwidth has dropped, so the window doesn't grow.
+	b.add(2000, now)
+	now = now.Add(time.Second)
+	if got := b.acked(now); got != 0 {
+		t.Fatalf("acked at lower bandwidth = %v, want 0", got)
+	}
+}
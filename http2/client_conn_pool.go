@@ -10,6 +10,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"net"
 	"net/http"
 	"sync"
 )
@@ -33,22 +34,36 @@ type clientConnPoolIdleCloser interface {
 	closeIdleConnections()
 }
 
+// clientConnPoolGoAwayHandler is the interface implemented by
+// ClientConnPool implementations which need to know when a
+// connection receives a GOAWAY frame, rather than just being
+// marked dead.
+type clientConnPoolGoAwayHandler interface {
+	ClientConnPool
+	markGoAway(*ClientConn)
+}
+
 var (
-	_ clientConnPoolIdleCloser = (*clientConnPool)(nil)
-	_ clientConnPoolIdleCloser = noDialClientConnPool{}
+	_ clientConnPoolIdleCloser    = (*clientConnPool)(nil)
+	_ clientConnPoolIdleCloser    = noDialClientConnPool{}
+	_ clientConnPoolGoAwayHandler = (*clientConnPool)(nil)
+	_ clientConnPoolGoAwayHandler = noDialClientConnPool{}
 )
 
 // TODO: use singleflight for dialing and addConnCalls?
 type clientConnPool struct {
 	t *Transport
 
-	mu sync.Mutex // TODO: maybe switch to RWMutex
-	// TODO: add support for sharing conns based on cert names
-	// (e.g. share conn for googleapis.com and appspot.com)
+	mu           sync.Mutex               // TODO: maybe switch to RWMutex
 	conns        map[string][]*ClientConn // key is host:port
 	dialing      map[string]*dialCall     // currently in-flight dials
 	keys         map[*ClientConn][]string
 	addConnCalls map[string]*addConnCall // in-flight addConnIfNeeded calls
+
+	// fillCtx is the context of background dials made by fillLocked.
+	// It is canceled by closeIdleConnections.
+	fillCtx    context.Context
+	fillCancel context.CancelFunc
 }
 
 func (p *clientConnPool) GetClientConn(req *http.Request, addr string) (*ClientConn, error) {
@@ -74,18 +89,40 @@ func (p *clientConnPool) getClientConn(req *http.Request, addr string, dialOnMis
 	}
 	for {
 		p.mu.Lock()
-		for _, cc := range p.conns[addr] {
-			if cc.ReserveNewRequest() {
-				// When a connection is presented to us by the net/http package,
-				// the GetConn hook has already been called.
-				// Don't call it a second time here.
+		if p.t.MaxConnsPerAuthority > 0 {
+			if cc := p.pickConnLocked(addr, dialOnMiss); cc != nil {
 				if !cc.getConnCalled {
 					traceGetConn(req, addr)
 				}
 				cc.getConnCalled = false
+				if dialOnMiss {
+					p.fillLocked(addr)
+				}
 				p.mu.Unlock()
 				return cc, nil
 			}
+		} else {
+			for _, cc := range p.conns[addr] {
+				if cc.ReserveNewRequest() {
+					// When a connection is presented to us by the net/http package,
+					// the GetConn hook has already been called.
+					// Don't call it a second time here.
+					if !cc.getConnCalled {
+						traceGetConn(req, addr)
+					}
+					cc.getConnCalled = false
+					p.mu.Unlock()
+					return cc, nil
+				}
+			}
+		}
+		if p.t.AllowConnectionCoalescing {
+			p.mu.Unlock()
+			if cc := p.getCoalescedConn(req, addr); cc != nil {
+				traceGetConn(req, addr)
+				return cc, nil
+			}
+			p.mu.Lock()
 		}
 		if !dialOnMiss {
 			p.mu.Unlock()
@@ -108,6 +145,75 @@ func (p *clientConnPool) getClientConn(req *http.Request, addr string, dialOnMis
 	}
 }
 
+// getCoalescedConn looks for a connection pooled under another key
+// which is also authoritative for addr, per RFC 9113 Section 9.1.1
+// and RFC 8336. If one is found, a stream is reserved on it and it
+// is added to the pool under addr.
+func (p *clientConnPool) getCoalescedConn(req *http.Request, addr string) *ClientConn {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	p.mu.Lock()
+	var candidates []*ClientConn
+	for key, vv := range p.conns {
+		if _, keyPort, err := net.SplitHostPort(key); err != nil || key == addr || keyPort != port {
+			continue
+		}
+		for _, cc := range vv {
+			if !clientConnSliceContains(candidates, cc) {
+				candidates = append(candidates, cc)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	var (
+		resolved bool
+		addrs    []net.IPAddr
+	)
+	for _, cc := range candidates {
+		ok, needLookup := cc.canCoalesce(addr, host)
+		if !ok {
+			continue
+		}
+		if needLookup {
+			if !resolved {
+				// A failed lookup leaves addrs empty, which
+				// prevents coalescing on its account.
+				addrs, _ = p.t.lookupIPAddr(req.Context(), host)
+				resolved = true
+			}
+			if !cc.remoteAddrIn(addrs) {
+				continue
+			}
+		}
+		if !cc.ReserveNewRequest() {
+			continue
+		}
+		p.mu.Lock()
+		if _, ok := p.keys[cc]; !ok {
+			// MarkDead was called while we weren't holding p.mu.
+			p.mu.Unlock()
+			cc.decrStreamReservations()
+			continue
+		}
+		p.addConnLocked(addr, cc)
+		p.mu.Unlock()
+		return cc
+	}
+	return nil
+}
+
+func clientConnSliceContains(ccs []*ClientConn, cc *ClientConn) bool {
+	for _, v := range ccs {
+		if v == cc {
+			return true
+		}
+	}
+	return false
+}
+
 // dialCall is an in-flight Transport dial call to a host.
 type dialCall struct {
 	_ incomparable
@@ -131,10 +237,119 @@ func (p *clientConnPool) getStartDialLocked(ctx context.Context, addr string) *d
 		p.dialing = make(map[string]*dialCall)
 	}
 	p.dialing[addr] = call
-	go call.dial(call.ctx, addr)
+	p.t.goRun(func() { call.dial(call.ctx, addr) })
 	return call
 }
 
+// getUpgradeClientConn returns a pooled connection to addr for req,
+// waiting for an h2c upgrade to addr in flight if there is one. If no
+// connection is available, it returns a dialCall for a new upgrade,
+// which the caller must perform and report with upgradeDone.
+func (p *clientConnPool) getUpgradeClientConn(req *http.Request, addr string) (*ClientConn, *dialCall, error) {
+	for {
+		cc, err := p.getClientConn(req, addr, noDialOnMiss)
+		if err != ErrNoCachedConn {
+			return cc, nil, err
+		}
+		p.mu.Lock()
+		call, ok := p.dialing[addr]
+		if !ok {
+			call = &dialCall{p: p, done: make(chan struct{}), ctx: req.Context()}
+			if p.dialing == nil {
+				p.dialing = make(map[string]*dialCall)
+			}
+			p.dialing[addr] = call
+			p.mu.Unlock()
+			return nil, call, nil
+		}
+		p.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, nil, req.Context().Err()
+		}
+	}
+}
+
+// upgradeDone reports the end of an h2c upgrade started with
+// getUpgradeClientConn, adding cc to the pool if it is non-nil.
+func (p *clientConnPool) upgradeDone(addr string, call *dialCall, cc *ClientConn) {
+	p.mu.Lock()
+	if p.dialing[addr] == call {
+		delete(p.dialing, addr)
+	}
+	if cc != nil {
+		p.addConnLocked(addr, cc)
+	}
+	p.mu.Unlock()
+	close(call.done)
+}
+
+// pickConnLocked chooses the pooled connection to addr with the fewest
+// streams in use, and reserves a stream on it. It returns nil if there
+// is no usable connection, or if every connection is at the peer's
+// concurrent stream limit and canDial permits dialing another one.
+// It is used when Transport.MaxConnsPerAuthority is set.
+// p.mu must be held.
+func (p *clientConnPool) pickConnLocked(addr string, canDial bool) *ClientConn {
+	var (
+		best      *ClientConn
+		bestLoad  int
+		bestLimit int
+		conns     int
+	)
+	for _, cc := range p.conns[addr] {
+		load, limit, ok := cc.streamLoad()
+		if !ok {
+			continue
+		}
+		conns++
+		if best == nil || load < bestLoad {
+			best, bestLoad, bestLimit = cc, load, limit
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	if _, ok := p.dialing[addr]; ok {
+		conns++
+	}
+	if bestLoad >= bestLimit && canDial && conns < p.t.MaxConnsPerAuthority {
+		return nil
+	}
+	if !best.ReserveNewRequest() {
+		return nil
+	}
+	return best
+}
+
+// fillLocked starts dialing a new connection to addr if the pool holds
+// fewer usable connections to it than Transport.MinConnsPerAuthority.
+// Only one such dial is in flight at a time; each completed dial
+// calls fillLocked again.
+// p.mu must be held.
+func (p *clientConnPool) fillLocked(addr string) {
+	min := p.t.minConnsPerAuthority()
+	if min == 0 {
+		return
+	}
+	if _, ok := p.dialing[addr]; ok {
+		return
+	}
+	conns := 0
+	for _, cc := range p.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			conns++
+		}
+	}
+	if conns < min {
+		if p.fillCtx == nil {
+			p.fillCtx, p.fillCancel = context.WithCancel(context.Background())
+		}
+		p.getStartDialLocked(p.fillCtx, addr)
+	}
+}
+
 // run in its own goroutine.
 func (c *dialCall) dial(ctx context.Context, addr string) {
 	const singleUse = false // shared conn
@@ -144,6 +359,7 @@ func (c *dialCall) dial(ctx context.Context, addr string) {
 	delete(c.p.dialing, addr)
 	if c.err == nil {
 		c.p.addConnLocked(addr, c.res)
+		c.p.fillLocked(addr)
 	}
 	c.p.mu.Unlock()
 
@@ -245,9 +461,29 @@ func (p *clientConnPool) MarkDead(cc *ClientConn) {
 	delete(p.keys, cc)
 }
 
+// markGoAway removes cc, which received a GOAWAY frame, from the pool.
+// In load balancing mode, replacement connections are dialed as
+// needed to keep Transport.MinConnsPerAuthority connections open.
+func (p *clientConnPool) markGoAway(cc *ClientConn) {
+	p.mu.Lock()
+	keys := append([]string(nil), p.keys[cc]...)
+	p.mu.Unlock()
+	p.MarkDead(cc)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		p.fillLocked(key)
+	}
+}
+
 func (p *clientConnPool) closeIdleConnections() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if p.fillCancel != nil {
+		// Stop background dials; later requests start new ones.
+		p.fillCancel()
+		p.fillCtx, p.fillCancel = nil, nil
+	}
 	// TODO: don't close a cc if it was just added to the pool
 	// milliseconds ago and has never been used. There's currently
 	// a small race window with the HTTP/1 Transport's integration
@@ -285,6 +521,12 @@ func (p noDialClientConnPool) GetClientConn(req *http.Request, addr string) (*Cl
 	return p.getClientConn(req, addr, noDialOnMiss)
 }
 
+// markGoAway removes cc from the pool. Replacement connections are
+// left for the HTTP/1.1 client to dial.
+func (p noDialClientConnPool) markGoAway(cc *ClientConn) {
+	p.MarkDead(cc)
+}
+
 // shouldRetryDial reports whether the current request should
 // retry dialing after the call finished unsuccessfully, for example
 // if the dial was canceled because of a context cancellation or
@@ -101,6 +101,7 @@ type testClientConn struct {
 	roundtrips []*testRoundTrip
 
 	rerr          error        // returned by Read
+	remoteAddr    net.Addr     // returned by RemoteAddr
 	netConnClosed bool         // set when the ClientConn closes the net.Conn
 	rbuf          bytes.Buffer // sent to the test conn
 	wbuf          bytes.Buffer // sent by the test conn
@@ -735,7 +736,7 @@ func (nc *testClientConnNetConn) Close() error {
 }
 
 func (*testClientConnNetConn) LocalAddr() (_ net.Addr)            { return }
-func (*testClientConnNetConn) RemoteAddr() (_ net.Addr)           { return }
+func (nc *testClientConnNetConn) RemoteAddr() net.Addr            { return nc.remoteAddr }
 func (*testClientConnNetConn) SetDeadline(t time.Time) error      { return nil }
 func (*testClientConnNetConn) SetReadDeadline(t time.Time) error  { return nil }
 func (*testClientConnNetConn) SetWriteDeadline(t time.Time) error { return nil }
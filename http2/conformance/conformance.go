@@ -0,0 +1,493 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package conformance tests that an HTTP/2 server conforms to
+// RFC 9113 (HTTP/2) and RFC 7541 (HPACK).
+//
+// Each test case opens a new connection to the server, exchanges frames
+// with it, and checks that it responds as the RFCs require. The tests
+// are run from a Go test, against any server reachable with a net.Conn:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.TestServer(t, &conformance.Config{
+//			Dial: conformance.DialAddr("localhost:8443", &tls.Config{
+//				InsecureSkipVerify: true,
+//			}),
+//		})
+//	}
+//
+// Where the RFCs allow a choice of responses, such as a connection error
+// in place of a stream error, any of them is accepted.
+package conformance
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ChillAndImprove/net/http2"
+	"github.com/ChillAndImprove/net/http2/hpack"
+)
+
+// Config configures the server under test.
+type Config struct {
+	// Dial opens a new connection to the server. It is called once
+	// for each test case. The connection must be ready for the client
+	// connection preface: for TLS, "h2" must have been negotiated.
+	Dial func() (net.Conn, error)
+
+	// Authority is the :authority of requests.
+	// If empty, "localhost" is used.
+	Authority string
+
+	// Scheme is the :scheme of requests. If empty, "https" is used
+	// for *tls.Conn connections and "http" otherwise.
+	Scheme string
+
+	// Path is the :path of a resource the server responds to for GET
+	// and POST requests. The server should read the body of POST
+	// requests before responding. If empty, "/" is used.
+	Path string
+
+	// Timeout is how long to wait for each expected frame.
+	// If zero, a default of 5 seconds is used.
+	Timeout time.Duration
+}
+
+func (cfg *Config) authority() string {
+	if cfg.Authority != "" {
+		return cfg.Authority
+	}
+	return "localhost"
+}
+
+func (cfg *Config) path() string {
+	if cfg.Path != "" {
+		return cfg.Path
+	}
+	return "/"
+}
+
+func (cfg *Config) timeout() time.Duration {
+	if cfg.Timeout > 0 {
+		return cfg.Timeout
+	}
+	return 5 * time.Second
+}
+
+// DialAddr returns a Config.Dial function which connects to the TCP
+// address addr. If tlsConfig is nil, it uses unencrypted HTTP/2 with
+// prior knowledge. Otherwise it negotiates "h2" over TLS.
+func DialAddr(addr string, tlsConfig *tls.Config) func() (net.Conn, error) {
+	if tlsConfig == nil {
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	}
+	return func() (net.Conn, error) {
+		tc, err := tls.Dial("tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		if p := tc.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+			tc.Close()
+			return nil, fmt.Errorf("negotiated protocol %q; want %q", p, http2.NextProtoTLS)
+		}
+		return tc, nil
+	}
+}
+
+// TestServer runs all conformance test cases against the server
+// described by cfg, each in its own subtest.
+func TestServer(t *testing.T, cfg *Config) {
+	if cfg.Dial == nil {
+		t.Fatal("conformance: Config.Dial is nil")
+	}
+	t.Run("RFC9113", func(t *testing.T) { runCases(t, cfg, http2Cases) })
+	t.Run("RFC7541", func(t *testing.T) { runCases(t, cfg, hpackCases) })
+}
+
+// A testCase is a conformance test for one requirement of an RFC.
+type testCase struct {
+	section string // RFC section, such as "6.5.2"
+	name    string
+	run     func(c *conn)
+}
+
+func runCases(t *testing.T, cfg *Config, cases []testCase) {
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.section+"/"+tc.name, func(t *testing.T) {
+			c := newConn(t, cfg)
+			defer c.nc.Close()
+			tc.run(c)
+		})
+	}
+}
+
+// conn is a client connection to the server under test.
+type conn struct {
+	t       *testing.T
+	cfg     *Config
+	nc      net.Conn
+	fr      *http2.Framer
+	scheme  string
+	timeout time.Duration
+
+	hbuf bytes.Buffer
+	henc *hpack.Encoder
+
+	// peerSettings are the settings from the server's first SETTINGS frame.
+	peerSettings map[http2.SettingID]uint32
+}
+
+func newConn(t *testing.T, cfg *Config) *conn {
+	t.Helper()
+	nc, err := cfg.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c := &conn{
+		t:            t,
+		cfg:          cfg,
+		nc:           nc,
+		scheme:       cfg.Scheme,
+		timeout:      cfg.timeout(),
+		peerSettings: make(map[http2.SettingID]uint32),
+	}
+	if c.scheme == "" {
+		c.scheme = "http"
+		if _, ok := nc.(*tls.Conn); ok {
+			c.scheme = "https"
+		}
+	}
+	c.fr = http2.NewFramer(nc, nc)
+	c.fr.AllowIllegalWrites = true
+	c.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	c.henc = hpack.NewEncoder(&c.hbuf)
+	return c
+}
+
+// handshake sends the client connection preface, and exchanges
+// SETTINGS frames and their acknowledgements with the server.
+func (c *conn) handshake() {
+	c.t.Helper()
+	c.write(func() error {
+		if _, err := io.WriteString(c.nc, http2.ClientPreface); err != nil {
+			return err
+		}
+		return c.fr.WriteSettings()
+	})
+	gotSettings, gotAck := false, false
+	for !gotSettings || !gotAck {
+		f := c.readFrame()
+		sf, ok := f.(*http2.SettingsFrame)
+		if !ok {
+			continue
+		}
+		if sf.IsAck() {
+			gotAck = true
+			continue
+		}
+		if gotSettings {
+			continue
+		}
+		gotSettings = true
+		sf.ForeachSetting(func(s http2.Setting) error {
+			c.peerSettings[s.ID] = s.Val
+			return nil
+		})
+		c.write(c.fr.WriteSettingsAck)
+	}
+}
+
+// peerSetting returns the value of a setting sent by the server,
+// or its initial value.
+func (c *conn) peerSetting(id http2.SettingID, initial uint32) uint32 {
+	if v, ok := c.peerSettings[id]; ok {
+		return v
+	}
+	return initial
+}
+
+// write calls f with a write deadline set, failing the test on error.
+func (c *conn) write(f func() error) {
+	c.t.Helper()
+	c.nc.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := f(); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+func (c *conn) writeRaw(t http2.FrameType, flags http2.Flags, streamID uint32, payload []byte) {
+	c.t.Helper()
+	c.write(func() error { return c.fr.WriteRawFrame(t, flags, streamID, payload) })
+}
+
+func (c *conn) writeHeaders(streamID uint32, endStream, endHeaders bool, block []byte) {
+	c.t.Helper()
+	c.write(func() error {
+		return c.fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      streamID,
+			BlockFragment: block,
+			EndStream:     endStream,
+			EndHeaders:    endHeaders,
+		})
+	})
+}
+
+func (c *conn) writeContinuation(streamID uint32, endHeaders bool, block []byte) {
+	c.t.Helper()
+	c.write(func() error { return c.fr.WriteContinuation(streamID, endHeaders, block) })
+}
+
+func (c *conn) writeData(streamID uint32, endStream bool, data []byte) {
+	c.t.Helper()
+	c.write(func() error { return c.fr.WriteData(streamID, endStream, data) })
+}
+
+func (c *conn) writeSettings(settings ...http2.Setting) {
+	c.t.Helper()
+	c.write(func() error { return c.fr.WriteSettings(settings...) })
+}
+
+func (c *conn) writeWindowUpdate(streamID, incr uint32) {
+	c.t.Helper()
+	c.write(func() error { return c.fr.WriteWindowUpdate(streamID, incr) })
+}
+
+// encode returns the HPACK encoding of the given name/value pairs.
+func (c *conn) encode(kv ...string) []byte {
+	if len(kv)%2 != 0 {
+		panic("odd number of kv args")
+	}
+	c.hbuf.Reset()
+	for i := 0; i < len(kv); i += 2 {
+		c.henc.WriteField(hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	return append([]byte(nil), c.hbuf.Bytes()...)
+}
+
+// request returns the encoded header block of a request with the given
+// method and additional name/value pairs.
+func (c *conn) request(method string, kv ...string) []byte {
+	return c.encode(append([]string{
+		":method", method,
+		":scheme", c.scheme,
+		":path", c.cfg.path(),
+		":authority", c.cfg.authority(),
+	}, kv...)...)
+}
+
+// openStream starts a POST request on the stream,
+// leaving the stream open for a request body.
+func (c *conn) openStream(streamID uint32) {
+	c.t.Helper()
+	c.writeHeaders(streamID, false, true, c.request("POST"))
+}
+
+// nextFrame reads the next frame from the server.
+func (c *conn) nextFrame() (http2.Frame, error) {
+	c.nc.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.fr.ReadFrame()
+}
+
+func (c *conn) readFrame() http2.Frame {
+	c.t.Helper()
+	f, err := c.nextFrame()
+	if err != nil {
+		c.t.Fatalf("reading frame: %v", err)
+	}
+	return f
+}
+
+// isClosed reports whether err from reading a frame means the
+// server closed the connection.
+func isClosed(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return !ne.Timeout()
+	}
+	return false
+}
+
+func hasCode(codes []http2.ErrCode, code http2.ErrCode) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// wantConnError waits for the server to close the connection, with a
+// GOAWAY frame with one of the given error codes or without one.
+func (c *conn) wantConnError(codes ...http2.ErrCode) {
+	c.t.Helper()
+	for {
+		f, err := c.nextFrame()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			c.t.Fatalf("waiting for connection error %v: %v", codes, err)
+		}
+		if ga, ok := f.(*http2.GoAwayFrame); ok {
+			if !hasCode(codes, ga.ErrCode) {
+				c.t.Fatalf("got GOAWAY with error code %v; want %v", ga.ErrCode, codes)
+			}
+			return
+		}
+	}
+}
+
+// wantStreamError waits for the server to reset the stream with one of
+// the given error codes. A connection error with one of the codes is
+// also accepted.
+func (c *conn) wantStreamError(streamID uint32, codes ...http2.ErrCode) {
+	c.t.Helper()
+	c.wantStreamErrorOrResponse(streamID, false, codes...)
+}
+
+// wantMalformed waits for the server to treat the request on the stream
+// as malformed, with a stream error of type PROTOCOL_ERROR or a 4xx
+// response (RFC 9113, Section 8.1.1).
+func (c *conn) wantMalformed(streamID uint32) {
+	c.t.Helper()
+	c.wantStreamErrorOrResponse(streamID, true, http2.ErrCodeProtocol)
+}
+
+func (c *conn) wantStreamErrorOrResponse(streamID uint32, allowResponse bool, codes ...http2.ErrCode) {
+	c.t.Helper()
+	for {
+		f, err := c.nextFrame()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			c.t.Fatalf("waiting for stream error %v: %v", codes, err)
+		}
+		switch f := f.(type) {
+		case *http2.RSTStreamFrame:
+			if f.StreamID != streamID {
+				continue
+			}
+			if !hasCode(codes, f.ErrCode) {
+				c.t.Fatalf("got RST_STREAM with error code %v; want %v", f.ErrCode, codes)
+			}
+			return
+		case *http2.GoAwayFrame:
+			if !hasCode(codes, f.ErrCode) {
+				c.t.Fatalf("got GOAWAY with error code %v; want %v", f.ErrCode, codes)
+			}
+			return
+		case *http2.MetaHeadersFrame:
+			if !allowResponse || f.StreamID != streamID {
+				continue
+			}
+			status := f.PseudoValue("status")
+			if len(status) == 3 && status[0] == '4' {
+				return
+			}
+			if len(status) == 3 && status[0] == '1' {
+				continue // informational; the final response follows
+			}
+			c.t.Fatalf("got response with :status %q; want stream error %v or a 4xx response", status, codes)
+		}
+	}
+}
+
+// wantResponse waits for the response headers on each of the streams,
+// in any order.
+func (c *conn) wantResponse(streamIDs ...uint32) {
+	c.t.Helper()
+	pending := make(map[uint32]bool)
+	for _, id := range streamIDs {
+		pending[id] = true
+	}
+	for len(pending) > 0 {
+		f, err := c.nextFrame()
+		if err != nil {
+			c.t.Fatalf("waiting for response: %v", err)
+		}
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			if !pending[f.StreamID] {
+				continue
+			}
+			if f.PseudoValue("status") == "" {
+				c.t.Fatalf("response on stream %v has no :status", f.StreamID)
+			}
+			delete(pending, f.StreamID)
+		case *http2.RSTStreamFrame:
+			if pending[f.StreamID] {
+				c.t.Fatalf("got RST_STREAM with error code %v on stream %v; want response", f.ErrCode, f.StreamID)
+			}
+		case *http2.GoAwayFrame:
+			c.t.Fatalf("got GOAWAY with error code %v; want response", f.ErrCode)
+		}
+	}
+}
+
+var pingData = [8]byte{'h', '2', 'c', 'o', 'n', 'f', 'o', 'r'}
+
+// ping checks that the connection is still usable, by sending
+// a PING frame and waiting for its acknowledgement.
+func (c *conn) ping() {
+	c.t.Helper()
+	c.write(func() error { return c.fr.WritePing(false, pingData) })
+	c.wantPingAck(pingData)
+}
+
+func (c *conn) wantPingAck(data [8]byte) {
+	c.t.Helper()
+	for {
+		f, err := c.nextFrame()
+		if err != nil {
+			c.t.Fatalf("waiting for PING acknowledgement: %v", err)
+		}
+		switch f := f.(type) {
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				continue
+			}
+			if f.Data != data {
+				c.t.Fatalf("got PING acknowledgement with data %q; want %q", f.Data, data)
+			}
+			return
+		case *http2.GoAwayFrame:
+			c.t.Fatalf("got GOAWAY with error code %v; want PING acknowledgement", f.ErrCode)
+		}
+	}
+}
+
+func (c *conn) wantSettingsAck() {
+	c.t.Helper()
+	for {
+		f, err := c.nextFrame()
+		if err != nil {
+			c.t.Fatalf("waiting for SETTINGS acknowledgement: %v", err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				return
+			}
+		case *http2.GoAwayFrame:
+			c.t.Fatalf("got GOAWAY with error code %v; want SETTINGS acknowledgement", f.ErrCode)
+		}
+	}
+}
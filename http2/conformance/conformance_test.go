@@ -0,0 +1,63 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ChillAndImprove/net/http2"
+)
+
+var testHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.Copy(ioutil.Discard, r.Body)
+	io.WriteString(w, "ok")
+})
+
+func TestServerTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(testHandler)
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if err := http2.ConfigureServer(ts.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	TestServer(t, &Config{
+		Dial: DialAddr(ts.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true}),
+	})
+}
+
+func TestServerH2C(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := &http2.Server{}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.ServeConn(c, &http2.ServeConnOpts{
+				BaseConfig: &http.Server{ErrorLog: log.New(ioutil.Discard, "", 0)},
+				Handler:    testHandler,
+			})
+		}
+	}()
+
+	TestServer(t, &Config{
+		Dial: DialAddr(l.Addr().String(), nil),
+	})
+}
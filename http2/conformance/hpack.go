@@ -0,0 +1,96 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import "github.com/ChillAndImprove/net/http2"
+
+// hpackCases are the RFC 7541 test cases. Each sends a request whose
+// field block is encoded by hand.
+var hpackCases = []testCase{
+	// 2.3.2. Dynamic Table
+	{"2.3.2", "DynamicTableReuse", func(c *conn) {
+		c.handshake()
+		// The second request refers to fields indexed by the first.
+		c.writeHeaders(1, true, true, c.request("GET", "x-test", "ok"))
+		c.writeHeaders(3, true, true, c.request("GET", "x-test", "ok"))
+		c.wantResponse(1, 3)
+	}},
+
+	// 2.3.3. Index Address Space
+	{"2.3.3", "IndexOutOfRange", func(c *conn) {
+		c.handshake()
+		// Indexed field 70, beyond the static table and the empty
+		// dynamic table.
+		c.writeHeaders(1, true, true, []byte{0x80 | 70})
+		c.wantConnError(http2.ErrCodeCompression)
+	}},
+
+	// 4.2. Maximum Table Size
+	{"4.2", "TableSizeUpdateTooLarge", func(c *conn) {
+		c.handshake()
+		max := c.peerSetting(http2.SettingHeaderTableSize, 4096)
+		block := appendVarInt([]byte{0x20}, 5, uint64(max)+1)
+		c.writeHeaders(1, true, true, append(block, c.request("GET")...))
+		c.wantConnError(http2.ErrCodeCompression)
+	}},
+	{"4.2", "TableSizeUpdateAfterField", func(c *conn) {
+		c.handshake()
+		// :method GET, then :path / added to the dynamic table,
+		// then a size update.
+		c.writeHeaders(1, true, true, []byte{0x82, 0x44, 0x01, '/', 0x20})
+		c.wantConnError(http2.ErrCodeCompression)
+	}},
+
+	// 5.2. String Literal Representation
+	{"5.2", "HuffmanEOS", func(c *conn) {
+		c.handshake()
+		// A Huffman-encoded name containing the EOS symbol.
+		c.writeHeaders(1, true, true, []byte{0x00, 0x84, 0xff, 0xff, 0xff, 0xff, 0x00})
+		c.wantConnError(http2.ErrCodeCompression)
+	}},
+	{"5.2", "HuffmanPaddingTooLong", func(c *conn) {
+		c.handshake()
+		// "a" followed by 11 bits of padding.
+		c.writeHeaders(1, true, true, []byte{0x00, 0x82, 0x1f, 0xff, 0x00})
+		c.wantConnError(http2.ErrCodeCompression)
+	}},
+	{"5.2", "HuffmanPaddingNotEOS", func(c *conn) {
+		c.handshake()
+		// "a" followed by zero padding bits.
+		c.writeHeaders(1, true, true, []byte{0x00, 0x81, 0x18, 0x00})
+		c.wantConnError(http2.ErrCodeCompression)
+	}},
+
+	// 6.1. Indexed Header Field Representation
+	{"6.1", "IndexZero", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, []byte{0x80})
+		c.wantConnError(http2.ErrCodeCompression)
+	}},
+
+	// 6.3. Dynamic Table Size Update
+	{"6.3", "TableSizeUpdate", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, append([]byte{0x20}, c.request("GET")...))
+		c.wantResponse(1)
+	}},
+}
+
+// appendVarInt appends i to dst as an HPACK integer with an n-bit
+// prefix (RFC 7541, Section 5.1). The prefix bits of the last byte of
+// dst are the first byte of the integer.
+func appendVarInt(dst []byte, n byte, i uint64) []byte {
+	k := uint64((1 << n) - 1)
+	if i < k {
+		dst[len(dst)-1] |= byte(i)
+		return dst
+	}
+	dst[len(dst)-1] |= byte(k)
+	i -= k
+	for ; i >= 128; i >>= 7 {
+		dst = append(dst, byte(0x80|(i&0x7f)))
+	}
+	return append(dst, byte(i))
+}
@@ -0,0 +1,369 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"io"
+
+	"github.com/ChillAndImprove/net/http2"
+)
+
+// http2Cases are the RFC 9113 test cases.
+var http2Cases = []testCase{
+	// 3.4. HTTP/2 Connection Preface
+	{"3.4", "InvalidPreface", func(c *conn) {
+		c.write(func() error {
+			_, err := io.WriteString(c.nc, "PRI * HTTP/2.0\r\n\r\nXX\r\n\r\n")
+			return err
+		})
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+
+	// 4.1. Frame Format
+	{"4.1", "UnknownFrameType", func(c *conn) {
+		c.handshake()
+		c.writeRaw(0xff, 0, 0, []byte("unknown"))
+		c.ping()
+	}},
+	{"4.1", "UnknownFlags", func(c *conn) {
+		c.handshake()
+		c.writeRaw(http2.FramePing, 0x16, 0, pingData[:])
+		c.wantPingAck(pingData)
+	}},
+
+	// 4.2. Frame Size
+	{"4.2", "DataLargerThanMaxFrameSize", func(c *conn) {
+		c.handshake()
+		c.openStream(1)
+		size := c.peerSetting(http2.SettingMaxFrameSize, 16384) + 1
+		// Write in the background: the server may stop reading
+		// before the end of the frame.
+		go c.fr.WriteRawFrame(http2.FrameData, 0, 1, make([]byte, size))
+		c.wantStreamError(1, http2.ErrCodeFrameSize)
+	}},
+
+	// 4.3. Field Section Compression and Decompression
+	{"4.3", "InvalidFieldBlock", func(c *conn) {
+		c.handshake()
+		// A literal field whose name is longer than the block.
+		c.writeHeaders(1, true, true, []byte{0x00, 0x0a, 'a', 'b'})
+		c.wantConnError(http2.ErrCodeCompression)
+	}},
+
+	// 5.1. Stream States
+	{"5.1", "DataOnIdleStream", func(c *conn) {
+		c.handshake()
+		c.writeData(1, true, []byte("test"))
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"5.1", "RSTStreamOnIdleStream", func(c *conn) {
+		c.handshake()
+		c.write(func() error { return c.fr.WriteRSTStream(1, http2.ErrCodeCancel) })
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"5.1", "WindowUpdateOnIdleStream", func(c *conn) {
+		c.handshake()
+		c.writeWindowUpdate(1, 100)
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"5.1", "DataOnHalfClosedStream", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.request("GET"))
+		c.writeData(1, true, []byte("test"))
+		c.wantStreamError(1, http2.ErrCodeStreamClosed)
+	}},
+
+	// 5.1.1. Stream Identifiers
+	{"5.1.1", "EvenStreamID", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(2, true, true, c.request("GET"))
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"5.1.1", "DecreasingStreamID", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(5, true, true, c.request("GET"))
+		c.writeHeaders(3, true, true, c.request("GET"))
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+
+	// 5.5. Extending HTTP/2
+	{"5.5", "UnknownFrameInFieldBlock", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, false, c.request("GET"))
+		c.writeRaw(0xff, 0, 1, []byte("unknown"))
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+
+	// 6.1. DATA
+	{"6.1", "DataOnStreamZero", func(c *conn) {
+		c.handshake()
+		c.writeData(0, true, []byte("test"))
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.1", "DataInvalidPadLength", func(c *conn) {
+		c.handshake()
+		c.openStream(1)
+		c.writeRaw(http2.FrameData, http2.FlagDataPadded|http2.FlagDataEndStream, 1, []byte{6, 't', 'e', 's', 't'})
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+
+	// 6.2. HEADERS
+	{"6.2", "HeadersOnStreamZero", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(0, true, true, c.request("GET"))
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.2", "HeadersInvalidPadLength", func(c *conn) {
+		c.handshake()
+		block := c.request("GET")
+		payload := append([]byte{byte(len(block) + 1)}, block...)
+		c.writeRaw(http2.FrameHeaders, http2.FlagHeadersPadded|http2.FlagHeadersEndStream|http2.FlagHeadersEndHeaders, 1, payload)
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.2", "PriorityInFieldBlock", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, false, c.request("GET"))
+		c.write(func() error { return c.fr.WritePriority(1, http2.PriorityParam{Weight: 15}) })
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+
+	// 6.3. PRIORITY
+	{"6.3", "PriorityOnStreamZero", func(c *conn) {
+		c.handshake()
+		c.write(func() error { return c.fr.WritePriority(0, http2.PriorityParam{StreamDep: 1, Weight: 15}) })
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.3", "PriorityInvalidLength", func(c *conn) {
+		c.handshake()
+		c.writeRaw(http2.FramePriority, 0, 1, []byte{0, 0, 0, 3})
+		c.wantStreamError(1, http2.ErrCodeFrameSize)
+	}},
+
+	// 6.4. RST_STREAM
+	{"6.4", "RSTStreamOnStreamZero", func(c *conn) {
+		c.handshake()
+		c.write(func() error { return c.fr.WriteRSTStream(0, http2.ErrCodeCancel) })
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.4", "RSTStreamInvalidLength", func(c *conn) {
+		c.handshake()
+		c.openStream(1)
+		c.writeRaw(http2.FrameRSTStream, 0, 1, []byte{0, 0, 0})
+		c.wantConnError(http2.ErrCodeFrameSize)
+	}},
+
+	// 6.5. SETTINGS
+	{"6.5", "SettingsAcknowledged", func(c *conn) {
+		c.handshake()
+		c.writeSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100})
+		c.wantSettingsAck()
+	}},
+	{"6.5", "SettingsAckWithPayload", func(c *conn) {
+		c.handshake()
+		c.writeRaw(http2.FrameSettings, http2.FlagSettingsAck, 0, []byte{0, 3, 0, 0, 0, 100})
+		c.wantConnError(http2.ErrCodeFrameSize)
+	}},
+	{"6.5", "SettingsOnStream", func(c *conn) {
+		c.handshake()
+		c.writeRaw(http2.FrameSettings, 0, 1, []byte{0, 3, 0, 0, 0, 100})
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.5", "SettingsInvalidLength", func(c *conn) {
+		c.handshake()
+		c.writeRaw(http2.FrameSettings, 0, 0, []byte{0, 3, 0})
+		c.wantConnError(http2.ErrCodeFrameSize)
+	}},
+
+	// 6.5.2. Defined Settings
+	{"6.5.2", "InvalidEnablePush", func(c *conn) {
+		c.handshake()
+		c.writeSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 2})
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.5.2", "InitialWindowSizeTooLarge", func(c *conn) {
+		c.handshake()
+		c.writeSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 31})
+		c.wantConnError(http2.ErrCodeFlowControl)
+	}},
+	{"6.5.2", "MaxFrameSizeTooSmall", func(c *conn) {
+		c.handshake()
+		c.writeSettings(http2.Setting{ID: http2.SettingMaxFrameSize, Val: 16383})
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.5.2", "MaxFrameSizeTooLarge", func(c *conn) {
+		c.handshake()
+		c.writeSettings(http2.Setting{ID: http2.SettingMaxFrameSize, Val: 1 << 24})
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.5.2", "UnknownSetting", func(c *conn) {
+		c.handshake()
+		c.writeSettings(http2.Setting{ID: 0xff, Val: 1})
+		c.wantSettingsAck()
+	}},
+
+	// 6.7. PING
+	{"6.7", "PingAcknowledged", func(c *conn) {
+		c.handshake()
+		c.ping()
+	}},
+	{"6.7", "PingAckNotAcknowledged", func(c *conn) {
+		c.handshake()
+		c.write(func() error { return c.fr.WritePing(true, [8]byte{'a', 'c', 'k'}) })
+		c.ping()
+	}},
+	{"6.7", "PingOnStream", func(c *conn) {
+		c.handshake()
+		c.writeRaw(http2.FramePing, 0, 1, pingData[:])
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.7", "PingInvalidLength", func(c *conn) {
+		c.handshake()
+		c.writeRaw(http2.FramePing, 0, 0, pingData[:6])
+		c.wantConnError(http2.ErrCodeFrameSize)
+	}},
+
+	// 6.8. GOAWAY
+	{"6.8", "GoAwayOnStream", func(c *conn) {
+		c.handshake()
+		c.writeRaw(http2.FrameGoAway, 0, 1, []byte{0, 0, 0, 0, 0, 0, 0, 0})
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+
+	// 6.9. WINDOW_UPDATE
+	{"6.9", "ZeroIncrementOnConnection", func(c *conn) {
+		c.handshake()
+		c.writeWindowUpdate(0, 0)
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.9", "ZeroIncrementOnStream", func(c *conn) {
+		c.handshake()
+		c.openStream(1)
+		c.writeWindowUpdate(1, 0)
+		c.wantStreamError(1, http2.ErrCodeProtocol)
+	}},
+	{"6.9", "WindowUpdateInvalidLength", func(c *conn) {
+		c.handshake()
+		c.writeRaw(http2.FrameWindowUpdate, 0, 0, []byte{0, 0, 1})
+		c.wantConnError(http2.ErrCodeFrameSize)
+	}},
+
+	// 6.9.1. The Flow-Control Window
+	{"6.9.1", "ConnectionWindowOverflow", func(c *conn) {
+		c.handshake()
+		c.writeWindowUpdate(0, 1<<31-1)
+		c.writeWindowUpdate(0, 1<<31-1)
+		c.wantConnError(http2.ErrCodeFlowControl)
+	}},
+	{"6.9.1", "StreamWindowOverflow", func(c *conn) {
+		c.handshake()
+		c.openStream(1)
+		c.writeWindowUpdate(1, 1<<31-1)
+		c.writeWindowUpdate(1, 1<<31-1)
+		c.wantStreamError(1, http2.ErrCodeFlowControl)
+	}},
+
+	// 6.10. CONTINUATION
+	{"6.10", "MultipleContinuations", func(c *conn) {
+		c.handshake()
+		block := c.request("GET")
+		n := len(block) / 3
+		c.writeHeaders(1, true, false, block[:n])
+		c.writeContinuation(1, false, block[n:2*n])
+		c.writeContinuation(1, true, block[2*n:])
+		c.wantResponse(1)
+	}},
+	{"6.10", "ContinuationAfterEndHeaders", func(c *conn) {
+		c.handshake()
+		c.openStream(1)
+		c.writeContinuation(1, true, c.encode("x-test", "ok"))
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.10", "ContinuationOnDifferentStream", func(c *conn) {
+		c.handshake()
+		block := c.request("GET")
+		c.writeHeaders(1, true, false, block[:1])
+		c.writeContinuation(3, true, block[1:])
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+	{"6.10", "ContinuationOnStreamZero", func(c *conn) {
+		c.handshake()
+		block := c.request("GET")
+		c.writeHeaders(1, true, false, block[:1])
+		c.writeContinuation(0, true, block[1:])
+		c.wantConnError(http2.ErrCodeProtocol)
+	}},
+
+	// 8.1. HTTP Message Framing
+	{"8.1", "Response", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.request("GET"))
+		c.wantResponse(1)
+	}},
+	{"8.1.1", "ContentLengthMismatch", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, false, true, c.request("POST", "content-length", "1"))
+		c.writeData(1, true, []byte("test"))
+		c.wantMalformed(1)
+	}},
+
+	// 8.2. HTTP Fields
+	{"8.2.1", "UppercaseFieldName", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.request("GET", "X-Test", "ok"))
+		c.wantMalformed(1)
+	}},
+	{"8.2.2", "ConnectionSpecificField", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.request("GET", "connection", "keep-alive"))
+		c.wantMalformed(1)
+	}},
+	{"8.2.2", "TEOtherThanTrailers", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.request("GET", "te", "gzip"))
+		c.wantMalformed(1)
+	}},
+
+	// 8.3. HTTP Control Data
+	{"8.3", "PseudoHeaderAfterRegularField", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.encode(
+			":method", "GET",
+			":scheme", c.scheme,
+			"x-test", "ok",
+			":path", c.cfg.path(),
+			":authority", c.cfg.authority(),
+		))
+		c.wantMalformed(1)
+	}},
+	{"8.3", "UnknownPseudoHeader", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.request("GET", ":test", "ok"))
+		c.wantMalformed(1)
+	}},
+	{"8.3.1", "MissingMethod", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.encode(
+			":scheme", c.scheme,
+			":path", c.cfg.path(),
+			":authority", c.cfg.authority(),
+		))
+		c.wantMalformed(1)
+	}},
+	{"8.3.1", "DuplicatePath", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.request("GET", ":path", c.cfg.path()))
+		c.wantMalformed(1)
+	}},
+	{"8.3.1", "EmptyPath", func(c *conn) {
+		c.handshake()
+		c.writeHeaders(1, true, true, c.encode(
+			":method", "GET",
+			":scheme", c.scheme,
+			":path", "",
+			":authority", c.cfg.authority(),
+		))
+		c.wantMalformed(1)
+	}},
+}
@@ -52,6 +52,17 @@ func (f *inflow) add(n int) (connAdd int32) {
 	return int32(unsent)
 }
 
+// grow increases the window by n bytes without a WINDOW_UPDATE,
+// for example because the peer learns of the larger window from a
+// change to SETTINGS_INITIAL_WINDOW_SIZE.
+func (f *inflow) grow(n int32) {
+	const maxWindow = 1<<31 - 1
+	if int64(f.avail)+int64(f.unsent)+int64(n) > maxWindow {
+		panic("flow control update exceeds maximum window size")
+	}
+	f.avail += n
+}
+
 // take attempts to take n bytes from the peer's flow control window.
 // It reports whether the window has available capacity.
 func (f *inflow) take(n uint32) bool {
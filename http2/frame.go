@@ -37,6 +37,7 @@ const (
 	FrameGoAway       FrameType = 0x7
 	FrameWindowUpdate FrameType = 0x8
 	FrameContinuation FrameType = 0x9
+	FrameOrigin       FrameType = 0xc
 )
 
 var frameName = map[FrameType]string{
@@ -50,6 +51,7 @@ var frameName = map[FrameType]string{
 	FrameGoAway:       "GOAWAY",
 	FrameWindowUpdate: "WINDOW_UPDATE",
 	FrameContinuation: "CONTINUATION",
+	FrameOrigin:       "ORIGIN",
 }
 
 func (t FrameType) String() string {
@@ -135,6 +137,7 @@ var frameParsers = map[FrameType]frameParser{
 	FrameGoAway:       parseGoAwayFrame,
 	FrameWindowUpdate: parseWindowUpdateFrame,
 	FrameContinuation: parseContinuationFrame,
+	FrameOrigin:       parseOriginFrame,
 }
 
 func typeFrameParser(t FrameType) frameParser {
@@ -272,6 +275,12 @@ type Framer struct {
 	// from Transport.CountError or Server.CountError.
 	countError func(errToken string)
 
+	// onContinuation, if non-nil, is called by ReadFrame after
+	// each CONTINUATION frame of a header block is read when
+	// ReadMetaHeaders is set. If it returns an error, reading the
+	// header block stops and ReadFrame returns the error.
+	onContinuation func() error
+
 	// lastHeaderStream is non-zero if the last frame was an
 	// unfinished HEADERS/CONTINUATION.
 	lastHeaderStream uint32
@@ -924,6 +933,49 @@ func (f *Framer) WriteGoAway(maxStreamID uint32, code ErrCode, debugData []byte)
 	return f.endWrite()
 }
 
+// An OriginFrame lists the origins a server is authoritative for on
+// this connection.
+// See https://www.rfc-editor.org/rfc/rfc8336.html#section-2
+type OriginFrame struct {
+	FrameHeader
+	Origins []string // ASCII serialized origins, e.g. "https://example.com"
+}
+
+func parseOriginFrame(_ *frameCache, fh FrameHeader, countError func(string), p []byte) (Frame, error) {
+	f := &OriginFrame{FrameHeader: fh}
+	for len(p) > 0 {
+		if len(p) < 2 {
+			countError("frame_origin_short")
+			return nil, ConnectionError(ErrCodeFrameSize)
+		}
+		n := int(binary.BigEndian.Uint16(p[:2]))
+		p = p[2:]
+		if len(p) < n {
+			countError("frame_origin_bad_len")
+			return nil, ConnectionError(ErrCodeFrameSize)
+		}
+		f.Origins = append(f.Origins, string(p[:n]))
+		p = p[n:]
+	}
+	return f, nil
+}
+
+// WriteOrigin writes an ORIGIN frame on stream 0 containing origins.
+//
+// It will perform exactly one Write to the underlying Writer.
+// It is the caller's responsibility to not call other Write methods concurrently.
+func (f *Framer) WriteOrigin(origins ...string) error {
+	f.startWrite(FrameOrigin, 0, 0)
+	for _, o := range origins {
+		if len(o) > 0xffff {
+			return errors.New("http2: ORIGIN frame entry too long")
+		}
+		f.writeUint16(uint16(len(o)))
+		f.writeBytes([]byte(o))
+	}
+	return f.endWrite()
+}
+
 // An UnknownFrame is the frame type returned when the frame type is unknown
 // or no specific frame type parser exists.
 type UnknownFrame struct {
@@ -1055,8 +1107,10 @@ func parseHeadersFrame(_ *frameCache, fh FrameHeader, countError func(string), p
 		}
 	}
 	if len(p)-int(padLength) < 0 {
+		// RFC 9113, Section 6.2: padding as long as the frame payload
+		// or longer MUST be treated as a connection error.
 		countError("frame_headers_pad_too_big")
-		return nil, streamError(fh.StreamID, ErrCodeProtocol)
+		return nil, connError{ErrCodeProtocol, "pad size larger than headers payload"}
 	}
 	hf.headerFragBuf = p[:len(p)-int(padLength)]
 	return hf, nil
@@ -1622,6 +1676,11 @@ func (fr *Framer) readMetaFrame(hf *HeadersFrame) (Frame, error) {
 		} else {
 			hc = f.(*ContinuationFrame) // guaranteed by checkFrameOrder
 		}
+		if fr.onContinuation != nil {
+			if err := fr.onContinuation(); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	mh.HeadersFrame.headerFragBuf = nil
@@ -1686,6 +1745,8 @@ func summarizeFrame(f Frame) string {
 			f.LastStreamID, f.ErrCode, f.debugData)
 	case *RSTStreamFrame:
 		fmt.Fprintf(&buf, " ErrCode=%v", f.ErrCode)
+	case *OriginFrame:
+		fmt.Fprintf(&buf, " origins=%q", f.Origins)
 	}
 	return buf.String()
 }
@@ -36,6 +36,7 @@ func TestFrameTypeString(t *testing.T) {
 		{FrameData, "DATA"},
 		{FramePing, "PING"},
 		{FrameGoAway, "GOAWAY"},
+		{FrameOrigin, "ORIGIN"},
 		{0xf, "UNKNOWN_FRAME_TYPE_15"},
 	}
 
@@ -708,6 +709,55 @@ func TestWriteGoAway(t *testing.T) {
 	}
 }
 
+func TestWriteOrigin(t *testing.T) {
+	fr, buf := testFramer()
+	if err := fr.WriteOrigin("https://a.example.com", "https://b.example.com:8443"); err != nil {
+		t.Fatal(err)
+	}
+	const wantEnc = "\x00\x00\x33\x0c\x00\x00\x00\x00\x00" +
+		"\x00\x15https://a.example.com" +
+		"\x00\x1ahttps://b.example.com:8443"
+	if buf.String() != wantEnc {
+		t.Errorf("encoded as %q; want %q", buf.Bytes(), wantEnc)
+	}
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &OriginFrame{
+		FrameHeader: FrameHeader{
+			valid:    true,
+			Type:     0xc,
+			Flags:    0,
+			Length:   uint32(2 + 21 + 2 + 26),
+			StreamID: 0,
+		},
+		Origins: []string{"https://a.example.com", "https://b.example.com:8443"},
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Fatalf("parsed back:\n%#v\nwant:\n%#v", f, want)
+	}
+}
+
+func TestReadOriginFrameTruncated(t *testing.T) {
+	fr, buf := testFramer()
+	buf.WriteString("\x00\x00\x05\x0c\x00\x00\x00\x00\x00\x00\x10abc")
+	_, err := fr.ReadFrame()
+	if err != ConnectionError(ErrCodeFrameSize) {
+		t.Fatalf("ReadFrame = %v; want %v", err, ConnectionError(ErrCodeFrameSize))
+	}
+}
+
+func TestReadHeadersFramePadTooLarge(t *testing.T) {
+	fr, buf := testFramer()
+	// PADDED|END_HEADERS, with a pad length of 5 and only 2 bytes left.
+	buf.WriteString("\x00\x00\x03\x01\x0c\x00\x00\x00\x01\x05ab")
+	_, err := fr.ReadFrame()
+	if err != ConnectionError(ErrCodeProtocol) {
+		t.Fatalf("ReadFrame = %v; want %v", err, ConnectionError(ErrCodeProtocol))
+	}
+}
+
 func TestWritePushPromise(t *testing.T) {
 	pp := PushPromiseParam{
 		StreamID:      42,
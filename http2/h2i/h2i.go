@@ -17,6 +17,39 @@ Interactive commands in the console: (all parts case-insensitive)
 	settings ack
 	settings FOO=n BAR=z
 	headers      (open a new stream by typing HTTP/1.1)
+	data <stream-id> <data> [END_STREAM]
+	raw <type> <flags> <stream-id> [hex-payload]
+
+Arguments containing spaces may be written as Go double-quoted strings.
+
+With -script, h2i runs the commands in a file (or standard input, for "-")
+instead of starting a console, and exits with a non-zero status if any
+command fails. Lines starting with # are comments. In a script, the headers
+command reads the HTTP/1.1 request from the following lines, up to a blank
+line. Scripts may also use:
+
+	wait <type> [field=value ...] [FLAG ...]
+	expect <type> [field=value ...] [FLAG ...]
+
+wait reads frames until one of the given type arrives, and expect requires
+the next frame to be of the given type. Either fails if the frame's fields
+do not match, or if no frame arrives within -timeout. The fields are
+stream, len, and, depending on the frame type:
+
+	DATA           data
+	HEADERS        any header name, such as :status
+	RST_STREAM     code
+	SETTINGS       any setting name, such as MAX_FRAME_SIZE
+	PING           data
+	GOAWAY         last_stream, code, debug
+	WINDOW_UPDATE  increment
+
+and the flags are those the frame type defines: END_STREAM, END_HEADERS,
+PADDED, PRIORITY, or ACK. A HEADERS frame's fields include those of the
+CONTINUATION frames that complete its header block.
+
+The -h2c flag uses unencrypted HTTP/2 with prior knowledge rather than TLS,
+and the -unix flag connects to a Unix domain socket.
 */
 package main
 
@@ -24,6 +57,7 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -35,6 +69,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ChillAndImprove/net/http2"
 	"github.com/ChillAndImprove/net/http2/hpack"
@@ -47,6 +82,10 @@ var (
 	flagInsecure  = flag.Bool("insecure", false, "Whether to skip TLS cert validation")
 	flagSettings  = flag.String("settings", "empty", "comma-separated list of KEY=value settings for the initial SETTINGS frame. The magic value 'empty' sends an empty initial settings frame, and the magic value 'omit' causes no initial settings frame to be sent.")
 	flagDial      = flag.String("dial", "", "optional ip:port to dial, to connect to a host:port but use a different SNI name (including a SNI name without DNS)")
+	flagUnix      = flag.String("unix", "", "optional path of a Unix domain socket to dial instead of a TCP address")
+	flagH2C       = flag.Bool("h2c", false, "Whether to use unencrypted HTTP/2 with prior knowledge instead of TLS")
+	flagScript    = flag.String("script", "", "optional file of commands to run instead of the interactive console, or - for standard input")
+	flagTimeout   = flag.Duration("timeout", 5*time.Second, "how long script wait and expect commands wait for a frame")
 )
 
 type command struct {
@@ -75,6 +114,10 @@ var commands = map[string]command{
 	},
 	"quit":    {run: (*h2i).cmdQuit},
 	"headers": {run: (*h2i).cmdHeaders},
+	"data":    {run: (*h2i).cmdData},
+	"raw":     {run: (*h2i).cmdRaw},
+	"wait":    {run: (*h2i).cmdWait},
+	"expect":  {run: (*h2i).cmdExpect},
 }
 
 func usage() {
@@ -82,10 +125,10 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-// withPort adds ":443" if another port isn't already present.
-func withPort(host string) string {
+// withPort adds the given default port if another port isn't already present.
+func withPort(host, port string) string {
 	if _, _, err := net.SplitHostPort(host); err != nil {
-		return net.JoinHostPort(host, "443")
+		return net.JoinHostPort(host, port)
 	}
 	return host
 }
@@ -101,9 +144,14 @@ func withoutPort(addr string) string {
 // h2i is the app's state.
 type h2i struct {
 	host   string
-	tc     *tls.Conn
+	conn   net.Conn
 	framer *http2.Framer
-	term   *term.Terminal
+	term   *term.Terminal // nil in script mode
+	lines  lineReader     // the terminal, or the script
+	scheme string
+
+	// script is the line number reader in script mode.
+	script *scriptReader
 
 	// owned by the command loop:
 	streamID uint32
@@ -113,6 +161,12 @@ type h2i struct {
 	// owned by the readFrames loop:
 	peerSetting map[http2.SettingID]uint32
 	hdec        *hpack.Decoder
+	headers     []hpack.HeaderField // fields of the last HEADERS header block
+}
+
+// A lineReader reads lines of commands.
+type lineReader interface {
+	ReadLine() (line string, err error)
 }
 
 func main() {
@@ -143,43 +197,23 @@ func main() {
 }
 
 func (app *h2i) Main() error {
-	cfg := &tls.Config{
-		ServerName:         withoutPort(app.host),
-		NextProtos:         strings.Split(*flagNextProto, ","),
-		InsecureSkipVerify: *flagInsecure,
-	}
-
-	hostAndPort := *flagDial
-	if hostAndPort == "" {
-		hostAndPort = withPort(app.host)
-	}
-	log.Printf("Connecting to %s ...", hostAndPort)
-	tc, err := tls.Dial("tcp", hostAndPort, cfg)
+	c, err := app.dial()
 	if err != nil {
-		return fmt.Errorf("Error dialing %s: %v", hostAndPort, err)
-	}
-	log.Printf("Connected to %v", tc.RemoteAddr())
-	defer tc.Close()
-
-	if err := tc.Handshake(); err != nil {
-		return fmt.Errorf("TLS handshake: %v", err)
-	}
-	if !*flagInsecure {
-		if err := tc.VerifyHostname(app.host); err != nil {
-			return fmt.Errorf("VerifyHostname: %v", err)
-		}
-	}
-	state := tc.ConnectionState()
-	log.Printf("Negotiated protocol %q", state.NegotiatedProtocol)
-	if !state.NegotiatedProtocolIsMutual || state.NegotiatedProtocol == "" {
-		return fmt.Errorf("Could not negotiate protocol mutually")
+		return err
 	}
+	app.conn = c
+	defer c.Close()
 
-	if _, err := io.WriteString(tc, http2.ClientPreface); err != nil {
+	if _, err := io.WriteString(c, http2.ClientPreface); err != nil {
 		return err
 	}
 
-	app.framer = http2.NewFramer(tc, tc)
+	app.framer = http2.NewFramer(c, c)
+	app.framer.AllowIllegalWrites = true // for testing peers
+
+	if *flagScript != "" {
+		return app.runScript(*flagScript)
+	}
 
 	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
@@ -193,6 +227,7 @@ func (app *h2i) Main() error {
 	}{os.Stdin, os.Stdout}
 
 	app.term = term.NewTerminal(screen, "h2i> ")
+	app.lines = app.term
 	lastWord := regexp.MustCompile(`.+\W(\w+)$`)
 	app.term.AutoCompleteCallback = func(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
 		if key != '\t' {
@@ -250,21 +285,89 @@ func (app *h2i) Main() error {
 	return <-errc
 }
 
+// dial connects to the target, and negotiates TLS unless -h2c is set.
+func (app *h2i) dial() (net.Conn, error) {
+	app.scheme = "https"
+	defaultPort := "443"
+	if *flagH2C {
+		app.scheme = "http"
+		defaultPort = "80"
+	}
+
+	network, addr := "tcp", *flagDial
+	if *flagUnix != "" {
+		network, addr = "unix", *flagUnix
+	} else if addr == "" {
+		addr = withPort(app.host, defaultPort)
+	}
+	log.Printf("Connecting to %s ...", addr)
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error dialing %s: %v", addr, err)
+	}
+	log.Printf("Connected to %v", c.RemoteAddr())
+	if *flagH2C {
+		return c, nil
+	}
+
+	tc := tls.Client(c, &tls.Config{
+		ServerName:         withoutPort(app.host),
+		NextProtos:         strings.Split(*flagNextProto, ","),
+		InsecureSkipVerify: *flagInsecure,
+	})
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("TLS handshake: %v", err)
+	}
+	if !*flagInsecure {
+		if err := tc.VerifyHostname(app.host); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("VerifyHostname: %v", err)
+		}
+	}
+	state := tc.ConnectionState()
+	log.Printf("Negotiated protocol %q", state.NegotiatedProtocol)
+	if !state.NegotiatedProtocolIsMutual || state.NegotiatedProtocol == "" {
+		c.Close()
+		return nil, fmt.Errorf("Could not negotiate protocol mutually")
+	}
+	return tc, nil
+}
+
 func (app *h2i) logf(format string, args ...interface{}) {
+	if app.term == nil {
+		fmt.Fprintf(os.Stdout, format+"\n", args...)
+		return
+	}
 	fmt.Fprintf(app.term, format+"\r\n", args...)
 }
 
+// usageErrorf reports a mistake in a command. In the console it is
+// only logged, but it ends a script.
+func (app *h2i) usageErrorf(format string, args ...interface{}) error {
+	if app.script != nil {
+		return fmt.Errorf(format, args...)
+	}
+	app.logf("Error: "+format, args...)
+	return nil
+}
+
+// sendInitialSettings sends the SETTINGS frame requested by -settings.
+func (app *h2i) sendInitialSettings() error {
+	s := *flagSettings
+	if s == "omit" {
+		return nil
+	}
+	var args []string
+	if s != "empty" {
+		args = strings.Split(s, ",")
+	}
+	return app.cmdSettings(args)
+}
+
 func (app *h2i) readConsole() error {
-	if s := *flagSettings; s != "omit" {
-		var args []string
-		if s != "empty" {
-			args = strings.Split(s, ",")
-		}
-		_, c, ok := lookupCommand("settings")
-		if !ok {
-			panic("settings command not found")
-		}
-		c.run(app, args)
+	if err := app.sendInitialSettings(); err != nil {
+		return err
 	}
 
 	for {
@@ -275,7 +378,11 @@ func (app *h2i) readConsole() error {
 		if err != nil {
 			return fmt.Errorf("term.ReadLine: %v", err)
 		}
-		f := strings.Fields(line)
+		f, err := splitArgs(line)
+		if err != nil {
+			app.logf("Error: %v", err)
+			continue
+		}
 		if len(f) == 0 {
 			continue
 		}
@@ -316,8 +423,7 @@ var errExitApp = errors.New("internal sentinel error value to quit the console r
 
 func (a *h2i) cmdQuit(args []string) error {
 	if len(args) > 0 {
-		a.logf("the QUIT command takes no argument")
-		return nil
+		return a.usageErrorf("the QUIT command takes no argument")
 	}
 	return errExitApp
 }
@@ -329,23 +435,19 @@ func (a *h2i) cmdSettings(args []string) error {
 	var settings []http2.Setting
 	for _, arg := range args {
 		if strings.EqualFold(arg, "ACK") {
-			a.logf("Error: ACK must be only argument with the SETTINGS command")
-			return nil
+			return a.usageErrorf("ACK must be only argument with the SETTINGS command")
 		}
 		eq := strings.Index(arg, "=")
 		if eq == -1 {
-			a.logf("Error: invalid argument %q (expected SETTING_NAME=nnnn)", arg)
-			return nil
+			return a.usageErrorf("invalid argument %q (expected SETTING_NAME=nnnn)", arg)
 		}
 		sid, ok := settingByName(arg[:eq])
 		if !ok {
-			a.logf("Error: unknown setting name %q", arg[:eq])
-			return nil
+			return a.usageErrorf("unknown setting name %q", arg[:eq])
 		}
 		val, err := strconv.ParseUint(arg[eq+1:], 10, 32)
 		if err != nil {
-			a.logf("Error: invalid argument %q (expected SETTING_NAME=nnnn)", arg)
-			return nil
+			return a.usageErrorf("invalid argument %q (expected SETTING_NAME=nnnn)", arg)
 		}
 		settings = append(settings, http2.Setting{
 			ID:  sid,
@@ -374,8 +476,7 @@ func settingByName(name string) (http2.SettingID, bool) {
 
 func (app *h2i) cmdPing(args []string) error {
 	if len(args) > 1 {
-		app.logf("invalid PING usage: only accepts 0 or 1 args")
-		return nil // nil means don't end the program
+		return app.usageErrorf("invalid PING usage: only accepts 0 or 1 args")
 	}
 	var data [8]byte
 	if len(args) == 1 {
@@ -386,18 +487,109 @@ func (app *h2i) cmdPing(args []string) error {
 	return app.framer.WritePing(false, data)
 }
 
+func (app *h2i) cmdData(args []string) error {
+	if len(args) < 2 || len(args) > 3 || (len(args) == 3 && !strings.EqualFold(args[2], "END_STREAM")) {
+		return app.usageErrorf("invalid DATA usage: data <stream-id> <data> [END_STREAM]")
+	}
+	streamID, err := strconv.ParseUint(args[0], 10, 31)
+	if err != nil {
+		return app.usageErrorf("invalid stream ID %q", args[0])
+	}
+	return app.framer.WriteData(uint32(streamID), len(args) == 3, []byte(args[1]))
+}
+
+func (app *h2i) cmdRaw(args []string) error {
+	if len(args) < 3 || len(args) > 4 {
+		return app.usageErrorf("invalid RAW usage: raw <type> <flags> <stream-id> [hex-payload]")
+	}
+	t, ok := frameTypeByName(args[0])
+	if !ok {
+		return app.usageErrorf("unknown frame type %q", args[0])
+	}
+	flags, err := strconv.ParseUint(args[1], 0, 8)
+	if err != nil {
+		return app.usageErrorf("invalid flags %q", args[1])
+	}
+	streamID, err := strconv.ParseUint(args[2], 10, 31)
+	if err != nil {
+		return app.usageErrorf("invalid stream ID %q", args[2])
+	}
+	var payload []byte
+	if len(args) == 4 {
+		payload, err = hex.DecodeString(args[3])
+		if err != nil {
+			return app.usageErrorf("invalid payload %q: %v", args[3], err)
+		}
+	}
+	return app.framer.WriteRawFrame(t, http2.Flags(flags), uint32(streamID), payload)
+}
+
+// frameTypeByName returns the frame type with the given name,
+// such as "RST_STREAM", or number.
+func frameTypeByName(name string) (http2.FrameType, bool) {
+	if n, err := strconv.ParseUint(name, 0, 8); err == nil {
+		return http2.FrameType(n), true
+	}
+	for t := http2.FrameData; t <= http2.FrameContinuation; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// splitArgs splits a command line into space-separated arguments.
+// Double-quoted parts of an argument are unquoted as Go strings.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	for i := 0; i < len(line); {
+		switch c := line[i]; c {
+		case ' ', '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+			i++
+		case '"':
+			q, err := strconv.QuotedPrefix(line[i:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string at %q", line[i:])
+			}
+			v, _ := strconv.Unquote(q)
+			arg.WriteString(v)
+			inArg = true
+			i += len(q)
+		default:
+			arg.WriteByte(c)
+			inArg = true
+			i++
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
 func (app *h2i) cmdHeaders(args []string) error {
 	if len(args) > 0 {
-		app.logf("Error: HEADERS doesn't yet take arguments.")
 		// TODO: flags for restricting window size, to force CONTINUATION
 		// frames.
-		return nil
+		return app.usageErrorf("HEADERS doesn't yet take arguments.")
 	}
 	var h1req bytes.Buffer
-	app.term.SetPrompt("(as HTTP/1.1)> ")
-	defer app.term.SetPrompt("h2i> ")
+	if app.term != nil {
+		app.term.SetPrompt("(as HTTP/1.1)> ")
+		defer app.term.SetPrompt("h2i> ")
+	}
 	for {
-		line, err := app.term.ReadLine()
+		line, err := app.lines.ReadLine()
+		if err == io.EOF && app.script != nil {
+			line, err = "", nil // end of script ends the request
+		}
 		if err != nil {
 			return err
 		}
@@ -409,8 +601,7 @@ func (app *h2i) cmdHeaders(args []string) error {
 	}
 	req, err := http.ReadRequest(bufio.NewReader(&h1req))
 	if err != nil {
-		app.logf("Invalid HTTP/1.1 request: %v", err)
-		return nil
+		return app.usageErrorf("Invalid HTTP/1.1 request: %v", err)
 	}
 	if app.streamID == 0 {
 		app.streamID = 1
@@ -420,8 +611,7 @@ func (app *h2i) cmdHeaders(args []string) error {
 	app.logf("Opening Stream-ID %d:", app.streamID)
 	hbf := app.encodeHeaders(req)
 	if len(hbf) > 16<<10 {
-		app.logf("TODO: h2i doesn't yet write CONTINUATION frames. Copy it from transport.go")
-		return nil
+		return app.usageErrorf("TODO: h2i doesn't yet write CONTINUATION frames. Copy it from transport.go")
 	}
 	return app.framer.WriteHeaders(http2.HeadersFrameParam{
 		StreamID:      app.streamID,
@@ -437,42 +627,52 @@ func (app *h2i) readFrames() error {
 		if err != nil {
 			return fmt.Errorf("ReadFrame: %v", err)
 		}
-		app.logf("%v", f)
-		switch f := f.(type) {
-		case *http2.PingFrame:
-			app.logf("  Data = %q", f.Data)
-		case *http2.SettingsFrame:
-			f.ForeachSetting(func(s http2.Setting) error {
-				app.logf("  %v", s)
-				app.peerSetting[s.ID] = s.Val
-				return nil
-			})
-		case *http2.WindowUpdateFrame:
-			app.logf("  Window-Increment = %v", f.Increment)
-		case *http2.GoAwayFrame:
-			app.logf("  Last-Stream-ID = %d; Error-Code = %v (%d)", f.LastStreamID, f.ErrCode, f.ErrCode)
-		case *http2.DataFrame:
-			app.logf("  %q", f.Data())
-		case *http2.HeadersFrame:
-			if f.HasPriority() {
-				app.logf("  PRIORITY = %v", f.Priority)
-			}
-			if app.hdec == nil {
-				// TODO: if the user uses h2i to send a SETTINGS frame advertising
-				// something larger, we'll need to respect SETTINGS_HEADER_TABLE_SIZE
-				// and stuff here instead of using the 4k default. But for now:
-				tableSize := uint32(4 << 10)
-				app.hdec = hpack.NewDecoder(tableSize, app.onNewHeaderField)
-			}
-			app.hdec.Write(f.HeaderBlockFragment())
-		case *http2.PushPromiseFrame:
-			if app.hdec == nil {
-				// TODO: if the user uses h2i to send a SETTINGS frame advertising
-				// something larger, we'll need to respect SETTINGS_HEADER_TABLE_SIZE
-				// and stuff here instead of using the 4k default. But for now:
-				tableSize := uint32(4 << 10)
-				app.hdec = hpack.NewDecoder(tableSize, app.onNewHeaderField)
-			}
+		app.logFrame(f)
+	}
+}
+
+// logFrame prints a frame read from the peer, decoding any header block.
+func (app *h2i) logFrame(f http2.Frame) {
+	app.logf("%v", f)
+	switch f := f.(type) {
+	case *http2.PingFrame:
+		app.logf("  Data = %q", f.Data)
+	case *http2.SettingsFrame:
+		f.ForeachSetting(func(s http2.Setting) error {
+			app.logf("  %v", s)
+			app.peerSetting[s.ID] = s.Val
+			return nil
+		})
+	case *http2.WindowUpdateFrame:
+		app.logf("  Window-Increment = %v", f.Increment)
+	case *http2.GoAwayFrame:
+		app.logf("  Last-Stream-ID = %d; Error-Code = %v (%d)", f.LastStreamID, f.ErrCode, f.ErrCode)
+	case *http2.DataFrame:
+		app.logf("  %q", f.Data())
+	case *http2.HeadersFrame:
+		if f.HasPriority() {
+			app.logf("  PRIORITY = %v", f.Priority)
+		}
+		if app.hdec == nil {
+			// TODO: if the user uses h2i to send a SETTINGS frame advertising
+			// something larger, we'll need to respect SETTINGS_HEADER_TABLE_SIZE
+			// and stuff here instead of using the 4k default. But for now:
+			tableSize := uint32(4 << 10)
+			app.hdec = hpack.NewDecoder(tableSize, app.onNewHeaderField)
+		}
+		app.headers = app.headers[:0]
+		app.hdec.Write(f.HeaderBlockFragment())
+	case *http2.PushPromiseFrame:
+		if app.hdec == nil {
+			// TODO: if the user uses h2i to send a SETTINGS frame advertising
+			// something larger, we'll need to respect SETTINGS_HEADER_TABLE_SIZE
+			// and stuff here instead of using the 4k default. But for now:
+			tableSize := uint32(4 << 10)
+			app.hdec = hpack.NewDecoder(tableSize, app.onNewHeaderField)
+		}
+		app.hdec.Write(f.HeaderBlockFragment())
+	case *http2.ContinuationFrame:
+		if app.hdec != nil {
 			app.hdec.Write(f.HeaderBlockFragment())
 		}
 	}
@@ -480,6 +680,7 @@ func (app *h2i) readFrames() error {
 
 // called from readLoop
 func (app *h2i) onNewHeaderField(f hpack.HeaderField) {
+	app.headers = append(app.headers, f)
 	if f.Sensitive {
 		app.logf("  %s = %q (SENSITIVE)", f.Name, f.Value)
 	}
@@ -503,7 +704,7 @@ func (app *h2i) encodeHeaders(req *http.Request) []byte {
 	app.writeHeader(":authority", host) // probably not right for all sites
 	app.writeHeader(":method", req.Method)
 	app.writeHeader(":path", path)
-	app.writeHeader(":scheme", "https")
+	app.writeHeader(":scheme", app.scheme)
 
 	for k, vv := range req.Header {
 		lowKey := strings.ToLower(k)
@@ -0,0 +1,45 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || windows
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, test := range []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{line: "", want: nil},
+		{line: "ping", want: []string{"ping"}},
+		{line: "  data 1\tabc  END_STREAM ", want: []string{"data", "1", "abc", "END_STREAM"}},
+		{line: `ping "a b"`, want: []string{"ping", "a b"}},
+		{line: `data 1 "x\ty\n"`, want: []string{"data", "1", "x\ty\n"}},
+		{line: `data 1 "\"quoted\""`, want: []string{"data", "1", `"quoted"`}},
+		{line: `data 1 "\x00é"`, want: []string{"data", "1", "\x00é"}},
+		{line: `expect GOAWAY debug="going away"`, want: []string{"expect", "GOAWAY", "debug=going away"}},
+		{line: `a"b c"d`, want: []string{"ab cd"}},
+		{line: `ping ""`, want: []string{"ping", ""}},
+		{line: `ping "abc`, wantErr: true},
+		{line: `ping "abc\"`, wantErr: true},
+		{line: `ping "\q"`, wantErr: true},
+	} {
+		got, err := splitArgs(test.line)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("splitArgs(%q) = %q, nil; want error", test.line, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitArgs(%q) = %q, %v; want %q, nil", test.line, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || windows
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChillAndImprove/net/http2"
+)
+
+// A scriptReader reads the lines of a script, counting them
+// for error messages.
+type scriptReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func (r *scriptReader) ReadLine() (string, error) {
+	if !r.s.Scan() {
+		if err := r.s.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	r.line++
+	return strings.TrimSuffix(r.s.Text(), "\r"), nil
+}
+
+// runScript runs the commands in the named file, or standard input
+// for "-". It returns an error for the first command which fails.
+func (app *h2i) runScript(name string) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	} else {
+		name = "stdin"
+	}
+	app.script = &scriptReader{s: bufio.NewScanner(r)}
+	app.lines = app.script
+
+	if err := app.sendInitialSettings(); err != nil {
+		return err
+	}
+	for {
+		line, err := app.script.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", name, err)
+		}
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lineno := app.script.line
+		args, err := splitArgs(line)
+		if err == nil {
+			if _, c, ok := lookupCommand(args[0]); ok {
+				err = c.run(app, args[1:])
+			} else {
+				err = fmt.Errorf("unknown command %q", args[0])
+			}
+		}
+		if err == errExitApp {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", name, lineno, err)
+		}
+	}
+}
+
+func (app *h2i) cmdWait(args []string) error {
+	return app.waitFrame("WAIT", args, true)
+}
+
+func (app *h2i) cmdExpect(args []string) error {
+	return app.waitFrame("EXPECT", args, false)
+}
+
+// waitFrame reads a frame of the type named by args[0] and checks it
+// against the conditions in the remaining args. If skip is true,
+// frames of other types are skipped; otherwise the next frame must
+// be of that type.
+func (app *h2i) waitFrame(cmd string, args []string, skip bool) error {
+	if app.script == nil {
+		return app.usageErrorf("%s is only available in script mode", cmd)
+	}
+	if len(args) == 0 {
+		return app.usageErrorf("invalid %s usage: %s <type> [field=value ...] [FLAG ...]", cmd, strings.ToLower(cmd))
+	}
+	t, ok := frameTypeByName(args[0])
+	if !ok {
+		return app.usageErrorf("unknown frame type %q", args[0])
+	}
+
+	app.conn.SetReadDeadline(time.Now().Add(*flagTimeout))
+	defer app.conn.SetReadDeadline(time.Time{})
+	for {
+		f, err := app.framer.ReadFrame()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return fmt.Errorf("timed out waiting for %v frame", t)
+			}
+			return fmt.Errorf("ReadFrame: %v", err)
+		}
+		app.logFrame(f)
+		if typ := f.Header().Type; typ != t {
+			if skip {
+				continue
+			}
+			return fmt.Errorf("got %v frame; want %v", typ, t)
+		}
+		if hf, ok := f.(*http2.HeadersFrame); ok && !hf.HeadersEnded() {
+			if err := app.readContinuations(); err != nil {
+				return err
+			}
+		}
+		return app.matchFrame(f, args[1:])
+	}
+}
+
+// readContinuations reads the CONTINUATION frames completing the
+// header block of a HEADERS frame, so that app.headers holds all of
+// its fields.
+func (app *h2i) readContinuations() error {
+	for {
+		f, err := app.framer.ReadFrame()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return fmt.Errorf("timed out waiting for %v frame", http2.FrameContinuation)
+			}
+			return fmt.Errorf("ReadFrame: %v", err)
+		}
+		app.logFrame(f)
+		cf, ok := f.(*http2.ContinuationFrame)
+		if !ok {
+			return fmt.Errorf("got %v frame; want %v", f.Header().Type, http2.FrameContinuation)
+		}
+		if cf.HeadersEnded() {
+			return nil
+		}
+	}
+}
+
+// flagsByType holds the names of the flags defined for each frame type.
+var flagsByType = map[http2.FrameType]map[string]http2.Flags{
+	http2.FrameData: {
+		"END_STREAM": http2.FlagDataEndStream,
+		"PADDED":     http2.FlagDataPadded,
+	},
+	http2.FrameHeaders: {
+		"END_STREAM":  http2.FlagHeadersEndStream,
+		"END_HEADERS": http2.FlagHeadersEndHeaders,
+		"PADDED":      http2.FlagHeadersPadded,
+		"PRIORITY":    http2.FlagHeadersPriority,
+	},
+	http2.FrameSettings: {
+		"ACK": http2.FlagSettingsAck,
+	},
+	http2.FramePushPromise: {
+		"END_HEADERS": http2.FlagPushPromiseEndHeaders,
+		"PADDED":      http2.FlagPushPromisePadded,
+	},
+	http2.FramePing: {
+		"ACK": http2.FlagPingAck,
+	},
+	http2.FrameContinuation: {
+		"END_HEADERS": http2.FlagContinuationEndHeaders,
+	},
+}
+
+// matchFrame checks f against conditions of the form field=value,
+// or the name of a flag which must be set.
+func (app *h2i) matchFrame(f http2.Frame, conds []string) error {
+	typ := f.Header().Type
+	for _, cond := range conds {
+		key, want, ok := strings.Cut(cond, "=")
+		if !ok {
+			flag, ok := flagsByType[typ][strings.ToUpper(cond)]
+			if !ok {
+				return fmt.Errorf("unknown flag %q for %v frame", cond, typ)
+			}
+			if !f.Header().Flags.Has(flag) {
+				return fmt.Errorf("%v frame: flag %s not set", typ, strings.ToUpper(cond))
+			}
+			continue
+		}
+		got, want, err := app.frameField(f, strings.ToLower(key), want)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("%v frame: %s = %q; want %q", typ, key, got, want)
+		}
+	}
+	return nil
+}
+
+// frameField returns the value of f's field named key, and want
+// converted to the same form for comparison.
+func (app *h2i) frameField(f http2.Frame, key, want string) (got, wantNorm string, err error) {
+	num := func(v uint32) (string, string, error) {
+		n, err := strconv.ParseUint(want, 0, 32)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid value for %s: %q", key, want)
+		}
+		return strconv.FormatUint(uint64(v), 10), strconv.FormatUint(n, 10), nil
+	}
+	code := func(c http2.ErrCode) (string, string, error) {
+		if n, err := strconv.ParseUint(want, 0, 32); err == nil {
+			return c.String(), http2.ErrCode(n).String(), nil
+		}
+		return c.String(), strings.ToUpper(want), nil
+	}
+
+	switch key {
+	case "stream":
+		return num(f.Header().StreamID)
+	case "len":
+		return num(f.Header().Length)
+	}
+	switch f := f.(type) {
+	case *http2.DataFrame:
+		if key == "data" {
+			return string(f.Data()), want, nil
+		}
+	case *http2.HeadersFrame:
+		var vals []string
+		for _, hf := range app.headers {
+			if hf.Name == key {
+				vals = append(vals, hf.Value)
+			}
+		}
+		if vals == nil {
+			return "", "", fmt.Errorf("HEADERS frame has no %q field", key)
+		}
+		return strings.Join(vals, ","), want, nil
+	case *http2.RSTStreamFrame:
+		if key == "code" {
+			return code(f.ErrCode)
+		}
+	case *http2.SettingsFrame:
+		if id, ok := settingByName(key); ok {
+			v, ok := f.Value(id)
+			if !ok {
+				return "", "", fmt.Errorf("SETTINGS frame has no %v setting", id)
+			}
+			return num(v)
+		}
+	case *http2.PingFrame:
+		if key == "data" {
+			var data [8]byte
+			copy(data[:], want)
+			return string(f.Data[:]), string(data[:]), nil
+		}
+	case *http2.GoAwayFrame:
+		switch key {
+		case "last_stream":
+			return num(f.LastStreamID)
+		case "code":
+			return code(f.ErrCode)
+		case "debug":
+			return string(f.DebugData()), want, nil
+		}
+	case *http2.WindowUpdateFrame:
+		if key == "increment" {
+			return num(f.Increment)
+		}
+	}
+	return "", "", fmt.Errorf("unknown field %q for %v frame", key, f.Header().Type)
+}
@@ -0,0 +1,252 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || windows
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ChillAndImprove/net/http2"
+	"github.com/ChillAndImprove/net/http2/hpack"
+)
+
+// readTestFrame returns the frame written by write.
+func readTestFrame(t *testing.T, write func(*http2.Framer) error) http2.Frame {
+	t.Helper()
+	var buf bytes.Buffer
+	fr := http2.NewFramer(&buf, &buf)
+	if err := write(fr); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestMatchFrame(t *testing.T) {
+	data := func(fr *http2.Framer) error { return fr.WriteData(1, true, []byte("hello")) }
+	headers := func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      3,
+			BlockFragment: []byte{0x88}, // :status: 200
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	}
+	settingsAck := func(fr *http2.Framer) error { return fr.WriteSettingsAck() }
+	settings := func(fr *http2.Framer) error {
+		return fr.WriteSettings(http2.Setting{ID: http2.SettingMaxFrameSize, Val: 1 << 20})
+	}
+	pingAck := func(fr *http2.Framer) error { return fr.WritePing(true, [8]byte{'a', 'b'}) }
+	ping := func(fr *http2.Framer) error { return fr.WritePing(false, [8]byte{'a', 'b'}) }
+	rst := func(fr *http2.Framer) error { return fr.WriteRSTStream(5, http2.ErrCodeCancel) }
+	goAway := func(fr *http2.Framer) error { return fr.WriteGoAway(7, http2.ErrCodeNo, []byte("bye")) }
+	windowUpdate := func(fr *http2.Framer) error { return fr.WriteWindowUpdate(0, 16) }
+
+	for _, test := range []struct {
+		name    string
+		write   func(*http2.Framer) error
+		conds   []string
+		wantErr string
+	}{
+		{name: "no conditions", write: data},
+		{name: "DATA fields", write: data, conds: []string{"stream=1", "len=5", "data=hello"}},
+		{name: "DATA END_STREAM", write: data, conds: []string{"END_STREAM"}},
+		{name: "lowercase flag", write: data, conds: []string{"end_stream"}},
+		{name: "DATA flag not set", write: data, conds: []string{"PADDED"}, wantErr: "flag PADDED not set"},
+		{name: "DATA ACK", write: data, conds: []string{"ACK"}, wantErr: `unknown flag "ACK" for DATA frame`},
+		{name: "DATA wrong stream", write: data, conds: []string{"stream=3"}, wantErr: `stream = "1"; want "3"`},
+		{name: "DATA wrong data", write: data, conds: []string{"data=bye"}, wantErr: `data = "hello"; want "bye"`},
+		{name: "HEADERS field", write: headers, conds: []string{":status=200", "END_STREAM", "END_HEADERS"}},
+		{name: "HEADERS missing field", write: headers, conds: []string{"server=x"}, wantErr: `no "server" field`},
+		{name: "HEADERS ACK", write: headers, conds: []string{"ACK"}, wantErr: "unknown flag"},
+		{name: "SETTINGS ACK", write: settingsAck, conds: []string{"ACK"}},
+		{name: "SETTINGS END_STREAM", write: settingsAck, conds: []string{"END_STREAM"}, wantErr: "unknown flag"},
+		{name: "SETTINGS value", write: settings, conds: []string{"MAX_FRAME_SIZE=1048576"}},
+		{name: "SETTINGS missing", write: settings, conds: []string{"MAX_CONCURRENT_STREAMS=1"}, wantErr: "no MAX_CONCURRENT_STREAMS setting"},
+		{name: "PING ACK", write: pingAck, conds: []string{"ACK", "data=ab"}},
+		{name: "PING no ACK", write: ping, conds: []string{"ACK"}, wantErr: "flag ACK not set"},
+		{name: "RST_STREAM", write: rst, conds: []string{"stream=5", "code=CANCEL"}},
+		{name: "GOAWAY", write: goAway, conds: []string{"last_stream=7", "code=NO_ERROR", "debug=bye"}},
+		{name: "GOAWAY wrong code", write: goAway, conds: []string{"code=PROTOCOL_ERROR"}, wantErr: `code = "NO_ERROR"; want "PROTOCOL_ERROR"`},
+		{name: "WINDOW_UPDATE", write: windowUpdate, conds: []string{"stream=0", "increment=0x10"}},
+		{name: "unknown field", write: windowUpdate, conds: []string{"data=x"}, wantErr: `unknown field "data"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			app := &h2i{
+				headers: []hpack.HeaderField{{Name: ":status", Value: "200"}},
+			}
+			f := readTestFrame(t, test.write)
+			err := app.matchFrame(f, test.conds)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("matchFrame(%v, %q) = %v; want nil", f, test.conds, err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Fatalf("matchFrame(%v, %q) = %v; want error containing %q", f, test.conds, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFrameField(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		write    func(*http2.Framer) error
+		key      string
+		want     string
+		wantGot  string
+		wantNorm string
+		wantErr  bool
+	}{{
+		name:     "decimal number",
+		write:    func(fr *http2.Framer) error { return fr.WriteWindowUpdate(1, 256) },
+		key:      "increment",
+		want:     "256",
+		wantGot:  "256",
+		wantNorm: "256",
+	}, {
+		name:     "hex number",
+		write:    func(fr *http2.Framer) error { return fr.WriteWindowUpdate(1, 256) },
+		key:      "increment",
+		want:     "0x100",
+		wantGot:  "256",
+		wantNorm: "256",
+	}, {
+		name:    "invalid number",
+		write:   func(fr *http2.Framer) error { return fr.WriteWindowUpdate(1, 256) },
+		key:     "stream",
+		want:    "one",
+		wantErr: true,
+	}, {
+		name:     "numeric error code",
+		write:    func(fr *http2.Framer) error { return fr.WriteRSTStream(1, http2.ErrCodeCancel) },
+		key:      "code",
+		want:     "8",
+		wantGot:  "CANCEL",
+		wantNorm: "CANCEL",
+	}, {
+		name:     "lowercase error code",
+		write:    func(fr *http2.Framer) error { return fr.WriteRSTStream(1, http2.ErrCodeCancel) },
+		key:      "code",
+		want:     "cancel",
+		wantGot:  "CANCEL",
+		wantNorm: "CANCEL",
+	}, {
+		name:     "short ping data",
+		write:    func(fr *http2.Framer) error { return fr.WritePing(true, [8]byte{'x'}) },
+		key:      "data",
+		want:     "x",
+		wantGot:  "x\x00\x00\x00\x00\x00\x00\x00",
+		wantNorm: "x\x00\x00\x00\x00\x00\x00\x00",
+	}, {
+		name: "repeated header",
+		write: func(fr *http2.Framer) error {
+			return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, EndHeaders: true})
+		},
+		key:      "vary",
+		want:     "a,b",
+		wantGot:  "a,b",
+		wantNorm: "a,b",
+	}, {
+		name:    "unknown setting",
+		write:   func(fr *http2.Framer) error { return fr.WriteSettings() },
+		key:     "no_such_setting",
+		want:    "1",
+		wantErr: true,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			app := &h2i{
+				headers: []hpack.HeaderField{
+					{Name: "vary", Value: "a"},
+					{Name: "vary", Value: "b"},
+				},
+			}
+			f := readTestFrame(t, test.write)
+			got, norm, err := app.frameField(f, test.key, test.want)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("frameField(%v, %q, %q) = %q, %q, nil; want error", f, test.key, test.want, got, norm)
+				}
+				return
+			}
+			if err != nil || got != test.wantGot || norm != test.wantNorm {
+				t.Fatalf("frameField(%v, %q, %q) = %q, %q, %v; want %q, %q, nil", f, test.key, test.want, got, norm, err, test.wantGot, test.wantNorm)
+			}
+		})
+	}
+}
+
+func TestExpectHeadersWithContinuation(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	app := &h2i{
+		conn:        c,
+		framer:      http2.NewFramer(c, c),
+		script:      &scriptReader{},
+		peerSetting: make(map[http2.SettingID]uint32),
+	}
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	enc.WriteField(hpack.HeaderField{Name: "x-first", Value: "1"})
+	enc.WriteField(hpack.HeaderField{Name: "x-last", Value: strings.Repeat("a", 100)})
+	b := block.Bytes()
+	go func() {
+		fr := http2.NewFramer(s, s)
+		// Split the block within a field, across two CONTINUATION frames.
+		fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: b[:5],
+			EndStream:     true,
+		})
+		fr.WriteContinuation(1, false, b[5:20])
+		fr.WriteContinuation(1, true, b[20:])
+		fr.WritePing(false, [8]byte{})
+	}()
+
+	err := app.cmdExpect([]string{"HEADERS", ":status=200", "x-first=1", "x-last=" + strings.Repeat("a", 100), "END_STREAM"})
+	if err != nil {
+		t.Fatalf("expect HEADERS: %v", err)
+	}
+	// The CONTINUATION frames were consumed with the HEADERS frame.
+	if err := app.cmdExpect([]string{"PING"}); err != nil {
+		t.Fatalf("expect PING: %v", err)
+	}
+}
+
+func TestExpectHeadersInterruptedContinuation(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	app := &h2i{
+		conn:        c,
+		framer:      http2.NewFramer(c, c),
+		script:      &scriptReader{},
+		peerSetting: make(map[http2.SettingID]uint32),
+	}
+	// A frame other than CONTINUATION within a header block is a
+	// connection error, reported by the Framer.
+	app.framer.AllowIllegalReads = true
+	go func() {
+		fr := http2.NewFramer(s, s)
+		fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: []byte{0x88},
+		})
+		fr.WritePing(false, [8]byte{})
+	}()
+	err := app.cmdExpect([]string{"HEADERS"})
+	if err == nil || !strings.Contains(err.Error(), "want CONTINUATION") {
+		t.Fatalf("expect HEADERS = %v; want error about CONTINUATION", err)
+	}
+}
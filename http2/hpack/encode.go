@@ -28,6 +28,71 @@ type Encoder struct {
 	tableSizeUpdate bool
 	w               io.Writer
 	buf             []byte
+	// policy, if non-nil, decides how fields are indexed.
+	policy IndexingPolicy
+}
+
+// Indexing is the representation an Encoder uses for a header field
+// which is not already in the static or dynamic table.
+// See RFC 7541, Section 6.2.
+type Indexing int
+
+const (
+	// IncrementalIndexing adds the field to the dynamic table, if it
+	// fits, so that later occurrences are encoded as an index.
+	IncrementalIndexing Indexing = iota
+
+	// WithoutIndexing encodes the field as a literal without adding
+	// it to the dynamic table.
+	WithoutIndexing
+
+	// NeverIndexed encodes the field as a literal which must not be
+	// added to a dynamic table by the peer or any intermediary either.
+	// It is always used for fields with Sensitive set.
+	NeverIndexed
+)
+
+// An IndexingPolicy decides how an Encoder indexes header fields.
+type IndexingPolicy interface {
+	// Indexing returns the representation to use for f.
+	Indexing(f HeaderField) Indexing
+}
+
+// The IndexingPolicyFunc type is an adapter to allow the use of
+// ordinary functions as an IndexingPolicy.
+type IndexingPolicyFunc func(f HeaderField) Indexing
+
+// Indexing returns fn(f).
+func (fn IndexingPolicyFunc) Indexing(f HeaderField) Indexing {
+	return fn(f)
+}
+
+// minIndexedCookieLen is the length below which DefaultIndexing does
+// not index cookies.
+const minIndexedCookieLen = 20
+
+// DefaultIndexing is an indexing policy which protects credentials
+// from compression oracle attacks such as CRIME, in which an attacker
+// who can add fields to requests learns whether a guessed value
+// matches one in the dynamic table from the size of the encoding.
+//
+// The values of "authorization" and "proxy-authorization" fields are
+// never indexed. Nor are "cookie" fields shorter than 20 bytes, which
+// are short enough to guess; longer cookies are indexed for
+// compression efficiency. For this to be effective, cookies should be
+// split into a field per cookie-pair as permitted by RFC 9113,
+// Section 8.2.3, as the http2 Transport does. Other fields use
+// IncrementalIndexing.
+func DefaultIndexing(f HeaderField) Indexing {
+	switch f.Name {
+	case "authorization", "proxy-authorization":
+		return NeverIndexed
+	case "cookie":
+		if len(f.Value) < minIndexedCookieLen {
+			return NeverIndexed
+		}
+	}
+	return IncrementalIndexing
 }
 
 // NewEncoder returns a new Encoder which performs HPACK encoding. An
@@ -59,11 +124,16 @@ func (e *Encoder) WriteField(f HeaderField) error {
 		e.buf = appendTableSize(e.buf, e.dynTab.maxSize)
 	}
 
+	policy := e.fieldIndexing(f)
+	if policy == NeverIndexed {
+		f.Sensitive = true
+	}
+
 	idx, nameValueMatch := e.searchTable(f)
 	if nameValueMatch {
 		e.buf = appendIndexed(e.buf, idx)
 	} else {
-		indexing := e.shouldIndex(f)
+		indexing := policy == IncrementalIndexing && e.shouldIndex(f)
 		if indexing {
 			e.dynTab.add(f)
 		}
@@ -136,6 +206,26 @@ func (e *Encoder) SetMaxDynamicTableSizeLimit(v uint32) {
 	}
 }
 
+// SetIndexingPolicy sets the policy deciding how e indexes header
+// fields. If p is nil, the default, fields are indexed whenever they
+// fit in the dynamic table. Fields with Sensitive set are never
+// indexed, regardless of the policy.
+func (e *Encoder) SetIndexingPolicy(p IndexingPolicy) {
+	e.policy = p
+}
+
+// fieldIndexing returns the representation to use for f
+// if it is not in the static or dynamic table.
+func (e *Encoder) fieldIndexing(f HeaderField) Indexing {
+	if f.Sensitive {
+		return NeverIndexed
+	}
+	if e.policy == nil {
+		return IncrementalIndexing
+	}
+	return e.policy.Indexing(f)
+}
+
 // shouldIndex reports whether f should be indexed.
 func (e *Encoder) shouldIndex(f HeaderField) bool {
 	return !f.Sensitive && f.Size() <= e.dynTab.maxSize
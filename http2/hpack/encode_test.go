@@ -90,6 +90,84 @@ func TestEncoderWriteField(t *testing.T) {
 	}
 }
 
+func TestEncoderIndexingPolicy(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetIndexingPolicy(IndexingPolicyFunc(func(f HeaderField) Indexing {
+		switch f.Name {
+		case "x-without":
+			return WithoutIndexing
+		case "x-never":
+			return NeverIndexed
+		}
+		return IncrementalIndexing
+	}))
+	var got []HeaderField
+	d := NewDecoder(4<<10, func(f HeaderField) {
+		got = append(got, f)
+	})
+
+	tests := []struct {
+		hf          HeaderField
+		wantType    byte // representation bits of the first byte
+		wantDynSize int  // dynamic table entries after encoding
+	}{
+		{pair("x-incremental", "a"), 0x40, 1},
+		{pair("x-incremental", "a"), 0x80, 1},
+		{pair("x-without", "b"), 0x00, 1},
+		{pair("x-never", "c"), 0x10, 1},
+		{HeaderField{Name: "x-incremental", Value: "d", Sensitive: true}, 0x10, 1},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		got = got[:0]
+		if err := e.WriteField(tt.hf); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()
+		var typ byte
+		switch {
+		case b[0]&0x80 != 0:
+			typ = 0x80
+		case b[0]&0x40 != 0:
+			typ = 0x40
+		default:
+			typ = b[0] & 0xf0
+		}
+		if typ != tt.wantType {
+			t.Errorf("WriteField(%v): representation %#x; want %#x", tt.hf, typ, tt.wantType)
+		}
+		if n := e.dynTab.table.len(); n != tt.wantDynSize {
+			t.Errorf("WriteField(%v): dynamic table has %v entries; want %v", tt.hf, n, tt.wantDynSize)
+		}
+		if _, err := d.Write(b); err != nil {
+			t.Fatalf("Decoder Write = %v", err)
+		}
+		wantSensitive := tt.wantType == 0x10
+		if len(got) != 1 || got[0].Name != tt.hf.Name || got[0].Value != tt.hf.Value || got[0].Sensitive != wantSensitive {
+			t.Errorf("WriteField(%v): decoded %v", tt.hf, got)
+		}
+	}
+}
+
+func TestDefaultIndexing(t *testing.T) {
+	tests := []struct {
+		hf   HeaderField
+		want Indexing
+	}{
+		{pair("authorization", "Bearer secret"), NeverIndexed},
+		{pair("proxy-authorization", "Basic c2VjcmV0"), NeverIndexed},
+		{pair("cookie", "session=1234"), NeverIndexed},
+		{pair("cookie", "preferences=dark-mode-enabled"), IncrementalIndexing},
+		{pair("user-agent", "Go-http-client/2.0"), IncrementalIndexing},
+	}
+	for _, tt := range tests {
+		if got := DefaultIndexing(tt.hf); got != tt.want {
+			t.Errorf("DefaultIndexing(%v) = %v; want %v", tt.hf, got, tt.want)
+		}
+	}
+}
+
 func TestEncoderSearchTable(t *testing.T) {
 	e := NewEncoder(nil)
 
@@ -45,6 +45,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ChillAndImprove/net/http/httpguts"
@@ -80,6 +81,8 @@ var (
 	testHookGetServerConn func(*serverConn)
 	testHookOnPanicMu     *sync.Mutex // nil except in tests
 	testHookOnPanic       func(sc *serverConn, panicVal interface{}) (rePanic bool)
+
+	testHookBeforeMemoryWait func()
 )
 
 // Server is an HTTP/2 server.
@@ -111,6 +114,11 @@ type Server struct {
 	// the default value of 4096 is used.
 	MaxEncoderHeaderTableSize uint32
 
+	// HeaderIndexingPolicy optionally decides how each response header
+	// field is indexed in the header compression table. If nil,
+	// hpack.DefaultIndexing is used, which never indexes credentials.
+	HeaderIndexingPolicy hpack.IndexingPolicy
+
 	// MaxReadFrameSize optionally specifies the largest frame
 	// this server is willing to read. A valid value is between
 	// 16k and 16M, inclusive. If zero or otherwise invalid, a
@@ -140,6 +148,29 @@ type Server struct {
 	// maximum, a default value will be used instead.
 	MaxUploadBufferPerStream int32
 
+	// MaxAutotunedUploadBufferPerConnection and
+	// MaxAutotunedUploadBufferPerStream enable upload window
+	// autotuning when larger than the initial connection and
+	// stream windows. The server estimates each connection's
+	// bandwidth-delay product by timing PING round trips while
+	// request bodies are being received, and raises the flow
+	// control windows as needed to keep the link busy, up to
+	// these limits.
+	MaxAutotunedUploadBufferPerConnection int32
+	MaxAutotunedUploadBufferPerStream     int32
+
+	// MaxMemory, if positive, limits the total memory held by all of
+	// the Server's connections: request body data not yet read by
+	// handlers, decoded request headers of open streams, and response
+	// data queued for writing. While the limit is exceeded, new streams
+	// are refused with REFUSED_STREAM and connections stop returning
+	// connection-level flow control credit to clients, so each
+	// connection's receive window shrinks as clients send data.
+	// Credit is returned once usage falls below the limit.
+	//
+	// Memory is tracked per Server. MemoryUsage reports current usage.
+	MaxMemory int64
+
 	// NewWriteScheduler constructs a write scheduler for a connection.
 	// If nil, a default scheduler is chosen.
 	NewWriteScheduler func() WriteScheduler
@@ -150,10 +181,20 @@ type Server struct {
 	// The errType consists of only ASCII word characters.
 	CountError func(errType string)
 
-	// Internal state. This is a pointer (rather than embedded directly)
-	// so that we don't embed a Mutex in this struct, which will make the
-	// struct non-copyable, which might break some callers.
-	state *serverInternalState
+	// AbusePolicy, if non-nil, scores each connection's use of frames
+	// which are cheap for clients to send but costly for the server
+	// to process, such as RST_STREAM, PING and SETTINGS, and decides
+	// whether to throttle or close the connection.
+	// See ScoreAbusePolicy for a configurable implementation.
+	//
+	// The Server's fixed limits, such as on queued control frames,
+	// apply regardless of the policy.
+	AbusePolicy AbusePolicy
+
+	// Internal state, created on first use by init.
+	initOnce sync.Once
+	state    *serverInternalState
+	memory   *serverMemoryBudget
 }
 
 func (s *Server) initialConnRecvWindowSize() int32 {
@@ -170,6 +211,24 @@ func (s *Server) initialStreamRecvWindowSize() int32 {
 	return 1 << 20
 }
 
+// maxAutotunedConnRecvWindowSize returns the largest connection
+// window autotuning may grow to, or 0 if it is disabled.
+func (s *Server) maxAutotunedConnRecvWindowSize() int32 {
+	if v := s.MaxAutotunedUploadBufferPerConnection; v > s.initialConnRecvWindowSize() {
+		return v
+	}
+	return 0
+}
+
+// maxAutotunedStreamRecvWindowSize returns the largest stream
+// window autotuning may grow to, or 0 if it is disabled.
+func (s *Server) maxAutotunedStreamRecvWindowSize() int32 {
+	if v := s.MaxAutotunedUploadBufferPerStream; v > s.initialStreamRecvWindowSize() {
+		return v
+	}
+	return 0
+}
+
 func (s *Server) maxReadFrameSize() uint32 {
 	if v := s.MaxReadFrameSize; v >= minMaxFrameSize && v <= maxFrameSize {
 		return v
@@ -191,6 +250,13 @@ func (s *Server) maxDecoderHeaderTableSize() uint32 {
 	return initialHeaderTableSize
 }
 
+func (s *Server) headerIndexingPolicy() hpack.IndexingPolicy {
+	if p := s.HeaderIndexingPolicy; p != nil {
+		return p
+	}
+	return hpack.IndexingPolicyFunc(hpack.DefaultIndexing)
+}
+
 func (s *Server) maxEncoderHeaderTableSize() uint32 {
 	if v := s.MaxEncoderHeaderTableSize; v > 0 {
 		return v
@@ -210,30 +276,29 @@ func (s *Server) maxQueuedControlFrames() int {
 type serverInternalState struct {
 	mu          sync.Mutex
 	activeConns map[*serverConn]struct{}
+
+	// drained is non-nil once Server.Shutdown has been called,
+	// and is closed when no connections remain.
+	drained chan struct{}
 }
 
-func (s *serverInternalState) registerConn(sc *serverConn) {
-	if s == nil {
-		return // if the Server was used without calling ConfigureServer
-	}
+// registerConn adds sc to the active connections.
+// It reports whether Server.Shutdown has been called.
+func (s *serverInternalState) registerConn(sc *serverConn) (shuttingDown bool) {
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.activeConns[sc] = struct{}{}
-	s.mu.Unlock()
+	return s.drained != nil
 }
 
 func (s *serverInternalState) unregisterConn(sc *serverConn) {
-	if s == nil {
-		return // if the Server was used without calling ConfigureServer
-	}
 	s.mu.Lock()
 	delete(s.activeConns, sc)
+	s.checkDrainedLocked()
 	s.mu.Unlock()
 }
 
 func (s *serverInternalState) startGracefulShutdown() {
-	if s == nil {
-		return // if the Server was used without calling ConfigureServer
-	}
 	s.mu.Lock()
 	for sc := range s.activeConns {
 		sc.startGracefulShutdown()
@@ -241,6 +306,162 @@ func (s *serverInternalState) startGracefulShutdown() {
 	s.mu.Unlock()
 }
 
+// beginShutdown gracefully shuts down all current and future
+// connections. It returns a channel which is closed when
+// no connections remain.
+func (s *serverInternalState) beginShutdown() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+	}
+	for sc := range s.activeConns {
+		sc.startGracefulShutdown()
+	}
+	s.checkDrainedLocked()
+	return s.drained
+}
+
+func (s *serverInternalState) checkDrainedLocked() {
+	if s.drained == nil || len(s.activeConns) > 0 {
+		return
+	}
+	select {
+	case <-s.drained:
+	default:
+		close(s.drained)
+	}
+}
+
+// closeConns closes the network connections of all current connections.
+func (s *serverInternalState) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sc := range s.activeConns {
+		sc.conn.Close()
+	}
+}
+
+// Shutdown gracefully shuts down all connections being served by s.
+// It sends a GOAWAY frame on each connection, waits for the streams
+// in flight to complete, and then closes the connection. Connections
+// passed to ServeConn after Shutdown is called are shut down the same
+// way as soon as they start.
+//
+// If ctx expires before all connections have closed, Shutdown closes
+// the remaining connections and returns ctx.Err().
+//
+// Shutdown does not stop any listener accepting connections.
+// When s was configured with ConfigureServer, the http.Server's
+// Shutdown method shuts down its HTTP/2 connections as well.
+func (s *Server) Shutdown(ctx context.Context) error {
+	state := s.internalState()
+	select {
+	case <-state.beginShutdown():
+		return nil
+	case <-ctx.Done():
+		state.closeConns()
+		return ctx.Err()
+	}
+}
+
+// ServerMemoryUsage reports the memory held by a Server's connections,
+// as tracked against Server.MaxMemory.
+type ServerMemoryUsage struct {
+	RecvBuffers  int64 // request body data not yet read by handlers
+	Headers      int64 // decoded request headers of open streams
+	QueuedWrites int64 // response data queued for writing
+}
+
+// Total returns the sum of all tracked memory.
+func (u ServerMemoryUsage) Total() int64 {
+	return u.RecvBuffers + u.Headers + u.QueuedWrites
+}
+
+// MemoryUsage returns the memory currently held by the Server's connections.
+func (s *Server) MemoryUsage() ServerMemoryUsage {
+	b := s.memoryBudget()
+	return ServerMemoryUsage{
+		RecvBuffers:  atomic.LoadInt64(&b.recvBuffers),
+		Headers:      atomic.LoadInt64(&b.headers),
+		QueuedWrites: atomic.LoadInt64(&b.queuedWrites),
+	}
+}
+
+// internalState returns s's connection tracking state. It is created
+// by ConfigureServer, or on first use for Servers used without it.
+func (s *Server) internalState() *serverInternalState {
+	s.initOnce.Do(s.init)
+	return s.state
+}
+
+func (s *Server) memoryBudget() *serverMemoryBudget {
+	s.initOnce.Do(s.init)
+	return s.memory
+}
+
+func (s *Server) init() {
+	s.state = &serverInternalState{activeConns: make(map[*serverConn]struct{})}
+	s.memory = &serverMemoryBudget{}
+}
+
+// A serverMemoryBudget tracks memory held by all connections of a Server.
+type serverMemoryBudget struct {
+	// Accessed atomically. These are first in the struct
+	// for 64-bit alignment on 32-bit platforms.
+	recvBuffers  int64
+	headers      int64
+	queuedWrites int64
+
+	nwaiters int32 // atomic; len(waiters)
+
+	mu      sync.Mutex
+	waiters map[*serverConn]struct{} // conns withholding flow control credit
+}
+
+func (b *serverMemoryBudget) used() int64 {
+	return atomic.LoadInt64(&b.recvBuffers) +
+		atomic.LoadInt64(&b.headers) +
+		atomic.LoadInt64(&b.queuedWrites)
+}
+
+// add adds n bytes to the counter c, one of b's fields.
+// If n is negative and conns are waiting for memory, they are notified.
+func (b *serverMemoryBudget) add(c *int64, n int64) {
+	atomic.AddInt64(c, n)
+	if n >= 0 || atomic.LoadInt32(&b.nwaiters) == 0 {
+		return
+	}
+	b.mu.Lock()
+	for sc := range b.waiters {
+		select {
+		case sc.memoryAvailableCh <- struct{}{}:
+		default:
+		}
+	}
+	b.waiters = nil
+	atomic.StoreInt32(&b.nwaiters, 0)
+	b.mu.Unlock()
+}
+
+// wait arranges for sc to be notified when memory is released.
+func (b *serverMemoryBudget) wait(sc *serverConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.waiters == nil {
+		b.waiters = make(map[*serverConn]struct{})
+	}
+	b.waiters[sc] = struct{}{}
+	atomic.StoreInt32(&b.nwaiters, int32(len(b.waiters)))
+}
+
+func (b *serverMemoryBudget) stopWaiting(sc *serverConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.waiters, sc)
+	atomic.StoreInt32(&b.nwaiters, int32(len(b.waiters)))
+}
+
 // ConfigureServer adds HTTP/2 support to a net/http Server.
 //
 // The configuration conf may be nil.
@@ -253,7 +474,7 @@ func ConfigureServer(s *http.Server, conf *Server) error {
 	if conf == nil {
 		conf = new(Server)
 	}
-	conf.state = &serverInternalState{activeConns: make(map[*serverConn]struct{})}
+	state := conf.internalState()
 	if h1, h2 := s, conf; h2.IdleTimeout == 0 {
 		if h1.IdleTimeout != 0 {
 			h2.IdleTimeout = h1.IdleTimeout
@@ -261,7 +482,7 @@ func ConfigureServer(s *http.Server, conf *Server) error {
 			h2.IdleTimeout = h1.ReadTimeout
 		}
 	}
-	s.RegisterOnShutdown(conf.state.startGracefulShutdown)
+	s.RegisterOnShutdown(state.startGracefulShutdown)
 
 	if s.TLSConfig == nil {
 		s.TLSConfig = new(tls.Config)
@@ -425,10 +646,20 @@ func (s *Server) ServeConn(c net.Conn, opts *ServeConnOpts) {
 		serveG:                      newGoroutineLock(),
 		pushEnabled:                 true,
 		sawClientPreface:            opts.SawClientPreface,
+		mem:                         s.memoryBudget(),
+		memoryAvailableCh:           make(chan struct{}, 1),
+	}
+	if s.AbusePolicy != nil {
+		sc.abuse = s.AbusePolicy.NewConn()
 	}
 
-	s.state.registerConn(sc)
-	defer s.state.unregisterConn(sc)
+	state := s.internalState()
+	if state.registerConn(sc) {
+		// The serve loop isn't running yet, so queue the message
+		// directly rather than with startGracefulShutdown.
+		sc.shutdownOnce.Do(func() { sc.serveMsgCh <- gracefulShutdownMsg })
+	}
+	defer state.unregisterConn(sc)
 
 	// The net/http package sets the write deadline from the
 	// http.Server.WriteTimeout during the TLS handshake, but then
@@ -450,8 +681,16 @@ func (s *Server) ServeConn(c net.Conn, opts *ServeConnOpts) {
 	// WINDOW_UPDATE shortly after sending SETTINGS.
 	sc.flow.add(initialWindowSize)
 	sc.inflow.init(initialWindowSize)
+	sc.connRecvWindow = s.initialConnRecvWindowSize()
+	sc.streamRecvWindow = s.initialStreamRecvWindowSize()
+	if max := s.maxAutotunedConnRecvWindowSize(); max > s.maxAutotunedStreamRecvWindowSize() {
+		sc.bdp.init(sc.streamRecvWindow, max)
+	} else {
+		sc.bdp.init(sc.streamRecvWindow, s.maxAutotunedStreamRecvWindowSize())
+	}
 	sc.hpackEncoder = hpack.NewEncoder(&sc.headerWriteBuf)
 	sc.hpackEncoder.SetMaxDynamicTableSizeLimit(s.maxEncoderHeaderTableSize())
+	sc.hpackEncoder.SetIndexingPolicy(s.headerIndexingPolicy())
 
 	fr := NewFramer(sc.bw, c)
 	if s.CountError != nil {
@@ -460,6 +699,9 @@ func (s *Server) ServeConn(c net.Conn, opts *ServeConnOpts) {
 	fr.ReadMetaHeaders = hpack.NewDecoder(s.maxDecoderHeaderTableSize(), nil)
 	fr.MaxHeaderListSize = sc.maxHeaderListSize()
 	fr.SetMaxReadFrameSize(s.maxReadFrameSize())
+	if sc.abuse != nil {
+		fr.onContinuation = sc.observeContinuation
+	}
 	sc.framer = fr
 
 	if tc, ok := c.(connectionStater); ok {
@@ -551,24 +793,29 @@ func (sc *serverConn) rejectConn(err ErrCode, debug string) {
 
 type serverConn struct {
 	// Immutable:
-	srv              *Server
-	hs               *http.Server
-	conn             net.Conn
-	bw               *bufferedWriter // writing to conn
-	handler          http.Handler
-	baseCtx          context.Context
-	framer           *Framer
-	doneServing      chan struct{}          // closed when serverConn.serve ends
-	readFrameCh      chan readFrameResult   // written by serverConn.readFrames
-	wantWriteFrameCh chan FrameWriteRequest // from handlers -> serve
-	wroteFrameCh     chan frameWriteResult  // from writeFrameAsync -> serve, tickles more frame writes
-	bodyReadCh       chan bodyReadMsg       // from handlers -> serve
-	serveMsgCh       chan interface{}       // misc messages & code to send to / run on the serve loop
-	flow             outflow                // conn-wide (not stream-specific) outbound flow control
-	inflow           inflow                 // conn-wide inbound flow control
-	tlsState         *tls.ConnectionState   // shared by all handlers, like net/http
-	remoteAddrStr    string
-	writeSched       WriteScheduler
+	srv               *Server
+	hs                *http.Server
+	conn              net.Conn
+	bw                *bufferedWriter // writing to conn
+	handler           http.Handler
+	baseCtx           context.Context
+	framer            *Framer
+	doneServing       chan struct{}          // closed when serverConn.serve ends
+	readFrameCh       chan readFrameResult   // written by serverConn.readFrames
+	wantWriteFrameCh  chan FrameWriteRequest // from handlers -> serve
+	wroteFrameCh      chan frameWriteResult  // from writeFrameAsync -> serve, tickles more frame writes
+	bodyReadCh        chan bodyReadMsg       // from handlers -> serve
+	serveMsgCh        chan interface{}       // misc messages & code to send to / run on the serve loop
+	memoryAvailableCh chan struct{}          // buffered; signaled when withheld flow control may be returned
+	flow              outflow                // conn-wide (not stream-specific) outbound flow control
+	inflow            inflow                 // conn-wide inbound flow control
+	bdp               bdpEstimator           // upload window autotuning; owned by serve loop
+	mem               *serverMemoryBudget    // shared by all of the Server's conns
+	connRecvWindow    int32                  // size of the conn-wide inbound window; owned by serve loop
+	streamRecvWindow  int32                  // initial inbound window of new streams; owned by serve loop
+	tlsState          *tls.ConnectionState   // shared by all handlers, like net/http
+	remoteAddrStr     string
+	writeSched        WriteScheduler
 
 	// Everything following is owned by the serve loop; use serveG.check():
 	serveG                      goroutineLock // used to verify funcs are on serve()
@@ -599,8 +846,14 @@ type serverConn struct {
 	inFrameScheduleLoop         bool              // whether we're in the scheduleFrameWrite loop
 	needToSendGoAway            bool              // we need to schedule a GOAWAY frame write
 	goAwayCode                  ErrCode
-	shutdownTimer               *time.Timer // nil until used
-	idleTimer                   *time.Timer // nil if unused
+	shutdownTimer               *time.Timer   // nil until used
+	idleTimer                   *time.Timer   // nil if unused
+	memRecvBuffers              int64         // this conn's share of mem.recvBuffers
+	memHeaders                  int64         // this conn's share of mem.headers
+	withheldInflow              int           // conn-level flow control credit withheld while over MaxMemory
+	abuse                       AbuseScorer   // nil if Server.AbusePolicy is unset
+	abuseMu                     sync.Mutex    // serializes calls to abuse, which readFrames also makes
+	abuseThrottle               time.Duration // delay before reading the next frame, set by abuse
 
 	// Owned by the writeFrameAsync goroutine:
 	headerWriteBuf bytes.Buffer
@@ -655,6 +908,8 @@ type stream struct {
 	readDeadline     *time.Timer // nil if unused
 	writeDeadline    *time.Timer // nil if unused
 	closeErr         error       // set before cw is closed
+	headerBytes      int64       // size of request headers charged to sc.mem
+	recvBuffered     int         // body bytes charged to sc.mem and not yet read by the handler
 
 	trailer    http.Header // accumulated trailers
 	reqTrailer http.Header // handler's Request.Trailer
@@ -889,6 +1144,7 @@ func (sc *serverConn) serve() {
 	sc.serveG.check()
 	defer sc.notePanic()
 	defer sc.conn.Close()
+	defer sc.releaseMemory()
 	defer sc.closeAllStreamsOnConnClose()
 	defer sc.stopShutdownTimer()
 	defer close(sc.doneServing) // unblocks handlers trying to send
@@ -935,6 +1191,17 @@ func (sc *serverConn) serve() {
 	settingsTimer := time.AfterFunc(firstSettingsTimeout, sc.onSettingsTimer)
 	defer settingsTimer.Stop()
 
+	// While throttled by the abuse policy, the next frame is not read
+	// until throttleTimer fires.
+	var throttleTimer *time.Timer
+	var throttleC <-chan time.Time
+	var throttledReadMore func()
+	defer func() {
+		if throttleTimer != nil {
+			throttleTimer.Stop()
+		}
+	}()
+
 	loopNum := 0
 	for {
 		loopNum++
@@ -960,13 +1227,26 @@ func (sc *serverConn) serve() {
 			if !sc.processFrameFromReader(res) {
 				return
 			}
-			res.readMore()
+			if d := sc.abuseThrottle; d > 0 {
+				sc.abuseThrottle = 0
+				throttleTimer = time.NewTimer(d)
+				throttleC = throttleTimer.C
+				throttledReadMore = res.readMore
+			} else {
+				res.readMore()
+			}
 			if settingsTimer != nil {
 				settingsTimer.Stop()
 				settingsTimer = nil
 			}
+		case <-throttleC:
+			throttleTimer, throttleC = nil, nil
+			throttledReadMore()
+			throttledReadMore = nil
 		case m := <-sc.bodyReadCh:
 			sc.noteBodyRead(m.st, m.n)
+		case <-sc.memoryAvailableCh:
+			sc.returnWithheldInflow()
 		case msg := <-sc.serveMsgCh:
 			switch v := msg.(type) {
 			case func(int):
@@ -1087,6 +1367,8 @@ var writeDataPool = sync.Pool{
 // writeDataFromHandler writes DATA response frames from a handler on
 // the given stream.
 func (sc *serverConn) writeDataFromHandler(stream *stream, data []byte, endStream bool) error {
+	sc.mem.add(&sc.mem.queuedWrites, int64(len(data)))
+	defer sc.mem.add(&sc.mem.queuedWrites, -int64(len(data)))
 	ch := errChanPool.Get().(chan error)
 	writeArg := writeDataPool.Get().(*writeData)
 	*writeArg = writeData{stream.id, data, endStream}
@@ -1511,6 +1793,10 @@ func (sc *serverConn) processFrame(f Frame) error {
 		sc.sawFirstSettings = true
 	}
 
+	if err := sc.observeAbuse(f); err != nil {
+		return err
+	}
+
 	// Discard frames for streams initiated after the identified last
 	// stream sent in a GOAWAY, or all frames after sending an error.
 	// We still need to return connection-level flow control for DATA frames.
@@ -1553,9 +1839,88 @@ func (sc *serverConn) processFrame(f Frame) error {
 	}
 }
 
+// observeAbuse reports the abuse events produced by f to the abuse policy.
+func (sc *serverConn) observeAbuse(f Frame) error {
+	sc.serveG.check()
+	if sc.abuse == nil {
+		return nil
+	}
+	var ev AbuseEvent
+	switch f := f.(type) {
+	case *RSTStreamFrame:
+		ev = AbuseRSTStream
+	case *DataFrame:
+		if len(f.Data()) > 0 || f.StreamEnded() {
+			return nil
+		}
+		ev = AbuseEmptyData
+	case *SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		ev = AbuseSettings
+	case *PingFrame:
+		if f.IsAck() {
+			return nil
+		}
+		ev = AbusePing
+	case *PriorityFrame:
+		ev = AbusePriority
+	case *WindowUpdateFrame:
+		if f.Increment >= smallWindowUpdate {
+			return nil
+		}
+		ev = AbuseSmallWindowUpdate
+	default:
+		return nil
+	}
+	res, err := sc.observe(ev)
+	if res.Throttle > sc.abuseThrottle {
+		sc.abuseThrottle = res.Throttle
+	}
+	return err
+}
+
+// observeContinuation reports a CONTINUATION frame to the abuse policy.
+// It is called by the framer on the readFrames goroutine as each frame
+// of a header block is read, so that a long header block is throttled
+// or rejected before it is complete.
+func (sc *serverConn) observeContinuation() error {
+	res, err := sc.observe(AbuseContinuation)
+	if err != nil || res.Throttle <= 0 {
+		return err
+	}
+	// The serve goroutine doesn't see the header block until it
+	// is complete, so pause reading here instead.
+	t := time.NewTimer(res.Throttle)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-sc.doneServing:
+	}
+	return nil
+}
+
+// observe reports ev to the abuse policy, returning a connection error
+// if the connection should be closed.
+func (sc *serverConn) observe(ev AbuseEvent) (AbuseResponse, error) {
+	sc.abuseMu.Lock()
+	res := sc.abuse.Observe(ev, time.Now())
+	sc.abuseMu.Unlock()
+	if res.GoAway {
+		sc.vlogf("http2: closing connection from %v after too many %v events", sc.conn.RemoteAddr(), ev)
+		name, _ := asciiToLower(ev.String())
+		return res, sc.countError("abuse_"+name, ConnectionError(ErrCodeEnhanceYourCalm))
+	}
+	return res, nil
+}
+
 func (sc *serverConn) processPing(f *PingFrame) error {
 	sc.serveG.check()
 	if f.IsAck() {
+		if f.Data == bdpPing {
+			sc.processBDPPingAck()
+		}
 		// 6.7 PING: " An endpoint MUST NOT respond to PING frames
 		// containing this flag."
 		return nil
@@ -1572,6 +1937,44 @@ func (sc *serverConn) processPing(f *PingFrame) error {
 	return nil
 }
 
+// processBDPPingAck updates the upload window estimate when the client
+// acknowledges a PING sent by bdpEstimator, and raises the connection
+// and stream windows if it has grown.
+func (sc *serverConn) processBDPPingAck() {
+	sc.serveG.check()
+	w := sc.bdp.acked(time.Now())
+	if w == 0 {
+		return
+	}
+	sw, cw := w, w
+	if max := sc.srv.maxAutotunedStreamRecvWindowSize(); sw > max {
+		sw = max
+	}
+	if max := sc.srv.maxAutotunedConnRecvWindowSize(); cw > max {
+		cw = max
+	}
+	if sw > sc.streamRecvWindow {
+		delta := sw - sc.streamRecvWindow
+		sc.streamRecvWindow = sw
+		for _, st := range sc.streams {
+			st.inflow.grow(delta)
+		}
+		sc.vlogf("http2: server raising stream receive window to %v", sw)
+		sc.unackedSettings++
+		sc.writeFrame(FrameWriteRequest{
+			write: writeSettings{{SettingInitialWindowSize, uint32(sw)}},
+		})
+	}
+	if cw > sc.connRecvWindow {
+		delta := cw - sc.connRecvWindow
+		sc.connRecvWindow = cw
+		sc.inflow.grow(delta)
+		sc.writeFrame(FrameWriteRequest{
+			write: writeWindowUpdate{streamID: 0, n: uint32(delta)},
+		})
+	}
+}
+
 func (sc *serverConn) processWindowUpdate(f *WindowUpdateFrame) error {
 	sc.serveG.check()
 	switch {
@@ -1650,6 +2053,12 @@ func (sc *serverConn) closeStream(st *stream, err error) {
 			sc.startGracefulShutdownInternal()
 		}
 	}
+	sc.chargeHeaders(-st.headerBytes)
+	st.headerBytes = 0
+	// Release the unread body, including bytes the handler may still
+	// read from the closed pipe; noteBodyRead ignores closed streams.
+	sc.chargeRecvBuffers(-st.recvBuffered)
+	st.recvBuffered = 0
 	if p := st.body; p != nil {
 		// Return any buffered unread bytes worth of conn-level flow control.
 		// See golang.org/issue/16481
@@ -1823,10 +2232,15 @@ func (sc *serverConn) processData(f *DataFrame) error {
 		if !takeInflows(&sc.inflow, &st.inflow, f.Length) {
 			return sc.countError("flow_on_data_length", streamError(id, ErrCodeFlowControl))
 		}
+		if sc.bdp.add(int(f.Length), time.Now()) && !sc.memoryExhausted() {
+			sc.writeFrame(FrameWriteRequest{write: writePing{bdpPing}})
+		}
 
 		if len(data) > 0 {
 			st.bodyBytes += int64(len(data))
 			wrote, err := st.body.Write(data)
+			sc.chargeRecvBuffers(wrote)
+			st.recvBuffered += wrote
 			if err != nil {
 				// The handler has closed the request body.
 				// Return the connection-level flow control for the discarded data,
@@ -1983,12 +2397,17 @@ func (sc *serverConn) processHeaders(f *MetaHeadersFrame) error {
 		// runtime.
 		return sc.countError("over_max_streams_race", streamError(id, ErrCodeRefusedStream))
 	}
+	if sc.memoryExhausted() {
+		return sc.countError("over_max_memory", streamError(id, ErrCodeRefusedStream))
+	}
 
 	initialState := stateOpen
 	if f.StreamEnded() {
 		initialState = stateHalfClosedRemote
 	}
 	st := sc.newStream(id, 0, initialState)
+	st.headerBytes = headerFieldsSize(f.Fields)
+	sc.chargeHeaders(st.headerBytes)
 
 	if f.HasPriority() {
 		if err := sc.checkPriority(f.StreamID, f.Priority); err != nil {
@@ -2121,7 +2540,7 @@ func (sc *serverConn) newStream(id, pusherID uint32, state streamState) *stream
 	st.cw.Init()
 	st.flow.conn = &sc.flow // link to conn-level counter
 	st.flow.add(sc.initialStreamSendWindowSize)
-	st.inflow.init(sc.srv.initialStreamRecvWindowSize())
+	st.inflow.init(sc.streamRecvWindow)
 	if sc.hs.WriteTimeout > 0 {
 		st.writeDeadline = time.AfterFunc(sc.hs.WriteTimeout, st.onWriteTimeout)
 	}
@@ -2446,8 +2865,60 @@ func (sc *serverConn) noteBodyReadFromHandler(st *stream, n int, err error) {
 	}
 }
 
+// memoryExhausted reports whether the Server's connections
+// are holding more than Server.MaxMemory.
+func (sc *serverConn) memoryExhausted() bool {
+	max := sc.srv.MaxMemory
+	return max > 0 && sc.mem.used() >= max
+}
+
+func (sc *serverConn) chargeRecvBuffers(n int) {
+	sc.serveG.check()
+	sc.memRecvBuffers += int64(n)
+	sc.mem.add(&sc.mem.recvBuffers, int64(n))
+}
+
+func (sc *serverConn) chargeHeaders(n int64) {
+	sc.serveG.check()
+	sc.memHeaders += n
+	sc.mem.add(&sc.mem.headers, n)
+}
+
+// returnWithheldInflow sends the conn-level flow control credit
+// withheld while the Server was over its memory limit.
+func (sc *serverConn) returnWithheldInflow() {
+	sc.serveG.check()
+	n := sc.withheldInflow
+	sc.withheldInflow = 0
+	sc.sendWindowUpdate(nil, n)
+}
+
+// releaseMemory releases all memory still charged to the conn
+// when it stops serving. Body reads by handlers after this
+// point are not reported to the serve loop.
+func (sc *serverConn) releaseMemory() {
+	sc.mem.stopWaiting(sc)
+	sc.chargeRecvBuffers(-int(sc.memRecvBuffers))
+	sc.chargeHeaders(-sc.memHeaders)
+}
+
+// headerFieldsSize returns the size of fields as defined
+// by SETTINGS_MAX_HEADER_LIST_SIZE.
+func headerFieldsSize(fields []hpack.HeaderField) int64 {
+	var n int64
+	for _, hf := range fields {
+		n += int64(hf.Size())
+	}
+	return n
+}
+
 func (sc *serverConn) noteBodyRead(st *stream, n int) {
 	sc.serveG.check()
+	if st.state != stateClosed {
+		// closeStream already released the memory of closed streams.
+		sc.chargeRecvBuffers(-n)
+		st.recvBuffered -= n
+	}
 	sc.sendWindowUpdate(nil, n) // conn-level
 	if st.state != stateHalfClosedRemote && st.state != stateClosed {
 		// Don't send this WINDOW_UPDATE if the stream is closed
@@ -2467,6 +2938,24 @@ func (sc *serverConn) sendWindowUpdate(st *stream, n int) {
 	var streamID uint32
 	var send int32
 	if st == nil {
+		if n > 0 && sc.memoryExhausted() {
+			if testHookBeforeMemoryWait != nil {
+				testHookBeforeMemoryWait()
+			}
+			// Withhold credit until memory is released,
+			// shrinking the client's connection window.
+			// Check again once registered as a waiter, in case
+			// memory was released before: it would not have
+			// notified this conn.
+			sc.mem.wait(sc)
+			if sc.memoryExhausted() {
+				sc.withheldInflow += n
+				return
+			}
+			sc.mem.stopWaiting(sc)
+			n += sc.withheldInflow
+			sc.withheldInflow = 0
+		}
 		send = sc.inflow.add(n)
 	} else {
 		streamID = st.id
@@ -1208,6 +1208,95 @@ func TestServer_Ping(t *testing.T) {
 	}
 }
 
+func TestServer_AbusePolicyGoAway(t *testing.T) {
+	st := newServerTester(t, nil, func(s *Server) {
+		s.AbusePolicy = &ScoreAbusePolicy{GoAwayScore: 5}
+	})
+	defer st.Close()
+	st.greet()
+
+	for i := 0; i < 10; i++ {
+		if err := st.fr.WritePing(false, [8]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pings := 0
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatalf("reading frame: %v", err)
+		}
+		if _, ok := f.(*PingFrame); ok {
+			pings++
+			continue
+		}
+		ga, ok := f.(*GoAwayFrame)
+		if !ok {
+			t.Fatalf("got %T; want PING or GOAWAY", f)
+		}
+		if ga.ErrCode != ErrCodeEnhanceYourCalm {
+			t.Errorf("GOAWAY error code = %v; want %v", ga.ErrCode, ErrCodeEnhanceYourCalm)
+		}
+		break
+	}
+	if pings >= 10 {
+		t.Errorf("server answered all %v pings before GOAWAY", pings)
+	}
+}
+
+type throttlePingPolicy time.Duration
+
+func (p throttlePingPolicy) NewConn() AbuseScorer { return p }
+
+func (p throttlePingPolicy) Observe(e AbuseEvent, now time.Time) AbuseResponse {
+	if e == AbusePing {
+		return AbuseResponse{Throttle: time.Duration(p)}
+	}
+	return AbuseResponse{}
+}
+
+func TestServer_AbusePolicyThrottle(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	st := newServerTester(t, nil, func(s *Server) {
+		s.AbusePolicy = throttlePingPolicy(delay)
+	})
+	defer st.Close()
+	st.greet()
+
+	st.writeReadPing()
+	start := time.Now()
+	st.writeReadPing()
+	if got := time.Since(start); got < delay {
+		t.Errorf("second PING answered after %v; want at least %v", got, delay)
+	}
+}
+
+func TestServer_AbusePolicyContinuation(t *testing.T) {
+	st := newServerTester(t, nil, func(s *Server) {
+		s.AbusePolicy = &ScoreAbusePolicy{GoAwayScore: 5}
+	})
+	defer st.Close()
+	st.greet()
+
+	// The header block is never finished, so the policy must act
+	// on the CONTINUATION frames as they are read.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+	})
+	for i := 0; i < 10; i++ {
+		if err := st.fr.WriteContinuation(1, false, st.encodeHeaderRaw(
+			fmt.Sprintf("x-%v", i), "1",
+		)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ga := st.wantGoAway(); ga.ErrCode != ErrCodeEnhanceYourCalm {
+		t.Errorf("GOAWAY error code = %v; want %v", ga.ErrCode, ErrCodeEnhanceYourCalm)
+	}
+}
+
 type filterListener struct {
 	net.Listener
 	accept func(conn net.Conn) (net.Conn, error)
@@ -1366,6 +1455,235 @@ func TestServer_Handler_Sends_WindowUpdate_Padding(t *testing.T) {
 	st.wantWindowUpdate(1, uint32(len(data)+1+len(pad)))
 }
 
+func TestServer_UploadWindowAutotuning(t *testing.T) {
+	const windowSize = 1 << 20
+	puppet := newHandlerPuppet()
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		puppet.act(w, r)
+	}, func(s *Server) {
+		s.MaxUploadBufferPerConnection = windowSize
+		s.MaxUploadBufferPerStream = windowSize
+		s.MaxAutotunedUploadBufferPerConnection = 64 << 20
+		s.MaxAutotunedUploadBufferPerStream = 64 << 20
+	})
+	defer st.Close()
+	defer puppet.done()
+
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+
+	// The first DATA frame starts a round trip measurement.
+	const frameSize = 16 << 10
+	const frames = 48 // 768KB, most of the initial 1MB window
+	st.writeData(1, false, make([]byte, frameSize))
+	if pf := st.wantPing(); pf.IsAck() || pf.Data != bdpPing {
+		t.Fatalf("after first DATA frame, got %v; want PING %q", summarizeFrame(pf), bdpPing)
+	}
+	for i := 1; i < frames; i++ {
+		st.writeData(1, false, make([]byte, frameSize))
+	}
+
+	// The window was nearly filled during the round trip,
+	// so the server doubles both the stream and connection windows.
+	if err := st.fr.WritePing(true, bdpPing); err != nil {
+		t.Fatal(err)
+	}
+	const want = 2 * frames * frameSize
+	sf := st.wantSettings()
+	if v, ok := sf.Value(SettingInitialWindowSize); !ok || v != want {
+		t.Fatalf("SETTINGS_INITIAL_WINDOW_SIZE = %v, %v; want %v", v, ok, want)
+	}
+	st.wantWindowUpdate(0, want-windowSize)
+	st.writeSettingsAck()
+
+	// Existing and new streams use the larger window.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	st.writeReadPing()
+	donec := make(chan struct{})
+	st.sc.sendServeMsg(func(sc *serverConn) {
+		defer close(donec)
+		if got, want := sc.streams[1].inflow.avail, int32(want-frames*frameSize); got != want {
+			t.Errorf("stream 1 inflow window = %v; want %v", got, want)
+		}
+		if got, want := sc.streams[3].inflow.avail, int32(want); got != want {
+			t.Errorf("stream 3 inflow window = %v; want %v", got, want)
+		}
+	})
+	<-donec
+}
+
+func TestServer_MaxMemory(t *testing.T) {
+	const maxMemory = 32 << 10
+	puppet := newHandlerPuppet()
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		puppet.act(w, r)
+	}, func(s *Server) {
+		s.MaxMemory = maxMemory
+	})
+	defer st.Close()
+	defer puppet.done()
+
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	data := make([]byte, 48<<10)
+	for i := 0; i < len(data); i += 16 << 10 {
+		st.writeData(1, false, data[i:i+16<<10])
+	}
+	st.writeReadPing()
+	usage := st.sc.srv.MemoryUsage()
+	if got, want := usage.RecvBuffers, int64(len(data)); got != want {
+		t.Errorf("MemoryUsage().RecvBuffers = %v; want %v", got, want)
+	}
+	if usage.Headers == 0 {
+		t.Errorf("MemoryUsage().Headers = 0; want request headers of stream 1")
+	}
+
+	// New streams are refused while over the limit.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	st.wantRSTStream(3, ErrCodeRefusedStream)
+
+	// Reading part of the body returns stream-level flow control,
+	// but connection-level flow control is withheld while still
+	// over the limit.
+	puppet.do(readBodyHandler(t, string(data[:16<<10])))
+	st.wantWindowUpdate(1, 16<<10)
+	st.writeReadPing()
+
+	// Once usage falls below the limit, the withheld credit is returned.
+	puppet.do(readBodyHandler(t, string(data[16<<10:])))
+	got := map[uint32]uint32{}
+	for i := 0; i < 3; i++ {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wu, ok := f.(*WindowUpdateFrame)
+		if !ok {
+			t.Fatalf("got %v; want WINDOW_UPDATE", summarizeFrame(f))
+		}
+		got[wu.StreamID] += wu.Increment
+	}
+	if want := map[uint32]uint32{0: 48 << 10, 1: 32 << 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WINDOW_UPDATE increments by stream = %v; want %v", got, want)
+	}
+	st.writeReadPing()
+	if got := st.sc.srv.MemoryUsage().RecvBuffers; got != 0 {
+		t.Errorf("after body is read, MemoryUsage().RecvBuffers = %v; want 0", got)
+	}
+}
+
+// Body bytes released when a stream is reset must not be released
+// again when the handler reads them afterwards.
+func TestServer_MaxMemoryReadAfterReset(t *testing.T) {
+	puppet := newHandlerPuppet()
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		puppet.act(w, r)
+	}, func(s *Server) {
+		s.MaxMemory = 1 << 20
+	})
+	defer st.Close()
+	defer puppet.done()
+
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	data := make([]byte, 16<<10)
+	st.writeData(1, false, data)
+	st.writeReadPing()
+	if got, want := st.sc.srv.MemoryUsage().RecvBuffers, int64(len(data)); got != want {
+		t.Fatalf("MemoryUsage().RecvBuffers = %v; want %v", got, want)
+	}
+
+	if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+		t.Fatal(err)
+	}
+	st.wantWindowUpdate(0, uint32(len(data)))
+	st.writeReadPing()
+	want := st.sc.srv.MemoryUsage()
+	if want.RecvBuffers != 0 {
+		t.Errorf("after reset, MemoryUsage().RecvBuffers = %v; want 0", want.RecvBuffers)
+	}
+
+	// The buffered body is still readable after the reset.
+	puppet.do(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadFull(r.Body, make([]byte, len(data))); err != nil {
+			t.Errorf("reading body after reset: %v", err)
+		}
+	})
+	st.wantWindowUpdate(0, uint32(len(data)))
+	st.writeReadPing()
+	if got := st.sc.srv.MemoryUsage(); got != want {
+		t.Errorf("after reading the body, MemoryUsage() = %+v; want %+v", got, want)
+	}
+}
+
+// Memory released by another conn between the check for exhausted
+// memory and the registration as a waiter must not leave the conn-level
+// flow control credit withheld.
+func TestServer_MaxMemoryReleasedBeforeWait(t *testing.T) {
+	const maxMemory = 64 << 10
+	const otherConn = 32 << 10
+	puppet := newHandlerPuppet()
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		puppet.act(w, r)
+	}, func(s *Server) {
+		s.MaxMemory = maxMemory
+	})
+	defer st.Close()
+	defer puppet.done()
+
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	data := make([]byte, 48<<10)
+	for i := 0; i < len(data); i += 16 << 10 {
+		st.writeData(1, false, data[i:i+16<<10])
+	}
+	st.writeReadPing()
+
+	// Memory held by another conn puts the Server over its limit,
+	// and is released right before this conn starts waiting.
+	mem := st.sc.mem
+	mem.add(&mem.recvBuffers, otherConn)
+	var once sync.Once
+	testHookBeforeMemoryWait = func() {
+		once.Do(func() { mem.add(&mem.recvBuffers, -otherConn) })
+	}
+	defer func() { testHookBeforeMemoryWait = nil }()
+
+	puppet.do(readBodyHandler(t, string(data[:16<<10])))
+	st.wantWindowUpdate(0, 16<<10)
+	st.wantWindowUpdate(1, 16<<10)
+}
+
 func TestServer_Send_GoAway_After_Bogus_WindowUpdate(t *testing.T) {
 	st := newServerTester(t, nil)
 	defer st.Close()
@@ -3637,6 +3955,40 @@ func TestServerHandleCustomConn(t *testing.T) {
 }
 
 // golang.org/issue/14214
+func TestServer_HeaderIndexingPolicy(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Secret", "value")
+		w.Header().Set("X-Public", "value")
+	}, func(s *Server) {
+		s.HeaderIndexingPolicy = hpack.IndexingPolicyFunc(func(f hpack.HeaderField) hpack.Indexing {
+			if f.Name == "x-secret" {
+				return hpack.NeverIndexed
+			}
+			return hpack.IncrementalIndexing
+		})
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+
+	hf := st.wantHeaders()
+	// This is the first response on the connection,
+	// so a new decoder has the same (empty) dynamic table.
+	sensitive := make(map[string]bool)
+	d := hpack.NewDecoder(initialHeaderTableSize, func(f hpack.HeaderField) {
+		sensitive[f.Name] = f.Sensitive
+	})
+	if _, err := d.Write(hf.HeaderBlockFragment()); err != nil {
+		t.Fatal(err)
+	}
+	if !sensitive["x-secret"] {
+		t.Errorf("x-secret was indexed; want never indexed")
+	}
+	if sensitive["x-public"] {
+		t.Errorf("x-public was never indexed; want indexed")
+	}
+}
+
 func TestServer_Rejects_ConnHeaders(t *testing.T) {
 	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
 		t.Error("should not get to Handler")
@@ -4178,6 +4530,109 @@ func TestServerGracefulShutdown(t *testing.T) {
 	}
 }
 
+func TestServerShutdown(t *testing.T) {
+	var srv *Server
+	var st *serverTester
+	handlerDone := make(chan struct{})
+	shutdownDone := make(chan error, 1)
+	st = newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		defer close(handlerDone)
+		go func() { shutdownDone <- srv.Shutdown(context.Background()) }()
+
+		ga := st.wantGoAway()
+		if ga.ErrCode != ErrCodeNo {
+			t.Errorf("GOAWAY error = %v; want ErrCodeNo", ga.ErrCode)
+		}
+		if ga.LastStreamID != 1 {
+			t.Errorf("GOAWAY LastStreamID = %v; want 1", ga.LastStreamID)
+		}
+		select {
+		case err := <-shutdownDone:
+			t.Errorf("Shutdown returned %v with a request in flight", err)
+		default:
+		}
+	}, func(s *Server) {
+		srv = s
+	})
+	defer st.Close()
+
+	st.greet()
+	st.bodylessReq1()
+
+	<-handlerDone
+	st.wantHeaders()
+	if n, err := st.cc.Read([]byte{0}); n != 0 || err == nil {
+		t.Errorf("Read = %v, %v; want 0, non-nil", n, err)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Errorf("Shutdown = %v; want nil", err)
+	}
+}
+
+func TestServerShutdownContextExpires(t *testing.T) {
+	var srv *Server
+	unblock := make(chan struct{})
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}, func(s *Server) {
+		srv = s
+	}, optQuiet)
+	defer st.Close()
+	defer close(unblock)
+
+	st.greet()
+	st.bodylessReq1()
+	st.writeReadPing() // wait for the request to reach the handler
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v; want %v", err, context.DeadlineExceeded)
+	}
+	st.wantGoAway()
+	if n, err := st.cc.Read([]byte{0}); n != 0 || err == nil {
+		t.Errorf("Read = %v, %v; want 0, non-nil", n, err)
+	}
+}
+
+// Connections passed to ServeConn after Shutdown are shut down
+// without a call to ConfigureServer.
+func TestServerShutdownBeforeServeConn(t *testing.T) {
+	var s Server
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown with no connections = %v", err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	serveDone := make(chan struct{})
+	go func() {
+		defer close(serveDone)
+		s.ServeConn(c1, &ServeConnOpts{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		})
+	}()
+	go func() {
+		io.WriteString(c2, ClientPreface)
+		NewFramer(c2, nil).WriteSettings()
+	}()
+	fr := NewFramer(nil, c2)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("reading frames: %v; want GOAWAY", err)
+		}
+		if ga, ok := f.(*GoAwayFrame); ok {
+			if ga.ErrCode != ErrCodeNo {
+				t.Errorf("GOAWAY error = %v; want ErrCodeNo", ga.ErrCode)
+			}
+			break
+		}
+	}
+	go io.Copy(ioutil.Discard, c2)
+	<-serveDone
+}
+
 // Issue 31753: don't sniff when Content-Encoding is set
 func TestContentEncodingNoSniffing(t *testing.T) {
 	type resp struct {
@@ -0,0 +1,173 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http2
+
+import (
+	"context"
+	"time"
+)
+
+// ClientTrace is a set of hooks to run at HTTP/2-specific stages of a
+// request made by a Transport. It complements httptrace.ClientTrace,
+// which covers milestones shared with HTTP/1.
+//
+// Hooks for events concerning a request's stream are called for that
+// request. Hooks for connection-level events (SETTINGS, GOAWAY, and
+// PINGs sent by the Transport itself) are called for every request with
+// a stream open on the connection when the event occurs.
+//
+// Any particular hook may be nil. Hooks may be called concurrently
+// from different goroutines, and must not block.
+type ClientTrace struct {
+	// StreamCreated is called when the request is assigned a stream
+	// on a connection, before its headers are written.
+	StreamCreated func(cc *ClientConn, streamID uint32)
+
+	// SettingsReceived is called when the server sends a SETTINGS frame.
+	SettingsReceived func(cc *ClientConn, settings []Setting)
+
+	// SettingsAcked is called when the server acknowledges
+	// a SETTINGS frame sent by the client.
+	SettingsAcked func(cc *ClientConn)
+
+	// GoAwayReceived is called when the server sends a GOAWAY frame.
+	GoAwayReceived func(cc *ClientConn, lastStreamID uint32, code ErrCode, debugData []byte)
+
+	// StreamReset is called when the server resets the request's stream
+	// with an RST_STREAM frame.
+	StreamReset func(cc *ClientConn, streamID uint32, code ErrCode)
+
+	// WaitWindowUpdate is called when writing the request body stalls
+	// because the stream or connection flow control window is exhausted.
+	WaitWindowUpdate func(cc *ClientConn, streamID uint32)
+
+	// GotWindowUpdate is called when a stalled request body write
+	// may proceed, with the time spent waiting.
+	GotWindowUpdate func(cc *ClientConn, streamID uint32, waited time.Duration)
+
+	// PingRTT is called when the server acknowledges a PING, with the
+	// round trip time. For a PING sent by ClientConn.Ping, it is taken
+	// from the context passed to Ping, not a request's context. PINGs
+	// the Transport sends itself, as health checks (ReadIdleTimeout) or
+	// to tune receive windows, are connection-level events.
+	PingRTT func(cc *ClientConn, rtt time.Duration)
+}
+
+// unique type to prevent assignment.
+type clientTraceContextKey struct{}
+
+// ContextClientTrace returns the ClientTrace associated with the
+// provided context. If none, it returns nil.
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceContextKey{}).(*ClientTrace)
+	return trace
+}
+
+// WithClientTrace returns a new context based on the provided parent
+// ctx. HTTP/2 requests made with the returned context will use the
+// provided trace hooks, replacing any ClientTrace in ctx.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	if trace == nil {
+		panic("nil trace")
+	}
+	return context.WithValue(ctx, clientTraceContextKey{}, trace)
+}
+
+// activeTraces returns the distinct ClientTraces of the requests
+// with streams open on cc.
+func (cc *ClientConn) activeTraces() []*ClientTrace {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	var traces []*ClientTrace
+	for _, cs := range cc.streams {
+		if cs.h2trace == nil || clientTraceSliceContains(traces, cs.h2trace) {
+			continue
+		}
+		traces = append(traces, cs.h2trace)
+	}
+	return traces
+}
+
+func clientTraceSliceContains(traces []*ClientTrace, trace *ClientTrace) bool {
+	for _, t := range traces {
+		if t == trace {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc *ClientConn) traceSettings(f *SettingsFrame) {
+	traces := cc.activeTraces()
+	if len(traces) == 0 {
+		return
+	}
+	if f.IsAck() {
+		for _, trace := range traces {
+			if trace.SettingsAcked != nil {
+				trace.SettingsAcked(cc)
+			}
+		}
+		return
+	}
+	settings := make([]Setting, 0, f.NumSettings())
+	f.ForeachSetting(func(s Setting) error {
+		settings = append(settings, s)
+		return nil
+	})
+	for _, trace := range traces {
+		if trace.SettingsReceived != nil {
+			trace.SettingsReceived(cc, settings)
+		}
+	}
+}
+
+func traceGoAwayReceived(traces []*ClientTrace, cc *ClientConn, f *GoAwayFrame) {
+	for _, trace := range traces {
+		if trace.GoAwayReceived != nil {
+			trace.GoAwayReceived(cc, f.LastStreamID, f.ErrCode, f.DebugData())
+		}
+	}
+}
+
+func traceStreamCreated(cs *clientStream) {
+	if trace := cs.h2trace; trace != nil && trace.StreamCreated != nil {
+		trace.StreamCreated(cs.cc, cs.ID)
+	}
+}
+
+func traceStreamReset(cs *clientStream, code ErrCode) {
+	if trace := cs.h2trace; trace != nil && trace.StreamReset != nil {
+		trace.StreamReset(cs.cc, cs.ID, code)
+	}
+}
+
+func traceWaitWindowUpdate(cs *clientStream) {
+	if trace := cs.h2trace; trace != nil && trace.WaitWindowUpdate != nil {
+		trace.WaitWindowUpdate(cs.cc, cs.ID)
+	}
+}
+
+func traceGotWindowUpdate(cs *clientStream, waited time.Duration) {
+	if trace := cs.h2trace; trace != nil && trace.GotWindowUpdate != nil {
+		trace.GotWindowUpdate(cs.cc, cs.ID, waited)
+	}
+}
+
+func tracePingRTT(ctx context.Context, cc *ClientConn, rtt time.Duration) {
+	if trace := ContextClientTrace(ctx); trace != nil && trace.PingRTT != nil {
+		trace.PingRTT(cc, rtt)
+	}
+}
+
+// traceConnPingRTT reports the round trip time of a PING sent by the
+// Transport itself to the requests with streams open on cc.
+func (cc *ClientConn) traceConnPingRTT(rtt time.Duration) {
+	for _, trace := range cc.activeTraces() {
+		if trace.PingRTT != nil {
+			trace.PingRTT(cc, rtt)
+		}
+	}
+}
@@ -13,6 +13,8 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -25,6 +27,7 @@ import (
 	"net/http"
 	"net/http/httptrace"
 	"net/textproto"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
@@ -106,6 +109,22 @@ type Transport struct {
 	// plain-text "http" scheme. Note that this does not enable h2c support.
 	AllowHTTP bool
 
+	// AllowHTTPUpgrade, if true, permits HTTP/2 requests using the
+	// plain-text "http" scheme, negotiated with the HTTP/1.1 Upgrade
+	// mechanism (RFC 7540, Section 3.2) rather than prior knowledge.
+	// When no connection to the server is available, the request is
+	// sent as HTTP/1.1 with "Upgrade: h2c" and "HTTP2-Settings" headers
+	// on a new connection. If the server responds with
+	// "101 Switching Protocols", the connection is used for HTTP/2 and
+	// added to the connection pool. Otherwise, the HTTP/1.1 response
+	// is returned and the connection is closed when its body is closed.
+	// Only one upgrade to a server is attempted at a time; concurrent
+	// requests wait for it to complete.
+	//
+	// Connections are dialed over plain TCP; DialTLSContext and DialTLS
+	// are not used. AllowHTTPUpgrade has no effect when ConnPool is set.
+	AllowHTTPUpgrade bool
+
 	// MaxHeaderListSize is the http2 SETTINGS_MAX_HEADER_LIST_SIZE to
 	// send in the initial settings frame. It is how many bytes
 	// of response headers are allowed. Unlike the http2 spec, zero here
@@ -137,6 +156,11 @@ type Transport struct {
 	// the default value of 4096 is used.
 	MaxEncoderHeaderTableSize uint32
 
+	// HeaderIndexingPolicy optionally decides how each request header
+	// field is indexed in the header compression table. If nil,
+	// hpack.DefaultIndexing is used, which never indexes credentials.
+	HeaderIndexingPolicy hpack.IndexingPolicy
+
 	// StrictMaxConcurrentStreams controls whether the server's
 	// SETTINGS_MAX_CONCURRENT_STREAMS should be respected
 	// globally. If false, new TCP connections are created to the
@@ -147,6 +171,49 @@ type Transport struct {
 	// waiting for their turn.
 	StrictMaxConcurrentStreams bool
 
+	// AllowConnectionCoalescing, if true, permits requests for one
+	// host to be sent on an existing connection to a different host,
+	// as described in RFC 9113 Section 9.1.1. A connection is only
+	// reused if its TLS certificate is valid for the new host and
+	// the new host resolves to the connection's remote IP address.
+	// If the server has sent an ORIGIN frame (RFC 8336), the origins
+	// it lists are used instead of DNS.
+	AllowConnectionCoalescing bool
+
+	// MaxConnsPerAuthority, if non-zero, enables load balancing across
+	// multiple connections to each authority (host:port). Requests are
+	// sent on the pooled connection with the fewest active streams.
+	// When every pooled connection has reached the server's
+	// SETTINGS_MAX_CONCURRENT_STREAMS, a new connection is dialed, up
+	// to MaxConnsPerAuthority connections. Past that limit, requests
+	// wait for a stream to become available on the least loaded
+	// connection, as with StrictMaxConcurrentStreams.
+	//
+	// Unlike net/http.Transport.MaxConnsPerHost, this is not a limit
+	// on dials: when it is zero, a single connection is used per
+	// authority.
+	//
+	// MaxConnsPerAuthority is only used by the default connection pool.
+	MaxConnsPerAuthority int
+
+	// MinConnsPerAuthority is the number of connections the pool keeps
+	// open to an authority after the first request to it, when
+	// MaxConnsPerAuthority is non-zero. Connections which receive a
+	// GOAWAY frame are replaced in the background to maintain this
+	// minimum. MinConnsPerAuthority is capped at MaxConnsPerAuthority.
+	MinConnsPerAuthority int
+
+	// MaxAutotunedStreamWindow, if larger than the default
+	// per-stream receive window of 4MB, enables receive window
+	// autotuning. The Transport estimates each connection's
+	// bandwidth-delay product by timing PING round trips while
+	// response bodies are being received, and raises the
+	// per-stream flow control window (via
+	// SETTINGS_INITIAL_WINDOW_SIZE) as needed to keep the link
+	// busy, up to MaxAutotunedStreamWindow bytes.
+	// The connection-level window is 1GB and is not tuned.
+	MaxAutotunedStreamWindow int32
+
 	// IdleConnTimeout is the maximum amount of time an idle
 	// (keep-alive) connection will remain idle before closing
 	// itself.
@@ -215,6 +282,27 @@ func (t *Transport) disableCompression() bool {
 	return t.DisableCompression || (t.t1 != nil && t.t1.DisableCompression)
 }
 
+// minConnsPerAuthority returns the number of connections the pool should
+// keep open to an authority in load balancing mode.
+func (t *Transport) minConnsPerAuthority() int {
+	if t.MaxConnsPerAuthority <= 0 || t.MinConnsPerAuthority <= 0 {
+		return 0
+	}
+	if t.MinConnsPerAuthority > t.MaxConnsPerAuthority {
+		return t.MaxConnsPerAuthority
+	}
+	return t.MinConnsPerAuthority
+}
+
+// goRun starts a new goroutine.
+func (t *Transport) goRun(f func()) {
+	if t.syncHooks != nil {
+		t.syncHooks.goRun(f)
+		return
+	}
+	go f()
+}
+
 func (t *Transport) pingTimeout() time.Duration {
 	if t.PingTimeout == 0 {
 		return 15 * time.Second
@@ -312,25 +400,28 @@ type ClientConn struct {
 	idleTimeout time.Duration // or 0 for never
 	idleTimer   timer
 
-	mu              sync.Mutex // guards following
-	cond            *sync.Cond // hold mu; broadcast on flow/closed changes
-	flow            outflow    // our conn-level flow control quota (cs.outflow is per stream)
-	inflow          inflow     // peer's conn-level flow control
-	doNotReuse      bool       // whether conn is marked to not be reused for any future requests
-	closing         bool
-	closed          bool
-	seenSettings    bool                     // true if we've seen a settings frame, false otherwise
-	wantSettingsAck bool                     // we sent a SETTINGS frame and haven't heard back
-	goAway          *GoAwayFrame             // if non-nil, the GoAwayFrame we received
-	goAwayDebug     string                   // goAway frame's debug data, retained as a string
-	streams         map[uint32]*clientStream // client-initiated
-	streamsReserved int                      // incr by ReserveNewRequest; decr on RoundTrip
-	nextStreamID    uint32
-	pendingRequests int                       // requests blocked and waiting to be sent because len(streams) == maxConcurrentStreams
-	pings           map[[8]byte]chan struct{} // in flight ping data to notification channel
-	br              *bufio.Reader
-	lastActive      time.Time
-	lastIdle        time.Time // time last idle
+	mu               sync.Mutex // guards following
+	cond             *sync.Cond // hold mu; broadcast on flow/closed changes
+	flow             outflow    // our conn-level flow control quota (cs.outflow is per stream)
+	inflow           inflow     // peer's conn-level flow control
+	doNotReuse       bool       // whether conn is marked to not be reused for any future requests
+	closing          bool
+	closed           bool
+	seenSettings     bool                     // true if we've seen a settings frame, false otherwise
+	unackedSettings  int                      // how many SETTINGS frames we sent without ACKs
+	goAway           *GoAwayFrame             // if non-nil, the GoAwayFrame we received
+	goAwayDebug      string                   // goAway frame's debug data, retained as a string
+	streams          map[uint32]*clientStream // client-initiated
+	streamsReserved  int                      // incr by ReserveNewRequest; decr on RoundTrip
+	nextStreamID     uint32
+	pendingRequests  int                       // requests blocked and waiting to be sent because len(streams) == maxConcurrentStreams
+	pings            map[[8]byte]chan struct{} // in flight ping data to notification channel
+	bdp              bdpEstimator              // receive window autotuning
+	streamRecvWindow int32                     // initial flow control window for new streams
+	originSet        map[string]bool           // host:port authorities from ORIGIN frames; nil if none received
+	br               *bufio.Reader
+	lastActive       time.Time
+	lastIdle         time.Time // time last idle
 	// Settings from peer: (also guarded by wmu)
 	maxFrameSize           uint32
 	maxConcurrentStreams   uint32
@@ -418,10 +509,12 @@ type clientStream struct {
 	reqCancel <-chan struct{}
 
 	trace         *httptrace.ClientTrace // or nil
+	h2trace       *ClientTrace           // or nil
 	ID            uint32
 	bufPipe       pipe // buffered pipe with the flow-controlled response payload
 	requestedGzip bool
 	isHead        bool
+	upgraded      bool // request was sent as HTTP/1.1 before an h2c upgrade
 
 	abortOnce sync.Once
 	abort     chan struct{} // closed to signal stream should end immediately
@@ -601,13 +694,25 @@ func authorityAddr(scheme string, authority string) (addr string) {
 
 // RoundTripOpt is like RoundTrip, but takes options.
 func (t *Transport) RoundTripOpt(req *http.Request, opt RoundTripOpt) (*http.Response, error) {
-	if !(req.URL.Scheme == "https" || (req.URL.Scheme == "http" && t.AllowHTTP)) {
+	if !(req.URL.Scheme == "https" || (req.URL.Scheme == "http" && (t.AllowHTTP || t.AllowHTTPUpgrade))) {
 		return nil, errors.New("http2: unsupported scheme")
 	}
 
 	addr := authorityAddr(req.URL.Scheme, req.URL.Host)
+	upgradePool, upgrade := t.connPool().(*clientConnPool)
+	upgrade = upgrade && t.AllowHTTPUpgrade && req.URL.Scheme == "http"
 	for retry := 0; ; retry++ {
-		cc, err := t.connPool().GetClientConn(req, addr)
+		var cc *ClientConn
+		var err error
+		if upgrade {
+			var call *dialCall
+			cc, call, err = upgradePool.getUpgradeClientConn(req, addr)
+			if call != nil {
+				return t.upgradeRoundTrip(req, addr, upgradePool, call)
+			}
+		} else {
+			cc, err = t.connPool().GetClientConn(req, addr)
+		}
 		if err != nil {
 			t.vlogf("http2: Transport failed to get client conn for %s: %v", addr, err)
 			return nil, err
@@ -774,6 +879,159 @@ func (t *Transport) dialTLS(ctx context.Context, network, addr string, tlsCfg *t
 	return tlsCn, nil
 }
 
+// upgradeRoundTrip sends req as an HTTP/1.1 request on a new connection
+// to addr, asking the server to upgrade the connection to h2c.
+// If the server switches protocols, the connection is added to p
+// and the response is read from stream 1. The upgrade is reported to
+// requests waiting on call in any case.
+func (t *Transport) upgradeRoundTrip(req *http.Request, addr string, p *clientConnPool, call *dialCall) (*http.Response, error) {
+	upgraded := false
+	defer func() {
+		if !upgraded {
+			p.upgradeDone(addr, call, nil)
+		}
+	}()
+	if err := checkConnHeaders(req); err != nil {
+		return nil, err
+	}
+	ctx := req.Context()
+	traceGetConn(req, addr)
+	c, err := t.dialUpgrade(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the connection if the request is canceled before
+	// the HTTP/1.1 exchange is complete.
+	donec := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-req.Cancel:
+			c.Close()
+		case <-donec:
+		}
+	}()
+	fail := func(err error) (*http.Response, error) {
+		close(donec)
+		c.Close()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		return nil, err
+	}
+
+	singleUse := t.disableKeepAlives() || isConnectionCloseRequest(req)
+	ureq := req.Clone(ctx)
+	ureq.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	ureq.Header.Set("Upgrade", "h2c")
+	ureq.Header.Set("HTTP2-Settings", encodeUpgradeSettings(t.initialSettings()))
+	bw := bufio.NewWriter(c)
+	if err := ureq.Write(bw); err != nil {
+		return fail(err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fail(err)
+	}
+
+	br := bufio.NewReader(c)
+	var res *http.Response
+	for {
+		res, err = http.ReadResponse(br, req)
+		if err != nil {
+			return fail(err)
+		}
+		if res.StatusCode < 100 || res.StatusCode > 199 || res.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.vlogf("http2: server at %v declined h2c upgrade: %v", addr, res.Status)
+		res.Body = &upgradeDeclinedBody{
+			ReadCloser: res.Body,
+			conn:       c,
+			donec:      donec,
+		}
+		return res, nil
+	}
+	if !asciiEqualFold(res.Header.Get("Upgrade"), "h2c") {
+		return fail(fmt.Errorf("http2: server switched to unexpected protocol %q", res.Header.Get("Upgrade")))
+	}
+	close(donec)
+
+	var uc net.Conn = c
+	if br.Buffered() > 0 {
+		uc = &upgradedConn{Conn: c, br: br}
+	}
+	cc, err := t.newClientConn(uc, singleUse, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	upgraded = true
+	if singleUse {
+		p.upgradeDone(addr, call, nil)
+	} else {
+		p.upgradeDone(addr, call, cc)
+	}
+	atomic.StoreUint32(&cc.reused, 1)
+	traceGotConn(req, cc, false)
+	return cc.roundTrip(req, func(cs *clientStream) {
+		// The request, including its body, was sent before the upgrade.
+		cs.upgraded = true
+		cs.reqBody = nil
+		cs.reqBodyContentLength = 0
+	})
+}
+
+// dialUpgrade dials a plain-text connection to addr for an h2c upgrade.
+// The DialTLS hooks are not used, as the connection is never TLS.
+func (t *Transport) dialUpgrade(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// encodeUpgradeSettings returns the value of the HTTP2-Settings header:
+// the payload of a SETTINGS frame, base64url encoded without padding.
+func encodeUpgradeSettings(settings []Setting) string {
+	buf := make([]byte, 6*len(settings))
+	for i, s := range settings {
+		binary.BigEndian.PutUint16(buf[6*i:], uint16(s.ID))
+		binary.BigEndian.PutUint32(buf[6*i+2:], s.Val)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// upgradedConn is a connection which has switched to HTTP/2,
+// with data read past the HTTP/1.1 response still buffered in br.
+type upgradedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) { return c.br.Read(p) }
+
+// upgradeDeclinedBody is the body of an HTTP/1.1 response to a request
+// which asked for an h2c upgrade. The connection is closed with the body.
+type upgradeDeclinedBody struct {
+	io.ReadCloser
+	conn      net.Conn
+	donec     chan struct{}
+	closeOnce sync.Once
+}
+
+func (b *upgradeDeclinedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.closeOnce.Do(func() {
+		close(b.donec)
+		b.conn.Close()
+	})
+	return err
+}
+
 // disableKeepAlives reports whether connections should be closed as
 // soon as possible after handling the first request.
 func (t *Transport) disableKeepAlives() bool {
@@ -794,6 +1052,13 @@ func (t *Transport) maxDecoderHeaderTableSize() uint32 {
 	return initialHeaderTableSize
 }
 
+func (t *Transport) headerIndexingPolicy() hpack.IndexingPolicy {
+	if p := t.HeaderIndexingPolicy; p != nil {
+		return p
+	}
+	return hpack.IndexingPolicyFunc(hpack.DefaultIndexing)
+}
+
 func (t *Transport) maxEncoderHeaderTableSize() uint32 {
 	if v := t.MaxEncoderHeaderTableSize; v > 0 {
 		return v
@@ -817,7 +1082,8 @@ func (t *Transport) newClientConn(c net.Conn, singleUse bool, hooks *testSyncHoo
 		peerMaxHeaderListSize: 0xffffffffffffffff,          // "infinite", per spec. Use 2^64-1 instead.
 		streams:               make(map[uint32]*clientStream),
 		singleUse:             singleUse,
-		wantSettingsAck:       true,
+		unackedSettings:       1,
+		streamRecvWindow:      transportDefaultStreamFlow,
 		pings:                 make(map[[8]byte]chan struct{}),
 		reqHeaderMu:           make(chan struct{}, 1),
 		syncHooks:             hooks,
@@ -836,6 +1102,7 @@ func (t *Transport) newClientConn(c net.Conn, singleUse bool, hooks *testSyncHoo
 
 	cc.cond = sync.NewCond(&cc.mu)
 	cc.flow.add(int32(initialWindowSize))
+	cc.bdp.init(transportDefaultStreamFlow, t.MaxAutotunedStreamWindow)
 
 	// TODO: adjust this writer size to account for frame size +
 	// MTU + crypto/tls record padding.
@@ -858,9 +1125,10 @@ func (t *Transport) newClientConn(c net.Conn, singleUse bool, hooks *testSyncHoo
 
 	cc.henc = hpack.NewEncoder(&cc.hbuf)
 	cc.henc.SetMaxDynamicTableSizeLimit(t.maxEncoderHeaderTableSize())
+	cc.henc.SetIndexingPolicy(t.headerIndexingPolicy())
 	cc.peerMaxHeaderTableSize = initialHeaderTableSize
 
-	if t.AllowHTTP {
+	if t.AllowHTTP || t.AllowHTTPUpgrade {
 		cc.nextStreamID = 3
 	}
 
@@ -869,22 +1137,8 @@ func (t *Transport) newClientConn(c net.Conn, singleUse bool, hooks *testSyncHoo
 		cc.tlsState = &state
 	}
 
-	initialSettings := []Setting{
-		{ID: SettingEnablePush, Val: 0},
-		{ID: SettingInitialWindowSize, Val: transportDefaultStreamFlow},
-	}
-	if max := t.maxFrameReadSize(); max != 0 {
-		initialSettings = append(initialSettings, Setting{ID: SettingMaxFrameSize, Val: max})
-	}
-	if max := t.maxHeaderListSize(); max != 0 {
-		initialSettings = append(initialSettings, Setting{ID: SettingMaxHeaderListSize, Val: max})
-	}
-	if maxHeaderTableSize != initialHeaderTableSize {
-		initialSettings = append(initialSettings, Setting{ID: SettingHeaderTableSize, Val: maxHeaderTableSize})
-	}
-
 	cc.bw.Write(clientPreface)
-	cc.fr.WriteSettings(initialSettings...)
+	cc.fr.WriteSettings(t.initialSettings()...)
 	cc.fr.WriteWindowUpdate(0, transportDefaultConnFlow)
 	cc.inflow.init(transportDefaultConnFlow + initialWindowSize)
 	cc.bw.Flush()
@@ -897,6 +1151,25 @@ func (t *Transport) newClientConn(c net.Conn, singleUse bool, hooks *testSyncHoo
 	return cc, nil
 }
 
+// initialSettings returns the settings sent in the client's initial
+// SETTINGS frame.
+func (t *Transport) initialSettings() []Setting {
+	initialSettings := []Setting{
+		{ID: SettingEnablePush, Val: 0},
+		{ID: SettingInitialWindowSize, Val: transportDefaultStreamFlow},
+	}
+	if max := t.maxFrameReadSize(); max != 0 {
+		initialSettings = append(initialSettings, Setting{ID: SettingMaxFrameSize, Val: max})
+	}
+	if max := t.maxHeaderListSize(); max != 0 {
+		initialSettings = append(initialSettings, Setting{ID: SettingMaxHeaderListSize, Val: max})
+	}
+	if max := t.maxDecoderHeaderTableSize(); max != initialHeaderTableSize {
+		initialSettings = append(initialSettings, Setting{ID: SettingHeaderTableSize, Val: max})
+	}
+	return initialSettings
+}
+
 func (cc *ClientConn) healthCheck() {
 	pingTimeout := cc.t.pingTimeout()
 	// We don't need to periodically ping in the health check, because the readLoop of ClientConn will
@@ -904,12 +1177,13 @@ func (cc *ClientConn) healthCheck() {
 	ctx, cancel := cc.contextWithTimeout(context.Background(), pingTimeout)
 	defer cancel()
 	cc.vlogf("http2: Transport sending health check")
-	err := cc.Ping(ctx)
+	rtt, err := cc.ping(ctx)
 	if err != nil {
 		cc.vlogf("http2: Transport health check failure: %v", err)
 		cc.closeForLostPing()
 	} else {
 		cc.vlogf("http2: Transport health check success")
+		cc.traceConnPingRTT(rtt)
 	}
 }
 
@@ -1051,11 +1325,12 @@ func (cc *ClientConn) idleStateLocked() (st clientConnIdleState) {
 		return
 	}
 	var maxConcurrentOkay bool
-	if cc.t.StrictMaxConcurrentStreams {
+	if cc.t.StrictMaxConcurrentStreams || cc.t.MaxConnsPerAuthority > 0 {
 		// We'll tell the caller we can take a new request to
 		// prevent the caller from dialing a new TCP
 		// connection, but then we'll block later before
-		// writing it.
+		// writing it. When load balancing, the pool tracks
+		// stream limits itself; see streamLoad.
 		maxConcurrentOkay = true
 	} else {
 		maxConcurrentOkay = int64(len(cc.streams)+cc.streamsReserved+1) <= int64(cc.maxConcurrentStreams)
@@ -1073,6 +1348,17 @@ func (cc *ClientConn) canTakeNewRequestLocked() bool {
 	return st.canTakeNewRequest
 }
 
+// streamLoad reports the number of streams which are open, reserved,
+// or waiting to be opened on cc, along with the peer's limit on
+// concurrent streams. It is used by the pool to balance requests
+// across connections.
+func (cc *ClientConn) streamLoad() (load, limit int, canTakeNewRequest bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	load = len(cc.streams) + cc.streamsReserved + cc.pendingRequests
+	return load, int(cc.maxConcurrentStreams), cc.canTakeNewRequestLocked()
+}
+
 // tooIdleLocked reports whether this connection has been been sitting idle
 // for too much wall time.
 func (cc *ClientConn) tooIdleLocked() bool {
@@ -1316,11 +1602,15 @@ func (cc *ClientConn) roundTrip(req *http.Request, streamf func(*clientStream))
 		reqBody:              req.Body,
 		reqBodyContentLength: actualContentLength(req),
 		trace:                httptrace.ContextClientTrace(ctx),
+		h2trace:              ContextClientTrace(ctx),
 		peerClosed:           make(chan struct{}),
 		abort:                make(chan struct{}),
 		respHeaderRecv:       make(chan struct{}),
 		donec:                make(chan struct{}),
 	}
+	if streamf != nil {
+		streamf(cs)
+	}
 	cc.goRun(func() {
 		cs.doRequest(req)
 	})
@@ -1398,10 +1688,6 @@ func (cc *ClientConn) roundTrip(req *http.Request, streamf func(*clientStream))
 		return err
 	}
 
-	if streamf != nil {
-		streamf(cs)
-	}
-
 	for {
 		if cc.syncHooks != nil {
 			cc.syncHooks.blockUntil(func() bool {
@@ -1498,13 +1784,17 @@ func (cs *clientStream) writeRequest(req *http.Request) (err error) {
 	if cc.idleTimer != nil {
 		cc.idleTimer.Stop()
 	}
-	cc.decrStreamReservationsLocked()
-	if err := cc.awaitOpenSlotForStreamLocked(cs); err != nil {
-		cc.mu.Unlock()
-		<-cc.reqHeaderMu
-		return err
+	if cs.upgraded {
+		cc.addUpgradedStreamLocked(cs)
+	} else {
+		cc.decrStreamReservationsLocked()
+		if err := cc.awaitOpenSlotForStreamLocked(cs); err != nil {
+			cc.mu.Unlock()
+			<-cc.reqHeaderMu
+			return err
+		}
+		cc.addStreamLocked(cs) // assigns stream ID
 	}
-	cc.addStreamLocked(cs) // assigns stream ID
 	if isConnectionCloseRequest(req) {
 		cc.doNotReuse = true
 	}
@@ -1513,9 +1803,11 @@ func (cs *clientStream) writeRequest(req *http.Request) (err error) {
 	if newStreamHook != nil {
 		newStreamHook(cs)
 	}
+	traceStreamCreated(cs)
 
 	// TODO(bradfitz): this is a copy of the logic in net/http. Unify somewhere?
 	if !cc.t.disableCompression() &&
+		!cs.upgraded &&
 		req.Header.Get("Accept-Encoding") == "" &&
 		req.Header.Get("Range") == "" &&
 		!cs.isHead {
@@ -1547,7 +1839,9 @@ func (cs *clientStream) writeRequest(req *http.Request) (err error) {
 	// RoundTrip to return successfully. Since the RoundTrip contract permits
 	// the caller to "mutate or reuse" the Request after closing the Response's Body,
 	// we must take care when referencing the Request from here on.
-	err = cs.encodeAndWriteHeaders(req)
+	if !cs.upgraded {
+		err = cs.encodeAndWriteHeaders(req)
+	}
 	<-cc.reqHeaderMu
 	if err != nil {
 		return err
@@ -2000,6 +2294,7 @@ func (cs *clientStream) awaitFlowControl(maxBytes int) (taken int32, err error)
 	ctx := cs.ctx
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
+	var stalledAt time.Time
 	for {
 		if cc.closed {
 			return 0, errClientConnClosed
@@ -2026,8 +2321,20 @@ func (cs *clientStream) awaitFlowControl(maxBytes int) (taken int32, err error)
 				take = int32(cc.maxFrameSize)
 			}
 			cs.flow.take(take)
+			if !stalledAt.IsZero() {
+				cc.mu.Unlock()
+				traceGotWindowUpdate(cs, time.Since(stalledAt))
+				cc.mu.Lock()
+			}
 			return take, nil
 		}
+		if stalledAt.IsZero() && cs.h2trace != nil {
+			stalledAt = time.Now()
+			cc.mu.Unlock()
+			traceWaitWindowUpdate(cs)
+			cc.mu.Lock()
+			continue
+		}
 		cc.condWait()
 	}
 }
@@ -2288,7 +2595,7 @@ type resAndError struct {
 func (cc *ClientConn) addStreamLocked(cs *clientStream) {
 	cs.flow.add(int32(cc.initialWindowSize))
 	cs.flow.setConnFlow(&cc.flow)
-	cs.inflow.init(transportDefaultStreamFlow)
+	cs.inflow.init(cc.streamRecvWindow)
 	cs.ID = cc.nextStreamID
 	cc.nextStreamID += 2
 	cc.streams[cs.ID] = cs
@@ -2297,6 +2604,18 @@ func (cc *ClientConn) addStreamLocked(cs *clientStream) {
 	}
 }
 
+// addUpgradedStreamLocked adds stream 1, on which the server responds
+// to the request sent with an h2c upgrade. The request has already been
+// sent, so the stream starts in the half-closed (local) state.
+func (cc *ClientConn) addUpgradedStreamLocked(cs *clientStream) {
+	cs.flow.add(int32(cc.initialWindowSize))
+	cs.flow.setConnFlow(&cc.flow)
+	cs.inflow.init(cc.streamRecvWindow)
+	cs.ID = 1
+	cs.sentHeaders = true
+	cc.streams[cs.ID] = cs
+}
+
 func (cc *ClientConn) forgetStreamID(id uint32) {
 	cc.mu.Lock()
 	slen := len(cc.streams)
@@ -2486,6 +2805,8 @@ func (rl *clientConnReadLoop) run() error {
 			err = rl.processWindowUpdate(f)
 		case *PingFrame:
 			err = rl.processPing(f)
+		case *OriginFrame:
+			err = rl.processOrigin(f)
 		default:
 			cc.logf("Transport: unhandled response frame type %T", f)
 		}
@@ -2897,9 +3218,10 @@ func (rl *clientConnReadLoop) processData(f *DataFrame) error {
 		if !didReset {
 			sendStream = cs.inflow.add(refund)
 		}
+		sendPing := cc.bdp.add(int(f.Length), time.Now())
 		cc.mu.Unlock()
 
-		if sendConn > 0 || sendStream > 0 {
+		if sendConn > 0 || sendStream > 0 || sendPing {
 			cc.wmu.Lock()
 			if sendConn > 0 {
 				cc.fr.WriteWindowUpdate(0, uint32(sendConn))
@@ -2907,6 +3229,9 @@ func (rl *clientConnReadLoop) processData(f *DataFrame) error {
 			if sendStream > 0 {
 				cc.fr.WriteWindowUpdate(cs.ID, uint32(sendStream))
 			}
+			if sendPing {
+				cc.fr.WritePing(false, bdpPing)
+			}
 			cc.bw.Flush()
 			cc.wmu.Unlock()
 		}
@@ -2966,7 +3291,11 @@ func (cs *clientStream) copyTrailers() {
 
 func (rl *clientConnReadLoop) processGoAway(f *GoAwayFrame) error {
 	cc := rl.cc
-	cc.t.connPool().MarkDead(cc)
+	if p, ok := cc.t.connPool().(clientConnPoolGoAwayHandler); ok {
+		p.markGoAway(cc)
+	} else {
+		cc.t.connPool().MarkDead(cc)
+	}
 	if f.ErrCode != 0 {
 		// TODO: deal with GOAWAY more. particularly the error code
 		cc.vlogf("transport got GOAWAY with error code = %v", f.ErrCode)
@@ -2974,7 +3303,9 @@ func (rl *clientConnReadLoop) processGoAway(f *GoAwayFrame) error {
 			fn("recv_goaway_" + f.ErrCode.stringToken())
 		}
 	}
+	traces := cc.activeTraces()
 	cc.setGoAway(f)
+	traceGoAwayReceived(traces, cc, f)
 	return nil
 }
 
@@ -2983,15 +3314,16 @@ func (rl *clientConnReadLoop) processSettings(f *SettingsFrame) error {
 	// Locking both mu and wmu here allows frame encoding to read settings with only wmu held.
 	// Acquiring wmu when f.IsAck() is unnecessary, but convenient and mostly harmless.
 	cc.wmu.Lock()
-	defer cc.wmu.Unlock()
-
-	if err := rl.processSettingsNoWrite(f); err != nil {
-		return err
-	}
-	if !f.IsAck() {
+	err := rl.processSettingsNoWrite(f)
+	if err == nil && !f.IsAck() {
 		cc.fr.WriteSettingsAck()
 		cc.bw.Flush()
 	}
+	cc.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	cc.traceSettings(f)
 	return nil
 }
 
@@ -3001,8 +3333,8 @@ func (rl *clientConnReadLoop) processSettingsNoWrite(f *SettingsFrame) error {
 	defer cc.mu.Unlock()
 
 	if f.IsAck() {
-		if cc.wantSettingsAck {
-			cc.wantSettingsAck = false
+		if cc.unackedSettings > 0 {
+			cc.unackedSettings--
 			return nil
 		}
 		return ConnectionError(ErrCodeProtocol)
@@ -3107,6 +3439,7 @@ func (rl *clientConnReadLoop) processResetStream(f *RSTStreamFrame) error {
 	if fn := cs.cc.t.CountError; fn != nil {
 		fn("recv_rststream_" + f.ErrCode.stringToken())
 	}
+	traceStreamReset(cs, f.ErrCode)
 	cs.abortStream(serr)
 
 	cs.bufPipe.CloseWithError(serr)
@@ -3115,12 +3448,22 @@ func (rl *clientConnReadLoop) processResetStream(f *RSTStreamFrame) error {
 
 // Ping sends a PING frame to the server and waits for the ack.
 func (cc *ClientConn) Ping(ctx context.Context) error {
+	rtt, err := cc.ping(ctx)
+	if err == nil {
+		tracePingRTT(ctx, cc, rtt)
+	}
+	return err
+}
+
+// ping sends a PING frame to the server, waits for the ack,
+// and returns the round trip time.
+func (cc *ClientConn) ping(ctx context.Context) (time.Duration, error) {
 	c := make(chan struct{})
 	// Generate a random payload
 	var p [8]byte
 	for {
 		if _, err := rand.Read(p[:]); err != nil {
-			return err
+			return 0, err
 		}
 		cc.mu.Lock()
 		// check for dup before insert
@@ -3133,6 +3476,7 @@ func (cc *ClientConn) Ping(ctx context.Context) error {
 	}
 	var pingError error
 	errc := make(chan struct{})
+	start := time.Now()
 	cc.goRun(func() {
 		cc.wmu.Lock()
 		defer cc.wmu.Unlock()
@@ -3160,18 +3504,21 @@ func (cc *ClientConn) Ping(ctx context.Context) error {
 	}
 	select {
 	case <-c:
-		return nil
+		return time.Since(start), nil
 	case <-errc:
-		return pingError
+		return 0, pingError
 	case <-ctx.Done():
-		return ctx.Err()
+		return 0, ctx.Err()
 	case <-cc.readerDone:
 		// connection closed
-		return cc.readerErr
+		return 0, cc.readerErr
 	}
 }
 
 func (rl *clientConnReadLoop) processPing(f *PingFrame) error {
+	if f.IsAck() && f.Data == bdpPing {
+		return rl.processBDPPingAck()
+	}
 	if f.IsAck() {
 		cc := rl.cc
 		cc.mu.Lock()
@@ -3192,6 +3539,96 @@ func (rl *clientConnReadLoop) processPing(f *PingFrame) error {
 	return cc.bw.Flush()
 }
 
+func (rl *clientConnReadLoop) processOrigin(f *OriginFrame) error {
+	if f.StreamID != 0 {
+		// RFC 8336, Section 2.1: "The ORIGIN frame MUST be sent on
+		// stream 0; an ORIGIN frame on any other stream is invalid
+		// and MUST be ignored."
+		return nil
+	}
+	cc := rl.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.originSet == nil {
+		cc.originSet = make(map[string]bool)
+	}
+	for _, o := range f.Origins {
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			continue
+		}
+		cc.originSet[authorityAddr(u.Scheme, u.Host)] = true
+	}
+	return nil
+}
+
+// canCoalesce reports whether cc may carry requests for addr, a
+// host:port that cc was not dialed for. If the answer depends on
+// where host resolves, needLookup is true and the caller must
+// additionally check the result of a lookup with remoteAddrIn.
+func (cc *ClientConn) canCoalesce(addr, host string) (ok, needLookup bool) {
+	if cc.tlsState == nil || len(cc.tlsState.PeerCertificates) == 0 {
+		return false, false
+	}
+	if cc.tlsState.PeerCertificates[0].VerifyHostname(host) != nil {
+		return false, false
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.originSet != nil {
+		return cc.originSet[addr], false
+	}
+	return true, true
+}
+
+// remoteAddrIn reports whether cc's remote IP address is one of addrs.
+func (cc *ClientConn) remoteAddrIn(addrs []net.IPAddr) bool {
+	ra, ok := cc.tconn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(ra.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// processBDPPingAck updates the receive window estimate when the
+// server acknowledges a PING sent by bdpEstimator, and raises the
+// initial window of current and future streams if it has grown.
+func (rl *clientConnReadLoop) processBDPPingAck() error {
+	cc := rl.cc
+	// Hold wmu while updating stream windows, so the new SETTINGS
+	// are written before any stream created with the new window.
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cc.mu.Lock()
+	now := time.Now()
+	pinging, rtt := cc.bdp.pinging, now.Sub(cc.bdp.sentAt)
+	w := cc.bdp.acked(now)
+	cc.mu.Unlock()
+	if pinging {
+		cc.traceConnPingRTT(rtt)
+	}
+	cc.mu.Lock()
+	if w <= cc.streamRecvWindow {
+		cc.mu.Unlock()
+		return nil
+	}
+	delta := w - cc.streamRecvWindow
+	cc.streamRecvWindow = w
+	for _, cs := range cc.streams {
+		cs.inflow.grow(delta)
+	}
+	cc.unackedSettings++
+	cc.mu.Unlock()
+	cc.vlogf("http2: Transport raising stream receive window to %v", w)
+	cc.fr.WriteSettings(Setting{ID: SettingInitialWindowSize, Val: uint32(w)})
+	return cc.bw.Flush()
+}
+
 func (rl *clientConnReadLoop) processPushPromise(f *PushPromiseFrame) error {
 	// We told the peer we don't want them.
 	// Spec says:
@@ -3330,6 +3767,19 @@ func (rt noDialH2RoundTripper) RoundTrip(req *http.Request) (*http.Response, err
 	return res, err
 }
 
+var testHookLookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// lookupIPAddr resolves host for the purpose of connection coalescing.
+func (t *Transport) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	if testHookLookupIPAddr != nil {
+		return testHookLookupIPAddr(ctx, host)
+	}
+	return net.DefaultResolver.LookupIPAddr(ctx, host)
+}
+
 func (t *Transport) idleConnTimeout() time.Duration {
 	// to keep things backwards compatible, we use non-zero values of
 	// IdleConnTimeout, followed by using the IdleConnTimeout on the underlying
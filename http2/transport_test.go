@@ -10,6 +10,8 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"flag"
@@ -218,6 +220,174 @@ func TestTransportH2c(t *testing.T) {
 	}
 }
 
+// startH2cUpgradeServer starts a server which responds to HTTP/1.1
+// requests for an h2c upgrade by switching protocols when upgrade is true,
+// or with an HTTP/1.1 response otherwise.
+func startH2cUpgradeServer(t *testing.T, upgrade bool, accepts *int32) net.Listener {
+	h2Server := &Server{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%v %v %q", r.Proto, r.URL.Path, body)
+	})
+	l := newLocalListener(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepts, 1)
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, err := io.ReadAll(req.Body)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				req.Body = io.NopCloser(bytes.NewReader(body))
+				if !upgrade || req.Header.Get("Upgrade") != "h2c" {
+					res := &http.Response{
+						StatusCode:    200,
+						ProtoMajor:    1,
+						ProtoMinor:    1,
+						Header:        http.Header{"Connection": {"close"}},
+						ContentLength: 5,
+						Body:          io.NopCloser(strings.NewReader("h1 ok")),
+					}
+					res.Write(conn)
+					return
+				}
+				settings, err := base64.RawURLEncoding.DecodeString(req.Header.Get("HTTP2-Settings"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+					"Connection: Upgrade\r\n"+
+					"Upgrade: h2c\r\n\r\n")
+				h2Server.ServeConn(&upgradedConn{Conn: conn, br: br}, &ServeConnOpts{
+					Handler:        handler,
+					UpgradeRequest: req,
+					Settings:       settings,
+				})
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTransportH2cUpgrade(t *testing.T) {
+	var accepts int32
+	l := startH2cUpgradeServer(t, true, &accepts)
+	defer l.Close()
+	tr := &Transport{AllowHTTPUpgrade: true}
+	defer tr.CloseIdleConnections()
+
+	for i, want := range []string{
+		// The first request is sent as HTTP/1.1, and answered on stream 1.
+		`HTTP/1.1 /upgrade "body 0"`,
+		// Later requests use the upgraded connection.
+		`HTTP/2.0 /upgrade "body 1"`,
+	} {
+		body := fmt.Sprintf("body %v", i)
+		req, err := http.NewRequest("POST", "http://"+l.Addr().String()+"/upgrade", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("request %v: %v", i, err)
+		}
+		got, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ProtoMajor != 2 {
+			t.Errorf("request %v: response proto = %v; want HTTP/2", i, res.Proto)
+		}
+		if string(got) != want {
+			t.Errorf("request %v: response body = %q; want %q", i, got, want)
+		}
+	}
+	if got := atomic.LoadInt32(&accepts); got != 1 {
+		t.Errorf("server accepted %v connections; want 1", got)
+	}
+}
+
+func TestTransportH2cUpgradeDeclined(t *testing.T) {
+	var accepts int32
+	l := startH2cUpgradeServer(t, false, &accepts)
+	defer l.Close()
+	tr := &Transport{AllowHTTPUpgrade: true}
+	defer tr.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("request %v: %v", i, err)
+		}
+		got, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ProtoMajor != 1 || string(got) != "h1 ok" {
+			t.Errorf("request %v: got %v response %q; want HTTP/1.1 response %q", i, res.Proto, got, "h1 ok")
+		}
+	}
+	if got := atomic.LoadInt32(&accepts); got != 2 {
+		t.Errorf("server accepted %v connections; want 2", got)
+	}
+}
+
+func TestTransportH2cUpgradeConcurrent(t *testing.T) {
+	var accepts int32
+	l := startH2cUpgradeServer(t, true, &accepts)
+	defer l.Close()
+	tr := &Transport{AllowHTTPUpgrade: true}
+	defer tr.CloseIdleConnections()
+
+	const n = 5
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	// Requests made while the first upgrade is in flight wait for it.
+	if got := atomic.LoadInt32(&accepts); got != 1 {
+		t.Errorf("server accepted %v connections; want 1", got)
+	}
+}
+
 func TestTransport(t *testing.T) {
 	const body = "sup"
 	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
@@ -1648,6 +1818,63 @@ func TestTransportCookieHeaderSplit(t *testing.T) {
 	}
 }
 
+func TestTransportHeaderIndexingPolicy(t *testing.T) {
+	tc := newTestClientConn(t, func(tr *Transport) {
+		tr.HeaderIndexingPolicy = hpack.IndexingPolicyFunc(func(f hpack.HeaderField) hpack.Indexing {
+			if f.Name == "x-secret" {
+				return hpack.NeverIndexed
+			}
+			return hpack.DefaultIndexing(f)
+		})
+	})
+	tc.greet()
+
+	req, _ := http.NewRequest("GET", "https://dummy.tld/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Cookie", "short=1; long=abcdefghijklmnopqrstuvwxyz")
+	req.Header.Set("X-Secret", "value")
+	req.Header.Set("X-Public", "value")
+	rt := tc.roundTrip(req)
+
+	hf := testClientConnReadFrame[*MetaHeadersFrame](tc)
+	want := map[string]bool{
+		"authorization":                   true,
+		"short=1":                         true,
+		"long=abcdefghijklmnopqrstuvwxyz": false,
+		"x-secret":                        true,
+		"x-public":                        false,
+	}
+	for _, f := range hf.Fields {
+		key := f.Name
+		if key == "cookie" {
+			key = f.Value
+		}
+		wantSensitive, ok := want[key]
+		if !ok {
+			continue
+		}
+		delete(want, key)
+		if f.Sensitive != wantSensitive {
+			t.Errorf("field %v: never indexed = %v; want %v", f, f.Sensitive, wantSensitive)
+		}
+	}
+	for key := range want {
+		t.Errorf("request has no %q field", key)
+	}
+
+	tc.writeHeaders(HeadersFrameParam{
+		StreamID:   rt.streamID(),
+		EndHeaders: true,
+		EndStream:  true,
+		BlockFragment: tc.makeHeaderBlockFragment(
+			":status", "204",
+		),
+	})
+	if err := rt.err(); err != nil {
+		t.Fatalf("RoundTrip = %v, want success", err)
+	}
+}
+
 // Test that the Transport returns a typed error from Response.Body.Read calls
 // when the server sends an error. (here we use a panic, since that should generate
 // a stream error, but others like cancel should be similar)
@@ -2610,6 +2837,94 @@ func TestTransportReturnsUnusedFlowControlMultipleWrites(t *testing.T) {
 	testTransportReturnsUnusedFlowControl(t, false)
 }
 
+func TestTransportClientTrace(t *testing.T) {
+	var events []string
+	var mu sync.Mutex
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf(format, args...))
+	}
+	wantEvents := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(events, want) {
+			t.Fatalf("trace events:\n%v\nwant:\n%v", strings.Join(events, "\n"), strings.Join(want, "\n"))
+		}
+		events = nil
+	}
+	trace := &ClientTrace{
+		StreamCreated: func(cc *ClientConn, id uint32) { logf("StreamCreated %v", id) },
+		SettingsReceived: func(cc *ClientConn, settings []Setting) {
+			logf("SettingsReceived %v", settings)
+		},
+		SettingsAcked: func(cc *ClientConn) { logf("SettingsAcked") },
+		GoAwayReceived: func(cc *ClientConn, lastStreamID uint32, code ErrCode, debugData []byte) {
+			logf("GoAwayReceived %v %v %q", lastStreamID, code, debugData)
+		},
+		StreamReset:      func(cc *ClientConn, id uint32, code ErrCode) { logf("StreamReset %v %v", id, code) },
+		WaitWindowUpdate: func(cc *ClientConn, id uint32) { logf("WaitWindowUpdate %v", id) },
+		GotWindowUpdate:  func(cc *ClientConn, id uint32, waited time.Duration) { logf("GotWindowUpdate %v", id) },
+		PingRTT:          func(cc *ClientConn, rtt time.Duration) { logf("PingRTT") },
+	}
+	ctx := WithClientTrace(context.Background(), trace)
+
+	tc := newTestClientConn(t)
+	tc.greet(Setting{ID: SettingInitialWindowSize, Val: 10})
+
+	body := tc.newRequestBody()
+	body.writeBytes(20)
+	body.closeWithError(io.EOF)
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://dummy.tld/", body)
+	rt := tc.roundTrip(req)
+	tc.wantFrameType(FrameHeaders)
+	tc.wantData(wantData{
+		streamID:  rt.streamID(),
+		size:      10,
+		endStream: false,
+	})
+	wantEvents(
+		"StreamCreated 1",
+		"WaitWindowUpdate 1",
+	)
+
+	tc.writeWindowUpdate(rt.streamID(), 10)
+	tc.wantData(wantData{
+		streamID:  rt.streamID(),
+		size:      10,
+		endStream: true,
+	})
+	wantEvents("GotWindowUpdate 1")
+
+	tc.writeSettings(Setting{ID: SettingMaxConcurrentStreams, Val: 5})
+	tc.wantFrameType(FrameSettings) // acknowledgement
+	wantEvents("SettingsReceived [[MAX_CONCURRENT_STREAMS = 5]]")
+
+	donec := make(chan error, 1)
+	tc.cc.goRun(func() { donec <- tc.cc.Ping(ctx) })
+	tc.sync()
+	pf := testClientConnReadFrame[*PingFrame](tc)
+	tc.writePing(true, pf.Data)
+	if err := <-donec; err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	wantEvents("PingRTT")
+
+	tc.writeGoAway(rt.streamID(), ErrCodeNo, []byte("bye"))
+	wantEvents(`GoAwayReceived 1 NO_ERROR "bye"`)
+
+	tc.writeRSTStream(rt.streamID(), ErrCodeCancel)
+	if err := rt.err(); err == nil {
+		t.Fatalf("RoundTrip succeeded after RST_STREAM; want error")
+	}
+	wantEvents("StreamReset 1 CANCEL")
+
+	// Connection-level events are only reported for open streams.
+	tc.writeSettings(Setting{ID: SettingMaxConcurrentStreams, Val: 10})
+	wantEvents()
+}
+
 // Issue 16612: adjust flow control on open streams when transport
 // receives SETTINGS with INITIAL_WINDOW_SIZE from server.
 func TestTransportAdjustsFlowControl(t *testing.T) {
@@ -3074,6 +3389,60 @@ func TestTransportPingWriteBlocks(t *testing.T) {
 	}
 }
 
+func TestTransportClientTraceConnPings(t *testing.T) {
+	var mu sync.Mutex
+	pings := 0
+	trace := &ClientTrace{
+		PingRTT: func(cc *ClientConn, rtt time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			pings++
+		},
+	}
+	wantPings := func(want int) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if pings != want {
+			t.Fatalf("PingRTT called %v times; want %v", pings, want)
+		}
+	}
+	tc := newTestClientConn(t, func(tr *Transport) {
+		tr.ReadIdleTimeout = 1 * time.Second
+		tr.MaxAutotunedStreamWindow = 64 << 20
+	})
+	tc.greet()
+
+	ctx := WithClientTrace(context.Background(), trace)
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://dummy.tld/", nil)
+	rt := tc.roundTrip(req)
+	tc.wantFrameType(FrameHeaders)
+	tc.writeHeaders(HeadersFrameParam{
+		StreamID:   rt.streamID(),
+		EndHeaders: true,
+		EndStream:  false,
+		BlockFragment: tc.makeHeaderBlockFragment(
+			":status", "200",
+		),
+	})
+	rt.wantStatus(200)
+
+	// Health check.
+	tc.advance(1 * time.Second)
+	pf := testClientConnReadFrame[*PingFrame](tc)
+	tc.writePing(true, pf.Data)
+	tc.sync()
+	wantPings(1)
+
+	// Receive window autotuning.
+	tc.writeData(rt.streamID(), false, make([]byte, 1024))
+	if pf := testClientConnReadFrame[*PingFrame](tc); pf.Data != bdpPing {
+		t.Fatalf("got PING %q; want %q", pf.Data, bdpPing)
+	}
+	tc.writePing(true, bdpPing)
+	wantPings(2)
+}
+
 func TestTransportPingWhenReadingMultiplePings(t *testing.T) {
 	tc := newTestClientConn(t, func(tr *Transport) {
 		tr.ReadIdleTimeout = 1000 * time.Millisecond
@@ -5426,3 +5795,292 @@ func TestTransportDataAfter1xxHeader(t *testing.T) {
 	}
 	tc.wantFrameType(FrameRSTStream)
 }
+
+func TestTransportConnectionCoalescing(t *testing.T) {
+	testHookLookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host == "c.example.com" {
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.2")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	defer func() { testHookLookupIPAddr = nil }()
+
+	tt := newTestTransport(t, func(tr *Transport) {
+		tr.AllowConnectionCoalescing = true
+	})
+
+	// roundTrip sends a request for host, and responds to it.
+	// It returns the conn the request was sent on.
+	// If reuse is non-nil, the request is expected to be sent on it.
+	// Otherwise, a new conn is expected. The first conn has a certificate
+	// for *.example.com, later ones have a certificate for just their host.
+	certName := "*.example.com"
+	roundTrip := func(host string, reuse *testClientConn) *testClientConn {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "https://"+host+"/", nil)
+		rt := tt.roundTrip(req)
+		tc := reuse
+		var hf *MetaHeadersFrame
+		if reuse == nil {
+			tc = tt.getConn()
+			tc.remoteAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+			tc.cc.tlsState = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{
+					DNSNames: []string{certName},
+				}},
+			}
+			certName = host
+			tc.wantFrameType(FrameSettings)
+			tc.wantFrameType(FrameWindowUpdate)
+			tc.writeSettings()
+			tc.wantUnorderedFrames(
+				func(f *SettingsFrame) bool { return f.IsAck() },
+				func(f *MetaHeadersFrame) bool { hf = f; return true },
+			)
+		} else {
+			if tt.hasConn() {
+				t.Fatalf("request for %v: new conn created, want reuse", host)
+			}
+			hf = testClientConnReadFrame[*MetaHeadersFrame](tc)
+		}
+		if got := hf.PseudoValue("authority"); got != host {
+			t.Fatalf("request :authority = %q, want %q", got, host)
+		}
+		tc.writeHeaders(HeadersFrameParam{
+			StreamID:   hf.StreamID,
+			EndHeaders: true,
+			EndStream:  true,
+			BlockFragment: tc.makeHeaderBlockFragment(
+				":status", "200",
+			),
+		})
+		rt.wantStatus(200)
+		return tc
+	}
+
+	tc := roundTrip("a.example.com", nil)
+
+	// Certificate is valid for b.example.com, and it resolves to the same address.
+	roundTrip("b.example.com", tc)
+	roundTrip("a.example.com", tc)
+
+	// Certificate is valid for c.example.com, but it resolves to a different address.
+	tc2 := roundTrip("c.example.com", nil)
+
+	// d.other.tld resolves to the same address, but the certificate doesn't cover it.
+	tc3 := roundTrip("d.other.tld", nil)
+
+	// Once the server sends an ORIGIN frame, its origin set is used instead of DNS.
+	tc.fr.WriteOrigin("https://c.example.com", "https://d.other.tld", "http://e.example.com")
+	tc.sync()
+	tc2.writeGoAway(0, ErrCodeNo, nil)
+	roundTrip("c.example.com", tc)
+	roundTrip("b.example.com", tc)
+	tc3.writeGoAway(0, ErrCodeNo, nil)
+	roundTrip("d.other.tld", nil)
+
+	// e.example.com resolves to the same address, but isn't in the origin set.
+	roundTrip("e.example.com", nil)
+}
+
+func TestTransportMaxConnsPerAuthority(t *testing.T) {
+	tt := newTestTransport(t, func(tr *Transport) {
+		tr.MaxConnsPerAuthority = 2
+	})
+	newConn := func() *testClientConn {
+		t.Helper()
+		tc := tt.getConn()
+		tc.wantFrameType(FrameSettings)
+		tc.wantFrameType(FrameWindowUpdate)
+		tc.wantHeaders(wantHeader{
+			streamID:  1,
+			endStream: true,
+		})
+		tc.writeSettings(Setting{SettingMaxConcurrentStreams, 1})
+		tc.wantFrameType(FrameSettings) // ACK
+		return tc
+	}
+	respond := func(tc *testClientConn, streamID uint32) {
+		tc.writeHeaders(HeadersFrameParam{
+			StreamID:   streamID,
+			EndHeaders: true,
+			EndStream:  true,
+			BlockFragment: tc.makeHeaderBlockFragment(
+				":status", "200",
+			),
+		})
+	}
+
+	req, _ := http.NewRequest("GET", "https://dummy.tld/", nil)
+	rt1 := tt.roundTrip(req)
+	tc1 := newConn()
+
+	// The first conn is at its stream limit, so a second one is dialed.
+	rt2 := tt.roundTrip(req)
+	tc2 := newConn()
+
+	// Both conns are at their stream limit, and MaxConnsPerAuthority is reached.
+	// The request waits for a stream on one of the existing conns.
+	rt3 := tt.roundTrip(req)
+	if tt.hasConn() {
+		t.Fatalf("third request dialed a new conn; want it to wait")
+	}
+	if tc1.hasFrame() || tc2.hasFrame() {
+		t.Fatalf("third request sent before a stream was available")
+	}
+
+	respond(tc1, 1)
+	rt1.wantStatus(200)
+	tc1.wantHeaders(wantHeader{
+		streamID:  3,
+		endStream: true,
+	})
+	respond(tc1, 3)
+	rt3.wantStatus(200)
+	respond(tc2, 1)
+	rt2.wantStatus(200)
+}
+
+func TestTransportMinConnsPerAuthority(t *testing.T) {
+	tt := newTestTransport(t, func(tr *Transport) {
+		tr.MaxConnsPerAuthority = 2
+		tr.MinConnsPerAuthority = 2
+	})
+	respond := func(tc *testClientConn, streamID uint32) {
+		tc.writeHeaders(HeadersFrameParam{
+			StreamID:   streamID,
+			EndHeaders: true,
+			EndStream:  true,
+			BlockFragment: tc.makeHeaderBlockFragment(
+				":status", "200",
+			),
+		})
+	}
+
+	// The first request dials a conn, and a second one is dialed
+	// in the background to reach MinConnsPerAuthority.
+	req, _ := http.NewRequest("GET", "https://dummy.tld/", nil)
+	rt1 := tt.roundTrip(req)
+	tc1 := tt.getConn()
+	tc1.wantFrameType(FrameSettings)
+	tc1.wantFrameType(FrameWindowUpdate)
+	tc1.wantHeaders(wantHeader{
+		streamID:  1,
+		endStream: true,
+	})
+	tc1.writeSettings()
+	tc1.wantFrameType(FrameSettings) // ACK
+	tc2 := tt.getConn()
+	tc2.greet()
+	if tt.hasConn() {
+		t.Fatalf("more than MinConnsPerAuthority conns dialed")
+	}
+
+	// The second request goes to the least loaded conn.
+	rt2 := tt.roundTrip(req)
+	tc2.wantHeaders(wantHeader{
+		streamID:  1,
+		endStream: true,
+	})
+	respond(tc1, 1)
+	rt1.wantStatus(200)
+	respond(tc2, 1)
+	rt2.wantStatus(200)
+
+	// A conn which receives a GOAWAY is replaced.
+	tc1.writeGoAway(1, ErrCodeNo, nil)
+	tc3 := tt.getConn()
+	tc3.greet()
+	if tt.hasConn() {
+		t.Fatalf("more than one replacement conn dialed")
+	}
+	rt3 := tt.roundTrip(req)
+	tc2.wantHeaders(wantHeader{
+		streamID:  3,
+		endStream: true,
+	})
+	respond(tc2, 3)
+	rt3.wantStatus(200)
+}
+
+func TestTransportCloseIdleConnectionsCancelsFill(t *testing.T) {
+	dialErr := make(chan error, 1)
+	tr := &Transport{
+		MaxConnsPerAuthority: 2,
+		MinConnsPerAuthority: 2,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			<-ctx.Done()
+			dialErr <- ctx.Err()
+			return nil, ctx.Err()
+		},
+	}
+	p := tr.connPool().(*clientConnPool)
+	p.mu.Lock()
+	p.fillLocked("dummy.tld:443")
+	p.mu.Unlock()
+
+	tr.CloseIdleConnections()
+	select {
+	case err := <-dialErr:
+		if err != context.Canceled {
+			t.Errorf("background dial ended with %v; want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("background dial not canceled by CloseIdleConnections")
+	}
+}
+
+func TestTransportReceiveWindowAutotuning(t *testing.T) {
+	tc := newTestClientConn(t, func(tr *Transport) {
+		tr.MaxAutotunedStreamWindow = 64 << 20
+	})
+	tc.greet()
+
+	req, _ := http.NewRequest("GET", "https://dummy.tld/", nil)
+	rt := tc.roundTrip(req)
+	tc.wantFrameType(FrameHeaders)
+	tc.writeHeaders(HeadersFrameParam{
+		StreamID:   rt.streamID(),
+		EndHeaders: true,
+		EndStream:  false,
+		BlockFragment: tc.makeHeaderBlockFragment(
+			":status", "200",
+		),
+	})
+	rt.wantStatus(200)
+
+	// The first DATA frame starts a round trip measurement.
+	const frameSize = 16 << 10
+	const frames = 192 // 3MB, most of the initial 4MB window
+	tc.writeData(rt.streamID(), false, make([]byte, frameSize))
+	if pf := testClientConnReadFrame[*PingFrame](tc); pf.IsAck() || pf.Data != bdpPing {
+		t.Fatalf("after first DATA frame, got %v; want PING %q", summarizeFrame(pf), bdpPing)
+	}
+	for i := 1; i < frames; i++ {
+		tc.writeData(rt.streamID(), false, make([]byte, frameSize))
+	}
+	if tc.hasFrame() {
+		t.Fatalf("unexpected frame sent before PING ACK: %v", summarizeFrame(tc.readFrame()))
+	}
+
+	// The window was nearly filled during the round trip,
+	// so the Transport doubles it.
+	before := tc.inflowWindow(rt.streamID())
+	tc.writePing(true, bdpPing)
+	sf := testClientConnReadFrame[*SettingsFrame](tc)
+	const want = 2 * frames * frameSize
+	if v, ok := sf.Value(SettingInitialWindowSize); !ok || v != want {
+		t.Fatalf("SETTINGS_INITIAL_WINDOW_SIZE = %v, %v; want %v", v, ok, want)
+	}
+	if got, wantAvail := tc.inflowWindow(rt.streamID()), before+want-transportDefaultStreamFlow; got != wantAvail {
+		t.Fatalf("stream inflow window = %v; want %v", got, wantAvail)
+	}
+	tc.writeSettingsAck()
+
+	// New streams use the larger window.
+	rt2 := tc.roundTrip(req)
+	tc.wantFrameType(FrameHeaders)
+	if got := tc.inflowWindow(rt2.streamID()); got != want {
+		t.Fatalf("new stream inflow window = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Listen requests the proxy server to accept a single incoming
+// connection with the BIND command, as used by protocols such as FTP.
+// The address is that of the peer expected to connect; servers may
+// ignore it, and an empty address requests any peer.
+//
+// The returned listener's Addr method returns the address assigned by
+// the proxy server for the peer to connect to. Its Accept method
+// returns the connection once the peer has connected, and fails
+// afterwards.
+//
+// The network must be "tcp", "tcp4" or "tcp6".
+func (d *Dialer) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+	default:
+		return nil, d.requestError(CmdBind, network, errors.New("network not implemented"))
+	}
+	if ctx == nil {
+		return nil, d.requestError(CmdBind, network, errors.New("nil context"))
+	}
+	host, port, err := splitRequestAddr(address)
+	if err != nil {
+		return nil, d.requestError(CmdBind, network, err)
+	}
+	c, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, d.requestError(CmdBind, network, err)
+	}
+	a, err := d.request(ctx, c, CmdBind, host, port)
+	if err != nil {
+		c.Close()
+		return nil, d.requestError(CmdBind, network, err)
+	}
+	return &listener{c: c, network: network, addr: serverAddr(a.(*Addr), c)}, nil
+}
+
+// A listener waits for the connection of a BIND request.
+type listener struct {
+	c       net.Conn // connection to the proxy server
+	network string
+	addr    *Addr
+
+	mu        sync.Mutex
+	accepting bool // Accept was called
+	accepted  bool // c was returned by Accept
+	closed    bool
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	ln.mu.Lock()
+	if ln.closed || ln.accepting {
+		ln.mu.Unlock()
+		return nil, &net.OpError{Op: "accept", Net: ln.network, Addr: ln.addr, Err: net.ErrClosed}
+	}
+	ln.accepting = true
+	ln.mu.Unlock()
+
+	// The proxy server sends a second reply once the peer connects.
+	a, err := readReply(ln.c)
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.closed {
+		err = net.ErrClosed
+	}
+	if err != nil {
+		ln.c.Close()
+		return nil, &net.OpError{Op: "accept", Net: ln.network, Addr: ln.addr, Err: err}
+	}
+	ln.accepted = true
+	return &bindConn{Conn: ln.c, laddr: ln.addr, raddr: a}, nil
+}
+
+// Close closes the listener, unless it has already returned a
+// connection.
+func (ln *listener) Close() error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.closed {
+		return nil
+	}
+	ln.closed = true
+	if ln.accepted {
+		return nil
+	}
+	return ln.c.Close()
+}
+
+func (ln *listener) Addr() net.Addr {
+	return ln.addr
+}
+
+// A bindConn is a connection accepted through the proxy server.
+type bindConn struct {
+	net.Conn
+
+	laddr, raddr net.Addr
+}
+
+// LocalAddr returns the address the peer connected to on the proxy
+// server.
+func (c *bindConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// requestError returns err as a *net.OpError for a cmd request.
+func (d *Dialer) requestError(cmd Command, network string, err error) error {
+	proxy, _, _ := d.pathAddrs(d.proxyAddress)
+	return &net.OpError{Op: cmd.String(), Net: network, Source: proxy, Err: err}
+}
+
+// splitRequestAddr is like splitHostPort, but accepts zero ports and
+// an empty address, for requests of the BIND and UDP ASSOCIATE
+// commands which may leave them unspecified.
+func splitRequestAddr(address string) (string, int, error) {
+	if address == "" {
+		return "0.0.0.0", 0, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, err
+	}
+	if 0 > portnum || portnum > 0xffff {
+		return "", 0, errors.New("port number out of range " + port)
+	}
+	return host, portnum, nil
+}
+
+// serverAddr returns a, the address in a reply received over c, with an
+// unspecified IP address replaced by that of the proxy server, as sent
+// by servers listening on all interfaces.
+func serverAddr(a *Addr, c net.Conn) *Addr {
+	if a.IP == nil || !a.IP.IsUnspecified() {
+		return a
+	}
+	if ra, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return &Addr{IP: ra.IP, Port: a.Port}
+	}
+	return a
+}
@@ -18,11 +18,17 @@ var (
 	aLongTimeAgo = time.Unix(1, 0)
 )
 
-func (d *Dialer) connect(ctx context.Context, c net.Conn, address string) (_ net.Addr, ctxErr error) {
+func (d *Dialer) connect(ctx context.Context, c net.Conn, address string) (net.Addr, error) {
 	host, port, err := splitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
+	return d.request(ctx, c, d.cmd, host, port)
+}
+
+// request authenticates with the proxy server over c and sends it a
+// cmd request for host and port. It returns the address in the reply.
+func (d *Dialer) request(ctx context.Context, c net.Conn, cmd Command, host string, port int) (_ net.Addr, ctxErr error) {
 	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
 		c.SetDeadline(deadline)
 		defer c.SetDeadline(noDeadline)
@@ -82,32 +88,26 @@ func (d *Dialer) connect(ctx context.Context, c net.Conn, address string) (_ net
 	}
 
 	b = b[:0]
-	b = append(b, Version5, byte(d.cmd), 0)
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			b = append(b, AddrTypeIPv4)
-			b = append(b, ip4...)
-		} else if ip6 := ip.To16(); ip6 != nil {
-			b = append(b, AddrTypeIPv6)
-			b = append(b, ip6...)
-		} else {
-			return nil, errors.New("unknown address type")
-		}
-	} else {
-		if len(host) > 255 {
-			return nil, errors.New("FQDN too long")
-		}
-		b = append(b, AddrTypeFQDN)
-		b = append(b, byte(len(host)))
-		b = append(b, host...)
+	b = append(b, Version5, byte(cmd), 0)
+	if b, ctxErr = appendAddr(b, host, port); ctxErr != nil {
+		return
 	}
-	b = append(b, byte(port>>8), byte(port))
 	if _, ctxErr = c.Write(b); ctxErr != nil {
 		return
 	}
 
-	if _, ctxErr = io.ReadFull(c, b[:4]); ctxErr != nil {
-		return
+	a, err := readReply(c)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// readReply reads a command reply and returns its address.
+func readReply(r io.Reader) (*Addr, error) {
+	b := make([]byte, 4, 6+255)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
 	}
 	if b[0] != Version5 {
 		return nil, errors.New("unexpected protocol version " + strconv.Itoa(int(b[0])))
@@ -128,20 +128,16 @@ func (d *Dialer) connect(ctx context.Context, c net.Conn, address string) (_ net
 		l += net.IPv6len
 		a.IP = make(net.IP, net.IPv6len)
 	case AddrTypeFQDN:
-		if _, err := io.ReadFull(c, b[:1]); err != nil {
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
 			return nil, err
 		}
 		l += int(b[0])
 	default:
 		return nil, errors.New("unknown address type " + strconv.Itoa(int(b[3])))
 	}
-	if cap(b) < l {
-		b = make([]byte, l)
-	} else {
-		b = b[:l]
-	}
-	if _, ctxErr = io.ReadFull(c, b); ctxErr != nil {
-		return
+	b = b[:l]
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
 	}
 	if a.IP != nil {
 		copy(a.IP, b)
@@ -152,6 +148,29 @@ func (d *Dialer) connect(ctx context.Context, c net.Conn, address string) (_ net
 	return &a, nil
 }
 
+// appendAddr appends host and port in wire format to b.
+func appendAddr(b []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, AddrTypeIPv4)
+			b = append(b, ip4...)
+		} else if ip6 := ip.To16(); ip6 != nil {
+			b = append(b, AddrTypeIPv6)
+			b = append(b, ip6...)
+		} else {
+			return nil, errors.New("unknown address type")
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("FQDN too long")
+		}
+		b = append(b, AddrTypeFQDN)
+		b = append(b, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
 func splitHostPort(address string) (string, int, error) {
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
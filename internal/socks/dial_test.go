@@ -6,6 +6,7 @@ package socks_test
 
 import (
 	"context"
+	"errors"
 	"io"
 	"math/rand"
 	"net"
@@ -129,6 +130,186 @@ func TestDial(t *testing.T) {
 	})
 }
 
+func TestListen(t *testing.T) {
+	ss, err := sockstest.NewServer(sockstest.NoAuthRequired, bindCmdFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	d := socks.NewDialer(ss.Addr().Network(), ss.Addr().String())
+	ln, err := d.Listen(context.Background(), "tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if a, ok := ln.Addr().(*socks.Addr); !ok || !a.IP.IsLoopback() {
+		t.Fatalf("got %v; want loopback socks.Addr", ln.Addr())
+	}
+
+	peer, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got, want := c.RemoteAddr().String(), peer.LocalAddr().String(); got != want {
+		t.Errorf("got remote address %v; want %v", got, want)
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Error("second Accept succeeded")
+	}
+	ln.Close()
+
+	if _, err := io.WriteString(peer, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("got %q, %v; want %q", b, err, "hello")
+	}
+}
+
+func TestListenPacket(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], from)
+		}
+	}()
+	ss, err := sockstest.NewServer(sockstest.NoAuthRequired, udpAssociateCmdFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	d := socks.NewDialer(ss.Addr().Network(), ss.Addr().String())
+	c, err := d.ListenPacket(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := c.WriteTo([]byte(msg), echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 512)
+		n, from, err := c.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != msg || from.String() != echo.LocalAddr().String() {
+			t.Errorf("got %q from %v; want %q from %v", b[:n], from, msg, echo.LocalAddr())
+		}
+	}
+}
+
+// bindCmdFunc accepts a single connection for a BIND request, and
+// relays it.
+func bindCmdFunc(rw io.ReadWriter, b []byte) error {
+	req, err := sockstest.ParseCmdRequest(b)
+	if err != nil {
+		return err
+	}
+	if req.Cmd != socks.CmdBind {
+		return errors.New("unexpected command")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	// Reply with an unspecified address, as a server listening on all
+	// interfaces does.
+	a := &socks.Addr{IP: net.IPv4zero, Port: ln.Addr().(*net.TCPAddr).Port}
+	if err := writeCmdReply(rw, a); err != nil {
+		return err
+	}
+	c, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ra := c.RemoteAddr().(*net.TCPAddr)
+	if err := writeCmdReply(rw, &socks.Addr{IP: ra.IP, Port: ra.Port}); err != nil {
+		return err
+	}
+	go io.Copy(c, rw)
+	io.Copy(rw, c)
+	return nil
+}
+
+// udpAssociateCmdFunc relays datagrams for a UDP ASSOCIATE request
+// until the connection is closed.
+func udpAssociateCmdFunc(rw io.ReadWriter, b []byte) error {
+	req, err := sockstest.ParseCmdRequest(b)
+	if err != nil {
+		return err
+	}
+	if req.Cmd != socks.CmdUDPAssociate {
+		return errors.New("unexpected command")
+	}
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+	ra := relay.LocalAddr().(*net.UDPAddr)
+	if err := writeCmdReply(rw, &socks.Addr{IP: ra.IP, Port: ra.Port}); err != nil {
+		return err
+	}
+	go func() {
+		var client net.Addr
+		b := make([]byte, 512)
+		for {
+			n, from, err := relay.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if client == nil || from.String() == client.String() {
+				client = from
+				a, payload, err := sockstest.ParseUDPDatagram(b[:n])
+				if err != nil {
+					continue
+				}
+				relay.WriteTo(payload, &net.UDPAddr{IP: a.IP, Port: a.Port})
+				continue
+			}
+			src := from.(*net.UDPAddr)
+			d, err := sockstest.MarshalUDPDatagram(&socks.Addr{IP: src.IP, Port: src.Port}, b[:n])
+			if err != nil {
+				continue
+			}
+			relay.WriteTo(d, client)
+		}
+	}()
+	io.Copy(io.Discard, rw)
+	return nil
+}
+
+func writeCmdReply(w io.Writer, a *socks.Addr) error {
+	b, err := sockstest.MarshalCmdReply(socks.Version5, socks.StatusSucceeded, a)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
 func blackholeCmdFunc(rw io.ReadWriter, b []byte) error {
 	if _, err := sockstest.ParseCmdRequest(b); err != nil {
 		return err
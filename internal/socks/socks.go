@@ -24,8 +24,10 @@ func (cmd Command) String() string {
 	switch cmd {
 	case CmdConnect:
 		return "socks connect"
-	case cmdBind:
+	case CmdBind:
 		return "socks bind"
+	case CmdUDPAssociate:
+		return "socks udp associate"
 	default:
 		return "socks " + strconv.Itoa(int(cmd))
 	}
@@ -41,21 +43,21 @@ func (code Reply) String() string {
 	switch code {
 	case StatusSucceeded:
 		return "succeeded"
-	case 0x01:
+	case StatusGeneralFailure:
 		return "general SOCKS server failure"
-	case 0x02:
+	case StatusNotAllowed:
 		return "connection not allowed by ruleset"
-	case 0x03:
+	case StatusNetworkUnreachable:
 		return "network unreachable"
-	case 0x04:
+	case StatusHostUnreachable:
 		return "host unreachable"
-	case 0x05:
+	case StatusConnectionRefused:
 		return "connection refused"
-	case 0x06:
+	case StatusTTLExpired:
 		return "TTL expired"
-	case 0x07:
+	case StatusCommandNotSupported:
 		return "command not supported"
-	case 0x08:
+	case StatusAddrTypeNotSupported:
 		return "address type not supported"
 	default:
 		return "unknown code: " + strconv.Itoa(int(code))
@@ -70,14 +72,23 @@ const (
 	AddrTypeFQDN = 0x03
 	AddrTypeIPv6 = 0x04
 
-	CmdConnect Command = 0x01 // establishes an active-open forward proxy connection
-	cmdBind    Command = 0x02 // establishes a passive-open forward proxy connection
+	CmdConnect      Command = 0x01 // establishes an active-open forward proxy connection
+	CmdBind         Command = 0x02 // establishes a passive-open forward proxy connection
+	CmdUDPAssociate Command = 0x03 // establishes a UDP relay
 
 	AuthMethodNotRequired         AuthMethod = 0x00 // no authentication required
 	AuthMethodUsernamePassword    AuthMethod = 0x02 // use username/password
 	AuthMethodNoAcceptableMethods AuthMethod = 0xff // no acceptable authentication methods
 
-	StatusSucceeded Reply = 0x00
+	StatusSucceeded            Reply = 0x00
+	StatusGeneralFailure       Reply = 0x01
+	StatusNotAllowed           Reply = 0x02
+	StatusNetworkUnreachable   Reply = 0x03
+	StatusHostUnreachable      Reply = 0x04
+	StatusConnectionRefused    Reply = 0x05
+	StatusTTLExpired           Reply = 0x06
+	StatusCommandNotSupported  Reply = 0x07
+	StatusAddrTypeNotSupported Reply = 0x08
 )
 
 // An Addr represents a SOCKS-specific address.
@@ -119,7 +130,7 @@ func (c *Conn) BoundAddr() net.Addr {
 
 // A Dialer holds SOCKS-specific options.
 type Dialer struct {
-	cmd          Command // either CmdConnect or cmdBind
+	cmd          Command // either CmdConnect or CmdBind
 	proxyNetwork string  // network between a proxy server and a client
 	proxyAddress string  // proxy server address
 
@@ -157,14 +168,7 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 		proxy, dst, _ := d.pathAddrs(address)
 		return nil, &net.OpError{Op: d.cmd.String(), Net: network, Source: proxy, Addr: dst, Err: errors.New("nil context")}
 	}
-	var err error
-	var c net.Conn
-	if d.ProxyDial != nil {
-		c, err = d.ProxyDial(ctx, d.proxyNetwork, d.proxyAddress)
-	} else {
-		var dd net.Dialer
-		c, err = dd.DialContext(ctx, d.proxyNetwork, d.proxyAddress)
-	}
+	c, err := d.dialProxy(ctx)
 	if err != nil {
 		proxy, dst, _ := d.pathAddrs(address)
 		return nil, &net.OpError{Op: d.cmd.String(), Net: network, Source: proxy, Addr: dst, Err: err}
@@ -178,6 +182,15 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	return &Conn{Conn: c, boundAddr: a}, nil
 }
 
+// dialProxy establishes the transport connection to the proxy server.
+func (d *Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	if d.ProxyDial != nil {
+		return d.ProxyDial(ctx, d.proxyNetwork, d.proxyAddress)
+	}
+	var dd net.Dialer
+	return dd.DialContext(ctx, d.proxyNetwork, d.proxyAddress)
+}
+
 // DialWithConn initiates a connection from SOCKS server to the target
 // network and address using the connection c that is already
 // connected to the SOCKS server.
@@ -237,7 +250,7 @@ func (d *Dialer) validateTarget(network, address string) error {
 		return errors.New("network not implemented")
 	}
 	switch d.cmd {
-	case CmdConnect, cmdBind:
+	case CmdConnect, CmdBind:
 	default:
 		return errors.New("command not implemented")
 	}
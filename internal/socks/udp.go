@@ -0,0 +1,175 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// maxUDPHeaderLen is the maximum length of the header of a UDP request,
+// with a 255-byte FQDN.
+const maxUDPHeaderLen = 3 + 1 + 1 + 255 + 2
+
+// ListenPacket requests the proxy server to relay UDP datagrams with
+// the UDP ASSOCIATE command. It returns a packet connection that sends
+// and receives datagrams through the relay, encapsulated as described
+// in Section 7 of RFC 1928. Fragmented datagrams are not supported and
+// are dropped.
+//
+// The network must be "udp", "udp4" or "udp6". The address is the
+// local address of the packet connection, as for net.ListenPacket; if
+// its host is empty, that of the connection to the proxy server is
+// used. Datagrams are sent to the relay directly, even if ProxyDial is
+// set.
+//
+// The association ends when the packet connection is closed, or when
+// the proxy server closes the connection used for the request.
+func (d *Dialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp6", "udp4":
+	default:
+		return nil, d.requestError(CmdUDPAssociate, network, errors.New("network not implemented"))
+	}
+	if ctx == nil {
+		return nil, d.requestError(CmdUDPAssociate, network, errors.New("nil context"))
+	}
+	laddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, d.requestError(CmdUDPAssociate, network, err)
+	}
+	c, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, d.requestError(CmdUDPAssociate, network, err)
+	}
+	if laddr.IP == nil {
+		if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
+			laddr.IP = a.IP
+		}
+	}
+	pc, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		c.Close()
+		return nil, d.requestError(CmdUDPAssociate, network, err)
+	}
+	// The client's address as seen by the proxy server is not known in
+	// general, so it is left unspecified.
+	a, err := d.request(ctx, c, CmdUDPAssociate, "0.0.0.0", 0)
+	if err != nil {
+		pc.Close()
+		c.Close()
+		return nil, d.requestError(CmdUDPAssociate, network, err)
+	}
+	relay, err := net.ResolveUDPAddr(network, serverAddr(a.(*Addr), c).String())
+	if err != nil {
+		pc.Close()
+		c.Close()
+		return nil, d.requestError(CmdUDPAssociate, network, err)
+	}
+	p := &packetConn{PacketConn: pc, c: c, relay: relay}
+	go p.watch()
+	return p, nil
+}
+
+// A packetConn sends and receives datagrams through a UDP relay.
+type packetConn struct {
+	net.PacketConn
+
+	c     net.Conn // connection to the proxy server
+	relay *net.UDPAddr
+}
+
+// watch closes the packet connection once the proxy server closes c.
+func (p *packetConn) watch() {
+	io.Copy(io.Discard, p.c)
+	p.PacketConn.Close()
+}
+
+func (p *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUDPHeaderLen+len(b))
+	for {
+		n, from, err := p.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if a, ok := from.(*net.UDPAddr); !ok || !a.IP.Equal(p.relay.IP) || a.Port != p.relay.Port {
+			continue
+		}
+		a, payload, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), a, nil
+	}
+}
+
+func (p *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	host, port, err := splitHostPort(addr.String())
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: addr.Network(), Source: p.LocalAddr(), Addr: addr, Err: err}
+	}
+	buf := make([]byte, 3, maxUDPHeaderLen+len(b))
+	if buf, err = appendAddr(buf, host, port); err != nil {
+		return 0, &net.OpError{Op: "write", Net: addr.Network(), Source: p.LocalAddr(), Addr: addr, Err: err}
+	}
+	buf = append(buf, b...)
+	if _, err := p.PacketConn.WriteTo(buf, p.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the packet connection, ending the association.
+func (p *packetConn) Close() error {
+	err := p.PacketConn.Close()
+	if cerr := p.c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// parseUDPHeader parses the header of a datagram received from a UDP
+// relay. It returns the source address and payload of the datagram.
+func parseUDPHeader(b []byte) (net.Addr, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errors.New("short UDP header")
+	}
+	if b[2] != 0 {
+		return nil, nil, errors.New("fragmented datagram")
+	}
+	l := 2
+	off := 4
+	var a Addr
+	switch b[3] {
+	case AddrTypeIPv4:
+		l += net.IPv4len
+		a.IP = make(net.IP, net.IPv4len)
+	case AddrTypeIPv6:
+		l += net.IPv6len
+		a.IP = make(net.IP, net.IPv6len)
+	case AddrTypeFQDN:
+		if len(b) < 5 {
+			return nil, nil, errors.New("short UDP header")
+		}
+		l += int(b[4])
+		off = 5
+	default:
+		return nil, nil, errors.New("unknown address type " + strconv.Itoa(int(b[3])))
+	}
+	if len(b[off:]) < l {
+		return nil, nil, errors.New("short UDP header")
+	}
+	port := int(b[off+l-2])<<8 | int(b[off+l-1])
+	if a.IP != nil {
+		copy(a.IP, b[off:])
+		return &net.UDPAddr{IP: a.IP, Port: port}, b[off+l:], nil
+	}
+	a.Name = string(b[off : off+l-2])
+	a.Port = port
+	return &a, b[off+l:], nil
+}
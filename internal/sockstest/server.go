@@ -61,7 +61,9 @@ func ParseCmdRequest(b []byte) (*CmdRequest, error) {
 	if b[0] != socks.Version5 {
 		return nil, errors.New("unexpected protocol version")
 	}
-	if socks.Command(b[1]) != socks.CmdConnect {
+	switch socks.Command(b[1]) {
+	case socks.CmdConnect, socks.CmdBind, socks.CmdUDPAssociate:
+	default:
 		return nil, errors.New("unexpected command")
 	}
 	if b[2] != 0 {
@@ -120,6 +122,48 @@ func MarshalCmdReply(ver int, reply socks.Reply, a *socks.Addr) ([]byte, error)
 	return b, nil
 }
 
+// ParseUDPDatagram parses a UDP datagram in wire format, as sent to a
+// UDP relay. It returns the destination address and payload of the
+// datagram.
+func ParseUDPDatagram(b []byte) (*socks.Addr, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errors.New("short UDP datagram")
+	}
+	if b[0] != 0 || b[1] != 0 {
+		return nil, nil, errors.New("non-zero reserved field")
+	}
+	if b[2] != 0 {
+		return nil, nil, errors.New("unexpected fragment")
+	}
+	// The address is laid out as in a command request.
+	req, err := ParseCmdRequest(append([]byte{socks.Version5, byte(socks.CmdConnect), 0}, b[3:]...))
+	if err != nil {
+		return nil, nil, err
+	}
+	l := 4 + 2
+	switch b[3] {
+	case socks.AddrTypeIPv4:
+		l += net.IPv4len
+	case socks.AddrTypeIPv6:
+		l += net.IPv6len
+	case socks.AddrTypeFQDN:
+		l += 1 + int(b[4])
+	}
+	return &req.Addr, b[l:], nil
+}
+
+// MarshalUDPDatagram returns a UDP datagram in wire format, as sent by
+// a UDP relay.
+func MarshalUDPDatagram(a *socks.Addr, payload []byte) ([]byte, error) {
+	b, err := MarshalCmdReply(0, 0, a)
+	if err != nil {
+		return nil, err
+	}
+	// The header of a reply only differs in its first two bytes.
+	b[0], b[1] = 0, 0
+	return append(b, payload...), nil
+}
+
 // A Server represents a server for handshake testing.
 type Server struct {
 	ln net.Listener
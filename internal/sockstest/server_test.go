@@ -101,3 +101,47 @@ func TestParseCmdRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestParseUDPDatagram(t *testing.T) {
+	for i, tt := range []struct {
+		wire    []byte
+		addr    *socks.Addr
+		payload []byte
+	}{
+		{
+			[]byte{0x00, 0x00, 0x00, 0x01, 192, 0, 2, 1, 0x00, 0x35, 'h', 'i'},
+			&socks.Addr{
+				IP:   net.IP{192, 0, 2, 1},
+				Port: 53,
+			},
+			[]byte("hi"),
+		},
+		{
+			[]byte{0x00, 0x00, 0x00, 0x03, 0x04, 'F', 'Q', 'D', 'N', 0x00, 0x35},
+			&socks.Addr{
+				Name: "FQDN",
+				Port: 53,
+			},
+			[]byte{},
+		},
+
+		// corrupted datagrams
+		{nil, nil, nil},
+		{[]byte{0x00, 0x00, 0x01, 0x01, 192, 0, 2, 2, 0x00, 0x35}, nil, nil},
+		{[]byte{0x00, 0x01, 0x00, 0x01, 192, 0, 2, 3, 0x00, 0x35}, nil, nil},
+		{[]byte{0x00, 0x00, 0x00, 0x01, 192, 0, 2, 4}, nil, nil},
+	} {
+		a, payload, err := ParseUDPDatagram(tt.wire)
+		if !reflect.DeepEqual(a, tt.addr) || !reflect.DeepEqual(payload, tt.payload) {
+			t.Errorf("#%d: got %v, %q, %v; want %v, %q", i, a, payload, err, tt.addr, tt.payload)
+			continue
+		}
+		if a == nil {
+			continue
+		}
+		b, err := MarshalUDPDatagram(a, payload)
+		if err != nil || !reflect.DeepEqual(b, tt.wire) {
+			t.Errorf("#%d: marshal got %v, %v; want %v", i, b, err, tt.wire)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProxyHeaderTimeout is the default value of
+// ProxyListener.ReadHeaderTimeout.
+const DefaultProxyHeaderTimeout = 10 * time.Second
+
+// ErrNoProxyHeader is returned by ProxyConn methods for connections from
+// trusted upstreams that do not start with a PROXY protocol header.
+var ErrNoProxyHeader = errors.New("netutil: no PROXY protocol header")
+
+// TLV types of PROXY protocol version 2 headers.
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+)
+
+// Sub-TLV types of the ProxyTLVSSL TLV.
+const (
+	proxyTLVSSLVersion = 0x21
+	proxyTLVSSLCN      = 0x22
+	proxyTLVSSLCipher  = 0x23
+	proxyTLVSSLSigAlg  = 0x24
+	proxyTLVSSLKeyAlg  = 0x25
+)
+
+// A ProxyListener is a Listener accepting connections from proxies or
+// load balancers speaking the HAProxy PROXY protocol, version 1 or 2,
+// as specified at
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+//
+// Its Accept method returns *ProxyConn connections, which read the
+// PROXY protocol header when first used, and report the addresses it
+// carries. Reading the header does not block Accept, but it blocks the
+// first call to Read, RemoteAddr, LocalAddr or Header on the connection
+// for up to ReadHeaderTimeout. Servers must make these calls on the
+// connection's own goroutine, as net/http does, and not on the
+// goroutine calling Accept, or a client that sends nothing stalls
+// every connection after it.
+type ProxyListener struct {
+	net.Listener
+
+	// ReadHeaderTimeout is how long a connection may take to send its
+	// PROXY protocol header. If zero, DefaultProxyHeaderTimeout is
+	// used.
+	ReadHeaderTimeout time.Duration
+
+	// Trusted, if non-nil, reports whether a connection from the
+	// given upstream address is expected to start with a PROXY
+	// protocol header. Connections from other addresses are returned
+	// as is, without looking for a header. If nil, all connections
+	// must start with a header.
+	Trusted func(upstream net.Addr) bool
+}
+
+// Accept waits for and returns the next connection to the listener, as
+// a *ProxyConn.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.ReadHeaderTimeout
+	if timeout == 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	return &ProxyConn{
+		Conn:    c,
+		r:       c,
+		timeout: timeout,
+		trusted: l.Trusted == nil || l.Trusted(c.RemoteAddr()),
+	}, nil
+}
+
+// A ProxyHeader is a PROXY protocol header.
+type ProxyHeader struct {
+	// Version is the version of the header, 1 or 2.
+	Version int
+
+	// Local is set for version 2 LOCAL commands and version 1
+	// UNKNOWN headers, sent by proxies for their own connections
+	// rather than on behalf of clients. Source and Destination are nil
+	// for them.
+	Local bool
+
+	// Source and Destination are the addresses of the client
+	// connection to the proxy. They are *net.TCPAddr, *net.UDPAddr or
+	// *net.UnixAddr values, or nil if the header carries no addresses.
+	Source, Destination net.Addr
+
+	// TLVs holds the type-length-value fields of a version 2 header,
+	// in order.
+	TLVs []ProxyTLV
+}
+
+// A ProxyTLV is a type-length-value field of a PROXY protocol version 2
+// header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first TLV of h with the given type, and
+// whether one was found.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ProxySSL describes the TLS connection between a client and a proxy, as
+// reported by the ProxyTLVSSL TLV of a header.
+type ProxySSL struct {
+	SSL      bool // the client connected over SSL or TLS
+	CertConn bool // the client provided a certificate over this connection
+	CertSess bool // the client provided a certificate during the TLS session
+	Verified bool // the client certificate, if any, was verified
+
+	// The following are empty if not sent by the proxy.
+	Version    string // such as "TLSv1.3"
+	CommonName string // of the client certificate
+	Cipher     string
+	SigAlg     string // signature algorithm of the client certificate
+	KeyAlg     string // key algorithm of the client certificate
+}
+
+// SSL returns the contents of the ProxyTLVSSL TLV of h, if it has a
+// valid one.
+func (h *ProxyHeader) SSL() (*ProxySSL, bool) {
+	b, ok := h.TLV(ProxyTLVSSL)
+	if !ok || len(b) < 5 {
+		return nil, false
+	}
+	ssl := &ProxySSL{
+		SSL:      b[0]&0x01 != 0,
+		CertConn: b[0]&0x02 != 0,
+		CertSess: b[0]&0x04 != 0,
+		Verified: binary.BigEndian.Uint32(b[1:5]) == 0,
+	}
+	tlvs, err := parseProxyTLVs(b[5:])
+	if err != nil {
+		return nil, false
+	}
+	for _, tlv := range tlvs {
+		switch tlv.Type {
+		case proxyTLVSSLVersion:
+			ssl.Version = string(tlv.Value)
+		case proxyTLVSSLCN:
+			ssl.CommonName = string(tlv.Value)
+		case proxyTLVSSLCipher:
+			ssl.Cipher = string(tlv.Value)
+		case proxyTLVSSLSigAlg:
+			ssl.SigAlg = string(tlv.Value)
+		case proxyTLVSSLKeyAlg:
+			ssl.KeyAlg = string(tlv.Value)
+		}
+	}
+	return ssl, true
+}
+
+// A ProxyConn is a connection accepted by a ProxyListener.
+//
+// The PROXY protocol header of a connection from a trusted upstream is
+// read by the first call to Read, RemoteAddr, LocalAddr or Header. If it
+// is missing or invalid, Read and Header return the error, and the
+// addresses of the underlying connection are reported.
+//
+// RemoteAddr and LocalAddr block, like Read, until the header has been
+// read or ReadHeaderTimeout has passed, so that they never report the
+// proxy's addresses for a client's connection.
+type ProxyConn struct {
+	net.Conn
+
+	timeout time.Duration
+	trusted bool
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+	r      io.Reader // reads the data following the header
+
+	mu           sync.Mutex
+	readDeadline time.Time // set by the user
+}
+
+// Header returns the PROXY protocol header of c, or nil if c is not from
+// a trusted upstream.
+func (c *ProxyConn) Header() (*ProxyHeader, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+func (c *ProxyConn) readHeader() {
+	if !c.trusted {
+		return
+	}
+	c.mu.Lock()
+	if deadline := time.Now().Add(c.timeout); c.readDeadline.IsZero() || deadline.Before(c.readDeadline) {
+		c.Conn.SetReadDeadline(deadline)
+	}
+	c.mu.Unlock()
+
+	br := bufio.NewReader(c.Conn)
+	c.header, c.err = readProxyHeader(br)
+
+	c.mu.Lock()
+	c.Conn.SetReadDeadline(c.readDeadline)
+	c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		c.r = io.MultiReader(bytes.NewReader(append([]byte(nil), b...)), c.Conn)
+	}
+}
+
+// Read reads data from the connection, following the PROXY protocol
+// header.
+func (c *ProxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address of the PROXY protocol header,
+// or the remote address of the underlying connection if it has none.
+// It blocks until the header has been read.
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the PROXY protocol
+// header, or the local address of the underlying connection if it has
+// none. It blocks until the header has been read.
+func (c *ProxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// SetDeadline implements the Conn SetDeadline method.
+func (c *ProxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *ProxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// proxyV1MaxLen is the maximum length of a version 1 header, including
+// the final CRLF.
+const proxyV1MaxLen = 107
+
+func proxyHeaderError(msg string) error {
+	return errors.New("netutil: invalid PROXY protocol header: " + msg)
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header from br.
+func readProxyHeader(br *bufio.Reader) (*ProxyHeader, error) {
+	b, err := br.Peek(len(proxyV2Signature))
+	switch {
+	case bytes.Equal(b, proxyV2Signature):
+		return readProxyHeaderV2(br)
+	case bytes.HasPrefix(b, []byte("PROXY ")):
+		return readProxyHeaderV1(br)
+	case err == io.EOF && len(b) > 0:
+		return nil, io.ErrUnexpectedEOF
+	case err != nil:
+		return nil, err
+	}
+	return nil, ErrNoProxyHeader
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLen {
+			return nil, proxyHeaderError("line too long")
+		}
+	}
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return nil, proxyHeaderError("line not terminated by CRLF")
+	}
+	f := strings.Split(s[:len(s)-2], " ")
+	h := &ProxyHeader{Version: 1}
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		h.Local = true
+		return h, nil
+	}
+	if len(f) != 6 {
+		return nil, proxyHeaderError("wrong number of fields")
+	}
+	var ipv6 bool
+	switch f[1] {
+	case "TCP4":
+	case "TCP6":
+		ipv6 = true
+	default:
+		return nil, proxyHeaderError("unknown protocol " + strconv.Quote(f[1]))
+	}
+	var addrs [2]*net.TCPAddr
+	for i := range addrs {
+		ip := net.ParseIP(f[2+i])
+		if ip == nil || strings.Contains(f[2+i], ":") != ipv6 {
+			return nil, proxyHeaderError("invalid address " + strconv.Quote(f[2+i]))
+		}
+		port, err := strconv.ParseUint(f[4+i], 10, 16)
+		if err != nil || (len(f[4+i]) > 1 && f[4+i][0] == '0') {
+			return nil, proxyHeaderError("invalid port " + strconv.Quote(f[4+i]))
+		}
+		addrs[i] = &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+	h.Source, h.Destination = addrs[0], addrs[1]
+	return h, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (*ProxyHeader, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, proxyHeaderError("unsupported version " + strconv.Itoa(int(hdr[12]>>4)))
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2}
+	switch cmd := hdr[12] & 0x0f; cmd {
+	case 0x0: // LOCAL
+		h.Local = true
+	case 0x1: // PROXY
+	default:
+		return nil, proxyHeaderError("unknown command " + strconv.Itoa(int(cmd)))
+	}
+	family, transport := hdr[13]>>4, hdr[13]&0x0f
+	var addrLen int
+	switch family {
+	case 0x0: // AF_UNSPEC
+	case 0x1: // AF_INET
+		addrLen = 2*net.IPv4len + 4
+	case 0x2: // AF_INET6
+		addrLen = 2*net.IPv6len + 4
+	case 0x3: // AF_UNIX
+		addrLen = 2 * 108
+	default:
+		return nil, proxyHeaderError("unknown address family " + strconv.Itoa(int(family)))
+	}
+	if transport > 0x2 {
+		return nil, proxyHeaderError("unknown transport protocol " + strconv.Itoa(int(transport)))
+	}
+	if len(payload) < addrLen {
+		return nil, proxyHeaderError("addresses truncated")
+	}
+	if !h.Local && family != 0x0 && transport != 0x0 {
+		h.Source, h.Destination = parseProxyAddrs(family, transport, payload[:addrLen])
+	}
+
+	var err error
+	if h.TLVs, err = parseProxyTLVs(payload[addrLen:]); err != nil {
+		return nil, err
+	}
+	if sum, ok := h.TLV(ProxyTLVCRC32C); ok {
+		if len(sum) != 4 {
+			return nil, proxyHeaderError("invalid CRC32C TLV")
+		}
+		want := binary.BigEndian.Uint32(sum)
+		// The checksum is computed with its own value zeroed.
+		copy(sum, []byte{0, 0, 0, 0})
+		crc := crc32.Update(0, castagnoli, hdr)
+		crc = crc32.Update(crc, castagnoli, payload)
+		binary.BigEndian.PutUint32(sum, want)
+		if crc != want {
+			return nil, proxyHeaderError("CRC32C mismatch")
+		}
+	}
+	return h, nil
+}
+
+// parseProxyAddrs parses the source and destination addresses of a
+// version 2 header.
+func parseProxyAddrs(family, transport byte, b []byte) (src, dst net.Addr) {
+	if family == 0x3 {
+		unixNet := "unix"
+		if transport == 0x2 {
+			unixNet = "unixgram"
+		}
+		name := func(b []byte) string {
+			if i := bytes.IndexByte(b, 0); i >= 0 {
+				b = b[:i]
+			}
+			return string(b)
+		}
+		return &net.UnixAddr{Name: name(b[:108]), Net: unixNet}, &net.UnixAddr{Name: name(b[108:]), Net: unixNet}
+	}
+	ipLen := (len(b) - 4) / 2
+	srcIP := net.IP(append([]byte(nil), b[:ipLen]...))
+	dstIP := net.IP(append([]byte(nil), b[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(b[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(b[2*ipLen+2:]))
+	if transport == 0x2 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+}
+
+// parseProxyTLVs parses a sequence of TLVs. The values returned alias b.
+func parseProxyTLVs(b []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, proxyHeaderError("TLV truncated")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, proxyHeaderError("TLV truncated")
+		}
+		tlvs = append(tlvs, ProxyTLV{Type: b[0], Value: b[3 : 3+n : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
@@ -0,0 +1,408 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 returns a version 2 header with the given command, family and
+// protocol byte, address block and TLVs. If crc is set, a CRC32C TLV is
+// appended.
+func proxyV2(verCmd, fam byte, addrs []byte, tlvs []ProxyTLV, crc bool) []byte {
+	payload := append([]byte(nil), addrs...)
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+	if crc {
+		payload = append(payload, ProxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+	b := append([]byte(nil), proxyV2Signature...)
+	b = append(b, verCmd, fam, byte(len(payload)>>8), byte(len(payload)))
+	b = append(b, payload...)
+	if crc {
+		binary.BigEndian.PutUint32(b[len(b)-4:], crc32.Checksum(b, castagnoli))
+	}
+	return b
+}
+
+var (
+	proxyV2IPv4 = []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+	proxyV2IPv6 = append(append(append([]byte(nil), net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...), 0x30, 0x39, 0x01, 0xbb)
+)
+
+func proxyV2Unix() []byte {
+	b := make([]byte, 216)
+	copy(b, "/tmp/src.sock")
+	copy(b[108:], "/tmp/dst.sock")
+	return b
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tlvs := []ProxyTLV{
+		{ProxyTLVALPN, []byte("h2")},
+		{ProxyTLVAuthority, []byte("example.com")},
+		{ProxyTLVUniqueID, []byte{1, 2, 3, 4}},
+	}
+	withTLVs := proxyV2(0x21, 0x11, proxyV2IPv4, tlvs, true)
+	corrupt := proxyV2(0x21, 0x11, proxyV2IPv4, nil, true)
+	corrupt[16] ^= 0xff
+
+	for _, tt := range []struct {
+		name    string
+		in      []byte
+		want    *ProxyHeader
+		wantErr bool
+	}{{
+		name: "v1 TCP4",
+		in:   []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"),
+		want: &ProxyHeader{
+			Version:     1,
+			Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345},
+			Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+		},
+	}, {
+		name: "v1 TCP6",
+		in:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"),
+		want: &ProxyHeader{
+			Version:     1,
+			Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345},
+			Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+	}, {
+		name: "v1 UNKNOWN",
+		in:   []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"),
+		want: &ProxyHeader{Version: 1, Local: true},
+	}, {
+		name:    "v1 address family mismatch",
+		in:      []byte("PROXY TCP4 2001:db8::1 2001:db8::2 12345 443\r\n"),
+		wantErr: true,
+	}, {
+		name:    "v1 bad port",
+		in:      []byte("PROXY TCP4 192.0.2.1 198.51.100.1 012345 443\r\n"),
+		wantErr: true,
+	}, {
+		name:    "v1 missing CR",
+		in:      []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\n"),
+		wantErr: true,
+	}, {
+		name:    "v1 too long",
+		in:      []byte("PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n"),
+		wantErr: true,
+	}, {
+		name:    "v1 truncated",
+		in:      []byte("PROXY TCP4 192.0.2.1"),
+		wantErr: true,
+	}, {
+		name: "v2 TCP over IPv4 with TLVs",
+		in:   withTLVs,
+		want: &ProxyHeader{
+			Version:     2,
+			Source:      &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 12345},
+			Destination: &net.TCPAddr{IP: net.IP{198, 51, 100, 1}, Port: 443},
+			TLVs:        append(tlvs[:len(tlvs):len(tlvs)], ProxyTLV{ProxyTLVCRC32C, withTLVs[len(withTLVs)-4:]}),
+		},
+	}, {
+		name: "v2 UDP over IPv6",
+		in:   proxyV2(0x21, 0x22, proxyV2IPv6, nil, false),
+		want: &ProxyHeader{
+			Version:     2,
+			Source:      &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345},
+			Destination: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+	}, {
+		name: "v2 unix stream",
+		in:   proxyV2(0x21, 0x31, proxyV2Unix(), nil, false),
+		want: &ProxyHeader{
+			Version:     2,
+			Source:      &net.UnixAddr{Name: "/tmp/src.sock", Net: "unix"},
+			Destination: &net.UnixAddr{Name: "/tmp/dst.sock", Net: "unix"},
+		},
+	}, {
+		name: "v2 LOCAL",
+		in:   proxyV2(0x20, 0x11, proxyV2IPv4, nil, false),
+		want: &ProxyHeader{Version: 2, Local: true},
+	}, {
+		name: "v2 UNSPEC",
+		in:   proxyV2(0x21, 0x00, nil, nil, false),
+		want: &ProxyHeader{Version: 2},
+	}, {
+		name:    "v2 bad version",
+		in:      proxyV2(0x11, 0x11, proxyV2IPv4, nil, false),
+		wantErr: true,
+	}, {
+		name:    "v2 bad command",
+		in:      proxyV2(0x22, 0x11, proxyV2IPv4, nil, false),
+		wantErr: true,
+	}, {
+		name:    "v2 addresses truncated",
+		in:      proxyV2(0x21, 0x21, proxyV2IPv4, nil, false),
+		wantErr: true,
+	}, {
+		name:    "v2 TLV truncated",
+		in:      proxyV2(0x21, 0x11, append(proxyV2IPv4[:12:12], ProxyTLVNoop, 0, 5), nil, false),
+		wantErr: true,
+	}, {
+		name:    "v2 CRC32C mismatch",
+		in:      corrupt,
+		wantErr: true,
+	}, {
+		name:    "v2 truncated",
+		in:      proxyV2(0x21, 0x11, proxyV2IPv4, nil, false)[:20],
+		wantErr: true,
+	}, {
+		name:    "no header",
+		in:      []byte("GET / HTTP/1.1\r\n\r\n"),
+		wantErr: true,
+	}} {
+		// Data following the header must be left unread.
+		br := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.in), strings.NewReader("data")))
+		h, err := readProxyHeader(br)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %+v; want error", tt.name, h)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(h, tt.want) {
+			t.Errorf("%s: got %+v; want %+v", tt.name, h, tt.want)
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != "data" {
+			t.Errorf("%s: data after header = %q; want %q", tt.name, rest, "data")
+		}
+	}
+}
+
+func TestProxyHeaderSSL(t *testing.T) {
+	b := []byte{0x05, 0, 0, 0, 1}
+	for _, tlv := range []ProxyTLV{
+		{proxyTLVSSLVersion, []byte("TLSv1.3")},
+		{proxyTLVSSLCN, []byte("client")},
+		{proxyTLVSSLCipher, []byte("TLS_AES_128_GCM_SHA256")},
+		{proxyTLVSSLSigAlg, []byte("SHA256")},
+		{proxyTLVSSLKeyAlg, []byte("RSA2048")},
+	} {
+		b = append(b, tlv.Type, 0, byte(len(tlv.Value)))
+		b = append(b, tlv.Value...)
+	}
+	h := &ProxyHeader{TLVs: []ProxyTLV{{ProxyTLVAuthority, []byte("example.com")}, {ProxyTLVSSL, b}}}
+	ssl, ok := h.SSL()
+	want := &ProxySSL{
+		SSL:        true,
+		CertSess:   true,
+		Version:    "TLSv1.3",
+		CommonName: "client",
+		Cipher:     "TLS_AES_128_GCM_SHA256",
+		SigAlg:     "SHA256",
+		KeyAlg:     "RSA2048",
+	}
+	if !ok || !reflect.DeepEqual(ssl, want) {
+		t.Errorf("got %+v, %v; want %+v", ssl, ok, want)
+	}
+	if v, ok := h.TLV(ProxyTLVAuthority); !ok || string(v) != "example.com" {
+		t.Errorf("authority TLV = %q, %v; want %q", v, ok, "example.com")
+	}
+	if _, ok := h.TLV(ProxyTLVALPN); ok {
+		t.Error("found missing ALPN TLV")
+	}
+	if _, ok := (&ProxyHeader{}).SSL(); ok {
+		t.Error("found missing SSL TLV")
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &ProxyListener{
+		Listener:          ln,
+		ReadHeaderTimeout: 100 * time.Millisecond,
+	}
+	defer l.Close()
+
+	send := func(data string) net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(c, data); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := send("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\nhello")
+	defer c.Close()
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sc.RemoteAddr().String(), "192.0.2.1:12345"; got != want {
+		t.Errorf("RemoteAddr = %v; want %v", got, want)
+	}
+	if got, want := sc.LocalAddr().String(), "198.51.100.1:443"; got != want {
+		t.Errorf("LocalAddr = %v; want %v", got, want)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(sc, b); err != nil || string(b) != "hello" {
+		t.Errorf("got %q, %v; want %q", b, err, "hello")
+	}
+	// The header timeout no longer applies.
+	time.Sleep(150 * time.Millisecond)
+	io.WriteString(c, "world")
+	if _, err := io.ReadFull(sc, b); err != nil || string(b) != "world" {
+		t.Errorf("got %q, %v; want %q", b, err, "world")
+	}
+	sc.Close()
+
+	// A connection without header.
+	c = send("GET / HTTP/1.1\r\n\r\n")
+	defer c.Close()
+	sc, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.Read(b); err != ErrNoProxyHeader {
+		t.Errorf("Read without header: got %v; want %v", err, ErrNoProxyHeader)
+	}
+	if got, want := sc.RemoteAddr().String(), c.LocalAddr().String(); got != want {
+		t.Errorf("RemoteAddr = %v; want %v", got, want)
+	}
+	sc.Close()
+
+	// A connection sending its header too slowly.
+	c = send("PROXY ")
+	defer c.Close()
+	sc, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sc.(*ProxyConn).Header()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Header from slow connection: got %v; want timeout", err)
+	}
+	sc.Close()
+}
+
+// A client that sends nothing blocks RemoteAddr on its own connection
+// only, not Accept or other connections.
+func TestProxyListenerSilentConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &ProxyListener{
+		Listener:          ln,
+		ReadHeaderTimeout: time.Minute,
+	}
+	defer l.Close()
+
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	sc1, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc1.Close()
+	addrc := make(chan string, 1)
+	go func() { addrc <- sc1.RemoteAddr().String() }()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n")
+	donec := make(chan string, 1)
+	go func() {
+		sc2, err := l.Accept()
+		if err != nil {
+			donec <- err.Error()
+			return
+		}
+		defer sc2.Close()
+		donec <- sc2.RemoteAddr().String()
+	}()
+	select {
+	case got := <-donec:
+		if want := "192.0.2.1:12345"; got != want {
+			t.Errorf("RemoteAddr of the second connection = %v; want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept or RemoteAddr stalled by a silent connection")
+	}
+
+	select {
+	case got := <-addrc:
+		t.Fatalf("RemoteAddr of the silent connection returned %v before its header", got)
+	default:
+	}
+	// Once the silent client leaves, RemoteAddr reports the address
+	// of the underlying connection.
+	silent.Close()
+	select {
+	case got := <-addrc:
+		if want := silent.LocalAddr().String(); got != want {
+			t.Errorf("RemoteAddr of the silent connection = %v; want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RemoteAddr still blocked after the client closed the connection")
+	}
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &ProxyListener{
+		Listener: ln,
+		Trusted:  func(net.Addr) bool { return false },
+	}
+	defer l.Close()
+
+	const data = "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, data)
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	if h, err := sc.(*ProxyConn).Header(); h != nil || err != nil {
+		t.Errorf("Header of untrusted connection = %+v, %v; want nil, nil", h, err)
+	}
+	if got, want := sc.RemoteAddr().String(), c.LocalAddr().String(); got != want {
+		t.Errorf("RemoteAddr = %v; want %v", got, want)
+	}
+	b := make([]byte, len(data))
+	if _, err := io.ReadFull(sc, b); err != nil || string(b) != data {
+		t.Errorf("got %q, %v; want %q", b, err, data)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Policy chooses the upstream Dialer used by a Balancer for a
+// connection.
+type Policy int
+
+const (
+	// RoundRobin uses the healthy upstreams in turn.
+	RoundRobin Policy = iota
+
+	// LeastConn uses the healthy upstream with the fewest open
+	// connections made by the Balancer.
+	LeastConn
+)
+
+const (
+	// DefaultMaxFails is the default value of Balancer.MaxFails.
+	DefaultMaxFails = 3
+
+	// DefaultFailTimeout is the default value of Balancer.FailTimeout.
+	DefaultFailTimeout = 30 * time.Second
+)
+
+// A Balancer spreads connections over a number of upstream Dialers,
+// such as redundant proxies, avoiding unhealthy ones.
+//
+// An upstream becomes unhealthy after MaxFails consecutive failed
+// dials, not counting those canceled by their context, and stays so for
+// FailTimeout. If CheckHealth is used, an upstream also becomes
+// unhealthy when a check fails, until a check succeeds.
+//
+// When a dial through an upstream fails, the next one is tried. If no
+// upstream is healthy, connections use Fallback if it is set, and
+// otherwise all upstreams are tried.
+//
+// The fields of a Balancer should not be modified once it is in use.
+type Balancer struct {
+	// Policy selects among healthy upstreams.
+	Policy Policy
+
+	// Fallback, if non-nil, is used when no upstream is healthy or
+	// all of them failed, for instance Direct.
+	Fallback Dialer
+
+	// MaxFails is the number of consecutive failed dials making an
+	// upstream unhealthy. If zero, DefaultMaxFails is used.
+	MaxFails int
+
+	// FailTimeout is how long an upstream stays unhealthy after
+	// failed dials. If zero, DefaultFailTimeout is used.
+	FailTimeout time.Duration
+
+	upstreams []*upstream
+
+	mu   sync.Mutex
+	next int // first upstream tried by RoundRobin
+}
+
+// An upstream is a Dialer used by a Balancer, and its state.
+type upstream struct {
+	d Dialer
+
+	// Guarded by Balancer.mu.
+	active      int       // open connections
+	fails       int       // consecutive failed dials
+	downUntil   time.Time // set after MaxFails failed dials
+	checkFailed bool      // the last health check failed
+}
+
+// NewBalancer returns a Balancer over the given upstream Dialers.
+func NewBalancer(upstreams ...Dialer) *Balancer {
+	b := &Balancer{}
+	for _, d := range upstreams {
+		b.upstreams = append(b.upstreams, &upstream{d: d})
+	}
+	return b
+}
+
+// An UpstreamStatus describes the state of an upstream Dialer of a
+// Balancer.
+type UpstreamStatus struct {
+	Dialer   Dialer
+	Healthy  bool
+	Active   int // open connections
+	Failures int // consecutive failed dials
+}
+
+// Status returns the state of the upstreams of b, in the order they
+// were given to NewBalancer.
+func (b *Balancer) Status() []UpstreamStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	st := make([]UpstreamStatus, len(b.upstreams))
+	for i, u := range b.upstreams {
+		st[i] = UpstreamStatus{Dialer: u.d, Healthy: u.healthy(now), Active: u.active, Failures: u.fails}
+	}
+	return st
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	return !u.checkFailed && !now.Before(u.downUntil)
+}
+
+// CheckHealth calls check for every upstream of b, and then again every
+// interval until ctx is done, updating their health with the results.
+// Each check is given at most interval to complete. CheckHealth returns
+// after the first round of checks, or an error if interval is not
+// positive.
+func (b *Balancer) CheckHealth(ctx context.Context, interval time.Duration, check func(ctx context.Context, d Dialer) error) error {
+	if interval <= 0 {
+		return errors.New("proxy: non-positive interval for CheckHealth")
+	}
+	b.checkAll(ctx, interval, check)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			b.checkAll(ctx, interval, check)
+		}
+	}()
+	return nil
+}
+
+func (b *Balancer) checkAll(ctx context.Context, timeout time.Duration, check func(ctx context.Context, d Dialer) error) {
+	var wg sync.WaitGroup
+	for _, u := range b.upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, timeout)
+			err := check(cctx, u.d)
+			cancel()
+			if ctx.Err() != nil {
+				// Stopped checking.
+				return
+			}
+			b.mu.Lock()
+			u.checkFailed = err != nil
+			if err == nil {
+				u.fails = 0
+				u.downUntil = time.Time{}
+			}
+			b.mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+}
+
+// DialCheck returns a health check for CheckHealth which succeeds if a
+// connection to address on network can be made through the upstream.
+func DialCheck(network, address string) func(ctx context.Context, d Dialer) error {
+	return func(ctx context.Context, d Dialer) error {
+		c, err := dialWith(ctx, d, network, address)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+}
+
+func dialWith(ctx context.Context, d Dialer, network, address string) (net.Conn, error) {
+	if x, ok := d.(ContextDialer); ok {
+		return x.DialContext(ctx, network, address)
+	}
+	return dialContext(ctx, d, network, address)
+}
+
+// Dial connects to the address on the named network through an
+// upstream Dialer.
+func (b *Balancer) Dial(network, address string) (net.Conn, error) {
+	return b.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network through an
+// upstream Dialer using the provided context.
+func (b *Balancer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var err error
+	for _, u := range b.candidates() {
+		var c net.Conn
+		c, err = dialWith(ctx, u.d, network, address)
+		if err == nil {
+			b.mu.Lock()
+			u.fails = 0
+			u.active++
+			b.mu.Unlock()
+			bc := &balancerConn{Conn: c, b: b, u: u}
+			if _, ok := c.(closeWriter); ok {
+				return halfClosableConn{bc}, nil
+			}
+			return bc, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		b.failed(u)
+	}
+	if b.Fallback != nil {
+		return dialWith(ctx, b.Fallback, network, address)
+	}
+	if err == nil {
+		err = errors.New("proxy: no upstream dialers")
+	}
+	return nil, err
+}
+
+// candidates returns the upstreams to try for a connection, in order.
+func (b *Balancer) candidates() []*upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	n := len(b.upstreams)
+	start := b.next
+	b.next++
+	if b.next >= n {
+		b.next = 0
+	}
+	var healthy, all []*upstream
+	for i := 0; i < n; i++ {
+		u := b.upstreams[(start+i)%n]
+		all = append(all, u)
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		if b.Fallback != nil {
+			return nil
+		}
+		return all
+	}
+	if b.Policy == LeastConn {
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].active < healthy[j].active
+		})
+	}
+	return healthy
+}
+
+// failed records a failed dial through u.
+func (b *Balancer) failed(u *upstream) {
+	maxFails := b.MaxFails
+	if maxFails <= 0 {
+		maxFails = DefaultMaxFails
+	}
+	timeout := b.FailTimeout
+	if timeout <= 0 {
+		timeout = DefaultFailTimeout
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u.fails++
+	if u.fails >= maxFails {
+		u.downUntil = time.Now().Add(timeout)
+	}
+}
+
+// A balancerConn is a connection made through an upstream, counted
+// until it is closed.
+type balancerConn struct {
+	net.Conn
+	b    *Balancer
+	u    *upstream
+	once sync.Once
+}
+
+func (c *balancerConn) Close() error {
+	c.once.Do(func() {
+		c.b.mu.Lock()
+		c.u.active--
+		c.b.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// closeWriter is implemented by connections which can be half-closed,
+// such as *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// A halfClosableConn is a balancerConn whose connection can be
+// half-closed, for relays which forward the end of each direction.
+type halfClosableConn struct {
+	*balancerConn
+}
+
+func (c halfClosableConn) CloseWrite() error {
+	return c.Conn.(closeWriter).CloseWrite()
+}
@@ -0,0 +1,253 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeUpstream makes in-memory connections, or fails when down.
+type fakeUpstream struct {
+	name string
+
+	mu    sync.Mutex
+	down  bool
+	dials int
+}
+
+func (u *fakeUpstream) Dial(network, addr string) (net.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.dials++
+	if u.down {
+		return nil, errors.New(u.name + " is down")
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (u *fakeUpstream) setDown(down bool) {
+	u.mu.Lock()
+	u.down = down
+	u.mu.Unlock()
+}
+
+// checkFake is a health check reporting whether a fakeUpstream is down,
+// without dialing through it.
+func checkFake(ctx context.Context, d Dialer) error {
+	u := d.(*fakeUpstream)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.down {
+		return errors.New(u.name + " is down")
+	}
+	return nil
+}
+
+func (u *fakeUpstream) takeDials() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n := u.dials
+	u.dials = 0
+	return n
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	a, b := &fakeUpstream{name: "a"}, &fakeUpstream{name: "b"}
+	bal := NewBalancer(a, b)
+	for i := 0; i < 4; i++ {
+		c, err := bal.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if na, nb := a.takeDials(), b.takeDials(); na != 2 || nb != 2 {
+		t.Errorf("got %d and %d dials; want 2 and 2", na, nb)
+	}
+
+	// Failed dials are retried on the next upstream, until the
+	// failing one is considered unhealthy.
+	b.setDown(true)
+	for i := 0; i < 10; i++ {
+		c, err := bal.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if na, nb := a.takeDials(), b.takeDials(); na != 10 || nb != DefaultMaxFails {
+		t.Errorf("got %d and %d dials; want 10 and %d", na, nb, DefaultMaxFails)
+	}
+	if st := bal.Status(); !st[0].Healthy || st[1].Healthy || st[1].Failures != DefaultMaxFails {
+		t.Errorf("got status %+v", st)
+	}
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	a, b := &fakeUpstream{name: "a"}, &fakeUpstream{name: "b"}
+	bal := NewBalancer(a, b)
+	bal.Policy = LeastConn
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		c, err := bal.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	// Close the connections made through b.
+	conns[1].Close()
+	conns[3].Close()
+	conns[3].Close()
+	a.takeDials()
+	b.takeDials()
+	for i := 0; i < 2; i++ {
+		if _, err := bal.Dial("tcp", "example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if na, nb := a.takeDials(), b.takeDials(); na != 0 || nb != 2 {
+		t.Errorf("got %d and %d dials; want 0 and 2", na, nb)
+	}
+	if st := bal.Status(); st[0].Active != 2 || st[1].Active != 2 {
+		t.Errorf("got status %+v; want 2 active connections each", st)
+	}
+}
+
+func TestBalancerFallback(t *testing.T) {
+	a, fallback := &fakeUpstream{name: "a", down: true}, &fakeUpstream{name: "fallback"}
+	bal := NewBalancer(a)
+	bal.MaxFails = 1
+	bal.FailTimeout = time.Hour
+	if _, err := bal.Dial("tcp", "example.com:80"); err == nil {
+		t.Fatal("Dial through a down upstream succeeded")
+	}
+	// Without a fallback, unhealthy upstreams are still tried.
+	if _, err := bal.Dial("tcp", "example.com:80"); err == nil {
+		t.Fatal("Dial through a down upstream succeeded")
+	}
+	if n := a.takeDials(); n != 2 {
+		t.Errorf("got %d dials; want 2", n)
+	}
+
+	bal = NewBalancer(a)
+	bal.Fallback = fallback
+	bal.MaxFails = 1
+	bal.FailTimeout = time.Hour
+	for i := 0; i < 2; i++ {
+		if _, err := bal.Dial("tcp", "example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if na, nf := a.takeDials(), fallback.takeDials(); na != 1 || nf != 2 {
+		t.Errorf("got %d and %d dials; want 1 and 2", na, nf)
+	}
+}
+
+func TestBalancerCheckHealth(t *testing.T) {
+	a, b := &fakeUpstream{name: "a"}, &fakeUpstream{name: "b", down: true}
+	bal := NewBalancer(a, b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := bal.CheckHealth(ctx, 0, checkFake); err == nil {
+		t.Error("CheckHealth with a zero interval succeeded")
+	}
+	if err := bal.CheckHealth(ctx, 10*time.Millisecond, checkFake); err != nil {
+		t.Fatal(err)
+	}
+	if st := bal.Status(); !st[0].Healthy || st[1].Healthy {
+		t.Fatalf("got status %+v; want only a healthy", st)
+	}
+
+	b.setDown(false)
+	for i := 0; !bal.Status()[1].Healthy; i++ {
+		if i == 500 {
+			t.Fatal("upstream not healthy after passing checks")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.setDown(true)
+	for i := 0; bal.Status()[0].Healthy; i++ {
+		if i == 500 {
+			t.Fatal("upstream healthy after failing checks")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.takeDials()
+	b.takeDials()
+	if _, err := bal.Dial("tcp", "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+	if na, nb := a.takeDials(), b.takeDials(); na != 0 || nb != 1 {
+		t.Errorf("got %d and %d dials; want 0 and 1", na, nb)
+	}
+}
+
+func TestDialCheck(t *testing.T) {
+	u := &fakeUpstream{name: "u"}
+	check := DialCheck("tcp", "example.com:80")
+	if err := check(context.Background(), u); err != nil {
+		t.Errorf("check of healthy upstream: %v", err)
+	}
+	u.setDown(true)
+	if err := check(context.Background(), u); err == nil {
+		t.Error("check of down upstream succeeded")
+	}
+}
+
+// A halfCloseUpstream makes connections which record CloseWrite.
+type halfCloseUpstream struct {
+	conn *halfCloseConn
+}
+
+type halfCloseConn struct {
+	net.Conn
+	closedWrite bool
+}
+
+func (c *halfCloseConn) CloseWrite() error {
+	c.closedWrite = true
+	return nil
+}
+
+func (u *halfCloseUpstream) Dial(network, addr string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	c2.Close()
+	u.conn = &halfCloseConn{Conn: c1}
+	return u.conn, nil
+}
+
+func TestBalancerCloseWrite(t *testing.T) {
+	u := &halfCloseUpstream{}
+	c, err := NewBalancer(u).Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cw, ok := c.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatalf("%T does not forward CloseWrite", c)
+	}
+	if err := cw.CloseWrite(); err != nil || !u.conn.closedWrite {
+		t.Errorf("CloseWrite = %v, forwarded %v; want nil, true", err, u.conn.closedWrite)
+	}
+
+	// Connections which cannot be half-closed do not pretend to be.
+	c, err = NewBalancer(&fakeUpstream{name: "a"}).Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(interface{ CloseWrite() error }); ok {
+		t.Errorf("%T has CloseWrite; want none for a connection without it", c)
+	}
+}
@@ -14,6 +14,25 @@ type ContextDialer interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+// A PacketListener listens for datagrams relayed through a proxy, such
+// as with the UDP ASSOCIATE command of SOCKS5. Dialers returned by
+// SOCKS5 implement it.
+type PacketListener interface {
+	// ListenPacket returns a packet connection whose datagrams are
+	// relayed through the proxy, listening on the given local address.
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// A Listener accepts a connection made to a proxy on the client's
+// behalf, such as with the BIND command of SOCKS5. Dialers returned by
+// SOCKS5 implement it.
+type Listener interface {
+	// Listen requests the proxy to accept a single connection from the
+	// peer with the given address. The returned listener's Addr method
+	// returns the proxy address the peer must connect to.
+	Listen(ctx context.Context, network, address string) (net.Listener, error)
+}
+
 // Dial works like DialContext on net.Dialer but using a dialer returned by FromEnvironment.
 //
 // The passed ctx is only used for returning the Conn, not the lifetime of the Conn.
@@ -33,22 +52,25 @@ func Dial(ctx context.Context, network, address string) (net.Conn, error) {
 // WARNING: this can leak a goroutine for as long as the underlying Dialer implementation takes to timeout
 // A Conn returned from a successful Dial after the context has been cancelled will be immediately closed.
 func dialContext(ctx context.Context, d Dialer, network, address string) (net.Conn, error) {
-	var (
+	type result struct {
 		conn net.Conn
-		done = make(chan struct{}, 1)
 		err  error
-	)
+	}
+	done := make(chan result)
 	go func() {
-		conn, err = d.Dial(network, address)
-		close(done)
-		if conn != nil && ctx.Err() != nil {
-			conn.Close()
+		conn, err := d.Dial(network, address)
+		select {
+		case done <- result{conn, err}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
 		}
 	}()
 	select {
 	case <-ctx.Done():
-		err = ctx.Err()
-	case <-done:
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.conn, r.err
 	}
-	return conn, err
 }
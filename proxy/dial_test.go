@@ -7,6 +7,7 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -117,3 +118,43 @@ func TestDial(t *testing.T) {
 		}
 	})
 }
+
+// A slowDialer returns a connection after delay, and closes closed when
+// that connection is closed.
+type slowDialer struct {
+	delay  time.Duration
+	closed chan struct{}
+}
+
+func (d *slowDialer) Dial(network, addr string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return &notifyCloseConn{Conn: c1, closed: d.closed}, nil
+}
+
+type notifyCloseConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *notifyCloseConn) Close() error {
+	close(c.closed)
+	return c.Conn.Close()
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	d := &slowDialer{delay: 50 * time.Millisecond, closed: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c, err := dialContext(ctx, d, "tcp", "example.com:80")
+	if c != nil || err != context.DeadlineExceeded {
+		t.Errorf("got %v, %v; want nil, %v", c, err, context.DeadlineExceeded)
+	}
+	// A connection made after the context is done is closed.
+	select {
+	case <-d.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("connection made after the context is done not closed")
+	}
+}
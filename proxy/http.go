@@ -0,0 +1,226 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// An HTTPDialer connects through an HTTP proxy, tunneling connections
+// with the CONNECT method.
+// See RFC 9110, Section 9.3.6.
+type HTTPDialer struct {
+	// Address is the host:port address of the proxy.
+	Address string
+
+	// TLSConfig, if non-nil, is used to connect to the proxy over TLS,
+	// as for proxy URLs with the https scheme. If its ServerName is
+	// empty, the host of Address is used.
+	TLSConfig *tls.Config
+
+	// Auth, if non-nil, holds the credentials sent to the proxy with
+	// Basic authentication.
+	Auth *Auth
+
+	// Header holds additional headers sent with each CONNECT request,
+	// such as User-Agent.
+	Header http.Header
+
+	// Forward is used to connect to the proxy. If nil, Direct is used.
+	Forward Dialer
+}
+
+// A ConnectError is returned, wrapped in a *net.OpError, when an HTTP
+// proxy rejects a CONNECT request.
+type ConnectError struct {
+	StatusCode int    // e.g. 407
+	Status     string // e.g. "407 Proxy Authentication Required"
+
+	// Header holds the headers of the proxy's response, such as
+	// Proxy-Authenticate.
+	Header http.Header
+}
+
+func (e *ConnectError) Error() string {
+	return "proxy: CONNECT failed: " + e.Status
+}
+
+// fromHTTPURL returns an HTTPDialer for a proxy URL with the http or https
+// scheme.
+func fromHTTPURL(u *url.URL, auth *Auth, forward Dialer) *HTTPDialer {
+	d := &HTTPDialer{Auth: auth, Forward: forward}
+	port := u.Port()
+	if u.Scheme == "https" {
+		d.TLSConfig = &tls.Config{}
+		if port == "" {
+			port = "443"
+		}
+	} else if port == "" {
+		port = "80"
+	}
+	d.Address = net.JoinHostPort(u.Hostname(), port)
+	return d
+}
+
+// Dial connects to addr through the proxy.
+func (d *HTTPDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate
+// cancellation of network operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// DialContext connects to addr through the proxy using the provided
+// context. The network must be "tcp", "tcp4" or "tcp6".
+//
+// The returned error value may be a *net.OpError whose Err field is a
+// *ConnectError if the proxy rejected the request.
+func (d *HTTPDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "proxyconnect", Net: network, Err: errors.New("network not implemented")}
+	}
+	c, err := d.dialProxy(ctx, network)
+	if err != nil {
+		return nil, &net.OpError{Op: "proxyconnect", Net: network, Err: err}
+	}
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		c.SetDeadline(deadline)
+	}
+	stop := func() {}
+	if ctx.Done() != nil {
+		// Abort the CONNECT request if ctx is done before it completes.
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				c.SetDeadline(aLongTimeAgo)
+			case <-done:
+			}
+		}()
+		stop = func() {
+			close(done)
+			<-stopped
+		}
+	}
+	conn, err := d.connect(c, addr)
+	stop()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.Close()
+		err = contextError(ctx, err)
+		return nil, &net.OpError{Op: "proxyconnect", Net: network, Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+	}
+	c.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// dialProxy connects to the proxy.
+func (d *HTTPDialer) dialProxy(ctx context.Context, network string) (net.Conn, error) {
+	forward := d.Forward
+	if forward == nil {
+		forward = Direct
+	}
+	var c net.Conn
+	var err error
+	if f, ok := forward.(ContextDialer); ok {
+		c, err = f.DialContext(ctx, network, d.Address)
+	} else {
+		c, err = dialContext(ctx, forward, network, d.Address)
+	}
+	if err != nil || d.TLSConfig == nil {
+		return c, err
+	}
+	config := d.TLSConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(d.Address)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(c, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// connect sends a CONNECT request for addr over c and reads the reply.
+func (d *HTTPDialer) connect(c net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	for k, v := range d.Header {
+		req.Header[k] = v
+	}
+	if d.Auth != nil {
+		auth := base64.StdEncoding.EncodeToString([]byte(d.Auth.User + ":" + d.Auth.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &ConnectError{StatusCode: resp.StatusCode, Status: resp.Status, Header: resp.Header}
+	}
+	if br.Buffered() > 0 {
+		// The destination spoke first, and its data was read along
+		// with the response.
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+// A bufferedConn is a net.Conn whose reads start with data already read
+// from it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// contextError returns the error of ctx if it is done, or if err is a
+// timeout caused by the deadline of ctx, which a connection may reach
+// before ctx does. Otherwise it returns err.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ChillAndImprove/net/nettest"
+)
+
+// connectProxy is an HTTP proxy that handles CONNECT requests.
+type connectProxy struct {
+	auth   string // required Proxy-Authorization, if any
+	header http.Header
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.auth != "" && r.Header.Get("Proxy-Authorization") != p.auth {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	p.header = r.Header
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, buf)
+	io.Copy(conn, target)
+}
+
+// newGreetingServer returns a listener whose connections receive greeting,
+// followed by an echo of what they send.
+func newGreetingServer(t *testing.T, greeting string) net.Listener {
+	l, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.WriteString(c, greeting)
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func testGreeting(t *testing.T, d Dialer, addr, greeting string) {
+	t.Helper()
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, len(greeting)+len("hello"))
+	if _, err := io.ReadFull(c, b[:len(greeting)]); err != nil {
+		t.Fatalf("reading greeting: %v", err)
+	}
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadFull(c, b[len(greeting):]); err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+	if got, want := string(b), greeting+"hello"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestHTTPDialer(t *testing.T) {
+	target := newGreetingServer(t, "220 ready\r\n")
+	defer target.Close()
+	p := &connectProxy{auth: "Basic dXNlcjpwYXNz"} // user:pass
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	d := &HTTPDialer{
+		Address: ps.Listener.Addr().String(),
+		Auth:    &Auth{User: "user", Password: "pass"},
+		Header:  http.Header{"User-Agent": {"proxy-test"}},
+	}
+	testGreeting(t, d, target.Addr().String(), "220 ready\r\n")
+	if got := p.header.Get("User-Agent"); got != "proxy-test" {
+		t.Errorf("User-Agent = %q; want %q", got, "proxy-test")
+	}
+
+	u, _ := url.Parse("http://user:pass@" + ps.Listener.Addr().String())
+	fd, err := FromURL(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGreeting(t, fd, target.Addr().String(), "220 ready\r\n")
+}
+
+func TestHTTPDialerTLS(t *testing.T) {
+	target := newGreetingServer(t, "hi")
+	defer target.Close()
+	ps := httptest.NewTLSServer(&connectProxy{})
+	defer ps.Close()
+
+	u, _ := url.Parse("https://" + ps.Listener.Addr().String())
+	d, err := FromURL(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hd := d.(*HTTPDialer)
+	if hd.TLSConfig == nil {
+		t.Fatal("TLSConfig not set for https proxy")
+	}
+	hd.TLSConfig.RootCAs = ps.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	testGreeting(t, d, target.Addr().String(), "hi")
+}
+
+func TestHTTPDialerErrors(t *testing.T) {
+	ps := httptest.NewServer(&connectProxy{auth: "Basic dXNlcjpwYXNz"})
+	defer ps.Close()
+	d := &HTTPDialer{Address: ps.Listener.Addr().String()}
+
+	_, err := d.Dial("tcp", "127.0.0.1:1")
+	var ce *ConnectError
+	if !errors.As(err, &ce) {
+		t.Fatalf("got %v; want *ConnectError", err)
+	}
+	if ce.StatusCode != http.StatusProxyAuthRequired || ce.Header.Get("Proxy-Authenticate") == "" {
+		t.Errorf("got %+v; want status %d with Proxy-Authenticate", ce, http.StatusProxyAuthRequired)
+	}
+	if _, ok := err.(*net.OpError); !ok {
+		t.Errorf("got %T; want *net.OpError", err)
+	}
+
+	if _, err := d.Dial("udp", "127.0.0.1:1"); err == nil {
+		t.Error("Dial with udp network succeeded")
+	}
+
+	// A proxy that never replies.
+	l, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}()
+	d = &HTTPDialer{Address: l.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "127.0.0.1:1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v; want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -11,7 +11,8 @@ import (
 )
 
 // A PerHost directs connections to a default Dialer unless the host name
-// requested matches one of a number of exceptions.
+// requested matches one of a number of exceptions. See Router for
+// routing between more than two Dialers.
 type PerHost struct {
 	def, bypass Dialer
 
@@ -7,11 +7,14 @@
 package proxy // import "github.com/ChillAndImprove/net/proxy"
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/url"
 	"os"
 	"sync"
+
+	"github.com/ChillAndImprove/net/http/httpproxy"
 )
 
 // A Dialer is a means to establish a connection.
@@ -62,6 +65,64 @@ func FromEnvironmentUsing(forward Dialer) Dialer {
 	return perHost
 }
 
+// FromConfig returns a dialer that connects through the proxy given by
+// cfg.AllProxy, except for destinations matched by cfg.NoProxy and
+// loopback destinations, which are dialed with forward. If forward is
+// nil, Direct is used. Changing the contents of cfg will not affect
+// dialers created earlier.
+//
+// If cfg.AllProxy is empty, FromConfig returns forward.
+func FromConfig(cfg *httpproxy.Config, forward Dialer) (Dialer, error) {
+	if forward == nil {
+		forward = Direct
+	}
+	if cfg.AllProxy == "" {
+		return forward, nil
+	}
+	proxyURL, err := url.Parse(cfg.AllProxy)
+	if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+		// Like httpproxy, assume the http scheme for a bare
+		// "host[:port]".
+		if u, err1 := url.Parse("http://" + cfg.AllProxy); err1 == nil {
+			proxyURL, err = u, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := FromURL(proxyURL, forward)
+	if err != nil {
+		return nil, err
+	}
+	return &configDialer{useProxy: cfg.UseProxyFunc(), proxy: proxy, forward: forward}, nil
+}
+
+// A configDialer chooses between a proxy and a direct dialer depending
+// on the NO_PROXY rules of an httpproxy.Config.
+type configDialer struct {
+	useProxy func(addr string) bool
+	proxy    Dialer
+	forward  Dialer
+}
+
+func (d *configDialer) dialerFor(addr string) Dialer {
+	if d.useProxy(addr) {
+		return d.proxy
+	}
+	return d.forward
+}
+
+// Dial connects to addr on the named network.
+func (d *configDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.dialerFor(addr).Dial(network, addr)
+}
+
+// DialContext connects to addr on the named network using the provided
+// context.
+func (d *configDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialWith(ctx, d.dialerFor(addr), network, addr)
+}
+
 // proxySchemes is a map from URL schemes to a function that creates a Dialer
 // from a URL with such a scheme.
 var proxySchemes map[string]func(*url.URL, Dialer) (Dialer, error)
@@ -77,7 +138,10 @@ func RegisterDialerType(scheme string, f func(*url.URL, Dialer) (Dialer, error))
 }
 
 // FromURL returns a Dialer given a URL specification and an underlying
-// Dialer for it to make network requests.
+// Dialer for it to make network requests. The socks5, socks5h, socks4,
+// socks4a, http and https schemes are built in. A dialer type registered
+// for http or https with RegisterDialerType takes precedence over the
+// built-in one.
 func FromURL(u *url.URL, forward Dialer) (Dialer, error) {
 	var auth *Auth
 	if u.User != nil {
@@ -96,6 +160,20 @@ func FromURL(u *url.URL, forward Dialer) (Dialer, error) {
 			port = "1080"
 		}
 		return SOCKS5("tcp", net.JoinHostPort(addr, port), auth, forward)
+	case "socks4", "socks4a":
+		port := u.Port()
+		if port == "" {
+			port = "1080"
+		}
+		if u.Scheme == "socks4a" {
+			return SOCKS4A("tcp", net.JoinHostPort(u.Hostname(), port), auth, forward)
+		}
+		return SOCKS4("tcp", net.JoinHostPort(u.Hostname(), port), auth, forward)
+	case "http", "https":
+		if f, ok := proxySchemes[u.Scheme]; ok {
+			return f(u, forward)
+		}
+		return fromHTTPURL(u, auth, forward), nil
 	}
 
 	// If the scheme doesn't match any of the built-in schemes, see if it
@@ -0,0 +1,476 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRejected is returned by a Router for connections routed to the
+// "reject" dialer.
+var ErrRejected = errors.New("proxy: connection rejected by rule")
+
+// A Rule matches connections by destination and network. A connection
+// matches a rule if it matches one of the values of each non-empty
+// field, except that Hosts and CIDRs are alternatives: if both are set,
+// the destination must match one of the values of either. A rule with
+// no fields set matches all connections.
+type Rule struct {
+	// Hosts holds host patterns. A pattern starting with "." matches
+	// the domain and all of its subdomains; other patterns are
+	// matched against the whole host with path.Match, so that
+	// "*.example.com" only matches subdomains. Patterns are matched
+	// against IP addresses in their literal form too.
+	Hosts []string
+
+	// CIDRs holds IP ranges. They only match if a literal IP address
+	// is dialed.
+	CIDRs []*net.IPNet
+
+	// Ports holds port ranges.
+	Ports []PortRange
+
+	// Networks holds network names. The network "tcp" also matches
+	// "tcp4" and "tcp6", and likewise for "udp" and "ip".
+	Networks []string
+
+	// Dialer is the name of the dialer used for matching connections.
+	Dialer string
+}
+
+// A PortRange is an inclusive range of ports.
+type PortRange struct {
+	Low, High int
+}
+
+// A Router directs connections to one of a number of named Dialers,
+// according to the first of an ordered list of rules matching each
+// connection. Connections not matching any rule use the default dialer.
+//
+// Two dialers are always defined: "direct", which makes connections
+// using the forward Dialer of the Router, and "reject", which fails
+// with ErrRejected.
+//
+// Rules and dialers may be loaded from a textual configuration, with
+// one directive per line:
+//
+//	# Comments start with #.
+//	dialer corp socks5://10.0.0.1:1080
+//	dialer web http://proxy.example.com:3128
+//	route corp host=.corp.example.com,intranet port=22,8000-8080
+//	route reject cidr=10.0.0.0/8 net=udp
+//	default web
+//
+// A dialer directive defines a named dialer from a proxy URL, as
+// accepted by FromURL. A route directive appends a rule using the named
+// dialer, with host, cidr, port and net taking comma-separated values
+// for the Hosts, CIDRs, Ports and Networks of the rule. A default
+// directive sets the default dialer, which is "direct" unless set.
+//
+// A Router is safe for concurrent use, and its configuration may be
+// replaced while it is in use.
+type Router struct {
+	forward Dialer
+
+	mu      sync.RWMutex
+	dialers map[string]Dialer // added with AddDialer
+	cfg     *routerConfig
+}
+
+// A routerConfig is a set of rules and the dialers they use. It is
+// not modified once in use by a Router.
+type routerConfig struct {
+	dialers map[string]Dialer // defined by the configuration
+	rules   []Rule
+	def     string
+}
+
+// NewRouter returns a Router that sends all connections to the
+// "direct" dialer until rules are added. The forward Dialer is used for
+// direct connections and to reach the proxies defined by a
+// configuration. If forward is nil, Direct is used.
+func NewRouter(forward Dialer) *Router {
+	if forward == nil {
+		forward = Direct
+	}
+	return &Router{
+		forward: forward,
+		dialers: map[string]Dialer{},
+		cfg:     &routerConfig{def: "direct"},
+	}
+}
+
+// AddDialer defines the dialer with the given name, replacing any
+// previous definition. Dialers added with AddDialer take precedence
+// over those defined by a configuration, and are kept when a new one is
+// loaded.
+func (r *Router) AddDialer(name string, d Dialer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dialers[name] = d
+}
+
+// AddRule appends rule to the rules of the Router. It fails if the
+// dialer of rule is not defined.
+func (r *Router) AddRule(rule Rule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lookup(r.cfg, rule.Dialer) == nil {
+		return errors.New("proxy: unknown dialer " + strconv.Quote(rule.Dialer))
+	}
+	cfg := *r.cfg
+	cfg.rules = append(cfg.rules[:len(cfg.rules):len(cfg.rules)], rule)
+	r.cfg = &cfg
+	return nil
+}
+
+// SetDefault sets the dialer used by connections matching no rule.
+func (r *Router) SetDefault(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lookup(r.cfg, name) == nil {
+		return errors.New("proxy: unknown dialer " + strconv.Quote(name))
+	}
+	cfg := *r.cfg
+	cfg.def = name
+	r.cfg = &cfg
+	return nil
+}
+
+// Load reads a configuration from rd, and replaces the rules, default
+// dialer and configured dialers of the Router with it, including rules
+// added with AddRule. If the configuration is invalid, the Router is
+// left unchanged.
+func (r *Router) Load(rd io.Reader) error {
+	cfg, err := r.parse(rd)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name := r.undefined(cfg); name != "" {
+		return errors.New("proxy: unknown dialer " + strconv.Quote(name))
+	}
+	r.cfg = cfg
+	return nil
+}
+
+// LoadFile is like Load, but reads the configuration from the named
+// file.
+func (r *Router) LoadFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := r.Load(f); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// WatchFile loads the configuration from the named file, and then
+// reloads it whenever the file changes, checking every interval until
+// ctx is done. Errors while reloading are reported to onError, if
+// non-nil, and leave the previous configuration in place. The interval
+// must be positive.
+func (r *Router) WatchFile(ctx context.Context, name string, interval time.Duration, onError func(error)) error {
+	if interval <= 0 {
+		return errors.New("proxy: non-positive interval for WatchFile")
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if err := r.LoadFile(name); err != nil {
+		return err
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			nfi, err := os.Stat(name)
+			if err == nil {
+				if nfi.ModTime().Equal(fi.ModTime()) && nfi.Size() == fi.Size() {
+					continue
+				}
+				fi = nfi
+				err = r.LoadFile(name)
+			}
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Dial connects to the address addr on the given network through the
+// dialer of the first rule matching the connection.
+func (r *Router) Dial(network, addr string) (net.Conn, error) {
+	d, err := r.dialerFor(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial(network, addr)
+}
+
+// DialContext connects to the address addr on the given network through
+// the dialer of the first rule matching the connection.
+func (r *Router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d, err := r.dialerFor(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if x, ok := d.(ContextDialer); ok {
+		return x.DialContext(ctx, network, addr)
+	}
+	return dialContext(ctx, d, network, addr)
+}
+
+func (r *Router) dialerFor(network, addr string) (Dialer, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portnum, _ := strconv.Atoi(port)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name := r.cfg.def
+	for i := range r.cfg.rules {
+		if rule := &r.cfg.rules[i]; rule.match(network, host, ip, portnum) {
+			name = rule.Dialer
+			break
+		}
+	}
+	d := r.lookup(r.cfg, name)
+	if d == nil {
+		return nil, errors.New("proxy: unknown dialer " + strconv.Quote(name))
+	}
+	return d, nil
+}
+
+// lookup returns the dialer with the given name, or nil.
+// r.mu must be held.
+func (r *Router) lookup(cfg *routerConfig, name string) Dialer {
+	if d, ok := r.dialers[name]; ok {
+		return d
+	}
+	if d, ok := cfg.dialers[name]; ok {
+		return d
+	}
+	switch name {
+	case "direct":
+		return r.forward
+	case "reject":
+		return rejectDialer{}
+	}
+	return nil
+}
+
+// undefined returns the name of a dialer used by cfg but not defined,
+// or "" if there is none. r.mu must be held.
+func (r *Router) undefined(cfg *routerConfig) string {
+	if r.lookup(cfg, cfg.def) == nil {
+		return cfg.def
+	}
+	for _, rule := range cfg.rules {
+		if r.lookup(cfg, rule.Dialer) == nil {
+			return rule.Dialer
+		}
+	}
+	return ""
+}
+
+// parse parses a configuration.
+func (r *Router) parse(rd io.Reader) (*routerConfig, error) {
+	cfg := &routerConfig{dialers: map[string]Dialer{}, def: "direct"}
+	s := bufio.NewScanner(rd)
+	for line := 1; s.Scan(); line++ {
+		text, _, _ := strings.Cut(s.Text(), "#")
+		f := strings.Fields(text)
+		if len(f) == 0 {
+			continue
+		}
+		if err := r.parseDirective(cfg, f); err != nil {
+			return nil, fmt.Errorf("proxy: line %d: %v", line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (r *Router) parseDirective(cfg *routerConfig, f []string) error {
+	switch f[0] {
+	case "dialer":
+		if len(f) != 3 {
+			return errors.New("usage: dialer NAME URL")
+		}
+		if f[1] == "direct" || f[1] == "reject" {
+			return errors.New("cannot redefine dialer " + f[1])
+		}
+		if _, ok := cfg.dialers[f[1]]; ok {
+			return errors.New("dialer " + f[1] + " already defined")
+		}
+		u, err := url.Parse(f[2])
+		if err != nil {
+			return err
+		}
+		d, err := FromURL(u, r.forward)
+		if err != nil {
+			return err
+		}
+		cfg.dialers[f[1]] = d
+	case "route":
+		if len(f) < 2 {
+			return errors.New("usage: route NAME [MATCH...]")
+		}
+		rule, err := parseRule(f[1], f[2:])
+		if err != nil {
+			return err
+		}
+		cfg.rules = append(cfg.rules, rule)
+	case "default":
+		if len(f) != 2 {
+			return errors.New("usage: default NAME")
+		}
+		cfg.def = f[1]
+	default:
+		return errors.New("unknown directive " + strconv.Quote(f[0]))
+	}
+	return nil
+}
+
+// parseRule parses the key=values matches of a rule.
+func parseRule(dialer string, matches []string) (Rule, error) {
+	rule := Rule{Dialer: dialer}
+	for _, m := range matches {
+		key, values, ok := strings.Cut(m, "=")
+		if !ok || values == "" {
+			return Rule{}, errors.New("invalid match " + strconv.Quote(m))
+		}
+		for _, v := range strings.Split(values, ",") {
+			switch key {
+			case "host":
+				if _, err := path.Match(v, ""); err != nil {
+					return Rule{}, errors.New("invalid host pattern " + strconv.Quote(v))
+				}
+				rule.Hosts = append(rule.Hosts, v)
+			case "cidr":
+				_, n, err := net.ParseCIDR(v)
+				if err != nil {
+					return Rule{}, err
+				}
+				rule.CIDRs = append(rule.CIDRs, n)
+			case "port":
+				pr, err := parsePortRange(v)
+				if err != nil {
+					return Rule{}, err
+				}
+				rule.Ports = append(rule.Ports, pr)
+			case "net":
+				rule.Networks = append(rule.Networks, v)
+			default:
+				return Rule{}, errors.New("unknown match " + strconv.Quote(key))
+			}
+		}
+	}
+	return rule, nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	low, err1 := strconv.Atoi(lo)
+	high, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || low < 0 || high > 0xffff || low > high {
+		return PortRange{}, errors.New("invalid port range " + strconv.Quote(s))
+	}
+	return PortRange{low, high}, nil
+}
+
+// match reports whether a connection to host:port on network matches
+// rule. The host is in lower case, and ip is non-nil if host is an IP
+// address.
+func (rule *Rule) match(network, host string, ip net.IP, port int) bool {
+	if len(rule.Networks) > 0 && !rule.matchNetwork(network) {
+		return false
+	}
+	if len(rule.Ports) > 0 && !rule.matchPort(port) {
+		return false
+	}
+	if len(rule.Hosts) == 0 && len(rule.CIDRs) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Hosts {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, ".") {
+			if strings.HasSuffix(host, pattern) || host == pattern[1:] {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	if ip != nil {
+		for _, n := range rule.CIDRs {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchNetwork(network string) bool {
+	for _, n := range rule.Networks {
+		if n == network || n == strings.TrimRight(network, "46") {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchPort(port int) bool {
+	for _, pr := range rule.Ports {
+		if pr.Low <= port && port <= pr.High {
+			return true
+		}
+	}
+	return false
+}
+
+// A rejectDialer fails all connections.
+type rejectDialer struct{}
+
+func (rejectDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, ErrRejected
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const routerConfigText = `
+# Split tunnel.
+dialer corp socks5://corp.proxy.tld
+route a host=.corp.example.com,intranet port=22,8000-8080
+route corp host=.corp.example.com
+route reject cidr=10.0.0.0/8 net=udp
+route b host=*.example.com net=tcp
+route b cidr=2001:db8::/32
+default a
+`
+
+func TestRouter(t *testing.T) {
+	var forward, a, b recordingProxy
+	r := NewRouter(&forward)
+	r.AddDialer("a", &a)
+	r.AddDialer("b", &b)
+	if err := r.Load(strings.NewReader(routerConfigText)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		network, addr string
+		want          *recordingProxy
+		wantAddr      string
+	}{
+		{"tcp", "git.corp.example.com:22", &a, "git.corp.example.com:22"},
+		{"tcp", "INTRANET.:8080", &a, "INTRANET.:8080"},
+		{"tcp", "corp.example.com:443", &forward, "corp.proxy.tld:1080"},
+		{"tcp", "intranet:443", &a, "intranet:443"},
+		{"tcp4", "www.example.com:443", &b, "www.example.com:443"},
+		{"udp", "www.example.com:443", &a, "www.example.com:443"},
+		{"tcp", "example.com:443", &a, "example.com:443"},
+		{"udp", "10.1.2.3:53", nil, ""},
+		{"tcp", "10.1.2.3:53", &a, "10.1.2.3:53"},
+		{"tcp", "[2001:db8::1]:443", &b, "[2001:db8::1]:443"},
+	} {
+		forward.addrs, a.addrs, b.addrs = nil, nil, nil
+		_, err := r.DialContext(context.Background(), tt.network, tt.addr)
+		if tt.want == nil {
+			if err != ErrRejected {
+				t.Errorf("Dial(%q, %q) = %v; want %v", tt.network, tt.addr, err, ErrRejected)
+			}
+			continue
+		}
+		if want := []string{tt.wantAddr}; !reflect.DeepEqual(tt.want.addrs, want) {
+			t.Errorf("Dial(%q, %q): dialer got %v; want %v", tt.network, tt.addr, tt.want.addrs, want)
+		}
+	}
+
+	// Rules added programmatically follow the loaded ones.
+	if err := r.AddRule(Rule{Hosts: []string{"example.com"}, Dialer: "direct"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddRule(Rule{Dialer: "nonexistent"}); err == nil {
+		t.Error("AddRule with an undefined dialer succeeded")
+	}
+	forward.addrs = nil
+	r.Dial("tcp", "example.com:443")
+	if want := []string{"example.com:443"}; !reflect.DeepEqual(forward.addrs, want) {
+		t.Errorf("direct dialer got %v; want %v", forward.addrs, want)
+	}
+}
+
+func TestRouterHostsAndCIDRs(t *testing.T) {
+	var forward, a recordingProxy
+	r := NewRouter(&forward)
+	r.AddDialer("a", &a)
+	_, n, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A destination matching either Hosts or CIDRs matches the rule,
+	// while Ports still has to match too.
+	rule := Rule{
+		Hosts:  []string{".corp.example.com"},
+		CIDRs:  []*net.IPNet{n},
+		Ports:  []PortRange{{443, 443}},
+		Dialer: "a",
+	}
+	if err := r.AddRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		addr string
+		want *recordingProxy
+	}{
+		{"git.corp.example.com:443", &a},
+		{"10.1.2.3:443", &a},
+		{"10.1.2.3:80", &forward},
+		{"example.com:443", &forward},
+		{"192.168.1.1:443", &forward},
+	} {
+		forward.addrs, a.addrs = nil, nil
+		r.Dial("tcp", tt.addr)
+		if want := []string{tt.addr}; !reflect.DeepEqual(tt.want.addrs, want) {
+			t.Errorf("Dial(%q): dialer got %v; want %v", tt.addr, tt.want.addrs, want)
+		}
+	}
+}
+
+func TestRouterLoadErrors(t *testing.T) {
+	for _, config := range []string{
+		"dialer",
+		"dialer direct socks5://proxy.tld",
+		"dialer p gopher://proxy.tld",
+		"dialer p socks5://proxy.tld\ndialer p socks5://proxy.tld",
+		"route",
+		"route nonexistent",
+		"route direct host",
+		"route direct host=[",
+		"route direct cidr=10.0.0.0",
+		"route direct port=80-",
+		"route direct port=90-80",
+		"route direct port=65536",
+		"route direct proto=tcp",
+		"default nonexistent",
+		"allow all",
+	} {
+		var forward recordingProxy
+		r := NewRouter(&forward)
+		r.AddRule(Rule{Dialer: "reject"})
+		if err := r.Load(strings.NewReader(config)); err == nil {
+			t.Errorf("Load(%q) succeeded", config)
+		}
+		if _, err := r.Dial("tcp", "example.com:80"); err != ErrRejected || len(forward.addrs) != 0 {
+			t.Errorf("after Load(%q): got %v; want previous rules in place", config, err)
+		}
+	}
+}
+
+func TestRouterWatchFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "routes")
+	if err := os.WriteFile(name, []byte("default reject\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	var forward recordingProxy
+	r := NewRouter(&forward)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := r.WatchFile(ctx, name, 0, nil); err == nil {
+		t.Error("WatchFile with a zero interval succeeded")
+	}
+	errc := make(chan error, 10)
+	if err := r.WatchFile(ctx, name, 10*time.Millisecond, func(err error) { errc <- err }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Dial("tcp", "example.com:80"); err != ErrRejected {
+		t.Fatalf("got %v; want %v", err, ErrRejected)
+	}
+
+	// An invalid configuration is reported, and the previous one kept.
+	if err := os.WriteFile(name, []byte("default nonexistent\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if !strings.Contains(err.Error(), "nonexistent") {
+			t.Errorf("got error %v; want unknown dialer error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalid configuration not reported")
+	}
+	if _, err := r.Dial("tcp", "example.com:80"); err != ErrRejected {
+		t.Fatalf("got %v; want %v", err, ErrRejected)
+	}
+
+	if err := os.WriteFile(name, []byte("# Everything direct.\ndefault direct\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if _, err := r.Dial("tcp", "example.com:80"); err != ErrRejected {
+			break
+		}
+		if i == 500 {
+			t.Fatal("configuration not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
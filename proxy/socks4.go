@@ -0,0 +1,208 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS4 returns a Dialer that makes SOCKSv4 connections to the given
+// address. Target host names are resolved locally, and only IPv4
+// targets can be reached. If auth is non-nil, its User is sent as the
+// user ID; SOCKSv4 has no passwords.
+func SOCKS4(network, address string, auth *Auth, forward Dialer) (Dialer, error) {
+	return newSOCKS4(network, address, auth, forward, false), nil
+}
+
+// SOCKS4A returns a Dialer that makes SOCKSv4a connections to the given
+// address. Unlike SOCKS4, it lets the proxy server resolve target host
+// names.
+func SOCKS4A(network, address string, auth *Auth, forward Dialer) (Dialer, error) {
+	return newSOCKS4(network, address, auth, forward, true), nil
+}
+
+func newSOCKS4(network, address string, auth *Auth, forward Dialer, remoteResolve bool) *socks4Dialer {
+	d := &socks4Dialer{
+		proxyNetwork:  network,
+		proxyAddress:  address,
+		forward:       forward,
+		remoteResolve: remoteResolve,
+	}
+	if auth != nil {
+		d.userID = auth.User
+	}
+	return d
+}
+
+// Wire protocol constants.
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+
+	socks4Granted = 0x5a
+)
+
+// A socks4Dialer dials through a SOCKSv4 or SOCKSv4a proxy server.
+type socks4Dialer struct {
+	proxyNetwork  string
+	proxyAddress  string
+	userID        string
+	forward       Dialer
+	remoteResolve bool // SOCKSv4a
+}
+
+func (d *socks4Dialer) op() string {
+	if d.remoteResolve {
+		return "socks4a connect"
+	}
+	return "socks4 connect"
+}
+
+// Dial connects to the provided address on the provided network.
+func (d *socks4Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the provided address on the provided network
+// using the provided context. The network must be "tcp" or "tcp4".
+func (d *socks4Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, d.error(network, address, errors.New("network not implemented"))
+	}
+	var c net.Conn
+	var err error
+	switch f := d.forward.(type) {
+	case nil:
+		var dd net.Dialer
+		c, err = dd.DialContext(ctx, d.proxyNetwork, d.proxyAddress)
+	case ContextDialer:
+		c, err = f.DialContext(ctx, d.proxyNetwork, d.proxyAddress)
+	default:
+		c, err = dialContext(ctx, f, d.proxyNetwork, d.proxyAddress)
+	}
+	if err != nil {
+		return nil, d.error(network, address, err)
+	}
+	if err := d.connect(ctx, c, address); err != nil {
+		c.Close()
+		err = contextError(ctx, err)
+		return nil, d.error(network, address, err)
+	}
+	return c, nil
+}
+
+func (d *socks4Dialer) error(network, address string, err error) error {
+	return &net.OpError{Op: d.op(), Net: network, Source: socks4Addr(d.proxyAddress), Addr: socks4Addr(address), Err: err}
+}
+
+// socks4Addr is an address in host:port form.
+type socks4Addr string
+
+func (a socks4Addr) Network() string { return "socks" }
+func (a socks4Addr) String() string  { return string(a) }
+
+// connect sends a CONNECT request for address over c and reads the reply.
+func (d *socks4Dialer) connect(ctx context.Context, c net.Conn, address string) (ctxErr error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	if 1 > portnum || portnum > 0xffff {
+		return errors.New("port number out of range " + port)
+	}
+	if len(d.userID) > 255 {
+		return errors.New("user ID too long")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil && !d.remoteResolve {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return err
+		}
+		ip = ips[0]
+	}
+	if ip != nil && ip.To4() == nil {
+		return errors.New("IPv6 address not supported: " + host)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	if ctx.Done() != nil {
+		errCh := make(chan error, 1)
+		done := make(chan struct{})
+		defer func() {
+			close(done)
+			if ctxErr == nil {
+				ctxErr = <-errCh
+			}
+		}()
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.SetDeadline(aLongTimeAgo)
+				errCh <- ctx.Err()
+			case <-done:
+				errCh <- nil
+			}
+		}()
+	}
+
+	b := make([]byte, 0, 8+len(d.userID)+1+len(host)+1)
+	b = append(b, socks4Version, socks4CmdConnect, byte(portnum>>8), byte(portnum))
+	if ip != nil {
+		b = append(b, ip.To4()...)
+	} else {
+		// An invalid IP address of 0.0.0.x, with x non-zero, asks the
+		// server to resolve the host name following the user ID.
+		b = append(b, 0, 0, 0, 1)
+	}
+	b = append(b, d.userID...)
+	b = append(b, 0)
+	if ip == nil {
+		b = append(b, host...)
+		b = append(b, 0)
+	}
+	if _, ctxErr = c.Write(b); ctxErr != nil {
+		return
+	}
+
+	b = b[:8]
+	if _, ctxErr = io.ReadFull(c, b); ctxErr != nil {
+		return
+	}
+	if b[0] != 0 {
+		return errors.New("unexpected reply version " + strconv.Itoa(int(b[0])))
+	}
+	if b[1] != socks4Granted {
+		return errors.New(socks4ReplyString(b[1]))
+	}
+	return nil
+}
+
+func socks4ReplyString(code byte) string {
+	switch code {
+	case 0x5b:
+		return "request rejected or failed"
+	case 0x5c:
+		return "request rejected: server cannot connect to identd on the client"
+	case 0x5d:
+		return "request rejected: client and identd report different user IDs"
+	default:
+		return "unknown reply code " + strconv.Itoa(int(code))
+	}
+}
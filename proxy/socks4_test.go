@@ -0,0 +1,164 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChillAndImprove/net/nettest"
+)
+
+// A socks4Request is a CONNECT request received by a socks4Server.
+type socks4Request struct {
+	addr   string // host:port, with host a name for SOCKSv4a requests
+	userID string
+}
+
+// socks4Server is a SOCKSv4 and SOCKSv4a server which replies with
+// reply, and echoes the data sent over granted connections.
+type socks4Server struct {
+	ln    net.Listener
+	reply byte
+	reqs  chan socks4Request
+}
+
+func newSOCKS4Server(t *testing.T, reply byte) *socks4Server {
+	ln, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks4Server{ln: ln, reply: reply, reqs: make(chan socks4Request, 10)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socks4Server) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(br, b); err != nil || b[0] != 4 || b[1] != 1 {
+		return
+	}
+	userID, err := br.ReadString(0)
+	if err != nil {
+		return
+	}
+	host := net.IP(b[4:8]).String()
+	if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+		if host, err = br.ReadString(0); err != nil {
+			return
+		}
+		host = strings.TrimSuffix(host, "\x00")
+	}
+	port := int(b[2])<<8 | int(b[3])
+	s.reqs <- socks4Request{
+		addr:   net.JoinHostPort(host, strconv.Itoa(port)),
+		userID: strings.TrimSuffix(userID, "\x00"),
+	}
+	if _, err := c.Write([]byte{0, s.reply, 0, 0, 0, 0, 0, 0}); err != nil || s.reply != socks4Granted {
+		return
+	}
+	io.Copy(c, br)
+}
+
+func TestSOCKS4(t *testing.T) {
+	s := newSOCKS4Server(t, socks4Granted)
+	defer s.ln.Close()
+
+	for _, tt := range []struct {
+		url     string
+		addr    string
+		wantReq socks4Request
+	}{
+		{"socks4://" + s.ln.Addr().String(), "192.0.2.1:80", socks4Request{"192.0.2.1:80", ""}},
+		{"socks4://user:password@" + s.ln.Addr().String(), "127.0.0.1:5963", socks4Request{"127.0.0.1:5963", "user"}},
+		{"socks4a://user@" + s.ln.Addr().String(), "fqdn.doesnotexist:443", socks4Request{"fqdn.doesnotexist:443", "user"}},
+		{"socks4a://" + s.ln.Addr().String(), "192.0.2.1:80", socks4Request{"192.0.2.1:80", ""}},
+	} {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := FromURL(u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.Dial("tcp", tt.addr)
+		if err != nil {
+			t.Errorf("%s: Dial(%q): %v", tt.url, tt.addr, err)
+			continue
+		}
+		if req := <-s.reqs; req != tt.wantReq {
+			t.Errorf("%s: Dial(%q) sent %+v; want %+v", tt.url, tt.addr, req, tt.wantReq)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		b := []byte("hello")
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Errorf("%s: got %q, %v; want %q", tt.url, b, err, "hello")
+		}
+		c.Close()
+	}
+}
+
+func TestSOCKS4Errors(t *testing.T) {
+	s := newSOCKS4Server(t, 0x5b)
+	defer s.ln.Close()
+
+	d, _ := SOCKS4("tcp", s.ln.Addr().String(), nil, nil)
+	_, err := d.Dial("tcp", "192.0.2.1:80")
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("got %v; want rejected request error", err)
+	}
+	if _, ok := err.(*net.OpError); !ok {
+		t.Errorf("got %T; want *net.OpError", err)
+	}
+	if _, err := d.Dial("tcp", "[2001:db8::1]:80"); err == nil {
+		t.Error("Dial to IPv6 address succeeded")
+	}
+	if _, err := d.Dial("udp", "192.0.2.1:53"); err == nil {
+		t.Error("Dial with udp network succeeded")
+	}
+
+	// A server that never replies.
+	ln, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}()
+	d, _ = SOCKS4A("tcp", ln.Addr().String(), nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.(ContextDialer).DialContext(ctx, "tcp", "192.0.2.1:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v; want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -12,7 +12,9 @@ import (
 )
 
 // SOCKS5 returns a Dialer that makes SOCKSv5 connections to the given
-// address with an optional username and password.
+// address with an optional username and password. The returned Dialer
+// also implements PacketListener and Listener, for the UDP ASSOCIATE
+// and BIND commands.
 // See RFC 1928 and RFC 1929.
 func SOCKS5(network, address string, auth *Auth, forward Dialer) (Dialer, error) {
 	d := socks.NewDialer(network, address)
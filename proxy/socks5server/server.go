@@ -0,0 +1,656 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package socks5server implements a SOCKS version 5 server.
+//
+// SOCKS protocol version 5 is defined in RFC 1928.
+// Username/Password authentication for SOCKS version 5 is defined in
+// RFC 1929.
+package socks5server // import "github.com/ChillAndImprove/net/proxy/socks5server"
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ChillAndImprove/net/internal/socks"
+	"github.com/ChillAndImprove/net/proxy"
+)
+
+// DefaultHandshakeTimeout is the default value of Server.HandshakeTimeout.
+const DefaultHandshakeTimeout = 30 * time.Second
+
+// DefaultBindTimeout is the default value of Server.BindTimeout.
+const DefaultBindTimeout = 2 * time.Minute
+
+// A Command is a SOCKS command.
+type Command int
+
+const (
+	Connect      Command = Command(socks.CmdConnect)
+	Bind         Command = Command(socks.CmdBind)
+	UDPAssociate Command = Command(socks.CmdUDPAssociate)
+)
+
+func (cmd Command) String() string {
+	switch cmd {
+	case Connect:
+		return "CONNECT"
+	case Bind:
+		return "BIND"
+	case UDPAssociate:
+		return "UDP ASSOCIATE"
+	}
+	return "Command(" + strconv.Itoa(int(cmd)) + ")"
+}
+
+// A Request is a command request received by a Server.
+type Request struct {
+	Command Command
+
+	// Addr is the host:port address in the request. For Connect, it is
+	// the destination; for Bind, the peer expected to connect; for
+	// UDPAssociate, the address the client sends datagrams from, or
+	// the destination of a datagram.
+	Addr string
+
+	// Username is the name the client authenticated with, if any.
+	Username string
+
+	// RemoteAddr is the address of the client.
+	RemoteAddr net.Addr
+}
+
+// ErrNotAllowed may be returned by Server.Allow to deny a request.
+var ErrNotAllowed = errors.New("socks5server: not allowed by ruleset")
+
+// Stats holds counters of the activity of a Server.
+type Stats struct {
+	Accepted     int64 // connections accepted
+	Active       int64 // connections being served
+	AuthFailures int64 // failed authentications
+	Denied       int64 // requests denied by Server.Allow
+	Failed       int64 // requests whose destination could not be reached
+	BytesIn      int64 // bytes relayed from clients
+	BytesOut     int64 // bytes relayed to clients
+}
+
+// A Server is a SOCKS version 5 server. It serves the CONNECT, BIND and
+// UDP ASSOCIATE commands.
+//
+// The zero value is a server which does not require authentication,
+// allows all requests and connects to destinations directly.
+type Server struct {
+	// Authenticate, if non-nil, enables username/password
+	// authentication: clients must authenticate, and Authenticate
+	// reports whether the credentials are valid.
+	Authenticate func(ctx context.Context, username, password string) bool
+
+	// Allow, if non-nil, is called for each request before it is
+	// served, and for the destination of each datagram relayed for
+	// UDPAssociate. The request is denied if it returns an error.
+	Allow func(ctx context.Context, req *Request) error
+
+	// Dialer is used to connect to the destinations of Connect
+	// requests, for instance a *proxy.PerHost to chain through another
+	// proxy. If it implements proxy.ContextDialer, DialContext is used.
+	// If it implements proxy.PacketListener, it is also used to relay
+	// datagrams for UDPAssociate. If nil, destinations are reached
+	// directly.
+	Dialer proxy.Dialer
+
+	// HandshakeTimeout is the maximum duration of the negotiation with
+	// a client, including authentication and connecting to the
+	// destination. If zero, DefaultHandshakeTimeout is used.
+	HandshakeTimeout time.Duration
+
+	// BindTimeout is the maximum time to wait for the peer's
+	// connection for Bind. If zero, DefaultBindTimeout is used.
+	BindTimeout time.Duration
+
+	// ErrorLog specifies an optional logger for errors serving
+	// connections. If nil, logging is done via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	mu        sync.Mutex
+	stats     Stats
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// ErrServerClosed is returned by Serve after a call to Close.
+var ErrServerClosed = errors.New("socks5server: Server closed")
+
+// ListenAndServe listens on the TCP network address addr and then calls
+// Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln and serves each in a new goroutine.
+// It always returns a non-nil error, and closes ln.
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	if !s.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+	var tempDelay time.Duration
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				s.logf("socks5server: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn serves a single client connection, and closes it.
+func (s *Server) ServeConn(c net.Conn) {
+	defer c.Close()
+	if !s.trackConn(c, true) {
+		return
+	}
+	defer s.trackConn(c, false)
+	s.count(func(st *Stats) { st.Accepted++; st.Active++ })
+	defer s.count(func(st *Stats) { st.Active-- })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc := &serverConn{s: s, c: c, br: bufio.NewReader(c)}
+	if err := sc.serve(ctx); err != nil && err != io.EOF {
+		s.logf("socks5server: %v: %v", c.RemoteAddr(), err)
+	}
+}
+
+// Close closes all listeners passed to Serve and all connections being
+// served.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+// Stats returns the counters of the server's activity.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// trackListener adds ln to or removes it from the listeners of s. It
+// reports false if ln cannot be added because s is closed.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+// trackConn is like trackListener, for connections.
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) count(f func(*Stats)) {
+	s.mu.Lock()
+	f(&s.stats)
+	s.mu.Unlock()
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (s *Server) handshakeTimeout() time.Duration {
+	if s.HandshakeTimeout != 0 {
+		return s.HandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+func (s *Server) bindTimeout() time.Duration {
+	if s.BindTimeout != 0 {
+		return s.BindTimeout
+	}
+	return DefaultBindTimeout
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch d := s.Dialer.(type) {
+	case nil:
+		var dd net.Dialer
+		return dd.DialContext(ctx, network, addr)
+	case proxy.ContextDialer:
+		return d.DialContext(ctx, network, addr)
+	default:
+		return d.Dial(network, addr)
+	}
+}
+
+// allow applies s.Allow to req.
+func (s *Server) allow(ctx context.Context, req *Request) error {
+	if s.Allow == nil {
+		return nil
+	}
+	if err := s.Allow(ctx, req); err != nil {
+		s.count(func(st *Stats) { st.Denied++ })
+		return err
+	}
+	return nil
+}
+
+// A serverConn is the server side of a client connection.
+type serverConn struct {
+	s        *Server
+	c        net.Conn
+	br       *bufio.Reader
+	username string
+}
+
+func (sc *serverConn) serve(ctx context.Context) error {
+	sc.c.SetDeadline(time.Now().Add(sc.s.handshakeTimeout()))
+	if err := sc.authenticate(ctx); err != nil {
+		return err
+	}
+	cmd, addr, err := sc.readRequest()
+	if err != nil {
+		if err == errAddrType {
+			sc.writeReply(socks.StatusAddrTypeNotSupported, nil)
+		}
+		return err
+	}
+	req := &Request{
+		Command:    Command(cmd),
+		Addr:       addr,
+		Username:   sc.username,
+		RemoteAddr: sc.c.RemoteAddr(),
+	}
+	switch req.Command {
+	case Connect, Bind, UDPAssociate:
+	default:
+		sc.writeReply(socks.StatusCommandNotSupported, nil)
+		return errors.New("unsupported command " + req.Command.String())
+	}
+	if err := sc.s.allow(ctx, req); err != nil {
+		sc.writeReply(socks.StatusNotAllowed, nil)
+		return nil
+	}
+	switch req.Command {
+	case Connect:
+		return sc.connect(ctx, req)
+	case Bind:
+		return sc.bind(ctx, req)
+	default:
+		return sc.udpAssociate(ctx, req)
+	}
+}
+
+const (
+	authUsernamePasswordVersion = 0x01
+	authStatusSucceeded         = 0x00
+	authStatusFailed            = 0x01
+)
+
+// authenticate negotiates the authentication method with the client,
+// and authenticates it.
+func (sc *serverConn) authenticate(ctx context.Context) error {
+	b := make([]byte, 2, 255)
+	if _, err := io.ReadFull(sc.br, b); err != nil {
+		return err
+	}
+	if b[0] != socks.Version5 {
+		return errors.New("unexpected protocol version " + strconv.Itoa(int(b[0])))
+	}
+	b = b[:b[1]]
+	if _, err := io.ReadFull(sc.br, b); err != nil {
+		return err
+	}
+	want := socks.AuthMethodNotRequired
+	if sc.s.Authenticate != nil {
+		want = socks.AuthMethodUsernamePassword
+	}
+	method := socks.AuthMethodNoAcceptableMethods
+	for _, m := range b {
+		if socks.AuthMethod(m) == want {
+			method = want
+		}
+	}
+	if _, err := sc.c.Write([]byte{socks.Version5, byte(method)}); err != nil {
+		return err
+	}
+	switch method {
+	case socks.AuthMethodNoAcceptableMethods:
+		sc.s.count(func(st *Stats) { st.AuthFailures++ })
+		return errors.New("no acceptable authentication methods")
+	case socks.AuthMethodNotRequired:
+		return nil
+	}
+
+	b = b[:2]
+	if _, err := io.ReadFull(sc.br, b); err != nil {
+		return err
+	}
+	if b[0] != authUsernamePasswordVersion {
+		return errors.New("invalid username/password version")
+	}
+	username := make([]byte, b[1])
+	if _, err := io.ReadFull(sc.br, username); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(sc.br, b[:1]); err != nil {
+		return err
+	}
+	password := make([]byte, b[0])
+	if _, err := io.ReadFull(sc.br, password); err != nil {
+		return err
+	}
+	if !sc.s.Authenticate(ctx, string(username), string(password)) {
+		sc.s.count(func(st *Stats) { st.AuthFailures++ })
+		sc.c.Write([]byte{authUsernamePasswordVersion, authStatusFailed})
+		return errors.New("username/password authentication failed")
+	}
+	sc.username = string(username)
+	_, err := sc.c.Write([]byte{authUsernamePasswordVersion, authStatusSucceeded})
+	return err
+}
+
+var (
+	errAddrType = errors.New("unknown address type")
+	errFragment = errors.New("fragmented datagram")
+)
+
+// readRequest reads a command request.
+func (sc *serverConn) readRequest() (socks.Command, string, error) {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(sc.br, b); err != nil {
+		return 0, "", err
+	}
+	if b[0] != socks.Version5 {
+		return 0, "", errors.New("unexpected protocol version " + strconv.Itoa(int(b[0])))
+	}
+	a, err := readAddr(sc.br)
+	if err != nil {
+		return 0, "", err
+	}
+	return socks.Command(b[1]), a.String(), nil
+}
+
+// writeReply writes a command reply with the address a, or an
+// unspecified address if a is nil.
+func (sc *serverConn) writeReply(code socks.Reply, a net.Addr) error {
+	b := []byte{socks.Version5, byte(code), 0}
+	b = appendAddr(b, a)
+	_, err := sc.c.Write(b)
+	return err
+}
+
+// connect serves a Connect request.
+func (sc *serverConn) connect(ctx context.Context, req *Request) error {
+	dctx, cancel := context.WithDeadline(ctx, time.Now().Add(sc.s.handshakeTimeout()))
+	defer cancel()
+	c, err := sc.s.dial(dctx, "tcp", req.Addr)
+	if err != nil {
+		sc.s.count(func(st *Stats) { st.Failed++ })
+		sc.writeReply(dialErrorReply(err), nil)
+		return err
+	}
+	defer c.Close()
+	if err := sc.writeReply(socks.StatusSucceeded, c.LocalAddr()); err != nil {
+		return err
+	}
+	return sc.relay(c)
+}
+
+// bind serves a Bind request.
+func (sc *serverConn) bind(ctx context.Context, req *Request) error {
+	var ip net.IP
+	if a, ok := sc.c.LocalAddr().(*net.TCPAddr); ok {
+		ip = a.IP
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		sc.s.count(func(st *Stats) { st.Failed++ })
+		sc.writeReply(socks.StatusGeneralFailure, nil)
+		return err
+	}
+	defer ln.Close()
+	if err := sc.writeReply(socks.StatusSucceeded, ln.Addr()); err != nil {
+		return err
+	}
+	expected, _, _ := net.SplitHostPort(req.Addr)
+	expectedIP := net.ParseIP(expected)
+	ln.SetDeadline(time.Now().Add(sc.s.bindTimeout()))
+	sc.c.SetDeadline(time.Time{})
+
+	// Stop waiting for the peer if the client closes the connection.
+	// Peeking leaves any data the client sends early for the relay.
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		if _, err := sc.br.Peek(1); err != nil {
+			ln.Close()
+		}
+	}()
+	c, err := acceptPeer(ln, expectedIP)
+	sc.c.SetReadDeadline(aLongTimeAgo)
+	<-watchDone
+	sc.c.SetReadDeadline(time.Time{})
+	if err != nil {
+		sc.s.count(func(st *Stats) { st.Failed++ })
+		sc.writeReply(socks.StatusTTLExpired, nil)
+		return err
+	}
+	defer c.Close()
+	ln.Close()
+	if err := sc.writeReply(socks.StatusSucceeded, c.RemoteAddr()); err != nil {
+		return err
+	}
+	return sc.relay(c)
+}
+
+// aLongTimeAgo is a deadline in the past, used to interrupt reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// acceptPeer accepts the connection from the peer expected by a Bind
+// request, or from any peer if expectedIP is nil or unspecified.
+func acceptPeer(ln *net.TCPListener, expectedIP net.IP) (net.Conn, error) {
+	for {
+		tc, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if expectedIP != nil && !expectedIP.IsUnspecified() && !expectedIP.Equal(tc.RemoteAddr().(*net.TCPAddr).IP) {
+			tc.Close()
+			continue
+		}
+		return tc, nil
+	}
+}
+
+// relay copies data between the client and c until either side closes.
+func (sc *serverConn) relay(c net.Conn) error {
+	sc.c.SetDeadline(time.Time{})
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(c, sc.br)
+		if cw, ok := c.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			c.Close()
+		}
+		done <- n
+	}()
+	out, _ := io.Copy(sc.c, c)
+	if cw, ok := sc.c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		sc.c.Close()
+	}
+	in := <-done
+	sc.s.count(func(st *Stats) { st.BytesIn += in; st.BytesOut += out })
+	return nil
+}
+
+// dialErrorReply returns the reply code for an error dialing a
+// destination.
+func dialErrorReply(err error) socks.Reply {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &dnsErr):
+		return socks.StatusHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded):
+		return socks.StatusTTLExpired
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return socks.StatusTTLExpired
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return socks.StatusConnectionRefused
+		}
+		return socks.StatusHostUnreachable
+	}
+	return socks.StatusGeneralFailure
+}
+
+// readAddr reads an address in wire format.
+func readAddr(r io.Reader) (*socks.Addr, error) {
+	b := make([]byte, 1, 255)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	var a socks.Addr
+	switch b[0] {
+	case socks.AddrTypeIPv4:
+		a.IP = make(net.IP, net.IPv4len)
+	case socks.AddrTypeIPv6:
+		a.IP = make(net.IP, net.IPv6len)
+	case socks.AddrTypeFQDN:
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errAddrType
+	}
+	if a.IP != nil {
+		b = a.IP
+	} else {
+		b = b[:b[0]]
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if a.IP == nil {
+		a.Name = string(b)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	a.Port = int(port[0])<<8 | int(port[1])
+	return &a, nil
+}
+
+// appendAddr appends a in wire format to b. A nil a, or one of an
+// unknown type, is appended as an unspecified IPv4 address.
+func appendAddr(b []byte, a net.Addr) []byte {
+	var ip net.IP
+	var name string
+	var port int
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *socks.Addr:
+		ip, name, port = a.IP, a.Name, a.Port
+	}
+	switch {
+	case ip == nil && name != "" && len(name) <= 255:
+		b = append(b, socks.AddrTypeFQDN, byte(len(name)))
+		b = append(b, name...)
+	case ip.To4() == nil && ip.To16() != nil:
+		b = append(b, socks.AddrTypeIPv6)
+		b = append(b, ip.To16()...)
+	default:
+		ip4 := ip.To4()
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		b = append(b, socks.AddrTypeIPv4)
+		b = append(b, ip4...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
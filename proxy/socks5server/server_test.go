@@ -0,0 +1,321 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks5server
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChillAndImprove/net/internal/socks"
+	"github.com/ChillAndImprove/net/nettest"
+	"github.com/ChillAndImprove/net/proxy"
+)
+
+// startServer starts serving s on a local listener, and returns its
+// address.
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ErrorLog == nil {
+		s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	}
+	go s.Serve(ln)
+	return ln.Addr().String()
+}
+
+// newEchoServer returns a listener echoing the data sent over its
+// connections.
+func newEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+func testEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b := []byte("hello")
+	if _, err := c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("got %q, %v; want %q", b, err, "hello")
+	}
+}
+
+// waitStats waits for the server to have no active connections, and
+// returns its stats.
+func waitStats(t *testing.T, s *Server) Stats {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if st := s.Stats(); st.Active == 0 {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("connections still active: %+v", s.Stats())
+	return Stats{}
+}
+
+func TestConnect(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	var mu sync.Mutex
+	var reqs []Request
+	s := &Server{
+		Authenticate: func(ctx context.Context, username, password string) bool {
+			return username == "user" && password == "password"
+		},
+		Allow: func(ctx context.Context, req *Request) error {
+			mu.Lock()
+			reqs = append(reqs, *req)
+			mu.Unlock()
+			if strings.HasPrefix(req.Addr, "192.0.2.") {
+				return ErrNotAllowed
+			}
+			return nil
+		},
+	}
+	defer s.Close()
+	addr := startServer(t, s)
+
+	d, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "user", Password: "password"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, c)
+	c.Close()
+
+	if _, err := d.Dial("tcp", "192.0.2.1:80"); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("got %v; want not allowed error", err)
+	}
+	if len(reqs) != 2 || reqs[0].Command != Connect || reqs[0].Addr != echo.Addr().String() || reqs[0].Username != "user" {
+		t.Errorf("got requests %+v", reqs)
+	}
+
+	d, _ = proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "user", Password: "wrong"}, nil)
+	if _, err := d.Dial("tcp", echo.Addr().String()); err == nil {
+		t.Error("Dial with wrong password succeeded")
+	}
+	d, _ = proxy.SOCKS5("tcp", addr, nil, nil)
+	if _, err := d.Dial("tcp", echo.Addr().String()); err == nil {
+		t.Error("Dial without credentials succeeded")
+	}
+
+	st := waitStats(t, s)
+	want := Stats{Accepted: 4, AuthFailures: 2, Denied: 1, BytesIn: 5, BytesOut: 5}
+	if st != want {
+		t.Errorf("got stats %+v; want %+v", st, want)
+	}
+}
+
+func TestConnectErrors(t *testing.T) {
+	ln, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	s := &Server{}
+	defer s.Close()
+	d := socks.NewDialer("tcp", startServer(t, s))
+	_, err = d.DialContext(context.Background(), "tcp", closedAddr)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("got %v; want connection refused error", err)
+	}
+	if st := waitStats(t, s); st.Failed != 1 {
+		t.Errorf("got stats %+v; want 1 failure", st)
+	}
+}
+
+type recordingDialer struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *recordingDialer) Dial(network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mu.Unlock()
+	return net.Dial(network, addr)
+}
+
+func TestDialer(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	rd := &recordingDialer{}
+	s := &Server{Dialer: rd}
+	defer s.Close()
+	d, _ := proxy.SOCKS5("tcp", startServer(t, s), nil, nil)
+	c, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c)
+	if len(rd.addrs) != 1 || rd.addrs[0] != echo.Addr().String() {
+		t.Errorf("Dialer dialed %v", rd.addrs)
+	}
+}
+
+func TestBind(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+	d := socks.NewDialer("tcp", startServer(t, s))
+	ln, err := d.Listen(context.Background(), "tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	peer, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got, want := c.RemoteAddr().String(), peer.LocalAddr().String(); got != want {
+		t.Errorf("got remote address %v; want %v", got, want)
+	}
+	go io.Copy(peer, peer)
+	testEcho(t, c)
+}
+
+func TestBindClientClosed(t *testing.T) {
+	s := &Server{BindTimeout: time.Minute}
+	defer s.Close()
+	d := socks.NewDialer("tcp", startServer(t, s))
+	ln, err := d.Listen(context.Background(), "tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound := ln.Addr().String()
+	// Closing the listener closes the connection to the server, which
+	// stops waiting for the peer.
+	ln.Close()
+	if st := waitStats(t, s); st.Failed != 1 {
+		t.Errorf("got stats %+v; want 1 failed", st)
+	}
+	if c, err := net.DialTimeout("tcp", bound, 5*time.Second); err == nil {
+		c.Close()
+		t.Errorf("bound address %v still accepts connections", bound)
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], from)
+		}
+	}()
+	s := &Server{
+		Allow: func(ctx context.Context, req *Request) error {
+			if req.Addr == "127.0.0.1:1" {
+				return ErrNotAllowed
+			}
+			return nil
+		},
+	}
+	defer s.Close()
+	d := socks.NewDialer("tcp", startServer(t, s))
+	c, err := d.ListenPacket(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	// Denied datagrams are dropped.
+	if _, err := c.WriteTo([]byte("denied"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := c.WriteTo([]byte(msg), echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 512)
+		n, from, err := c.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != msg || from.String() != echo.LocalAddr().String() {
+			t.Errorf("got %q from %v; want %q from %v", b[:n], from, msg, echo.LocalAddr())
+		}
+	}
+	c.Close()
+	if st := waitStats(t, s); st.BytesIn != 10 || st.BytesOut != 10 || st.Denied != 1 {
+		t.Errorf("got stats %+v; want 10 bytes in and out, 1 denied", st)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ln, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ln) }()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for s.Stats().Active == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+	if err := <-errc; err != ErrServerClosed {
+		t.Errorf("Serve returned %v; want %v", err, ErrServerClosed)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from connection got %v; want %v", err, io.EOF)
+	}
+}
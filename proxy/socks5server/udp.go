@@ -0,0 +1,216 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks5server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ChillAndImprove/net/internal/socks"
+	"github.com/ChillAndImprove/net/proxy"
+)
+
+// maxDatagramSize is the size of the buffers used to relay datagrams.
+const maxDatagramSize = 64 << 10
+
+// udpAssociate serves a UDPAssociate request, relaying datagrams until
+// the client closes the connection.
+func (sc *serverConn) udpAssociate(ctx context.Context, req *Request) error {
+	var ip net.IP
+	if a, ok := sc.c.LocalAddr().(*net.TCPAddr); ok {
+		ip = a.IP
+	}
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		sc.s.count(func(st *Stats) { st.Failed++ })
+		sc.writeReply(socks.StatusGeneralFailure, nil)
+		return err
+	}
+	defer client.Close()
+	var remote net.PacketConn
+	pl, chained := sc.s.Dialer.(proxy.PacketListener)
+	if chained {
+		remote, err = pl.ListenPacket(ctx, "udp", "")
+	} else {
+		remote, err = net.ListenPacket("udp", "")
+	}
+	if err != nil {
+		sc.s.count(func(st *Stats) { st.Failed++ })
+		sc.writeReply(socks.StatusGeneralFailure, nil)
+		return err
+	}
+	defer remote.Close()
+	if err := sc.writeReply(socks.StatusSucceeded, client.LocalAddr()); err != nil {
+		return err
+	}
+	sc.c.SetDeadline(time.Time{})
+
+	r := &udpRelay{sc: sc, req: req, client: client, remote: remote, chained: chained}
+	if a, ok := sc.c.RemoteAddr().(*net.TCPAddr); ok {
+		r.clientIP = a.IP
+	}
+	if _, port, err := net.SplitHostPort(req.Addr); err == nil {
+		r.clientPort, _ = strconv.Atoi(port)
+	}
+	go r.fromClient(ctx)
+	go r.toClient()
+	// The association ends with the connection it was requested on.
+	io.Copy(io.Discard, sc.br)
+	return nil
+}
+
+// A udpRelay relays datagrams between a client and destinations.
+type udpRelay struct {
+	sc      *serverConn
+	req     *Request
+	client  *net.UDPConn   // receives datagrams from the client
+	remote  net.PacketConn // sends datagrams to destinations
+	chained bool           // remote is provided by Server.Dialer
+
+	clientIP   net.IP
+	clientPort int // if non-zero, the port the client sends from
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr // where the client sends datagrams from
+
+	resolved map[string]resolvedIP // destination names; owned by fromClient
+}
+
+// A resolvedIP is a cached lookup of a destination name.
+type resolvedIP struct {
+	ip      net.IP
+	err     error
+	expires time.Time
+}
+
+const (
+	// resolveTTL is how long the lookup of a destination name is used.
+	resolveTTL = time.Minute
+
+	// maxResolved limits the names cached by a UDP association.
+	maxResolved = 64
+)
+
+// fromClient relays datagrams from the client to their destinations.
+func (r *udpRelay) fromClient(ctx context.Context) {
+	b := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := r.client.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		// Only accept datagrams from the client's host, and from the
+		// first port used if the client did not specify one.
+		if r.clientIP != nil && !from.IP.Equal(r.clientIP) {
+			continue
+		}
+		if r.clientPort != 0 && from.Port != r.clientPort {
+			continue
+		}
+		r.mu.Lock()
+		if r.clientAddr == nil {
+			r.clientAddr = from
+		}
+		ok := r.clientAddr.Port == from.Port
+		r.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		dst, payload, err := parseDatagram(b[:n])
+		if err != nil {
+			continue
+		}
+		req := *r.req
+		req.Addr = dst.String()
+		if r.sc.s.allow(ctx, &req) != nil {
+			continue
+		}
+		var to net.Addr = dst
+		if !r.chained {
+			if to, err = r.resolve(dst); err != nil {
+				continue
+			}
+		}
+		if _, err := r.remote.WriteTo(payload, to); err != nil {
+			continue
+		}
+		r.sc.s.count(func(st *Stats) { st.BytesIn += int64(len(payload)) })
+	}
+}
+
+// resolve returns the UDP address of dst. Lookups of names, including
+// failed ones, are cached for resolveTTL, so that datagrams sent to the
+// same destination do not each wait for one.
+func (r *udpRelay) resolve(dst *socks.Addr) (*net.UDPAddr, error) {
+	if dst.Name == "" {
+		return &net.UDPAddr{IP: dst.IP, Port: dst.Port}, nil
+	}
+	now := time.Now()
+	e, ok := r.resolved[dst.Name]
+	if !ok || now.After(e.expires) {
+		e = resolvedIP{expires: now.Add(resolveTTL)}
+		var a *net.UDPAddr
+		if a, e.err = net.ResolveUDPAddr("udp", net.JoinHostPort(dst.Name, "0")); e.err == nil {
+			e.ip = a.IP
+		}
+		if r.resolved == nil || len(r.resolved) >= maxResolved {
+			r.resolved = make(map[string]resolvedIP)
+		}
+		r.resolved[dst.Name] = e
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return &net.UDPAddr{IP: e.ip, Port: dst.Port}, nil
+}
+
+// toClient relays datagrams from destinations to the client.
+func (r *udpRelay) toClient() {
+	const maxHeaderLen = 3 + 1 + 1 + 255 + 2
+	b := make([]byte, maxHeaderLen+maxDatagramSize)
+	for {
+		n, from, err := r.remote.ReadFrom(b[maxHeaderLen:])
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		to := r.clientAddr
+		r.mu.Unlock()
+		if to == nil {
+			continue
+		}
+		h := appendAddr(make([]byte, 3, maxHeaderLen), from)
+		d := b[maxHeaderLen-len(h) : maxHeaderLen+n]
+		copy(d, h)
+		if _, err := r.client.WriteToUDP(d, to); err != nil {
+			continue
+		}
+		r.sc.s.count(func(st *Stats) { st.BytesOut += int64(n) })
+	}
+}
+
+// parseDatagram parses a datagram sent by a client. It returns the
+// destination address and payload of the datagram. Fragmented datagrams
+// are not supported.
+func parseDatagram(b []byte) (*socks.Addr, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if b[2] != 0 {
+		return nil, nil, errFragment
+	}
+	r := bytes.NewReader(b[3:])
+	a, err := readAddr(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, b[len(b)-r.Len():], nil
+}
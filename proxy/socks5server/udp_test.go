@@ -0,0 +1,60 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks5server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ChillAndImprove/net/internal/socks"
+)
+
+func TestUDPRelayResolve(t *testing.T) {
+	r := &udpRelay{}
+	a, err := r.resolve(&socks.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 53})
+	if err != nil || a.String() != "127.0.0.1:53" {
+		t.Errorf("resolve IP address = %v, %v; want 127.0.0.1:53", a, err)
+	}
+	if len(r.resolved) != 0 {
+		t.Errorf("IP address cached: %v", r.resolved)
+	}
+
+	// A cached name is not looked up again, and keeps the port of
+	// each datagram.
+	ip := net.IPv4(192, 0, 2, 1)
+	r.resolved = map[string]resolvedIP{
+		"example.test": {ip: ip, expires: time.Now().Add(resolveTTL)},
+	}
+	for _, port := range []int{80, 443} {
+		a, err := r.resolve(&socks.Addr{Name: "example.test", Port: port})
+		if err != nil || !a.IP.Equal(ip) || a.Port != port {
+			t.Errorf("resolve cached name = %v, %v; want %v:%v", a, err, ip, port)
+		}
+	}
+
+	// Expired names are looked up again.
+	r.resolved["localhost"] = resolvedIP{ip: ip, expires: time.Now().Add(-time.Second)}
+	a, err = r.resolve(&socks.Addr{Name: "localhost", Port: 53})
+	if err != nil || !a.IP.IsLoopback() {
+		t.Errorf("resolve expired name = %v, %v; want a loopback address", a, err)
+	}
+	if e := r.resolved["localhost"]; !e.ip.IsLoopback() || !e.expires.After(time.Now()) {
+		t.Errorf("localhost cached as %+v; want a fresh loopback address", e)
+	}
+
+	// The cache is bounded.
+	r.resolved = make(map[string]resolvedIP)
+	for i := 0; i < maxResolved; i++ {
+		r.resolved[strconv.Itoa(i)+".example.test"] = resolvedIP{ip: ip, expires: time.Now().Add(resolveTTL)}
+	}
+	if _, err := r.resolve(&socks.Addr{Name: "localhost", Port: 53}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.resolved) > maxResolved {
+		t.Errorf("%d names cached; want at most %d", len(r.resolved), maxResolved)
+	}
+}
@@ -0,0 +1,494 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+// This file implements the permessage-deflate extension.
+// https://www.rfc-editor.org/rfc/rfc7692
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	deflateExtension = "permessage-deflate"
+
+	minWindowBits = 8
+	maxWindowBits = 15
+	maxWindowSize = 1 << maxWindowBits
+)
+
+// deflateTail is the trailer of a sync flush, which the sender strips from
+// every compressed message and the receiver appends before decompressing.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+var (
+	errBadCompressionLevel = errors.New("websocket: invalid compression level")
+	errBadWindowBits       = errors.New("websocket: invalid compression window bits")
+)
+
+// CompressionConfig configures the permessage-deflate extension as specified
+// in RFC 7692.
+//
+// A client offers the extension with the parameters set here; a server
+// accepts the first offer whose parameters it can satisfy, adding its own
+// parameters to the response. Messages are only compressed if both peers
+// agree on the extension.
+type CompressionConfig struct {
+	// Level is the compression level used for outgoing messages, as
+	// defined by compress/flate. If zero, flate.DefaultCompression is used.
+	Level int
+
+	// ServerNoContextTakeover requests that the server reset its
+	// compression context after each message.
+	ServerNoContextTakeover bool
+
+	// ClientNoContextTakeover requests that the client reset its
+	// compression context after each message.
+	ClientNoContextTakeover bool
+
+	// ServerMaxWindowBits limits the LZ77 window size used by the server,
+	// from 8 to 15. If zero, no limit is requested.
+	ServerMaxWindowBits int
+
+	// ClientMaxWindowBits limits the LZ77 window size used by the client,
+	// from 8 to 15. If zero, no limit is requested.
+	ClientMaxWindowBits int
+}
+
+func (c *CompressionConfig) validate() error {
+	if c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+		return errBadCompressionLevel
+	}
+	for _, bits := range []int{c.ServerMaxWindowBits, c.ClientMaxWindowBits} {
+		if bits != 0 && (bits < minWindowBits || bits > maxWindowBits) {
+			return errBadWindowBits
+		}
+	}
+	return nil
+}
+
+// offer returns the extension negotiation offer sent by a client.
+func (c *CompressionConfig) offer() *deflateParams {
+	return &deflateParams{
+		serverNoContextTakeover: c.ServerNoContextTakeover,
+		clientNoContextTakeover: c.ClientNoContextTakeover,
+		serverMaxWindowBits:     c.ServerMaxWindowBits,
+		clientMaxWindowBits:     c.ClientMaxWindowBits,
+	}
+}
+
+// deflateParams holds the parameters of permessage-deflate agreed upon in
+// the opening handshake.
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+
+	// level is the local compression level; it is not sent to the peer.
+	level int
+}
+
+func (p *deflateParams) String() string {
+	var b strings.Builder
+	b.WriteString(deflateExtension)
+	if p.serverNoContextTakeover {
+		b.WriteString("; server_no_context_takeover")
+	}
+	if p.clientNoContextTakeover {
+		b.WriteString("; client_no_context_takeover")
+	}
+	if p.serverMaxWindowBits != 0 {
+		b.WriteString("; server_max_window_bits=" + strconv.Itoa(p.serverMaxWindowBits))
+	}
+	if p.clientMaxWindowBits != 0 {
+		b.WriteString("; client_max_window_bits=" + strconv.Itoa(p.clientMaxWindowBits))
+	}
+	return b.String()
+}
+
+// An extension is a single entry of a Sec-WebSocket-Extensions header.
+type extension struct {
+	name   string
+	params []extensionParam
+}
+
+type extensionParam struct {
+	name, value string
+}
+
+// parseExtensions parses all Sec-WebSocket-Extensions header fields in h.
+func parseExtensions(h http.Header) []extension {
+	var exts []extension
+	for _, v := range h["Sec-Websocket-Extensions"] {
+		for _, s := range strings.Split(v, ",") {
+			parts := strings.Split(s, ";")
+			ext := extension{name: strings.TrimSpace(parts[0])}
+			if ext.name == "" {
+				continue
+			}
+			for _, part := range parts[1:] {
+				name, value, _ := strings.Cut(part, "=")
+				value = strings.TrimSpace(value)
+				if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+					value = value[1 : len(value)-1]
+				}
+				ext.params = append(ext.params, extensionParam{strings.TrimSpace(name), value})
+			}
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// parseWindowBits parses the value of a max_window_bits parameter.
+func parseWindowBits(v string) (int, bool) {
+	if len(v) == 0 || v[0] < '1' || v[0] > '9' {
+		return 0, false
+	}
+	bits, err := strconv.Atoi(v)
+	if err != nil || bits < minWindowBits || bits > maxWindowBits {
+		return 0, false
+	}
+	return bits, true
+}
+
+// acceptDeflate returns the parameters with which a server configured by c
+// accepts a permessage-deflate offer, or nil if the offer must be declined.
+func acceptDeflate(c *CompressionConfig, offer []extensionParam) *deflateParams {
+	p := &deflateParams{
+		serverNoContextTakeover: c.ServerNoContextTakeover,
+		clientNoContextTakeover: c.ClientNoContextTakeover,
+		serverMaxWindowBits:     c.ServerMaxWindowBits,
+		level:                   c.Level,
+	}
+	seen := make(map[string]bool)
+	for _, param := range offer {
+		if seen[param.name] {
+			return nil
+		}
+		seen[param.name] = true
+		switch param.name {
+		case "server_no_context_takeover":
+			if param.value != "" {
+				return nil
+			}
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if param.value != "" {
+				return nil
+			}
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, ok := parseWindowBits(param.value)
+			if !ok {
+				return nil
+			}
+			if p.serverMaxWindowBits == 0 || bits < p.serverMaxWindowBits {
+				p.serverMaxWindowBits = bits
+			}
+		case "client_max_window_bits":
+			// The client may send this without a value to indicate that
+			// it supports the parameter in the response.
+			bits := maxWindowBits
+			if param.value != "" {
+				var ok bool
+				if bits, ok = parseWindowBits(param.value); !ok {
+					return nil
+				}
+			}
+			if c.ClientMaxWindowBits != 0 && c.ClientMaxWindowBits < bits {
+				bits = c.ClientMaxWindowBits
+			}
+			if bits < maxWindowBits {
+				p.clientMaxWindowBits = bits
+			}
+		default:
+			return nil
+		}
+	}
+	return p
+}
+
+// negotiateDeflate selects the permessage-deflate offer accepted by a server
+// configured by c among the extensions requested by the client.
+func negotiateDeflate(c *CompressionConfig, offers []extension) *deflateParams {
+	for _, ext := range offers {
+		if ext.name != deflateExtension {
+			continue
+		}
+		if p := acceptDeflate(c, ext.params); p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// parseDeflateResponse validates the extensions accepted by a server in
+// response to an offer made with c, and returns the resulting parameters.
+func parseDeflateResponse(c *CompressionConfig, exts []extension) (*deflateParams, error) {
+	if len(exts) == 0 {
+		return nil, nil
+	}
+	if c == nil || len(exts) != 1 || exts[0].name != deflateExtension {
+		return nil, ErrUnsupportedExtensions
+	}
+	p := &deflateParams{
+		clientNoContextTakeover: c.ClientNoContextTakeover,
+		clientMaxWindowBits:     c.ClientMaxWindowBits,
+		level:                   c.Level,
+	}
+	seen := make(map[string]bool)
+	for _, param := range exts[0].params {
+		if seen[param.name] {
+			return nil, ErrUnsupportedExtensions
+		}
+		seen[param.name] = true
+		switch param.name {
+		case "server_no_context_takeover":
+			if param.value != "" {
+				return nil, ErrUnsupportedExtensions
+			}
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if param.value != "" {
+				return nil, ErrUnsupportedExtensions
+			}
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, ok := parseWindowBits(param.value)
+			if !ok || (c.ServerMaxWindowBits != 0 && bits > c.ServerMaxWindowBits) {
+				return nil, ErrUnsupportedExtensions
+			}
+			p.serverMaxWindowBits = bits
+		case "client_max_window_bits":
+			// Only allowed if the client offered it.
+			bits, ok := parseWindowBits(param.value)
+			if !ok || c.ClientMaxWindowBits == 0 || bits > c.ClientMaxWindowBits {
+				return nil, ErrUnsupportedExtensions
+			}
+			p.clientMaxWindowBits = bits
+		default:
+			return nil, ErrUnsupportedExtensions
+		}
+	}
+	return p, nil
+}
+
+// A deflater compresses outgoing messages.
+type deflater struct {
+	level             int
+	noContextTakeover bool
+
+	buf bytes.Buffer
+	fw  *flate.Writer
+}
+
+func newDeflater(level, windowBits int, noContextTakeover bool) *deflater {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	if windowBits != 0 && windowBits < maxWindowBits {
+		// compress/flate always uses a 32KB window. Without back
+		// references, Huffman-only compression never exceeds a smaller
+		// window agreed upon with the peer.
+		level = flate.HuffmanOnly
+	}
+	return &deflater{level: level, noContextTakeover: noContextTakeover}
+}
+
+// compress returns the compressed form of p, a fragment of a message; fin
+// reports whether it is the final one. The result is only valid until the
+// next call.
+func (d *deflater) compress(p []byte, fin bool) ([]byte, error) {
+	d.buf.Reset()
+	if d.fw == nil {
+		fw, err := flate.NewWriter(&d.buf, d.level)
+		if err != nil {
+			return nil, err
+		}
+		d.fw = fw
+	}
+	if _, err := d.fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := d.fw.Flush(); err != nil {
+		return nil, err
+	}
+	b := d.buf.Bytes()
+	if !fin {
+		return b, nil
+	}
+	if d.noContextTakeover {
+		d.fw.Reset(&d.buf)
+	}
+	if !bytes.HasSuffix(b, deflateTail) {
+		return nil, errors.New("websocket: missing deflate sync marker")
+	}
+	return b[:len(b)-len(deflateTail)], nil
+}
+
+// A deflateFrameWriterFactory creates frame writers that compress the
+// payload of text and binary frames.
+type deflateFrameWriterFactory struct {
+	hybiFrameWriterFactory
+	deflater *deflater
+}
+
+func (buf deflateFrameWriterFactory) NewFrameWriter(payloadType byte) (frame frameWriter, err error) {
+	frame, err = buf.hybiFrameWriterFactory.NewFrameWriter(payloadType)
+	if err != nil {
+		return nil, err
+	}
+	if payloadType != TextFrame && payloadType != BinaryFrame {
+		return frame, nil
+	}
+	hybiFrame := frame.(*hybiFrameWriter)
+	hybiFrame.header.Rsv[0] = true
+	return &deflateFrameWriter{frame: hybiFrame, deflater: buf.deflater, fin: true}, nil
+}
+
+func (buf deflateFrameWriterFactory) NewFragmentWriter(payloadType byte, first, fin bool) (frame frameWriter, err error) {
+	frame, err = buf.hybiFrameWriterFactory.NewFragmentWriter(payloadType, first, fin)
+	if err != nil {
+		return nil, err
+	}
+	// Only the first frame of a compressed message has RSV1 set.
+	hybiFrame := frame.(*hybiFrameWriter)
+	hybiFrame.header.Rsv[0] = first
+	return &deflateFrameWriter{frame: hybiFrame, deflater: buf.deflater, fin: fin}, nil
+}
+
+// A deflateFrameWriter writes a compressed frame, either a whole message or
+// a fragment of it.
+type deflateFrameWriter struct {
+	frame    *hybiFrameWriter
+	deflater *deflater
+	fin      bool
+}
+
+func (w *deflateFrameWriter) Write(msg []byte) (n int, err error) {
+	b, err := w.deflater.compress(msg, w.fin)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.frame.Write(b); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (w *deflateFrameWriter) Close() error { return nil }
+
+// An inflater decompresses incoming messages.
+type inflater struct {
+	noContextTakeover bool
+
+	fr   io.ReadCloser
+	dict []byte // last decompressed bytes, used by the next message
+}
+
+// newMessage returns a reader for the decompressed payload of the message
+// starting with frame.
+func (f *inflater) newMessage(handler *hybiFrameHandler, frame *hybiFrameReader) frameReader {
+	msg := &deflatedMessage{handler: handler, frame: frame, fin: frame.header.Fin}
+	if f.fr == nil {
+		f.fr = flate.NewReaderDict(msg, f.dict)
+	} else {
+		f.fr.(flate.Resetter).Reset(msg, f.dict)
+	}
+	return &inflateFrameReader{inflater: f, first: frame, msg: msg}
+}
+
+func (f *inflater) record(p []byte) {
+	if f.noContextTakeover {
+		return
+	}
+	f.dict = append(f.dict, p...)
+	if len(f.dict) > maxWindowSize {
+		f.dict = f.dict[len(f.dict)-maxWindowSize:]
+	}
+}
+
+// A deflatedMessage reads the compressed payload of a message across its
+// continuation frames, followed by the trailer stripped by the sender.
+type deflatedMessage struct {
+	handler *hybiFrameHandler
+	frame   io.Reader
+	fin     bool
+	tail    bool
+	done    bool
+}
+
+func (m *deflatedMessage) Read(p []byte) (n int, err error) {
+	for {
+		if m.done {
+			return 0, io.EOF
+		}
+		n, err = m.frame.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		switch {
+		case m.tail:
+			m.done = true
+		case m.fin:
+			m.frame = bytes.NewReader(deflateTail)
+			m.tail = true
+		default:
+			frame, fin, err := nextContinuation(m.handler.conn)
+			if err != nil {
+				return 0, err
+			}
+			m.frame, m.fin = frame, fin
+		}
+	}
+}
+
+// An inflateFrameReader reads the decompressed payload of a message.
+type inflateFrameReader struct {
+	inflater *inflater
+	first    *hybiFrameReader
+	msg      *deflatedMessage
+	err      error
+}
+
+func (r *inflateFrameReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err = r.inflater.fr.Read(p)
+	r.inflater.record(p[:n])
+	switch {
+	case err == io.EOF, err == io.ErrUnexpectedEOF && r.msg.done:
+		// Discard anything following a final deflate block.
+		if _, err := io.Copy(ioutil.Discard, r.msg); err != nil {
+			r.err = err
+			return n, nil
+		}
+		r.err = io.EOF
+	case err != nil:
+		r.err = err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, r.err
+}
+
+func (r *inflateFrameReader) PayloadType() byte { return r.first.PayloadType() }
+
+func (r *inflateFrameReader) HeaderReader() io.Reader { return r.first.HeaderReader() }
+
+func (r *inflateFrameReader) TrailerReader() io.Reader { return nil }
+
+func (r *inflateFrameReader) Len() int { return r.first.Len() }
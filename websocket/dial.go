@@ -8,9 +8,47 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+
+	"github.com/ChillAndImprove/net/proxy"
 )
 
 func dialWithDialer(ctx context.Context, dialer *net.Dialer, config *Config) (conn net.Conn, err error) {
+	switch config.Location.Scheme {
+	case "ws", "wss":
+	default:
+		return nil, ErrBadScheme
+	}
+	forward, err := proxyDialer(dialer, config)
+	if err != nil {
+		return nil, err
+	}
+	if forward == nil {
+		return dialDirect(ctx, dialer, config)
+	}
+
+	conn, err = forward.DialContext(ctx, "tcp", parseAuthority(config.Location))
+	if err != nil {
+		return nil, err
+	}
+	if config.Location.Scheme == "wss" {
+		tlsConfig := config.TlsConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = config.Location.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+func dialDirect(ctx context.Context, dialer *net.Dialer, config *Config) (conn net.Conn, err error) {
 	switch config.Location.Scheme {
 	case "ws":
 		conn, err = dialer.DialContext(ctx, "tcp", parseAuthority(config.Location))
@@ -27,3 +65,63 @@ func dialWithDialer(ctx context.Context, dialer *net.Dialer, config *Config) (co
 	}
 	return
 }
+
+// proxyDialer returns the dialer used to reach config.Location through a
+// proxy, or nil if it is dialed directly.
+func proxyDialer(dialer *net.Dialer, config *Config) (proxy.ContextDialer, error) {
+	if config.ProxyDialer != nil {
+		return config.ProxyDialer, nil
+	}
+	if config.Proxy == nil {
+		return nil, nil
+	}
+	location := *config.Location
+	if location.Scheme == "wss" {
+		location.Scheme = "https"
+	} else {
+		location.Scheme = "http"
+	}
+	proxyURL, err := config.Proxy(&location)
+	if err != nil || proxyURL == nil {
+		return nil, err
+	}
+	d, err := proxy.FromURL(proxyURL, dialer)
+	if err != nil {
+		return nil, err
+	}
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd, nil
+	}
+	return contextDialer{d}, nil
+}
+
+// contextDialer adapts a proxy.Dialer which does not support contexts.
+// The dial runs in its own goroutine, so that DialContext returns when
+// ctx is done; a connection it makes afterwards is closed.
+type contextDialer struct {
+	proxy.Dialer
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		conn, err := d.Dial(network, addr)
+		select {
+		case done <- result{conn, err}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.conn, r.err
+	}
+}
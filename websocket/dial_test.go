@@ -9,12 +9,19 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/ChillAndImprove/net/internal/socks"
+	"github.com/ChillAndImprove/net/internal/sockstest"
 )
 
 // This test depend on Go 1.3+ because in earlier versions the Dialer won't be
@@ -78,3 +85,207 @@ func TestDialConfigTLSWithTimeouts(t *testing.T) {
 		t.Fatalf("context.Canceled error expected, got %#v", dialerr.Err)
 	}
 }
+
+// connectProxy is an HTTP proxy that handles CONNECT requests.
+type connectProxy struct {
+	auth  string // required Proxy-Authorization, if any
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.auth != "" && r.Header.Get("Proxy-Authorization") != p.auth {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	p.mu.Lock()
+	p.addrs = append(p.addrs, r.Host)
+	p.mu.Unlock()
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, buf)
+	io.Copy(conn, target)
+}
+
+func testEcho(t *testing.T, config *Config) {
+	t.Helper()
+	ws, err := DialConfig(config)
+	if err != nil {
+		t.Fatalf("DialConfig: %v", err)
+	}
+	defer ws.Close()
+	if _, err := ws.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	msg := make([]byte, 16)
+	n, err := ws.Read(msg)
+	if err != nil || string(msg[:n]) != "hello" {
+		t.Fatalf("Read: got %q, %v; want %q", msg[:n], err, "hello")
+	}
+}
+
+func TestDialConfigHTTPProxy(t *testing.T) {
+	server := httptest.NewServer(Handler(echoServer))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(Handler(echoServer))
+	defer tlsServer.Close()
+	p := &connectProxy{auth: "Basic dXNlcjpwYXNz"} // user:pass
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse("http://user:pass@" + proxyServer.Listener.Addr().String())
+
+	for _, tt := range []struct {
+		location *url.URL
+		scheme   string
+	}{
+		{location: mustParseURL(t, "ws://"+server.Listener.Addr().String()+"/"), scheme: "http"},
+		{location: mustParseURL(t, "wss://"+tlsServer.Listener.Addr().String()+"/"), scheme: "https"},
+	} {
+		config, _ := NewConfig(tt.location.String(), "http://localhost")
+		config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+		config.Proxy = func(u *url.URL) (*url.URL, error) {
+			if u.Scheme != tt.scheme || u.Host != tt.location.Host {
+				t.Errorf("Proxy called with %v; want scheme %q and host %q", u, tt.scheme, tt.location.Host)
+			}
+			return proxyURL, nil
+		}
+		testEcho(t, config)
+	}
+	if len(p.addrs) != 2 || p.addrs[0] != server.Listener.Addr().String() || p.addrs[1] != tlsServer.Listener.Addr().String() {
+		t.Errorf("proxy tunneled to %v", p.addrs)
+	}
+
+	// Missing credentials.
+	config, _ := NewConfig("ws://"+server.Listener.Addr().String()+"/", "http://localhost")
+	config.Proxy = func(*url.URL) (*url.URL, error) {
+		return url.Parse("http://" + proxyServer.Listener.Addr().String())
+	}
+	_, err := DialConfig(config)
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("DialConfig without proxy credentials: got %v, want 407 error", err)
+	}
+}
+
+func TestDialConfigSOCKS5Proxy(t *testing.T) {
+	server := httptest.NewServer(Handler(echoServer))
+	defer server.Close()
+	ss, err := sockstest.NewServer(sockstest.NoAuthRequired, func(rw io.ReadWriter, b []byte) error {
+		req, err := sockstest.ParseCmdRequest(b)
+		if err != nil {
+			return err
+		}
+		target, err := net.Dial("tcp", req.Addr.String())
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+		b, err = sockstest.MarshalCmdReply(socks.Version5, socks.StatusSucceeded, &req.Addr)
+		if err != nil {
+			return err
+		}
+		if _, err := rw.Write(b); err != nil {
+			return err
+		}
+		go io.Copy(target, rw)
+		io.Copy(rw, target)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	config, _ := NewConfig("ws://"+server.Listener.Addr().String()+"/", "http://localhost")
+	config.Proxy = func(*url.URL) (*url.URL, error) {
+		return url.Parse("socks5://" + ss.Addr().String())
+	}
+	testEcho(t, config)
+}
+
+type recordingDialer struct {
+	addrs []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.addrs = append(d.addrs, addr)
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+func TestDialConfigProxyDialer(t *testing.T) {
+	server := httptest.NewServer(Handler(echoServer))
+	defer server.Close()
+	d := &recordingDialer{}
+	config, _ := NewConfig("ws://"+server.Listener.Addr().String()+"/", "http://localhost")
+	config.ProxyDialer = d
+	config.Proxy = func(*url.URL) (*url.URL, error) {
+		t.Error("Proxy called when ProxyDialer is set")
+		return nil, nil
+	}
+	testEcho(t, config)
+	if len(d.addrs) != 1 || d.addrs[0] != server.Listener.Addr().String() {
+		t.Errorf("ProxyDialer dialed %v", d.addrs)
+	}
+}
+
+// blockingDialer is a proxy.Dialer without DialContext whose dials
+// complete when release is closed.
+type blockingDialer struct {
+	release chan struct{}
+	conn    net.Conn
+}
+
+func (d *blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	<-d.release
+	return d.conn, nil
+}
+
+func TestContextDialerCanceled(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	d := &blockingDialer{release: make(chan struct{}), conn: c1}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := contextDialer{d}.DialContext(ctx, "tcp", "example.com:80")
+		errc <- err
+	}()
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("DialContext = %v; want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DialContext did not return after its context was canceled")
+	}
+
+	// The connection made after cancellation is closed.
+	close(d.release)
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the abandoned connection's peer = %v; want %v", err, io.EOF)
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
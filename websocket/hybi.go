@@ -20,23 +20,12 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
 	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
-	closeStatusNormal            = 1000
-	closeStatusGoingAway         = 1001
-	closeStatusProtocolError     = 1002
-	closeStatusUnsupportedData   = 1003
-	closeStatusFrameTooLarge     = 1004
-	closeStatusNoStatusRcvd      = 1005
-	closeStatusAbnormalClosure   = 1006
-	closeStatusBadMessageData    = 1007
-	closeStatusPolicyViolation   = 1008
-	closeStatusTooBigData        = 1009
-	closeStatusExtensionMismatch = 1010
-
 	maxControlFramePayloadLength = 125
 )
 
@@ -48,14 +37,15 @@ var (
 	ErrNotImplemented        = &ProtocolError{"not implemented"}
 
 	handshakeHeader = map[string]bool{
-		"Host":                   true,
-		"Upgrade":                true,
-		"Connection":             true,
-		"Sec-Websocket-Key":      true,
-		"Sec-Websocket-Origin":   true,
-		"Sec-Websocket-Version":  true,
-		"Sec-Websocket-Protocol": true,
-		"Sec-Websocket-Accept":   true,
+		"Host":                     true,
+		"Upgrade":                  true,
+		"Connection":               true,
+		"Sec-Websocket-Key":        true,
+		"Sec-Websocket-Origin":     true,
+		"Sec-Websocket-Version":    true,
+		"Sec-Websocket-Protocol":   true,
+		"Sec-Websocket-Accept":     true,
+		"Sec-Websocket-Extensions": true,
 	}
 )
 
@@ -259,35 +249,99 @@ func (buf hybiFrameWriterFactory) NewFrameWriter(payloadType byte) (frame frameW
 	return &hybiFrameWriter{writer: buf.Writer, header: frameHeader}, nil
 }
 
+func (buf hybiFrameWriterFactory) NewFragmentWriter(payloadType byte, first, fin bool) (frame frameWriter, err error) {
+	if !first {
+		payloadType = ContinuationFrame
+	}
+	frame, err = buf.NewFrameWriter(payloadType)
+	if err != nil {
+		return nil, err
+	}
+	frame.(*hybiFrameWriter).header.Fin = fin
+	return frame, nil
+}
+
+// nextContinuation reads the next continuation frame of a fragmented message
+// from ws, handling any control frames in between. It reports whether the
+// frame is the final one of the message.
+func nextContinuation(ws *Conn) (frame frameReader, fin bool, err error) {
+	for {
+		frame, err = ws.frameReaderFactory.NewFrameReader()
+		if err != nil {
+			return nil, false, err
+		}
+		header := frame.(*hybiFrameReader).header
+		if header.OpCode == TextFrame || header.OpCode == BinaryFrame {
+			// A new message must not start before the current one is
+			// complete.
+			ws.frameHandler.WriteClose(CloseProtocolError, "")
+			return nil, false, ErrBadFrame
+		}
+		frame, err = ws.frameHandler.HandleFrame(frame)
+		if err != nil {
+			return nil, false, err
+		}
+		if frame != nil {
+			return frame, header.Fin, nil
+		}
+	}
+}
+
 type hybiFrameHandler struct {
 	conn        *Conn
 	payloadType byte
+	inflater    *inflater
+
+	// Used in strict mode.
+	fragmented bool // a fragmented message is being received
+	compressed bool // the current message is compressed
+	utf8       utf8Validator
 }
 
 func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (frameReader, error) {
 	if handler.conn.IsServerConn() {
 		// The client MUST mask all frames sent to the server.
 		if frame.(*hybiFrameReader).header.MaskingKey == nil {
-			handler.WriteClose(closeStatusProtocolError)
+			handler.WriteClose(CloseProtocolError, "")
 			return nil, io.EOF
 		}
 	} else {
 		// The server MUST NOT mask all frames.
 		if frame.(*hybiFrameReader).header.MaskingKey != nil {
-			handler.WriteClose(closeStatusProtocolError)
+			handler.WriteClose(CloseProtocolError, "")
 			return nil, io.EOF
 		}
 	}
+	hybiFrame := frame.(*hybiFrameReader)
+	strict := handler.conn.config.Strict
+	if strict {
+		if err := handler.checkFrame(&hybiFrame.header); err != nil {
+			return nil, handler.fail(CloseProtocolError, err)
+		}
+	}
 	if header := frame.HeaderReader(); header != nil {
 		io.Copy(ioutil.Discard, header)
 	}
 	switch frame.PayloadType() {
 	case ContinuationFrame:
-		frame.(*hybiFrameReader).header.OpCode = handler.payloadType
+		hybiFrame.header.OpCode = handler.payloadType
+		if strict && handler.payloadType == TextFrame && !handler.compressed {
+			return &utf8FrameReader{frame, handler, hybiFrame.header.Fin}, nil
+		}
 	case TextFrame, BinaryFrame:
 		handler.payloadType = frame.PayloadType()
+		handler.compressed = handler.inflater != nil && hybiFrame.header.Rsv[0]
+		fin := hybiFrame.header.Fin
+		if handler.compressed {
+			frame, fin = handler.inflater.newMessage(handler, hybiFrame), true
+		}
+		if strict && handler.payloadType == TextFrame {
+			handler.utf8.reset()
+			return &utf8FrameReader{frame, handler, fin}, nil
+		}
+		return frame, nil
 	case CloseFrame:
-		return nil, io.EOF
+		return nil, handler.handleClose(frame)
 	case PingFrame, PongFrame:
 		b := make([]byte, maxControlFramePayloadLength)
 		n, err := io.ReadFull(frame, b)
@@ -299,26 +353,109 @@ func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (frameReader, er
 			if _, err := handler.WritePong(b[:n]); err != nil {
 				return nil, err
 			}
+		} else {
+			handler.conn.handlePong(b[:n])
 		}
 		return nil, nil
 	}
 	return frame, nil
 }
 
-func (handler *hybiFrameHandler) WriteClose(status int) (err error) {
+// handleClose reads a Close frame sent by the peer and replies to it, unless
+// a Close frame has already been sent. It returns the error reported by
+// subsequent reads.
+// See Section 5.5.1 Close for detail.
+// http://tools.ietf.org/html/draft-ietf-hybi-thewebsocketprotocol-17#section-5.5.1
+func (handler *hybiFrameHandler) handleClose(frame frameReader) error {
+	b := make([]byte, maxControlFramePayloadLength+1)
+	n, err := io.ReadFull(frame, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	io.Copy(ioutil.Discard, frame)
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	status := CloseNoStatusReceived
+	var readErr error = closeErr
+	switch {
+	case n == 0:
+	case n == 1 || n > maxControlFramePayloadLength:
+		status, readErr = CloseProtocolError, ErrBadClosingStatus
+	default:
+		closeErr.Code = int(binary.BigEndian.Uint16(b))
+		closeErr.Reason = string(b[2:n])
+		status = closeErr.Code
+		if !validCloseCode(closeErr.Code) {
+			status, readErr = CloseProtocolError, ErrBadClosingStatus
+		} else if !utf8.ValidString(closeErr.Reason) {
+			status, readErr = CloseInvalidFramePayloadData, ErrBadClosingStatus
+		}
+	}
+	if readErr == closeErr && (status == CloseNormalClosure || status == CloseNoStatusReceived) {
+		readErr = io.EOF
+	}
+	handler.conn.closeErr = readErr
+	if err := handler.WriteClose(status, ""); err != nil {
+		return err
+	}
+	return readErr
+}
+
+// WriteClose sends a Close frame with the given status and reason, unless one
+// has already been sent. A status of CloseNoStatusReceived sends a Close frame
+// without payload.
+func (handler *hybiFrameHandler) WriteClose(status int, reason string) (err error) {
 	handler.conn.wio.Lock()
 	defer handler.conn.wio.Unlock()
+	if handler.conn.closeSent {
+		return nil
+	}
+	handler.conn.closeSent = true
+	// No message can follow the Close frame.
+	handler.conn.releaseWriterLocked()
 	w, err := handler.conn.frameWriterFactory.NewFrameWriter(CloseFrame)
 	if err != nil {
 		return err
 	}
-	msg := make([]byte, 2)
-	binary.BigEndian.PutUint16(msg, uint16(status))
+	var msg []byte
+	if status != CloseNoStatusReceived {
+		msg = make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(msg, uint16(status))
+		msg = append(msg, reason...)
+	}
 	_, err = w.Write(msg)
 	w.Close()
 	return err
 }
 
+// validCloseCode reports whether code may be sent in a Close frame.
+// See Section 7.4 Status Codes for detail.
+// http://tools.ietf.org/html/draft-ietf-hybi-thewebsocketprotocol-17#section-7.4
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		// Reserved for libraries, frameworks and applications.
+		return true
+	}
+	return false
+}
+
+func (handler *hybiFrameHandler) WritePing(msg []byte) (n int, err error) {
+	handler.conn.wio.Lock()
+	defer handler.conn.wio.Unlock()
+	if handler.conn.closeSent {
+		return 0, ErrCloseSent
+	}
+	w, err := handler.conn.frameWriterFactory.NewFrameWriter(PingFrame)
+	if err != nil {
+		return 0, err
+	}
+	n, err = w.Write(msg)
+	w.Close()
+	return n, err
+}
+
 func (handler *hybiFrameHandler) WritePong(msg []byte) (n int, err error) {
 	handler.conn.wio.Lock()
 	defer handler.conn.wio.Unlock()
@@ -343,8 +480,29 @@ func newHybiConn(config *Config, buf *bufio.ReadWriter, rwc io.ReadWriteCloser,
 		frameWriterFactory: hybiFrameWriterFactory{
 			buf.Writer, request == nil},
 		PayloadType:        TextFrame,
-		defaultCloseStatus: closeStatusNormal}
-	ws.frameHandler = &hybiFrameHandler{conn: ws}
+		defaultCloseStatus: CloseNormalClosure}
+	handler := &hybiFrameHandler{conn: ws}
+	if p := config.deflate; p != nil {
+		// Each peer compresses with its own parameters, and decompresses
+		// with those of the other peer.
+		var own *deflater
+		if request == nil {
+			own = newDeflater(p.level, p.clientMaxWindowBits, p.clientNoContextTakeover)
+			handler.inflater = &inflater{noContextTakeover: p.serverNoContextTakeover}
+		} else {
+			own = newDeflater(p.level, p.serverMaxWindowBits, p.serverNoContextTakeover)
+			handler.inflater = &inflater{noContextTakeover: p.clientNoContextTakeover}
+		}
+		ws.frameWriterFactory = deflateFrameWriterFactory{
+			hybiFrameWriterFactory{buf.Writer, request == nil}, own}
+	}
+	ws.frameHandler = handler
+	if config.PingInterval > 0 {
+		ws.pongc = make(chan struct{}, 1)
+		ws.readc = make(chan struct{}, 1)
+		ws.closed = make(chan struct{})
+		go ws.keepalive(handler, config.PingInterval, config.PongTimeout)
+	}
 	return ws
 }
 
@@ -426,7 +584,13 @@ func hybiClientHandshake(config *Config, br *bufio.Reader, bw *bufio.Writer) (er
 	if len(config.Protocol) > 0 {
 		bw.WriteString("Sec-WebSocket-Protocol: " + strings.Join(config.Protocol, ", ") + "\r\n")
 	}
-	// TODO(ukai): send Sec-WebSocket-Extensions.
+	config.deflate = nil
+	if config.Compression != nil {
+		if err := config.Compression.validate(); err != nil {
+			return err
+		}
+		bw.WriteString("Sec-WebSocket-Extensions: " + config.Compression.offer().String() + "\r\n")
+	}
 	err = config.Header.WriteSubset(bw, handshakeHeader)
 	if err != nil {
 		return err
@@ -455,8 +619,9 @@ func hybiClientHandshake(config *Config, br *bufio.Reader, bw *bufio.Writer) (er
 	if resp.Header.Get("Sec-WebSocket-Accept") != string(expectedAccept) {
 		return ErrChallengeResponse
 	}
-	if resp.Header.Get("Sec-WebSocket-Extensions") != "" {
-		return ErrUnsupportedExtensions
+	config.deflate, err = parseDeflateResponse(config.Compression, parseExtensions(resp.Header))
+	if err != nil {
+		return err
 	}
 	offeredProtocol := resp.Header.Get("Sec-WebSocket-Protocol")
 	if offeredProtocol != "" {
@@ -484,7 +649,8 @@ func newHybiClientConn(config *Config, buf *bufio.ReadWriter, rwc io.ReadWriteCl
 // A HybiServerHandshaker performs a server handshake using hybi draft protocol.
 type hybiServerHandshaker struct {
 	*Config
-	accept []byte
+	accept     []byte
+	extensions []extension
 }
 
 func (c *hybiServerHandshaker) ReadHandshake(buf *bufio.Reader, req *http.Request) (code int, err error) {
@@ -527,6 +693,7 @@ func (c *hybiServerHandshaker) ReadHandshake(buf *bufio.Reader, req *http.Reques
 			c.Protocol = append(c.Protocol, strings.TrimSpace(protocols[i]))
 		}
 	}
+	c.extensions = parseExtensions(req.Header)
 	c.accept, err = getNonceAccept([]byte(key))
 	if err != nil {
 		return http.StatusInternalServerError, err
@@ -555,6 +722,13 @@ func (c *hybiServerHandshaker) AcceptHandshake(buf *bufio.Writer) (err error) {
 			return ErrBadWebSocketProtocol
 		}
 	}
+	c.deflate = nil
+	if c.Compression != nil {
+		if err := c.Compression.validate(); err != nil {
+			return err
+		}
+		c.deflate = negotiateDeflate(c.Compression, c.extensions)
+	}
 	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
 	buf.WriteString("Upgrade: websocket\r\n")
 	buf.WriteString("Connection: Upgrade\r\n")
@@ -562,7 +736,9 @@ func (c *hybiServerHandshaker) AcceptHandshake(buf *bufio.Writer) (err error) {
 	if len(c.Protocol) > 0 {
 		buf.WriteString("Sec-WebSocket-Protocol: " + c.Protocol[0] + "\r\n")
 	}
-	// TODO(ukai): send Sec-WebSocket-Extensions.
+	if c.deflate != nil {
+		buf.WriteString("Sec-WebSocket-Extensions: " + c.deflate.String() + "\r\n")
+	}
 	if c.Header != nil {
 		err := c.Header.WriteSubset(buf, handshakeHeader)
 		if err != nil {
@@ -7,12 +7,18 @@ package websocket
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Test the getNonceAccept function with values in
@@ -606,3 +612,677 @@ Sec-WebSocket-Version: 13
 		t.Errorf("handshake expected %q but got %q", expectedResponse, b.String())
 	}
 }
+
+func TestHybiClientHandshakeDeflate(t *testing.T) {
+	b := bytes.NewBuffer([]byte{})
+	bw := bufio.NewWriter(b)
+	br := bufio.NewReader(strings.NewReader(`HTTP/1.1 101 Switching Protocols
+Upgrade: websocket
+Connection: Upgrade
+Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=
+Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_max_window_bits=10
+
+`))
+	config := newConfig(t, "/chat")
+	config.Compression = &CompressionConfig{ClientMaxWindowBits: 12}
+	config.handshakeData = map[string]string{
+		"key": "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+	if err := hybiClientHandshake(config, br, bw); err != nil {
+		t.Fatal("handshake", err)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(b))
+	if err != nil {
+		t.Fatal("read request", err)
+	}
+	if got, want := req.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate; client_max_window_bits=12"; got != want {
+		t.Errorf("Sec-WebSocket-Extensions expected %q but got %q", want, got)
+	}
+	want := &deflateParams{serverNoContextTakeover: true, clientMaxWindowBits: 10}
+	if config.deflate == nil || *config.deflate != *want {
+		t.Errorf("negotiated %+v, want %+v", config.deflate, want)
+	}
+}
+
+func TestHybiClientHandshakeBadExtensions(t *testing.T) {
+	for _, tt := range []struct {
+		compression *CompressionConfig
+		extensions  string
+	}{
+		{nil, "permessage-deflate"},
+		{&CompressionConfig{}, "x-webkit-deflate-frame"},
+		{&CompressionConfig{}, "permessage-deflate, permessage-deflate"},
+		{&CompressionConfig{}, "permessage-deflate; client_max_window_bits=10"},
+		{&CompressionConfig{ServerMaxWindowBits: 10}, "permessage-deflate; server_max_window_bits=12"},
+		{&CompressionConfig{}, "permessage-deflate; server_max_window_bits=7"},
+		{&CompressionConfig{}, "permessage-deflate; server_no_context_takeover; server_no_context_takeover"},
+		{&CompressionConfig{}, "permessage-deflate; unknown"},
+	} {
+		br := bufio.NewReader(strings.NewReader(`HTTP/1.1 101 Switching Protocols
+Upgrade: websocket
+Connection: Upgrade
+Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=
+Sec-WebSocket-Extensions: ` + tt.extensions + `
+
+`))
+		config := newConfig(t, "/chat")
+		config.Compression = tt.compression
+		config.handshakeData = map[string]string{
+			"key": "dGhlIHNhbXBsZSBub25jZQ==",
+		}
+		err := hybiClientHandshake(config, br, bufio.NewWriter(ioutil.Discard))
+		if err != ErrUnsupportedExtensions {
+			t.Errorf("%q: handshake expected %v but got %v", tt.extensions, ErrUnsupportedExtensions, err)
+		}
+	}
+}
+
+func TestHybiServerHandshakeDeflate(t *testing.T) {
+	for _, tt := range []struct {
+		compression *CompressionConfig
+		extensions  string
+		want        string
+	}{{
+		compression: &CompressionConfig{},
+		extensions:  "permessage-deflate; client_max_window_bits",
+		want:        "permessage-deflate",
+	}, {
+		compression: &CompressionConfig{ServerNoContextTakeover: true, ClientMaxWindowBits: 10},
+		extensions:  "permessage-deflate; client_max_window_bits",
+		want:        "permessage-deflate; server_no_context_takeover; client_max_window_bits=10",
+	}, {
+		compression: &CompressionConfig{ServerMaxWindowBits: 12},
+		extensions:  "permessage-deflate; server_max_window_bits=10",
+		want:        "permessage-deflate; server_max_window_bits=10",
+	}, {
+		// The first acceptable offer is chosen.
+		compression: &CompressionConfig{},
+		extensions:  "permessage-deflate; server_max_window_bits=16, x-foo, permessage-deflate; client_no_context_takeover, permessage-deflate",
+		want:        "permessage-deflate; client_no_context_takeover",
+	}, {
+		compression: &CompressionConfig{},
+		extensions:  `permessage-deflate; server_max_window_bits="9"`,
+		want:        "permessage-deflate; server_max_window_bits=9",
+	}, {
+		compression: &CompressionConfig{},
+		extensions:  "permessage-deflate; server_max_window_bits=09, permessage-deflate; foo",
+		want:        "",
+	}, {
+		compression: nil,
+		extensions:  "permessage-deflate",
+		want:        "",
+	}} {
+		config := &Config{Compression: tt.compression}
+		handshaker := &hybiServerHandshaker{Config: config}
+		br := bufio.NewReader(strings.NewReader(`GET /chat HTTP/1.1
+Host: server.example.com
+Upgrade: websocket
+Connection: Upgrade
+Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==
+Origin: http://example.com
+Sec-WebSocket-Version: 13
+Sec-WebSocket-Extensions: ` + tt.extensions + `
+
+`))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Fatal("request", err)
+		}
+		if _, err := handshaker.ReadHandshake(br, req); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		b := bytes.NewBuffer([]byte{})
+		if err := handshaker.AcceptHandshake(bufio.NewWriter(b)); err != nil {
+			t.Fatalf("handshake response failed: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(b), req)
+		if err != nil {
+			t.Fatal("response", err)
+		}
+		if got := resp.Header.Get("Sec-WebSocket-Extensions"); got != tt.want {
+			t.Errorf("%q: Sec-WebSocket-Extensions expected %q but got %q", tt.extensions, tt.want, got)
+		}
+		if (config.deflate != nil) != (tt.want != "") {
+			t.Errorf("%q: negotiated %+v", tt.extensions, config.deflate)
+		}
+	}
+}
+
+// Test decompression of the examples in RFC 7692 section 7.2.3.
+func TestHybiClientReadDeflate(t *testing.T) {
+	wireData := []byte{
+		0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00, // Hello
+		0xc1, 0x05, 0xf2, 0x00, 0x11, 0x00, 0x00, // Hello, using the sliding window
+		0x41, 0x03, 0xf2, 0x48, 0xcd, // fragmented Hello
+		0x89, 0x05, 'h', 'e', 'l', 'l', 'o', // ping
+		0x80, 0x04, 0xc9, 0xc9, 0x07, 0x00,
+		0xc1, 0x01, 0x00, // empty message
+		0x81, 0x05, 'w', 'o', 'r', 'l', 'd', // uncompressed
+	}
+	br := bufio.NewReader(bytes.NewBuffer(wireData))
+	b := bytes.NewBuffer([]byte{})
+	bw := bufio.NewWriter(b)
+	config := newConfig(t, "/")
+	config.deflate = &deflateParams{}
+	conn := newHybiConn(config, bufio.NewReadWriter(br, bw), nil, nil)
+
+	for i, want := range []string{"Hello", "Hello", "Hello", "", "world"} {
+		var got string
+		if err := Message.Receive(conn, &got); err != nil {
+			t.Fatalf("receive message #%d: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("message #%d expected %q but got %q", i, want, got)
+		}
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read expected %v but got %v", io.EOF, err)
+	}
+	if !bytes.Contains(b.Bytes(), []byte{0x8a, 0x85}) {
+		t.Errorf("pong not sent in the middle of a fragmented message: %x", b.Bytes())
+	}
+}
+
+func TestHybiDeflateWrite(t *testing.T) {
+	msg := strings.Repeat(`{"key":"value"}`, 64)
+	for _, tt := range []struct {
+		params        deflateParams
+		contextShared bool
+	}{
+		{deflateParams{}, true},
+		{deflateParams{level: flate.BestCompression}, true},
+		{deflateParams{serverNoContextTakeover: true}, false},
+		{deflateParams{serverMaxWindowBits: 9}, false},
+	} {
+		b := bytes.NewBuffer([]byte{})
+		br := bufio.NewReader(bytes.NewBuffer(nil))
+		bw := bufio.NewWriter(b)
+		config := newConfig(t, "/")
+		config.deflate = &tt.params
+		conn := newHybiConn(config, bufio.NewReadWriter(br, bw), nil, new(http.Request))
+		var lens []int
+		for i := 0; i < 2; i++ {
+			n := b.Len()
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				t.Fatalf("%+v: write: %v", tt.params, err)
+			}
+			lens = append(lens, b.Len()-n)
+		}
+		if wire := b.Bytes(); wire[0] != 0xc1 {
+			t.Errorf("%+v: frame header expected %#x but got %#x", tt.params, 0xc1, wire[0])
+		}
+		if lens[0] >= len(msg) {
+			t.Errorf("%+v: message not compressed: %d bytes", tt.params, lens[0])
+		}
+		if shared := lens[1] < lens[0]; shared != tt.contextShared {
+			t.Errorf("%+v: frame sizes %v; context takeover expected %v", tt.params, lens, tt.contextShared)
+		}
+
+		config = newConfig(t, "/")
+		config.deflate = &tt.params
+		conn = newHybiConn(config, bufio.NewReadWriter(bufio.NewReader(b), bufio.NewWriter(ioutil.Discard)), nil, nil)
+		for i := 0; i < 2; i++ {
+			var got string
+			if err := Message.Receive(conn, &got); err != nil {
+				t.Fatalf("%+v: receive: %v", tt.params, err)
+			}
+			if got != msg {
+				t.Errorf("%+v: message #%d expected %q but got %q", tt.params, i, msg, got)
+			}
+		}
+	}
+}
+
+func TestHybiClientReadClose(t *testing.T) {
+	for _, tt := range []struct {
+		payload   []byte
+		err       error
+		replyCode int // -1 for a Close frame without payload
+	}{
+		{[]byte{0x03, 0xe9, 'b', 'y', 'e'}, &CloseError{CloseGoingAway, "bye"}, CloseGoingAway},
+		{[]byte{0x0b, 0xb8}, &CloseError{3000, ""}, 3000},
+		{[]byte{0x03, 0xe8, 'o', 'k'}, io.EOF, CloseNormalClosure},
+		{nil, io.EOF, -1},
+		{[]byte{0x03}, ErrBadClosingStatus, CloseProtocolError},
+		{[]byte{0x03, 0xec}, ErrBadClosingStatus, CloseProtocolError}, // 1004
+		{[]byte{0x03, 0xed}, ErrBadClosingStatus, CloseProtocolError}, // 1005
+		{[]byte{0x03, 0xe7}, ErrBadClosingStatus, CloseProtocolError}, // 999
+		{[]byte{0x13, 0x88}, ErrBadClosingStatus, CloseProtocolError}, // 5000
+		{[]byte{0x03, 0xe8, 0xff}, ErrBadClosingStatus, CloseInvalidFramePayloadData},
+	} {
+		wireData := []byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o', 0x88, byte(len(tt.payload))}
+		wireData = append(wireData, tt.payload...)
+		br := bufio.NewReader(bytes.NewBuffer(wireData))
+		b := bytes.NewBuffer([]byte{})
+		conn := newHybiConn(newConfig(t, "/"), bufio.NewReadWriter(br, bufio.NewWriter(b)), nil, nil)
+
+		var msg string
+		if err := Message.Receive(conn, &msg); err != nil || msg != "hello" {
+			t.Fatalf("%x: receive message got %q, %v", tt.payload, msg, err)
+		}
+		for i := 0; i < 2; i++ {
+			_, err := conn.Read(make([]byte, 512))
+			if !reflect.DeepEqual(err, tt.err) {
+				t.Errorf("%x: read #%d expected %v but got %v", tt.payload, i, tt.err, err)
+			}
+			if tt.err != ErrBadClosingStatus && !errors.Is(err, io.EOF) {
+				t.Errorf("%x: read #%d error %v does not match io.EOF", tt.payload, i, err)
+			}
+		}
+		if _, err := conn.Write([]byte("hello")); err != ErrCloseSent {
+			t.Errorf("%x: write expected %v but got %v", tt.payload, ErrCloseSent, err)
+		}
+
+		frameReaderFactory := &hybiFrameReaderFactory{bufio.NewReader(b)}
+		r, err := frameReaderFactory.NewFrameReader()
+		if err != nil {
+			t.Fatalf("%x: reading reply: %v", tt.payload, err)
+		}
+		reply, _ := ioutil.ReadAll(r)
+		if r.PayloadType() != CloseFrame {
+			t.Errorf("%x: reply type expected %d but got %d", tt.payload, CloseFrame, r.PayloadType())
+		}
+		replyCode := -1
+		if len(reply) >= 2 {
+			replyCode = int(reply[0])<<8 | int(reply[1])
+		}
+		if replyCode != tt.replyCode || len(reply) > 2 {
+			t.Errorf("%x: reply expected status %d but got %x", tt.payload, tt.replyCode, reply)
+		}
+		if _, err := frameReaderFactory.NewFrameReader(); err != io.EOF {
+			t.Errorf("%x: more than one Close frame sent", tt.payload)
+		}
+	}
+}
+
+func TestHybiCloseWithStatus(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	config := newConfig(t, "/")
+	config.CloseTimeout = 50 * time.Millisecond
+	conn := newHybiConn(config, nil, c1, nil)
+
+	if err := conn.CloseWithStatus(CloseNoStatusReceived, ""); err != ErrBadClosingStatus {
+		t.Errorf("CloseWithStatus(%d) expected %v but got %v", CloseNoStatusReceived, ErrBadClosingStatus, err)
+	}
+	if err := conn.CloseWithStatus(CloseNormalClosure, strings.Repeat("x", 124)); err != ErrBadClosingStatus {
+		t.Errorf("CloseWithStatus with long reason expected %v but got %v", ErrBadClosingStatus, err)
+	}
+
+	// The peer never replies, so CloseWithStatus must time out.
+	read := make(chan []byte, 1)
+	go func() {
+		r, err := (&hybiFrameReaderFactory{bufio.NewReader(c2)}).NewFrameReader()
+		if err != nil {
+			close(read)
+			return
+		}
+		b, _ := ioutil.ReadAll(r)
+		read <- b
+		io.Copy(ioutil.Discard, c2)
+	}()
+	start := time.Now()
+	if err := conn.CloseWithStatus(ClosePolicyViolation, "go away"); err != nil {
+		t.Errorf("CloseWithStatus: %v", err)
+	}
+	if d := time.Since(start); d < config.CloseTimeout {
+		t.Errorf("CloseWithStatus returned after %v, before the close timeout", d)
+	}
+	if got, want := <-read, []byte("\x03\xf0go away"); !bytes.Equal(got, want) {
+		t.Errorf("Close frame payload expected %q but got %q", want, got)
+	}
+}
+
+func TestHybiNextReader(t *testing.T) {
+	wireData := []byte{
+		0x01, 0x03, 'H', 'e', 'l', // fragmented text
+		0x89, 0x05, 'h', 'e', 'l', 'l', 'o', // ping
+		0x00, 0x00, // empty continuation
+		0x80, 0x02, 'l', 'o',
+		0x02, 0x03, 'b', 'i', 'n', // fragmented binary, partially read
+		0x80, 0x03, 'a', 'r', 'y',
+		0x81, 0x05, 'w', 'o', 'r', 'l', 'd',
+	}
+	br := bufio.NewReader(bytes.NewBuffer(wireData))
+	b := bytes.NewBuffer([]byte{})
+	conn := newHybiConn(newConfig(t, "/"), bufio.NewReadWriter(br, bufio.NewWriter(b)), nil, nil)
+
+	payloadType, r, err := conn.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader: %v", err)
+	}
+	if payloadType != TextFrame {
+		t.Errorf("payload type expected %d but got %d", TextFrame, payloadType)
+	}
+	if msg, err := ioutil.ReadAll(r); err != nil || string(msg) != "Hello" {
+		t.Errorf("read message expected %q but got %q, %v", "Hello", msg, err)
+	}
+	if !bytes.HasPrefix(b.Bytes(), []byte{0x8a, 0x85}) {
+		t.Errorf("pong not sent in the middle of a fragmented message: %x", b.Bytes())
+	}
+
+	payloadType, r, err = conn.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader: %v", err)
+	}
+	if payloadType != BinaryFrame {
+		t.Errorf("payload type expected %d but got %d", BinaryFrame, payloadType)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Errorf("read: %v", err)
+	}
+
+	// The rest of the binary message is discarded.
+	_, r2, err := conn.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader: %v", err)
+	}
+	if msg, err := ioutil.ReadAll(r2); err != nil || string(msg) != "world" {
+		t.Errorf("read message expected %q but got %q, %v", "world", msg, err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != errStaleReader {
+		t.Errorf("read from stale reader expected %v but got %v", errStaleReader, err)
+	}
+	if _, _, err := conn.NextReader(); err != io.EOF {
+		t.Errorf("NextReader expected %v but got %v", io.EOF, err)
+	}
+}
+
+func TestHybiNextWriter(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 3*messageFragmentSize/16+1)
+	for _, deflate := range []*deflateParams{nil, {}} {
+		b := bytes.NewBuffer([]byte{})
+		config := newConfig(t, "/")
+		config.deflate = deflate
+		conn := newHybiConn(config, bufio.NewReadWriter(bufio.NewReader(b), bufio.NewWriter(b)), nil, new(http.Request))
+		w, err := conn.NextWriter(BinaryFrame)
+		if err != nil {
+			t.Fatalf("NextWriter: %v", err)
+		}
+		for p := msg; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			p = p[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if _, err := w.Write([]byte("x")); err != errWriterClosed {
+			t.Errorf("write after close expected %v but got %v", errWriterClosed, err)
+		}
+		if _, err := conn.Write([]byte("next")); err != nil {
+			t.Fatalf("write next message: %v", err)
+		}
+
+		var headers []hybiFrameHeader
+		wire := bytes.NewBuffer(append([]byte(nil), b.Bytes()...))
+		frameReaderFactory := &hybiFrameReaderFactory{bufio.NewReader(wire)}
+		for {
+			r, err := frameReaderFactory.NewFrameReader()
+			if err != nil {
+				break
+			}
+			io.Copy(ioutil.Discard, r)
+			headers = append(headers, r.(*hybiFrameReader).header)
+		}
+		if len(headers) != 5 {
+			t.Fatalf("deflate %v: expected 4 fragments and a message, got %d frames", deflate != nil, len(headers))
+		}
+		for i, h := range headers[:4] {
+			wantOpCode := byte(ContinuationFrame)
+			if i == 0 {
+				wantOpCode = BinaryFrame
+			}
+			if h.OpCode != wantOpCode || h.Fin != (i == 3) || h.Rsv[0] != (deflate != nil && i == 0) {
+				t.Errorf("deflate %v: frame #%d: unexpected header %+v", deflate != nil, i, h)
+			}
+		}
+
+		config = newConfig(t, "/")
+		config.deflate = deflate
+		conn = newHybiConn(config, bufio.NewReadWriter(bufio.NewReader(b), bufio.NewWriter(ioutil.Discard)), nil, nil)
+		_, r, err := conn.NextReader()
+		if err != nil {
+			t.Fatalf("NextReader: %v", err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("deflate %v: read %d bytes, %v; want %d bytes", deflate != nil, len(got), err, len(msg))
+		}
+		var next string
+		if err := Message.Receive(conn, &next); err != nil || next != "next" {
+			t.Errorf("deflate %v: receive next message got %q, %v", deflate != nil, next, err)
+		}
+	}
+}
+
+// bufferConn is an in-memory connection for a Conn's rwc.
+type bufferConn struct{ bytes.Buffer }
+
+func (*bufferConn) Close() error { return nil }
+
+func TestHybiNextWriterAbandoned(t *testing.T) {
+	b := &bufferConn{}
+	conn := newHybiConn(newConfig(t, "/"), bufio.NewReadWriter(bufio.NewReader(b), bufio.NewWriter(b)), b, new(http.Request))
+	w, err := conn.NextWriter(BinaryFrame)
+	if err != nil {
+		t.Fatalf("NextWriter: %v", err)
+	}
+	if _, err := w.Write([]byte("never closed")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("next"))
+		errc <- err
+	}()
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != ErrCloseSent {
+			t.Errorf("write waiting for the writer got %v; want %v", err, ErrCloseSent)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still blocked by an abandoned writer after Close")
+	}
+	if _, err := conn.NextWriter(TextFrame); err != ErrCloseSent {
+		t.Errorf("NextWriter after Close got %v; want %v", err, ErrCloseSent)
+	}
+	if err := w.Close(); err != ErrCloseSent {
+		t.Errorf("closing the abandoned writer got %v; want %v", err, ErrCloseSent)
+	}
+}
+
+type errorWriter struct{}
+
+func (errorWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestHybiNextWriterError(t *testing.T) {
+	b := &bufferConn{}
+	conn := newHybiConn(newConfig(t, "/"), bufio.NewReadWriter(bufio.NewReader(b), bufio.NewWriter(errorWriter{})), b, new(http.Request))
+	w, err := conn.NextWriter(BinaryFrame)
+	if err != nil {
+		t.Fatalf("NextWriter: %v", err)
+	}
+	if _, err := w.Write(make([]byte, 2*messageFragmentSize)); err == nil {
+		t.Fatal("write succeeded; want error")
+	}
+
+	// The failed writer does not block other writes.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("next"))
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("write to a broken connection succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked by a writer which failed")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("closing the failed writer succeeded; want the write error")
+	}
+}
+
+func TestHybiStrict(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		wireData  []byte
+		deflate   bool
+		msgs      []string
+		receive   bool // read the last message with Receive
+		err       error
+		replyCode int // 0 if no Close frame is sent
+	}{
+		{
+			name:     "valid",
+			wireData: []byte{0x81, 0x03, 0xe2, 0x82, 0xac, 0x01, 0x01, 0xe2, 0x89, 0x00, 0x80, 0x02, 0x82, 0xac},
+			msgs:     []string{"€", "€"},
+			err:      io.EOF,
+		},
+		{
+			name:     "compressed",
+			wireData: []byte{0x41, 0x03, 0xf2, 0x48, 0xcd, 0x80, 0x04, 0xc9, 0xc9, 0x07, 0x00},
+			deflate:  true,
+			msgs:     []string{"Hello"},
+			err:      io.EOF,
+		},
+		{
+			name:      "reserved bits",
+			wireData:  []byte{0xa1, 0x01, 'a'},
+			err:       ErrBadFrame,
+			replyCode: CloseProtocolError,
+		},
+		{
+			name:      "compression not negotiated",
+			wireData:  []byte{0xc1, 0x01, 0x00},
+			err:       ErrBadFrame,
+			replyCode: CloseProtocolError,
+		},
+		{
+			name:      "compressed control frame",
+			wireData:  []byte{0xc9, 0x00},
+			deflate:   true,
+			err:       ErrBadFrame,
+			replyCode: CloseProtocolError,
+		},
+		{
+			name:      "unknown opcode",
+			wireData:  []byte{0x83, 0x00},
+			err:       ErrBadFrame,
+			replyCode: CloseProtocolError,
+		},
+		{
+			name:      "fragmented ping",
+			wireData:  []byte{0x09, 0x00, 0x80, 0x00},
+			err:       ErrBadFrame,
+			replyCode: CloseProtocolError,
+		},
+		{
+			name:      "long ping",
+			wireData:  append([]byte{0x89, 0x7e, 0x00, 0x7e}, make([]byte, 126)...),
+			err:       ErrBadFrame,
+			replyCode: CloseProtocolError,
+		},
+		{
+			name:      "unexpected continuation",
+			wireData:  []byte{0x81, 0x01, 'a', 0x80, 0x01, 'b'},
+			msgs:      []string{"a"},
+			err:       ErrBadFrame,
+			replyCode: CloseProtocolError,
+		},
+		{
+			name:      "invalid UTF-8",
+			wireData:  []byte{0x81, 0x02, 0xc0, 0xaf},
+			err:       ErrInvalidUTF8,
+			replyCode: CloseInvalidFramePayloadData,
+		},
+		{
+			name:      "invalid UTF-8 across fragments",
+			wireData:  []byte{0x01, 0x01, 0xed, 0x80, 0x02, 0xa0, 0x80},
+			err:       ErrInvalidUTF8,
+			replyCode: CloseInvalidFramePayloadData,
+		},
+		{
+			name:      "truncated UTF-8",
+			wireData:  []byte{0x81, 0x01, 0xe2},
+			err:       ErrInvalidUTF8,
+			replyCode: CloseInvalidFramePayloadData,
+		},
+		{
+			name:      "message too big",
+			wireData:  []byte{0x82, 0x06, 'h', 'e', 'l', 'l', 'o', '!'},
+			receive:   true,
+			err:       ErrFrameTooLarge,
+			replyCode: CloseMessageTooBig,
+		},
+	} {
+		br := bufio.NewReader(bytes.NewBuffer(tt.wireData))
+		b := bytes.NewBuffer([]byte{})
+		config := newConfig(t, "/")
+		config.Strict = true
+		if tt.deflate {
+			config.deflate = &deflateParams{}
+		}
+		conn := newHybiConn(config, bufio.NewReadWriter(br, bufio.NewWriter(b)), nil, nil)
+		conn.MaxPayloadBytes = 5
+
+		for i, want := range tt.msgs {
+			_, r, err := conn.NextReader()
+			if err != nil {
+				t.Fatalf("%s: message #%d: %v", tt.name, i, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s: reading message #%d: %v", tt.name, i, err)
+			}
+			if string(got) != want {
+				t.Errorf("%s: message #%d expected %q but got %q", tt.name, i, want, got)
+			}
+		}
+		var err error
+		if tt.receive {
+			var msg []byte
+			err = Message.Receive(conn, &msg)
+		} else {
+			var r io.Reader
+			if _, r, err = conn.NextReader(); err == nil {
+				_, err = ioutil.ReadAll(r)
+			}
+		}
+		if err != tt.err {
+			t.Errorf("%s: reading expected %v but got %v", tt.name, tt.err, err)
+		}
+		if tt.replyCode != 0 {
+			if _, err := conn.Read(make([]byte, 1)); err != tt.err {
+				t.Errorf("%s: read after failure expected %v but got %v", tt.name, tt.err, err)
+			}
+		}
+
+		replyCode := 0
+		frameReaderFactory := &hybiFrameReaderFactory{bufio.NewReader(b)}
+		for {
+			r, err := frameReaderFactory.NewFrameReader()
+			if err != nil {
+				break
+			}
+			reply, _ := ioutil.ReadAll(r)
+			if r.PayloadType() == CloseFrame && len(reply) == 2 {
+				replyCode = int(reply[0])<<8 | int(reply[1])
+			}
+		}
+		if replyCode != tt.replyCode {
+			t.Errorf("%s: reply expected status %d but got %d", tt.name, tt.replyCode, replyCode)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPongTimeout is returned by reads and writes on a Conn that was closed
+// because the peer did not reply to a ping within Config.PongTimeout.
+var ErrPongTimeout = errors.New("websocket: pong timeout")
+
+// keepalive pings the peer every interval, and closes the connection if no
+// pong is received within timeout of a ping. Pongs are only received by
+// reads, so the timeout only expires while a read is in progress: once it
+// has passed, the next read has another timeout to receive the pong.
+func (ws *Conn) keepalive(handler *hybiFrameHandler, interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ws.closed:
+			return
+		}
+		select {
+		case <-ws.pongc: // unsolicited or late pong
+		default:
+		}
+		if _, err := handler.WritePing(nil); err != nil {
+			return
+		}
+		if !ws.waitPong(t, timeout) {
+			return
+		}
+		t.Reset(interval)
+	}
+}
+
+// waitPong waits for a pong, using t to time out reads. It reports
+// whether one was received before the connection timed out or was closed.
+func (ws *Conn) waitPong(t *time.Timer, timeout time.Duration) bool {
+	for {
+		t.Reset(timeout)
+		select {
+		case <-ws.pongc:
+			if !t.Stop() {
+				<-t.C
+			}
+			return true
+		case <-t.C:
+		case <-ws.closed:
+			return false
+		}
+		// Drain the signal of reads that have already begun,
+		// which readers reflects.
+		select {
+		case <-ws.readc:
+		default:
+		}
+		if atomic.LoadInt32(&ws.readers) > 0 {
+			atomic.StoreInt32(&ws.pongTimedOut, 1)
+			ws.rwc.Close()
+			return false
+		}
+		// Nothing is reading the pong; wait until something does.
+		select {
+		case <-ws.pongc:
+			return true
+		case <-ws.readc:
+		case <-ws.closed:
+			return false
+		}
+	}
+}
+
+// beginRead and endRead bracket reads of the connection, which may
+// receive the pong the keepalive goroutine is waiting for.
+func (ws *Conn) beginRead() {
+	if ws.readc == nil {
+		return
+	}
+	atomic.AddInt32(&ws.readers, 1)
+	select {
+	case ws.readc <- struct{}{}:
+	default:
+	}
+}
+
+func (ws *Conn) endRead() {
+	if ws.readc != nil {
+		atomic.AddInt32(&ws.readers, -1)
+	}
+}
+
+// handlePong is called by the frame handler when a Pong frame is received.
+func (ws *Conn) handlePong(msg []byte) {
+	if ws.pongc != nil {
+		select {
+		case ws.pongc <- struct{}{}:
+		default:
+		}
+	}
+	if ws.config.OnPong != nil {
+		ws.config.OnPong(ws, msg)
+	}
+}
+
+// stopKeepalive stops the keepalive goroutine, if any.
+func (ws *Conn) stopKeepalive() {
+	if ws.closed != nil {
+		ws.closeOnce.Do(func() { close(ws.closed) })
+	}
+}
+
+// keepaliveErr returns ErrPongTimeout in place of err if the connection
+// was closed for lack of a pong.
+func (ws *Conn) keepaliveErr(err error) error {
+	if err != nil && atomic.LoadInt32(&ws.pongTimedOut) != 0 {
+		return ErrPongTimeout
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// ErrInvalidUTF8 is returned by reads in strict mode when a text message
+// is not valid UTF-8.
+var ErrInvalidUTF8 = &ProtocolError{"invalid UTF-8 in text message"}
+
+// checkFrame validates the header of a frame received in strict mode.
+// See Section 5.2 Base Framing Protocol for detail.
+// http://tools.ietf.org/html/draft-ietf-hybi-thewebsocketprotocol-17#section-5.2
+func (handler *hybiFrameHandler) checkFrame(header *hybiFrameHeader) error {
+	if header.Rsv[1] || header.Rsv[2] {
+		return ErrBadFrame
+	}
+	switch header.OpCode {
+	case ContinuationFrame:
+		if !handler.fragmented || header.Rsv[0] {
+			return ErrBadFrame
+		}
+	case TextFrame, BinaryFrame:
+		if handler.fragmented || header.Rsv[0] && handler.inflater == nil {
+			return ErrBadFrame
+		}
+	case CloseFrame, PingFrame, PongFrame:
+		// Control frames must not be fragmented or compressed.
+		// See Section 5.5 Control Frames for detail.
+		if !header.Fin || header.Rsv[0] || header.Length > maxControlFramePayloadLength {
+			return ErrBadFrame
+		}
+		return nil
+	default:
+		return ErrBadFrame
+	}
+	handler.fragmented = !header.Fin
+	return nil
+}
+
+// fail fails the connection after the peer violated the protocol, sending
+// a Close frame with status. Subsequent reads return err.
+func (handler *hybiFrameHandler) fail(status int, err error) error {
+	handler.conn.closeErr = err
+	handler.WriteClose(status, "")
+	return err
+}
+
+// A utf8Validator validates UTF-8 text written to it in pieces, which may
+// split encoded runes.
+type utf8Validator struct {
+	partial [utf8.UTFMax]byte // incomplete rune at the end of the last write
+	n       int
+}
+
+func (v *utf8Validator) reset() {
+	v.n = 0
+}
+
+// write reports whether p, following the previous writes, is valid UTF-8
+// so far.
+func (v *utf8Validator) write(p []byte) bool {
+	for v.n > 0 && len(p) > 0 {
+		v.partial[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if utf8.FullRune(v.partial[:v.n]) {
+			if r, size := utf8.DecodeRune(v.partial[:v.n]); r == utf8.RuneError && size == 1 {
+				return false
+			}
+			v.n = 0
+		}
+	}
+	for len(p) > 0 {
+		if p[0] < utf8.RuneSelf {
+			p = p[1:]
+			continue
+		}
+		if !utf8.FullRune(p) {
+			v.n = copy(v.partial[:], p)
+			break
+		}
+		r, size := utf8.DecodeRune(p)
+		if r == utf8.RuneError && size == 1 {
+			return false
+		}
+		p = p[size:]
+	}
+	return true
+}
+
+// complete reports whether the text written so far does not end in the
+// middle of a rune.
+func (v *utf8Validator) complete() bool {
+	return v.n == 0
+}
+
+// A utf8FrameReader validates the payload of a text frame read in strict
+// mode, failing the connection with CloseInvalidFramePayloadData on
+// invalid UTF-8.
+type utf8FrameReader struct {
+	frameReader
+	handler *hybiFrameHandler
+	fin     bool // whether the frame ends the message
+}
+
+func (r *utf8FrameReader) Read(p []byte) (n int, err error) {
+	n, err = r.frameReader.Read(p)
+	v := &r.handler.utf8
+	if !v.write(p[:n]) || err == io.EOF && r.fin && !v.complete() {
+		return 0, r.handler.fail(CloseInvalidFramePayloadData, ErrInvalidUTF8)
+	}
+	return n, err
+}
+
+// readsMessage reports whether frame reads a whole message rather than a
+// single frame of it.
+func readsMessage(frame frameReader) bool {
+	switch f := frame.(type) {
+	case *inflateFrameReader:
+		return true
+	case *utf8FrameReader:
+		return readsMessage(f.frameReader)
+	}
+	return false
+}
@@ -21,8 +21,12 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
+	"unicode/utf8"
+
+	"github.com/ChillAndImprove/net/proxy"
 )
 
 const (
@@ -39,6 +43,26 @@ const (
 	UnknownFrame      = 255
 
 	DefaultMaxPayloadBytes = 32 << 20 // 32MB
+
+	DefaultCloseTimeout = 5 * time.Second
+)
+
+// Close status codes, as defined in RFC 6455, section 7.4.1.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerError     = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+	CloseTLSHandshake            = 1015
 )
 
 // ProtocolError represents WebSocket protocol errors.
@@ -65,6 +89,39 @@ var (
 	ErrNotSupported         = &ProtocolError{"not supported"}
 )
 
+// CloseError is returned by Read and Codec's Receive method once the peer has
+// started the closing handshake with a status code other than
+// CloseNormalClosure. A Close frame with CloseNormalClosure or without a
+// status code is reported as io.EOF instead.
+//
+// A CloseError matches io.EOF with errors.Is, so that code which only
+// cares about the end of the stream can treat all closures alike.
+type CloseError struct {
+	// Code is the status code sent by the peer, or CloseNoStatusReceived
+	// if its Close frame had no payload.
+	Code int
+
+	// Reason is the reason sent by the peer, if any.
+	Reason string
+}
+
+func (err *CloseError) Error() string {
+	s := "websocket: close " + strconv.Itoa(err.Code)
+	if err.Reason != "" {
+		s += ": " + err.Reason
+	}
+	return s
+}
+
+// Is reports whether target is io.EOF.
+func (err *CloseError) Is(target error) bool {
+	return target == io.EOF
+}
+
+// ErrCloseSent is returned when writing a message to a Conn after a Close
+// frame has been sent.
+var ErrCloseSent = errors.New("websocket: close sent")
+
 // ErrFrameTooLarge is returned by Codec's Receive method if payload size
 // exceeds limit set by Conn.MaxPayloadBytes
 var ErrFrameTooLarge = errors.New("websocket: frame payload size exceeds limit")
@@ -100,7 +157,61 @@ type Config struct {
 	// Dialer used when opening websocket connections.
 	Dialer *net.Dialer
 
+	// Proxy, if non-nil, returns the URL of the proxy used to reach a
+	// WebSocket server, or nil to connect to it directly. The server
+	// location is passed with its ws or wss scheme replaced by http or
+	// https, so that functions such as httpproxy.Config.ProxyFunc may be
+	// used. Proxies are dialed with proxy.FromURL, so HTTP proxies are
+	// tunneled through with the CONNECT method. Credentials in the proxy
+	// URL are used to authenticate with the proxy.
+	Proxy func(*url.URL) (*url.URL, error)
+
+	// ProxyDialer, if non-nil, is used to connect to WebSocket servers,
+	// for example through a dialer returned by proxy.FromEnvironment. It
+	// takes precedence over Proxy.
+	ProxyDialer proxy.ContextDialer
+
+	// PingInterval, if non-zero, is the interval at which a Conn sends
+	// Ping frames to the peer. If the peer does not reply with a Pong
+	// frame within PongTimeout, the connection is closed and subsequent
+	// reads and writes fail with ErrPongTimeout.
+	PingInterval time.Duration
+
+	// PongTimeout is the time to wait for a Pong frame after sending a
+	// Ping frame. If zero, PingInterval is used. Pongs are only received
+	// while the connection is being read, so only time spent reading
+	// counts: a connection that is only written to is pinged, but not
+	// closed for lack of a pong.
+	PongTimeout time.Duration
+
+	// OnPong, if non-nil, is called with the payload of each Pong frame
+	// received, on the goroutine reading ws. It must not read from ws.
+	OnPong func(ws *Conn, data []byte)
+
+	// CloseTimeout is the time CloseWithStatus waits for the peer's
+	// Close frame. If zero, DefaultCloseTimeout is used.
+	CloseTimeout time.Duration
+
+	// Compression, if non-nil, enables the permessage-deflate extension.
+	// A client offers it in the opening handshake; a server accepts it
+	// if offered by the client.
+	Compression *CompressionConfig
+
+	// Strict enables strict validation of the frames received, as
+	// required by RFC 6455. The connection is failed with status
+	// CloseProtocolError on reserved bits that no extension defined,
+	// unknown opcodes, fragmented or oversized control frames and
+	// unexpected continuation frames, and with status
+	// CloseInvalidFramePayloadData on text messages that are not valid
+	// UTF-8. Messages larger than MaxPayloadBytes received by Receive
+	// fail it with status CloseMessageTooBig.
+	Strict bool
+
 	handshakeData map[string]string
+
+	// deflate holds the negotiated permessage-deflate parameters, or nil
+	// if messages are not compressed.
+	deflate *deflateParams
 }
 
 // serverHandshaker is an interface to handle WebSocket server side handshake.
@@ -150,11 +261,15 @@ type frameWriter interface {
 // frameWriterFactory is an interface to create new frame writer.
 type frameWriterFactory interface {
 	NewFrameWriter(payloadType byte) (w frameWriter, err error)
+
+	// NewFragmentWriter creates a frame writer for a fragment of a message.
+	// first and fin report whether it is the first and the final fragment.
+	NewFragmentWriter(payloadType byte, first, fin bool) (w frameWriter, err error)
 }
 
 type frameHandler interface {
 	HandleFrame(frame frameReader) (r frameReader, err error)
-	WriteClose(status int) (err error)
+	WriteClose(status int, reason string) (err error)
 }
 
 // Conn represents a WebSocket connection.
@@ -170,14 +285,27 @@ type Conn struct {
 	rio sync.Mutex
 	frameReaderFactory
 	frameReader
+	msgReader *messageReader // last reader returned by NextReader
+	closeErr  error          // returned by reads once a Close frame was received or the connection failed
 
+	mio sync.Mutex // held while writing a message
 	wio sync.Mutex
 	frameWriterFactory
+	closeSent bool
+	msgWriter *messageWriter // open writer holding mio; guarded by wio
 
 	frameHandler
 	PayloadType        byte
 	defaultCloseStatus int
 
+	// keepalive state, set if Config.PingInterval is non-zero
+	pongc        chan struct{}
+	readc        chan struct{} // signaled when a read begins
+	closed       chan struct{}
+	closeOnce    sync.Once
+	pongTimedOut int32 // atomic
+	readers      int32 // atomic; reads in progress
+
 	// MaxPayloadBytes limits the size of frame payload received over Conn
 	// by Codec's Receive method. If zero, DefaultMaxPayloadBytes is used.
 	MaxPayloadBytes int
@@ -188,10 +316,18 @@ type Conn struct {
 // if msg is not large enough for the frame data, it fills the msg and next Read
 // will read the rest of the frame data.
 // it reads Text frame or Binary frame.
+// once the peer has sent a Close frame, it returns io.EOF or a *CloseError.
 func (ws *Conn) Read(msg []byte) (n int, err error) {
+	defer func() { err = ws.keepaliveErr(err) }()
 	ws.rio.Lock()
 	defer ws.rio.Unlock()
+	ws.beginRead()
+	defer ws.endRead()
+	ws.msgReader = nil
 again:
+	if ws.closeErr != nil {
+		return 0, ws.closeErr
+	}
 	if ws.frameReader == nil {
 		frame, err := ws.frameReaderFactory.NewFrameReader()
 		if err != nil {
@@ -219,8 +355,14 @@ again:
 // Write implements the io.Writer interface:
 // it writes data as a frame to the WebSocket connection.
 func (ws *Conn) Write(msg []byte) (n int, err error) {
+	defer func() { err = ws.keepaliveErr(err) }()
+	ws.mio.Lock()
+	defer ws.mio.Unlock()
 	ws.wio.Lock()
 	defer ws.wio.Unlock()
+	if ws.closeSent {
+		return 0, ErrCloseSent
+	}
 	w, err := ws.frameWriterFactory.NewFrameWriter(ws.PayloadType)
 	if err != nil {
 		return 0, err
@@ -230,9 +372,243 @@ func (ws *Conn) Write(msg []byte) (n int, err error) {
 	return n, err
 }
 
+// messageFragmentSize is the payload size of the frames written by the
+// writers returned by NextWriter.
+const messageFragmentSize = 32 << 10
+
+var errStaleReader = errors.New("websocket: read from a message reader after NextReader or Read")
+
+// NextReader returns the payload type of the next message received from the
+// peer, and a reader for it. Unlike Read, which reads a frame at a time, the
+// reader spans the continuation frames of a fragmented message and returns
+// io.EOF at the end of the message. Control frames received meanwhile are
+// handled as by Read.
+//
+// Any unread part of the previous message is discarded. The reader is no
+// longer valid after the next call to NextReader, Read or Codec's Receive
+// method.
+func (ws *Conn) NextReader() (payloadType byte, r io.Reader, err error) {
+	defer func() { err = ws.keepaliveErr(err) }()
+	ws.rio.Lock()
+	defer ws.rio.Unlock()
+	ws.beginRead()
+	defer ws.endRead()
+	if mr := ws.msgReader; mr != nil {
+		if err := mr.discard(); err != nil {
+			return UnknownFrame, nil, err
+		}
+		ws.msgReader = nil
+	}
+	if ws.frameReader != nil {
+		if _, err := io.Copy(ioutil.Discard, ws.frameReader); err != nil {
+			return UnknownFrame, nil, err
+		}
+		ws.frameReader = nil
+	}
+	for {
+		if ws.closeErr != nil {
+			return UnknownFrame, nil, ws.closeErr
+		}
+		frame, err := ws.frameReaderFactory.NewFrameReader()
+		if err != nil {
+			return UnknownFrame, nil, err
+		}
+		header := frame.(*hybiFrameReader).header
+		frame, err = ws.frameHandler.HandleFrame(frame)
+		if err != nil {
+			return UnknownFrame, nil, err
+		}
+		if frame == nil {
+			continue
+		}
+		if header.OpCode == ContinuationFrame {
+			// The rest of a message partially consumed by Read.
+			if _, err := io.Copy(ioutil.Discard, frame); err != nil {
+				return UnknownFrame, nil, err
+			}
+			continue
+		}
+		// A compressed message is read as a whole by its frame reader.
+		ws.msgReader = &messageReader{ws: ws, frame: frame, fin: header.Fin || readsMessage(frame)}
+		return frame.PayloadType(), ws.msgReader, nil
+	}
+}
+
+// A messageReader reads a message across its continuation frames.
+type messageReader struct {
+	ws    *Conn
+	frame frameReader
+	fin   bool
+	err   error
+}
+
+func (r *messageReader) Read(p []byte) (n int, err error) {
+	r.ws.rio.Lock()
+	defer r.ws.rio.Unlock()
+	r.ws.beginRead()
+	defer r.ws.endRead()
+	n, err = r.read(p)
+	return n, r.ws.keepaliveErr(err)
+}
+
+// read is like Read, but requires r.ws.rio to be held.
+func (r *messageReader) read(p []byte) (n int, err error) {
+	if r.ws.msgReader != r {
+		return 0, errStaleReader
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	for {
+		n, err = r.frame.Read(p)
+		if n > 0 || err != io.EOF {
+			if err != nil && err != io.EOF {
+				r.err = err
+			}
+			return n, r.err
+		}
+		if r.fin {
+			r.err = io.EOF
+			return 0, r.err
+		}
+		frame, fin, err := nextContinuation(r.ws)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.frame, r.fin = frame, fin
+	}
+}
+
+// discard reads the rest of the message. It requires r.ws.rio to be held.
+func (r *messageReader) discard() error {
+	b := make([]byte, 512)
+	for {
+		_, err := r.read(b)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// NextWriter returns a writer for a new message of the given payload type,
+// TextFrame or BinaryFrame. The message is sent as a sequence of frames as
+// data is written to it, and is completed when the writer is closed.
+//
+// No other message can be written until the writer is closed, but control
+// frames, such as replies to pings, may be sent in between its frames.
+// A write error also ends the message. Sending a Close frame ends it too,
+// so that a writer which is never closed does not block later writes:
+// they return ErrCloseSent.
+func (ws *Conn) NextWriter(payloadType byte) (io.WriteCloser, error) {
+	if payloadType != TextFrame && payloadType != BinaryFrame {
+		return nil, ErrNotSupported
+	}
+	ws.mio.Lock()
+	ws.wio.Lock()
+	defer ws.wio.Unlock()
+	if ws.closeSent {
+		ws.mio.Unlock()
+		return nil, ErrCloseSent
+	}
+	ws.msgWriter = &messageWriter{
+		ws:          ws,
+		payloadType: payloadType,
+		first:       true,
+		buf:         make([]byte, 0, messageFragmentSize),
+	}
+	return ws.msgWriter, nil
+}
+
+// releaseWriterLocked ends the message of the open writer, if any,
+// so that other messages can be written. It requires ws.wio to be held.
+func (ws *Conn) releaseWriterLocked() {
+	if ws.msgWriter != nil {
+		ws.msgWriter = nil
+		ws.mio.Unlock()
+	}
+}
+
+// A messageWriter writes a message as a sequence of fragments.
+type messageWriter struct {
+	ws          *Conn
+	payloadType byte
+	first       bool
+	buf         []byte
+	err         error
+}
+
+var errWriterClosed = errors.New("websocket: write to a closed message writer")
+
+func (w *messageWriter) Write(p []byte) (n int, err error) {
+	defer func() { err = w.ws.keepaliveErr(err) }()
+	for len(p) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+		if len(w.buf) == cap(w.buf) {
+			// Keep the last fragment for Close, which sends it as
+			// the final frame.
+			w.flush(false)
+			continue
+		}
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+	}
+	return n, w.err
+}
+
+func (w *messageWriter) flush(fin bool) {
+	w.ws.wio.Lock()
+	defer w.ws.wio.Unlock()
+	if w.ws.msgWriter != w {
+		// A Close frame was sent, which released the writer.
+		w.err = ErrCloseSent
+		return
+	}
+	frame, err := w.ws.frameWriterFactory.NewFragmentWriter(w.payloadType, w.first, fin)
+	if err == nil {
+		_, err = frame.Write(w.buf)
+		frame.Close()
+	}
+	if err != nil {
+		w.err = err
+		w.ws.releaseWriterLocked()
+		return
+	}
+	w.first = false
+	w.buf = w.buf[:0]
+}
+
+// Close sends the final frame of the message.
+func (w *messageWriter) Close() error {
+	if w.err == errWriterClosed {
+		return w.err
+	}
+	if w.err == nil {
+		w.flush(true)
+	}
+	err := w.err
+	w.err = errWriterClosed
+	w.ws.wio.Lock()
+	if w.ws.msgWriter == w {
+		w.ws.releaseWriterLocked()
+	}
+	w.ws.wio.Unlock()
+	return w.ws.keepaliveErr(err)
+}
+
 // Close implements the io.Closer interface.
+// It sends a Close frame, unless one has already been sent, and closes the
+// connection without waiting for the peer to reply.
 func (ws *Conn) Close() error {
-	err := ws.frameHandler.WriteClose(ws.defaultCloseStatus)
+	ws.stopKeepalive()
+	err := ws.frameHandler.WriteClose(ws.defaultCloseStatus, "")
 	err1 := ws.rwc.Close()
 	if err != nil {
 		return err
@@ -240,6 +616,71 @@ func (ws *Conn) Close() error {
 	return err1
 }
 
+// CloseWithStatus performs the closing handshake with the given status code
+// and reason, and closes the connection. It waits up to Config.CloseTimeout
+// for the peer's Close frame, discarding any message received meanwhile.
+//
+// The code must be one of the status codes defined in RFC 6455, section
+// 7.4, or in the range 3000-4999, and the reason must be valid UTF-8 of at
+// most 123 bytes.
+func (ws *Conn) CloseWithStatus(code int, reason string) error {
+	if !validCloseCode(code) || len(reason) > maxControlFramePayloadLength-2 || !utf8.ValidString(reason) {
+		return ErrBadClosingStatus
+	}
+	ws.stopKeepalive()
+	err := ws.frameHandler.WriteClose(code, reason)
+	if err == nil {
+		timeout := ws.config.CloseTimeout
+		if timeout == 0 {
+			timeout = DefaultCloseTimeout
+		}
+		ws.waitClose(timeout)
+	}
+	err1 := ws.rwc.Close()
+	if err != nil {
+		return err
+	}
+	return err1
+}
+
+// waitClose waits until a Close frame is received from the peer, reading
+// the connection unless another goroutine is already doing so.
+func (ws *Conn) waitClose(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ws.rio.Lock()
+		defer ws.rio.Unlock()
+		if ws.frameReader != nil {
+			if _, err := io.Copy(ioutil.Discard, ws.frameReader); err != nil {
+				return
+			}
+			ws.frameReader = nil
+		}
+		for ws.closeErr == nil {
+			frame, err := ws.frameReaderFactory.NewFrameReader()
+			if err != nil {
+				return
+			}
+			frame, err = ws.frameHandler.HandleFrame(frame)
+			if err != nil {
+				return
+			}
+			if frame != nil {
+				if _, err := io.Copy(ioutil.Discard, frame); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
 // IsClientConn reports whether ws is a client-side connection.
 func (ws *Conn) IsClientConn() bool { return ws.request == nil }
 
@@ -305,12 +746,18 @@ type Codec struct {
 
 // Send sends v marshaled by cd.Marshal as single frame to ws.
 func (cd Codec) Send(ws *Conn, v interface{}) (err error) {
+	defer func() { err = ws.keepaliveErr(err) }()
 	data, payloadType, err := cd.Marshal(v)
 	if err != nil {
 		return err
 	}
+	ws.mio.Lock()
+	defer ws.mio.Unlock()
 	ws.wio.Lock()
 	defer ws.wio.Unlock()
+	if ws.closeSent {
+		return ErrCloseSent
+	}
 	w, err := ws.frameWriterFactory.NewFrameWriter(payloadType)
 	if err != nil {
 		return err
@@ -325,10 +772,19 @@ func (cd Codec) Send(ws *Conn, v interface{}) (err error) {
 // payload is defined by ws.MaxPayloadBytes. If frame payload size exceeds
 // limit, ErrFrameTooLarge is returned; in this case frame is not read off wire
 // completely. The next call to Receive would read and discard leftover data of
-// previous oversized frame before processing next frame.
+// previous oversized frame before processing next frame, unless Config.Strict
+// is set, in which case the connection is failed. Once the peer has sent a
+// Close frame, Receive returns io.EOF or a *CloseError.
 func (cd Codec) Receive(ws *Conn, v interface{}) (err error) {
+	defer func() { err = ws.keepaliveErr(err) }()
 	ws.rio.Lock()
 	defer ws.rio.Unlock()
+	ws.beginRead()
+	defer ws.endRead()
+	ws.msgReader = nil
+	if ws.closeErr != nil {
+		return ws.closeErr
+	}
 	if ws.frameReader != nil {
 		_, err = io.Copy(ioutil.Discard, ws.frameReader)
 		if err != nil {
@@ -359,16 +815,33 @@ again:
 		// the next call to this function can drain leftover
 		// data before processing the next frame
 		ws.frameReader = frame
-		return ErrFrameTooLarge
+		return ws.frameTooLarge()
 	}
 	payloadType := frame.PayloadType()
-	data, err := ioutil.ReadAll(frame)
+	data, err := ioutil.ReadAll(io.LimitReader(frame, int64(maxPayloadBytes)+1))
 	if err != nil {
 		return err
 	}
+	if len(data) > maxPayloadBytes {
+		// the size of a compressed message is only known once
+		// decompressed; as above, leave the rest of it to be
+		// drained by the next call
+		ws.frameReader = frame
+		return ws.frameTooLarge()
+	}
 	return cd.Unmarshal(data, payloadType, v)
 }
 
+// frameTooLarge returns ErrFrameTooLarge, after failing the connection in
+// strict mode. It requires ws.rio to be held.
+func (ws *Conn) frameTooLarge() error {
+	if ws.config.Strict {
+		ws.closeErr = ErrFrameTooLarge
+		ws.frameHandler.WriteClose(CloseMessageTooBig, "")
+	}
+	return ErrFrameTooLarge
+}
+
 func marshal(v interface{}) (msg []byte, payloadType byte, err error) {
 	switch data := v.(type) {
 	case string:
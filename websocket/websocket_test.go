@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -663,3 +664,253 @@ func TestCodec_ReceiveLimited(t *testing.T) {
 	}
 	<-handlerDone
 }
+
+func TestCompression(t *testing.T) {
+	const limit = 4096
+	server := httptest.NewServer(Server{
+		Config: Config{Compression: &CompressionConfig{ServerNoContextTakeover: true}},
+		Handler: func(ws *Conn) {
+			defer ws.Close()
+			ws.MaxPayloadBytes = limit
+			for {
+				var msg []byte
+				err := Message.Receive(ws, &msg)
+				if err == ErrFrameTooLarge {
+					msg = []byte("too large")
+				} else if err != nil {
+					return
+				}
+				if err := Message.Send(ws, msg); err != nil {
+					return
+				}
+			}
+		},
+	})
+	defer server.Close()
+
+	config, err := NewConfig("ws://"+server.Listener.Addr().String()+"/", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Compression = &CompressionConfig{Level: 1}
+	ws, err := DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	want := &deflateParams{serverNoContextTakeover: true, level: 1}
+	if ws.Config().deflate == nil || *ws.Config().deflate != *want {
+		t.Fatalf("negotiated %+v, want %+v", ws.Config().deflate, want)
+	}
+
+	for i, tt := range []struct {
+		msg, want []byte
+	}{
+		{[]byte("hello"), []byte("hello")},
+		{nil, nil},
+		{bytes.Repeat([]byte("a"), limit), bytes.Repeat([]byte("a"), limit)},
+		// Highly compressible, but exceeds the limit once decompressed.
+		{bytes.Repeat([]byte("a"), 1<<20), []byte("too large")},
+		{[]byte("world"), []byte("world")},
+	} {
+		if err := Message.Send(ws, tt.msg); err != nil {
+			t.Fatalf("#%d: send: %v", i, err)
+		}
+		var got []byte
+		if err := Message.Receive(ws, &got); err != nil {
+			t.Fatalf("#%d: receive: %v", i, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("#%d: received %d bytes, want %d", i, len(got), len(tt.want))
+		}
+	}
+}
+
+func TestCloseWithStatus(t *testing.T) {
+	serverErr := make(chan error, 1)
+	server := httptest.NewServer(Handler(func(ws *Conn) {
+		defer ws.Close()
+		_, err := ioutil.ReadAll(ws)
+		serverErr <- err
+	}))
+	defer server.Close()
+
+	ws, err := Dial("ws://"+server.Listener.Addr().String()+"/", "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := ws.CloseWithStatus(CloseGoingAway, "bye"); err != nil {
+		t.Errorf("CloseWithStatus: %v", err)
+	}
+	if d := time.Since(start); d >= DefaultCloseTimeout {
+		t.Errorf("CloseWithStatus took %v; closing handshake not completed", d)
+	}
+	want := &CloseError{Code: CloseGoingAway, Reason: "bye"}
+	if err := <-serverErr; !reflect.DeepEqual(err, want) {
+		t.Errorf("server read error %v, want %v", err, want)
+	}
+}
+
+func streamEchoServer(ws *Conn) {
+	defer ws.Close()
+	for {
+		payloadType, r, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		w, err := ws.NextWriter(payloadType)
+		if err != nil {
+			return
+		}
+		_, err = io.Copy(w, r)
+		if err := w.Close(); err != nil {
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestStreamingMessages(t *testing.T) {
+	msg := make([]byte, 1<<20)
+	rand.Read(msg[:len(msg)/2]) // half incompressible
+	for _, compression := range []*CompressionConfig{nil, {}} {
+		server := httptest.NewServer(Server{
+			Config:  Config{Compression: compression},
+			Handler: streamEchoServer,
+		})
+		config, err := NewConfig("ws://"+server.Listener.Addr().String()+"/", "http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Compression = compression
+		ws, err := DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			w, err := ws.NextWriter(BinaryFrame)
+			if err != nil {
+				errc <- err
+				return
+			}
+			_, err = io.Copy(w, bytes.NewReader(msg))
+			if err1 := w.Close(); err == nil {
+				err = err1
+			}
+			errc <- err
+		}()
+		payloadType, r, err := ws.NextReader()
+		if err != nil {
+			t.Fatalf("compression %v: NextReader: %v", compression != nil, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("compression %v: read: %v", compression != nil, err)
+		}
+		if payloadType != BinaryFrame || !bytes.Equal(got, msg) {
+			t.Errorf("compression %v: received message of type %d and %d bytes, want %d bytes", compression != nil, payloadType, len(got), len(msg))
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("compression %v: write: %v", compression != nil, err)
+		}
+		ws.Close()
+		server.Close()
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	pongs := make(chan []byte, 10)
+	server := httptest.NewServer(Server{
+		Config: Config{
+			PingInterval: 10 * time.Millisecond,
+			OnPong: func(ws *Conn, data []byte) {
+				select {
+				case pongs <- data:
+				default:
+				}
+			},
+		},
+		Handler: func(ws *Conn) {
+			io.Copy(ioutil.Discard, ws)
+		},
+	})
+	defer server.Close()
+
+	ws, err := Dial("ws://"+server.Listener.Addr().String()+"/", "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// Reading replies to the server's pings.
+	go io.Copy(ioutil.Discard, ws)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pongs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d pongs, want 3", i)
+		}
+	}
+}
+
+func TestKeepalivePongTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	// The peer reads, but never replies to pings.
+	go io.Copy(ioutil.Discard, c2)
+
+	config := newConfig(t, "/")
+	config.PingInterval = 10 * time.Millisecond
+	config.PongTimeout = 20 * time.Millisecond
+	ws := newHybiConn(config, nil, c1, nil)
+	defer ws.Close()
+
+	start := time.Now()
+	if _, err := ws.Read(make([]byte, 1)); err != ErrPongTimeout {
+		t.Errorf("Read: got %v, want %v", err, ErrPongTimeout)
+	}
+	if d := time.Since(start); d < config.PingInterval+config.PongTimeout {
+		t.Errorf("connection closed after %v, before the pong timeout", d)
+	}
+	if _, err := ws.Write([]byte("hello")); err != ErrPongTimeout {
+		t.Errorf("Write: got %v, want %v", err, ErrPongTimeout)
+	}
+}
+
+func TestKeepaliveWriteOnly(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	// The peer reads, but never replies to pings.
+	go io.Copy(ioutil.Discard, c2)
+
+	config := newConfig(t, "/")
+	config.PingInterval = 10 * time.Millisecond
+	config.PongTimeout = 20 * time.Millisecond
+	ws := newHybiConn(config, nil, c1, nil)
+	defer ws.Close()
+
+	// Without reads, pongs cannot be received, so the connection
+	// is not closed for lack of them.
+	for deadline := time.Now().Add(10 * (config.PingInterval + config.PongTimeout)); time.Now().Before(deadline); {
+		if _, err := ws.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A read gets the full timeout to receive the pong.
+	start := time.Now()
+	if _, err := ws.Read(make([]byte, 1)); err != ErrPongTimeout {
+		t.Errorf("Read: got %v, want %v", err, ErrPongTimeout)
+	}
+	if d := time.Since(start); d < config.PongTimeout {
+		t.Errorf("connection closed %v after the read began, before the pong timeout", d)
+	}
+}